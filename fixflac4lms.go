@@ -1,60 +1,493 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"image"
-	_ "image/jpeg" // Register JPEG decoder
+	"image/color"
+	"image/jpeg"  // Also registers the JPEG decoder
+	_ "image/png" // Registers the PNG decoder
 	"io"
+	"io/fs"
+	"maps"
+	"math"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/pprof"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/charmbracelet/bubbles/progress"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 	"github.com/go-flac/go-flac"
+	_ "golang.org/x/image/webp" // Registers the WebP decoder
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
 )
 
+// LogLevel orders log messages by detail. A message is printed when its
+// level is at most the configured one; the zero value is LogInfo.
 type LogLevel int
 
 const (
-	LogInfo LogLevel = iota
-	LogVerbose
+	LogError LogLevel = iota - 2
 	LogWarn
+	LogInfo
+	LogVerbose
+	LogDebug
+)
+
+var logLevelNames = []string{"error", "warn", "info", "verbose", "debug"}
+
+func (l LogLevel) String() string {
+	if i := int(l - LogError); i >= 0 && i < len(logLevelNames) {
+		return logLevelNames[i]
+	}
+	return strconv.Itoa(int(l))
+}
+
+// parseLogLevel accepts the level names of --log-level.
+func parseLogLevel(s string) (LogLevel, error) {
+	i := slices.Index(logLevelNames, strings.ToLower(s))
+	if i < 0 {
+		return 0, fmt.Errorf("unknown log level %q (use %s)", s, strings.Join(logLevelNames, ", "))
+	}
+	return LogError + LogLevel(i), nil
+}
+
+// MergeMode is how repeated values of a merge tag are resolved.
+type MergeMode int
+
+const (
+	MergeJoin  MergeMode = iota // Join the values with the merge separator
+	MergeFirst                  // Keep the first value only
 )
 
+var mergeModeNames = []string{"join", "first"}
+
+func (m MergeMode) String() string {
+	if i := int(m); i >= 0 && i < len(mergeModeNames) {
+		return mergeModeNames[i]
+	}
+	return strconv.Itoa(int(m))
+}
+
+// defaultMergeSeparator is the separator LMS splits merged IDs at.
+const defaultMergeSeparator = "+"
+
+// mergeSeparator returns the configured merge separator or the default.
+func (c Config) mergeSeparator() string {
+	if c.MergeSeparator != "" {
+		return c.MergeSeparator
+	}
+	return defaultMergeSeparator
+}
+
+// mergedValues returns the values of key as the MBID merge leaves them.
+func (c Config) mergedValues(key string, values []string) []string {
+	if len(values) < 2 || !slices.Contains(c.MergeTags, key) {
+		return values
+	}
+	if c.MergeMode == MergeFirst {
+		return values[:1]
+	}
+	return []string{strings.Join(values, c.mergeSeparator())}
+}
+
+// parseMergeMode accepts the mode names of --merge-mode.
+func parseMergeMode(s string) (MergeMode, error) {
+	i := slices.Index(mergeModeNames, strings.ToLower(s))
+	if i < 0 {
+		return 0, fmt.Errorf("unknown merge mode %q (use %s)", s, strings.Join(mergeModeNames, ", "))
+	}
+	return MergeMode(i), nil
+}
+
 type Config struct {
-	Write       bool
-	Verbose     bool
-	FixMBIDs    bool
-	EmbedCover  bool
-	ConvertOpus string
-	NoPrune     bool
-	CoverName   string
-	MergeTags   []string
-	Progress    bool
-	LogFunc     func(level LogLevel, format string, args ...any)
+	Write bool
+	// LogLevel is the most detailed level Log prints.
+	LogLevel LogLevel
+	FixMBIDs bool
+	// OutDir, when set, receives the fixed files in a tree mirroring the
+	// input; the input is left alone.
+	OutDir string
+	// CopyUnmodified copies files without fixes into OutDir as well.
+	CopyUnmodified bool
+	// ListOrphans only reports what pruning would remove.
+	ListOrphans bool
+	// OpusTagsOnly updates the tags of outdated Opus files instead of
+	// converting them again.
+	OpusTagsOnly bool
+	// OpusMergeMBIDs applies the --mb-ids merge to the tags of the
+	// converted files.
+	OpusMergeMBIDs bool
+	// BatchSize caps the number of output files held in memory while
+	// pruning; 0 means defaultBatchSize.
+	BatchSize int
+	// TrackUID copies MUSICBRAINZ_TRACKID into the UFID tag.
+	TrackUID bool
+	// NormalizeKeys uppercases Vorbis comment keys.
+	NormalizeKeys bool
+	// StripTags lists the keys of Vorbis comments to remove, compared
+	// case-insensitively.
+	StripTags []string
+	// DedupTags removes repeated identical Vorbis comments.
+	DedupTags bool
+	// TrimValues trims whitespace and control characters from the values
+	// of the Vorbis comments.
+	TrimValues bool
+	// DropEmpty removes Vorbis comments whose value is empty or only
+	// whitespace.
+	DropEmpty bool
+	// SetTags lists KEY=VALUE comments to write, replacing the values of
+	// their keys.
+	SetTags []string
+	// ASCIIFold lists SOURCE=TARGET key pairs: TARGET is written from
+	// the ASCII-folded values of SOURCE where it is missing.
+	ASCIIFold []string
+	// RenameTags lists OLD=NEW key pairs: comments with key OLD get the
+	// key NEW.
+	RenameTags []string
+	// ReplayGainPrefer is the gain convention kept in files that carry
+	// both: "track" for the REPLAYGAIN_* tags, "r128" for the R128_* ones.
+	ReplayGainPrefer string
+	// Compact replaces the PADDING blocks with a single one of
+	// CompactPadding bytes when that makes the metadata smaller.
+	Compact        bool
+	CompactPadding int
+	// DropApplication also removes APPLICATION blocks when compacting.
+	DropApplication bool
+	EmbedCover      bool
+	// EmbedThumbnail, when positive, adds a front cover scaled down to
+	// this many pixels next to larger ones.
+	EmbedThumbnail int
+	// ConvertOpus is the output directory of convert mode, in the format
+	// named by ConvertFormat ("" is Opus).
+	ConvertOpus    string
+	ConvertFormat  string
+	RetagOpus      string
+	PreserveXattrs bool
+	// StripID3v2 removes ID3v2 tags found in front of the FLAC data.
+	StripID3v2 bool
+	NoPrune    bool
+	// CoverName is the cover file of an album, or a comma-separated list
+	// of names tried in order, see coverFileIn.
+	CoverName string
+	// CoverSearchParents is how many directories above a file are
+	// searched for the cover file when there is none next to it.
+	CoverSearchParents int
+	// coverRoot is the input root of the file being fixed; the cover
+	// search does not go above it.
+	coverRoot string
+	// CoverMaxAspect rejects covers whose longer edge exceeds the shorter
+	// one by more than this factor (0 disables the check).
+	CoverMaxAspect float64
+	// MaxCoverDimension downscales covers whose longer edge exceeds it
+	// before embedding (0 disables it).
+	MaxCoverDimension int
+	// CoverQuality is the JPEG quality of downscaled covers; 0 means
+	// defaultCoverQuality.
+	CoverQuality int
+	// CoverTranscode re-encodes covers that are not JPEG (e.g. WebP,
+	// which some players cannot show) as JPEG before embedding.
+	CoverTranscode bool
+	// CoverFiles, when set, lists the cover files to embed with their
+	// picture types instead of CoverName and CoverType.
+	CoverFiles []coverSpec
+	// coverOptional logs a missing cover file without a warning.
+	coverOptional bool
+	// CoverType is the picture type embedded and checked for (0 selects
+	// the front cover).
+	CoverType uint32
+	// CoverDescription is the description of embedded covers.
+	CoverDescription string
+	// DefaultCover is embedded when a file has no cover at all.
+	DefaultCover string
+	// PreserveMtime keeps the modification time of fixed files.
+	PreserveMtime bool
+	// Backup copies each file to <name>.bak before it is fixed, or to
+	// the mirrored path below BackupDir if set.
+	Backup    bool
+	BackupDir string
+	// ForceBackup overwrites existing backups instead of failing.
+	ForceBackup bool
+	// Verify tests the audio of a file with flac -t before saving it.
+	Verify bool
+	// ForceCover replaces embedded covers with the cover file.
+	ForceCover bool
+	// StrictCover fails files whose cover file is corrupt instead of
+	// skipping the embed with a warning.
+	StrictCover bool
+	// StrictMBID leaves the merge tags of a file alone if one of the
+	// values to merge is not a valid MusicBrainz ID.
+	StrictMBID bool
+	MergeTags  []string
+	// MergeMode resolves repeated values of MergeTags.
+	MergeMode MergeMode
+	// MergeSeparator joins the values in MergeJoin mode; "" means
+	// defaultMergeSeparator.
+	MergeSeparator string
+	Progress       bool
+	// ProgressBySize advances the progress bar by bytes instead of files.
+	ProgressBySize bool
+	// Bitrates, when set, selects the read-only bitrate audit and collects
+	// its results.
+	Bitrates *bitrateReport
+	// Thumbnails, when set, selects thumbnail generation.
+	Thumbnails *thumbnailer
+	// Report, when set, collects the results of the fixing modes for
+	// --report.
+	Report *fixReport
+	// CoverExtracts, when set, selects cover extraction.
+	CoverExtracts *coverExtractor
+	// CoverSync, set by --sync-cover, extracts the embedded cover of
+	// albums without a cover file before fixing, which embeds it.
+	CoverSync *coverExtractor
+	// Lint, when set, selects the read-only LMS tag audit and collects its
+	// findings.
+	Lint *lmsLinter
+	// ArtistIDCheck, when set, collects the artist IDs of each album to
+	// warn about albums whose album artist is none of its artists.
+	ArtistIDCheck *artistIDChecker
+	// AudioInfo, when set, selects the read-only STREAMINFO listing.
+	AudioInfo *audioInfoReport
+	// TagList, when set, selects the read-only tag listing.
+	TagList *tagLister
+	// AlbumSummary, when set, selects the read-only per-directory track
+	// count and duration listing.
+	AlbumSummary *albumSummary
+	// Covers caches the cover pictures across files when embedding.
+	Covers *coverCache
+	// Abort, when set and done, kills the encoders still running.
+	Abort context.Context
+	// MinFreeSpace stops the conversion when the output filesystem has
+	// less bytes available (0 disables the check).
+	MinFreeSpace int64
+	// CoverCopies, when set, copies the cover file of each album into the
+	// output directory.
+	CoverCopies *coverCopier
+	// OpusBitrate is the bitrate in kbps of converted files that no
+	// rule matches (0 uses the encoder's default).
+	OpusBitrate float64
+	// Jobs is the number of files converted at the same time; 0 and 1
+	// convert one after the other.
+	Jobs int
+	// EncodeTimeout stops encoder runs that take longer (0 waits
+	// forever).
+	EncodeTimeout time.Duration
+	// VerifyOpus decodes each converted file before keeping it.
+	VerifyOpus bool
+	// OpusRules, when set, picks the bitrate of each converted file.
+	OpusRules opusRules
+	// Encoder converts to Opus; nil selects opusenc.
+	Encoder Encoder
+	// Budget, when set, limits the total size of the Opus output.
+	Budget *sizeBudget
+	// FailFast stops the run on the first file that fails instead of
+	// reporting the error and continuing.
+	FailFast bool
+	// Limit, when positive, stops the run after that many FLAC files.
+	Limit int
+	// MaxFileSize, when positive, skips files larger than that many
+	// bytes instead of reading them into memory.
+	MaxFileSize int64
+	// Since, when set, skips files of the walk modified before it.
+	Since time.Time
+	// FollowSymlinks descends into symlinked directories of the input.
+	FollowSymlinks bool
+	// InputFormats are the extensions of the files to convert, e.g.
+	// ".m4a"; nil means FLAC only.
+	InputFormats []string
+	// Counter, when set, prefixes log lines of the default logger with the
+	// position in the run.
+	Counter *fileCounter
+	LogFunc func(level LogLevel, format string, args ...any)
+}
+
+// DryRun reports whether changes must not be written to disk. Every
+// operation that modifies files checks it.
+func (c Config) DryRun() bool {
+	return !c.Write
+}
+
+// fixing reports whether one of the tag fixing modes is selected.
+func (c Config) fixing() bool {
+	return c.FixMBIDs || c.EmbedCover || c.TrackUID || c.NormalizeKeys || len(c.StripTags) > 0 || c.DedupTags || c.TrimValues || c.DropEmpty || len(c.SetTags) > 0 || len(c.ASCIIFold) > 0 || len(c.RenameTags) > 0 || c.ReplayGainPrefer != "" || c.Compact || c.EmbedThumbnail > 0
+}
+
+// fixingFlags lists the flags of the fixing modes for error messages.
+const fixingFlags = "--mb-ids, --embed-cover, --sync-cover, --track-uid, --normalize-keys, --strip-tags, --dedup-tags, --trim-values, --drop-empty, --set-tag, --rename-tag, --ascii-fold, --replaygain-prefer, --compact or --embed-thumbnail"
+
+// mirrorRoot returns the output tree mirroring the input, of convert mode
+// or of --out-dir, or "" when files are processed in place.
+func (c Config) mirrorRoot() string {
+	if c.ConvertOpus != "" {
+		return c.ConvertOpus
+	}
+	return c.OutDir
+}
+
+// mirrorExt returns the extension of the files in mirrorRoot.
+func (c Config) mirrorExt() string {
+	if c.ConvertOpus != "" {
+		return c.convertFormat().Ext
+	}
+	return ".flac"
+}
+
+// convertFormat describes an output format of convert mode.
+type convertFormat struct {
+	// Name is shown in the summary.
+	Name string
+	// Ext is the extension of the converted files.
+	Ext string
+	// Codec and Muxer are the ffmpeg audio encoder and output format.
+	Codec string
+	Muxer string
+}
+
+// convertFormats are the choices of --convert.
+var convertFormats = map[string]convertFormat{
+	"opus": {Name: "Opus", Ext: ".opus", Codec: "libopus", Muxer: "opus"},
+	"mp3":  {Name: "MP3", Ext: ".mp3", Codec: "libmp3lame", Muxer: "mp3"},
+	"aac":  {Name: "AAC", Ext: ".m4a", Codec: "aac", Muxer: "ipod"},
+}
+
+// convertFormatNames lists the keys of convertFormats for messages.
+var convertFormatNames = []string{"opus", "mp3", "aac"}
+
+// convertFormat returns the output format of convert mode.
+func (c Config) convertFormat() convertFormat {
+	if f, ok := convertFormats[c.ConvertFormat]; ok {
+		return f
+	}
+	return convertFormats["opus"]
+}
+
+// convertsOpus reports whether convert mode writes Opus files.
+func (c Config) convertsOpus() bool {
+	return c.convertFormat().Ext == ".opus"
+}
+
+func (c Config) encoder() Encoder {
+	if c.Encoder != nil {
+		return c.Encoder
+	}
+	return opusencEncoder{}
+}
+
+// inputFormatNames are the choices of --input-formats.
+var inputFormatNames = []string{"flac", "wav", "m4a"}
+
+// opusencInputs are the input extensions opusenc reads; other formats are
+// converted with ffmpeg.
+var opusencInputs = []string{".flac", ".wav"}
+
+// parseInputFormats parses the comma-separated format names of
+// --input-formats into extensions.
+func parseInputFormats(s string) ([]string, error) {
+	var exts []string
+	for part := range strings.SplitSeq(s, ",") {
+		name := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(part), ".")))
+		if name == "" {
+			continue
+		}
+		if !slices.Contains(inputFormatNames, name) {
+			return nil, fmt.Errorf("unknown input format %q (use %s)", part, strings.Join(inputFormatNames, ", "))
+		}
+		if ext := "." + name; !slices.Contains(exts, ext) {
+			exts = append(exts, ext)
+		}
+	}
+	if len(exts) == 0 {
+		return nil, errors.New("no input format given")
+	}
+	return exts, nil
+}
+
+// inputExtensions returns the extensions of the files to process.
+func (c Config) inputExtensions() []string {
+	if len(c.InputFormats) > 0 {
+		return c.InputFormats
+	}
+	return []string{".flac"}
+}
+
+// encoderFor returns the encoder for the input file. Formats opusenc
+// cannot read go to ffmpeg.
+func (c Config) encoderFor(input string) Encoder {
+	encoder := c.encoder()
+	if _, ok := encoder.(opusencEncoder); ok && !hasExtension(input, opusencInputs) {
+		return ffmpegEncoder{}
+	}
+	return encoder
+}
+
+// needsFfmpeg reports whether some input formats are converted with
+// ffmpeg although the selected encoder is opusenc.
+func (c Config) needsFfmpeg() bool {
+	if _, ok := c.encoder().(opusencEncoder); !ok {
+		return false
+	}
+	for _, ext := range c.inputExtensions() {
+		if !slices.Contains(opusencInputs, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasExtension reports whether path ends in one of exts, ignoring case.
+func hasExtension(path string, exts []string) bool {
+	return slices.ContainsFunc(exts, func(ext string) bool {
+		return strings.EqualFold(filepath.Ext(path), ext)
+	})
+}
+
+// isFlacFile reports whether path names a FLAC file.
+func isFlacFile(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".flac")
 }
 
 func (c Config) Log(level LogLevel, format string, args ...any) {
+	if level > c.LogLevel {
+		return
+	}
 	if c.LogFunc != nil {
 		c.LogFunc(level, format, args...)
 	} else {
 		// Default logging if no function provided
-		if level == LogVerbose && !c.Verbose {
-			return
-		}
 		prefix := ""
+		if c.Counter != nil {
+			prefix = c.Counter.Prefix()
+		}
 		if level == LogWarn {
-			prefix = "Warning: "
+			prefix += "Warning: "
 		}
 		msg := fmt.Sprintf(format, args...)
-		if level == LogWarn {
+		if level <= LogWarn {
 			fmt.Fprint(os.Stderr, prefix+msg)
 		} else {
 			fmt.Print(prefix + msg)
@@ -62,6 +495,115 @@ func (c Config) Log(level LogLevel, format string, args ...any) {
 	}
 }
 
+// fileCounter tracks the position in a run for the verbose plain output.
+type fileCounter struct {
+	current int
+	total   int
+	start   time.Time
+}
+
+func newFileCounter(total int) *fileCounter {
+	return &fileCounter{total: total, start: time.Now()}
+}
+
+// Next marks the start of the next file.
+func (fc *fileCounter) Next() {
+	fc.current++
+}
+
+// Prefix returns "[current/total] ", with an ETA once at least one file
+// has been completed.
+func (fc *fileCounter) Prefix() string {
+	done := fc.current - 1
+	if done <= 0 {
+		return fmt.Sprintf("[%d/%d] ", fc.current, fc.total)
+	}
+	perFile := time.Since(fc.start) / time.Duration(done)
+	eta := perFile * time.Duration(fc.total-done)
+	return fmt.Sprintf("[%d/%d ETA %s] ", fc.current, fc.total, eta.Round(time.Second))
+}
+
+// sizeBudget tracks the accumulated size of the conversion output against
+// a limit. Once a file does not fit anymore, no further files are
+// converted.
+type sizeBudget struct {
+	mu        sync.Mutex
+	limit     int64
+	used      int64
+	exhausted bool
+}
+
+// Exhausted reports whether an output did not fit anymore.
+func (b *sizeBudget) Exhausted() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.exhausted
+}
+
+// Fits reports whether size more bytes fit into the budget and accounts for
+// them if so.
+func (b *sizeBudget) Fits(size int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.exhausted || b.used+size > b.limit {
+		b.exhausted = true
+		return false
+	}
+	b.used += size
+	return true
+}
+
+// Add accounts for output that exists already, whether it fits or not.
+func (b *sizeBudget) Add(size int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used += size
+	if b.used > b.limit {
+		b.exhausted = true
+	}
+}
+
+// formatBytes formats a size in binary units, e.g. "1.5 GiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// parseByteSize parses sizes like "512M" or "32G" (binary units, an
+// optional trailing "B" is accepted).
+func parseByteSize(s string) (int64, error) {
+	str := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	multiplier := int64(1)
+	if n := len(str); n > 0 {
+		switch str[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			str = str[:n-1]
+		}
+	}
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
 type VorbisComment struct {
 	Vendor   string
 	Comments []string
@@ -144,21 +686,300 @@ func (p *Picture) Marshal() []byte {
 	return buf.Bytes()
 }
 
+// ParsePicture reads a FLAC picture block. All lengths are checked against
+// the data, so a truncated block returns an error.
+func ParsePicture(data []byte) (*Picture, error) {
+	r := bytes.NewReader(data)
+	p := &Picture{}
+
+	// Reads a length-prefixed field
+	readField := func() ([]byte, error) {
+		var n uint32
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return nil, err
+		}
+		if int64(n) > int64(r.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &p.PictureType); err != nil {
+		return nil, fmt.Errorf("failed to read picture type: %w", err)
+	}
+	mimeType, err := readField()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mime type: %w", err)
+	}
+	p.MimeType = string(mimeType)
+	description, err := readField()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read description: %w", err)
+	}
+	p.Description = string(description)
+	for _, v := range []*uint32{&p.Width, &p.Height, &p.Depth, &p.Colors} {
+		if err := binary.Read(r, binary.BigEndian, v); err != nil {
+			return nil, fmt.Errorf("failed to read picture dimensions: %w", err)
+		}
+	}
+	if p.Data, err = readField(); err != nil {
+		return nil, fmt.Errorf("failed to read picture data: %w", err)
+	}
+
+	return p, nil
+}
+
+// configFileName is the config file below os.UserConfigDir that is read
+// when --config is not given.
+const configFileName = "fixflac4lms/config.toml"
+
+// defaultConfigFile returns the path of the default config file, or ""
+// if there is no config directory.
+func defaultConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, configFileName)
+}
+
+// applyConfigFile sets the flags of fs from the "name = value" lines of a
+// TOML style config file. Flags set on the command line keep their
+// values. Unknown names are passed to warn, invalid values are errors.
+func applyConfigFile(fs *flag.FlagSet, filename string, warn func(format string, args ...any)) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return fmt.Errorf("%s:%d: tables are not supported", filename, i+1)
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected name = value", filename, i+1)
+		}
+		name = strings.TrimSpace(name)
+		value, err := parseConfigValue(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", filename, i+1, err)
+		}
+		if fs.Lookup(name) == nil || name == "config" || slices.Contains(hiddenFlags, name) {
+			warn("%s:%d: Unknown key %q, ignoring\n", filename, i+1, name)
+			continue
+		}
+		if explicit[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s:%d: %s: %w", filename, i+1, name, err)
+		}
+	}
+	return nil
+}
+
+// parseConfigValue returns the value of a config line: a basic ("...")
+// or literal ('...') string, or a bare word like true or 96 up to an
+// optional comment.
+func parseConfigValue(s string) (string, error) {
+	quote := byte(0)
+	if s != "" && (s[0] == '"' || s[0] == '\'') {
+		quote = s[0]
+	}
+	if quote == 0 {
+		value, _, _ := strings.Cut(s, "#")
+		return strings.TrimSpace(value), nil
+	}
+
+	for i := 1; i < len(s); i++ {
+		if s[i] == '\\' && quote == '"' {
+			i++
+			continue
+		}
+		if s[i] != quote {
+			continue
+		}
+		if rest := strings.TrimSpace(s[i+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected %q after value", rest)
+		}
+		if quote == '\'' {
+			return s[1:i], nil
+		}
+		return strconv.Unquote(s[:i+1])
+	}
+	return "", errors.New("unterminated string")
+}
+
+// hiddenFlags are development aids left out of the usage message.
+var hiddenFlags = []string{"cpuprofile", "memprofile"}
+
 func main() {
-	writePtr := flag.Bool("w", false, "Write changes to disk (default is dry-run)")
-	verbosePtr := flag.Bool("v", false, "Verbose output (show processed files)")
+	writePtr := flag.Bool("w", false, "Write changes to disk (default is dry-run, except for --convert-opus)")
+	dryRunPtr := flag.Bool("dry-run", false, "Do not modify any files, also for --convert-opus")
+	verbosePtr := flag.Bool("v", false, "Verbose output (show processed files), same as --log-level verbose")
+	logLevelPtr := flag.String("log-level", "info", "Log detail: error, warn, info, verbose or debug")
+	quietPtr := flag.Bool("quiet", false, "Only log warnings and errors, same as --log-level warn")
 	fixMBIDsPtr := flag.Bool("mb-ids", false, "Fix MusicBrainz IDs (merge multiple IDs)")
+	outDirPtr := flag.String("out-dir", "", "Write fixed files to the mirrored path in this directory instead of modifying them in place, or the output of --convert")
+	copyUnmodifiedPtr := flag.Bool("copy-unmodified", false, "Also copy files that need no fixes (only with --out-dir)")
+	trackUIDPtr := flag.Bool("track-uid", false, "Set the UFID tag from MUSICBRAINZ_TRACKID so LMS recognizes the same track in different folders")
+	normalizeKeysPtr := flag.Bool("normalize-keys", false, "Uppercase Vorbis comment keys and drop duplicates differing only in key case")
+	stripTagsPtr := flag.String("strip-tags", "", "Comma-separated list of tags to remove, e.g. COMMENT,ENCODEDBY")
+	dedupTagsPtr := flag.Bool("dedup-tags", false, "Remove repeated identical tags (same key and value)")
+	var setTags []string
+	flag.Func("set-tag", "Set a tag to a value, replacing its values, e.g. 'ALBUMARTIST=Various Artists'; repeat a key for several values", func(s string) error {
+		if err := validateSetTag(s); err != nil {
+			return err
+		}
+		setTags = append(setTags, s)
+		return nil
+	})
+	var renameTags []string
+	flag.Func("rename-tag", "Rename a tag, keeping its values, e.g. 'ALBUM ARTIST=ALBUMARTIST'; repeat for several tags", func(s string) error {
+		if err := validateRenameTag(s); err != nil {
+			return err
+		}
+		renameTags = append(renameTags, s)
+		return nil
+	})
+	var asciiFolds []string
+	flag.Func("ascii-fold", "Write a tag from the ASCII-folded values of another where missing, e.g. ARTIST=ARTISTSORT; repeat for several tags", func(s string) error {
+		if err := validateASCIIFold(s); err != nil {
+			return err
+		}
+		asciiFolds = append(asciiFolds, s)
+		return nil
+	})
+	var replayGainPrefer string
+	flag.Func("replaygain-prefer", "Gain tags to keep in files that have both: track (REPLAYGAIN_*) or r128 (R128_*); warns about files with neither", func(s string) error {
+		if s != "track" && s != "r128" {
+			return fmt.Errorf("expected track or r128, got %q", s)
+		}
+		replayGainPrefer = s
+		return nil
+	})
+	compactPtr := flag.Bool("compact", false, "Shrink oversized PADDING blocks to --padding bytes")
+	paddingPtr := flag.Int("padding", defaultCompactPadding, "Size in bytes of the padding kept by --compact (0 removes it)")
+	dropApplicationPtr := flag.Bool("drop-application", false, "Also remove APPLICATION metadata blocks (only with --compact)")
+	trimValuesPtr := flag.Bool("trim-values", false, "Trim surrounding whitespace and remove control characters from tag values")
+	dropEmptyPtr := flag.Bool("drop-empty", false, "Remove tags whose value is empty or only whitespace, e.g. DISCNUMBER=")
 	embedCoverPtr := flag.Bool("embed-cover", false, "Embed cover.jpg if missing")
-	convertOpusPtr := flag.String("convert-opus", "", "Convert to Opus in specified output directory")
-	noPrunePtr := flag.Bool("no-prune", false, "Disable pruning of orphaned files in output directory (only with --convert-opus)")
-	coverNamePtr := flag.String("cover-name", "cover.jpg", "Filename for external cover art (default: cover.jpg)")
+	syncCoverPtr := flag.Bool("sync-cover", false, "Like --embed-cover, and also extract the embedded front cover of albums without cover.jpg to it")
+	embedThumbnailPtr := flag.Int("embed-thumbnail", 0, "Also embed the front cover scaled down to this many pixels, e.g. 200, for remote apps (0 disables it)")
+	convertOpusPtr := flag.String("convert-opus", "", "Convert to Opus in specified output directory (same as --convert opus --out-dir)")
+	convertPtr := flag.String("convert", "", "Convert to this format in the --out-dir directory: opus, mp3 or aac")
+	retagOpusPtr := flag.String("retag-from-opus", "", "Copy changed tags from the Opus mirror in specified directory back into the FLAC files")
+	copyCoverPtr := flag.Bool("copy-cover", false, "Copy the cover file (see --cover-name) of each album next to the Opus files (only with --convert-opus)")
+	inputFormatsPtr := flag.String("input-formats", "flac", "Comma-separated input formats to convert: flac, wav, m4a (only with --convert-opus)")
+	encoderPtr := flag.String("encoder", "auto", "Opus encoder: auto (opusenc, else ffmpeg), opusenc or ffmpeg (only with --convert-opus)")
+	jobsPtr := flag.Int("jobs", 1, "Number of files to convert at the same time, e.g. the number of CPU cores (only with --convert-opus)")
+	verifyOpusPtr := flag.Bool("verify-opus", false, "Decode each converted file with opusdec (ffmpeg for MP3 and AAC) before keeping it and skip broken ones (only with --convert-opus)")
+	encodeTimeoutPtr := flag.Duration("encode-timeout", 0, "Give up on files whose encoding takes longer than this, e.g. 120s (only with --convert-opus; 0 waits forever)")
+	opusBitratePtr := flag.String("opus-bitrate", "", "Target bitrate in kbps for converted files, e.g. 96 (only with --convert-opus)")
+	opusRulesPtr := flag.String("opus-rules", "", "File with rules picking the Opus bitrate per file from its tags or STREAMINFO (only with --convert-opus)")
+	stripID3v2Ptr := flag.Bool("strip-id3v2", false, "Remove ID3v2 tags found in front of the FLAC data (written with -w)")
+	preserveXattrsPtr := flag.Bool("preserve-xattrs", false, "Copy extended attributes from the FLAC to the Opus file (only with --convert-opus)")
+	sizeBudgetPtr := flag.String("size-budget", "", "Stop converting once the Opus output would exceed this size, e.g. 32G (only with --convert-opus)")
+	minFreeSpacePtr := flag.String("min-free-space", "", "Stop converting when free space on the output filesystem drops below this size, e.g. 2G (only with --convert-opus)")
+	listOrphansPtr := flag.Bool("list-orphans", false, "List the orphaned files and empty directories pruning would remove, then exit (with --convert-opus or --out-dir)")
+	opusMBIDsPtr := flag.Bool("opus-mb-ids", false, "Merge repeated MusicBrainz IDs in the Opus files like --mb-ids, leaving the FLAC files alone (only with --convert-opus)")
+	opusTagsOnlyPtr := flag.Bool("opus-tags-only", false, "Update only the tags and cover of existing Opus files whose FLAC is newer, without re-encoding (only with --convert-opus)")
+	batchSizePtr := flag.Int("batch-size", defaultBatchSize, "Number of output files checked at once while pruning")
+	noPrunePtr := flag.Bool("no-prune", false, "Disable pruning of orphaned files in output directory (only with --convert-opus or --out-dir)")
+	coverNamePtr := flag.String("cover-name", "cover.jpg", "Filename for external cover art, or a comma-separated list tried in order, e.g. cover.jpg,folder.jpg (default: cover.jpg)")
+	coverSearchParentsPtr := flag.Int("cover-search-parents", 0, "Also look for the cover file up to N directories above each file, within the input (only with --embed-cover)")
+	maxCoverSizePtr := flag.Int("max-cover-size", 0, "Downscale covers whose longest edge exceeds this many pixels before embedding, e.g. 1000 (0 disables it)")
+	coverQualityPtr := flag.Int("cover-quality", defaultCoverQuality, "JPEG quality (1-100) of covers downscaled by --max-cover-size")
+	coverTranscodePtr := flag.Bool("cover-transcode", false, "Re-encode covers that are not JPEG (e.g. WebP) as JPEG before embedding, with --cover-quality")
+	coverMaxAspectPtr := flag.Float64("cover-max-aspect", 0, "Skip embedding covers whose aspect ratio (long/short edge) exceeds this value (0 disables the check)")
+	var coverFiles []coverSpec
+	flag.Func("cover", "Cover file to embed as name:type, e.g. back.jpg:4; repeatable, replaces --cover-name and --cover-type for --embed-cover", func(s string) error {
+		spec, err := parseCoverSpec(s)
+		if err == nil {
+			coverFiles = append(coverFiles, spec)
+		}
+		return err
+	})
+	coverTypePtr := flag.Uint("cover-type", pictureTypeFrontCover, "FLAC picture type to embed and to look for (3 = front cover)")
+	coverDescriptionPtr := flag.String("cover-description", "", "Description of embedded covers, e.g. \"Front Cover\" (default empty)")
+	backupPtr := flag.Bool("backup", false, "Copy each file to <name>.bak before fixing it (only with fixing modes)")
+	backupDirPtr := flag.String("backup-dir", "", "Copy each file to the mirrored path in this directory before fixing it (implies --backup)")
+	forcePtr := flag.Bool("force", false, "Overwrite existing backups (only with --backup)")
+	preserveMtimePtr := flag.Bool("preserve-mtime", false, "Keep the modification time of fixed files (only with fixing modes)")
+	reportPtr := flag.String("report", "", "Write the per-file results of the fixing modes to this JSON file (.jsonl or .gz: one line per file, written as they are processed)")
+	verifyPtr := flag.Bool("verify", false, "Test files with 'flac -t' before saving and skip damaged ones (only with fixing modes)")
+	forceCoverPtr := flag.Bool("force-cover", false, "Replace embedded covers with the cover file (only with --embed-cover)")
+	strictCoverPtr := flag.Bool("strict-cover", false, "Fail files whose cover file is corrupt instead of warning (only with --embed-cover)")
+	defaultCoverPtr := flag.String("default-cover", "", "Image to embed as placeholder when no cover is found (only with --embed-cover)")
+	strictMBIDPtr := flag.Bool("strict-mbid", false, "Do not merge the tags of files with malformed MusicBrainz IDs (only with --mb-ids or --opus-mb-ids)")
+	mergeModePtr := flag.String("merge-mode", "join", "How to resolve repeated merge tags: join (with --merge-sep) or first (keep the first value)")
+	mergeSepPtr := flag.String("merge-sep", defaultMergeSeparator, "Separator for joined merge tag values (LMS expects '+')")
 	mergeTagsPtr := flag.String("merge-tags", "", "Comma-separated list of tags to merge (overrides defaults)")
+	infoPtr := flag.Bool("info", false, "List sample rate, bit depth, channels, length and MD5 signature of the FLAC files (read-only)")
+	listTagsPtr := flag.Bool("list-tags", false, "List the tags and pictures of the FLAC files (read-only)")
+	albumSummaryPtr := flag.Bool("album-summary", false, "List the number of tracks and total duration of each album directory (read-only)")
+	var tagFilter []string
+	flag.Func("tag-filter", "Only list this tag, e.g. MUSICBRAINZ_ALBUMID; repeatable (only with --list-tags)", func(s string) error {
+		tagFilter = append(tagFilter, strings.ToUpper(s))
+		return nil
+	})
+	checkArtistIDsPtr := flag.Bool("check-artist-ids", false, "Warn about albums whose MUSICBRAINZ_ALBUMARTISTID shares no ID with the MUSICBRAINZ_ARTISTID of their tracks, e.g. after a bad import")
+	lmsLintPtr := flag.Bool("lms-lint", false, "Report tags LMS is known to misinterpret (read-only)")
+	reportBitratePtr := flag.Bool("report-bitrate", false, "Report the bitrate distribution of the FLAC files (read-only)")
+	bitrateThresholdPtr := flag.Int("bitrate-threshold", 400, "Bitrate in kbps below which files are reported as suspicious (only with --report-bitrate)")
+	extractCoverPtr := flag.String("extract-cover", "", "Write the embedded front cover of each album to a file with this name next to it, e.g. cover.jpg (the extension follows the image type)")
+	genThumbnailsPtr := flag.Bool("gen-thumbnails", false, "Generate a downscaled copy of each album's cover file next to it")
+	thumbnailSizePtr := flag.Int("thumbnail-size", 300, "Longest edge in pixels of generated thumbnails (only with --gen-thumbnails)")
+	failFastPtr := flag.Bool("fail-fast", false, "Stop on the first file that fails (default is to report the error and continue)")
+	followSymlinksPtr := flag.Bool("follow-symlinks", false, "Descend into symlinked directories (each file is processed once)")
+	limitPtr := flag.Int("limit", 0, "Only process the first N FLAC files (0 means all)")
+	maxFileSizePtr := flag.String("max-file-size", "", "Skip files larger than this size instead of loading them for fixing or retagging, e.g. 500M")
+	sincePtr := flag.String("since", "", "Only process files modified within this duration (e.g. 24h, 7d) or since this time (e.g. 2024-05-01)")
 	noProgressPtr := flag.Bool("no-progress", false, "Disable progress bar")
+	progressBySizePtr := flag.Bool("progress-by-size", false, "Advance the progress bar by file size instead of file count, for libraries with very different file sizes")
+	cpuProfilePtr := flag.String("cpuprofile", "", "Write a CPU profile to this file")
+	memProfilePtr := flag.String("memprofile", "", "Write a heap profile to this file at the end of the run")
+	configPtr := flag.String("config", "", "Read default flags from this file (default "+configFileName+" in the user config directory)")
 	flag.Parse()
 
+	// A missing default config file is fine, a missing --config is not
+	configFile := *configPtr
+	if configFile == "" {
+		configFile = defaultConfigFile()
+		if _, err := os.Stat(configFile); err != nil {
+			configFile = ""
+		}
+	}
+	if configFile != "" {
+		warn := func(format string, args ...any) {
+			fmt.Fprintf(os.Stderr, "Warning: "+format, args...)
+		}
+		if err := applyConfigFile(flag.CommandLine, configFile, warn); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: config file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	if flag.NArg() < 1 {
-		fmt.Println("Usage: fixflac4lms [-w] [-v] [--no-progress] [--mb-ids] [--embed-cover] [--convert-opus <dir> [--no-prune]] [--cover-name <name>] [--merge-tags <tags>] <path>")
+		fmt.Println("Usage: fixflac4lms [-w] [-v] [--no-progress] [--mb-ids] [--embed-cover] [--convert-opus <dir> [--no-prune]] [--retag-from-opus <dir>] [--cover-name <name>] [--merge-tags <tags>] <path>")
 		flag.VisitAll(func(f *flag.Flag) {
+			if slices.Contains(hiddenFlags, f.Name) {
+				return
+			}
 			prefix := "-"
 			if len(f.Name) > 1 {
 				prefix = "--"
@@ -168,8 +989,39 @@ func main() {
 		os.Exit(1)
 	}
 
-	if *verbosePtr && !*noProgressPtr {
-		fmt.Fprintln(os.Stderr, "Error: -v and progress bar (enabled by default) are mutually exclusive. Use --no-progress with -v.")
+	logLevel, err := parseLogLevel(*logLevelPtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --log-level: %v\n", err)
+		os.Exit(1)
+	}
+	mergeMode, err := parseMergeMode(*mergeModePtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --merge-mode: %v\n", err)
+		os.Exit(1)
+	}
+	if *mergeSepPtr == "" {
+		fmt.Fprintln(os.Stderr, "Error: --merge-sep must not be empty")
+		os.Exit(1)
+	}
+
+	if *quietPtr {
+		if *verbosePtr || logLevel > LogInfo {
+			fmt.Fprintln(os.Stderr, "Error: --quiet and -v (or --log-level verbose/debug) are mutually exclusive")
+			os.Exit(1)
+		}
+		logLevel = min(logLevel, LogWarn)
+	}
+	if *verbosePtr && logLevel < LogVerbose {
+		logLevel = LogVerbose
+	}
+
+	if logLevel >= LogVerbose && !*noProgressPtr {
+		fmt.Fprintln(os.Stderr, "Error: -v (or --log-level verbose/debug) and progress bar (enabled by default) are mutually exclusive. Use --no-progress with -v.")
+		os.Exit(1)
+	}
+
+	if *progressBySizePtr && *noProgressPtr {
+		fmt.Fprintln(os.Stderr, "Error: --progress-by-size cannot be used with --no-progress")
 		os.Exit(1)
 	}
 
@@ -187,501 +1039,5525 @@ func main() {
 		}
 	}
 
+	var stripTags []string
+	for part := range strings.SplitSeq(*stripTagsPtr, ",") {
+		if tag := strings.TrimSpace(part); tag != "" {
+			stripTags = append(stripTags, tag)
+		}
+	}
+
 	config := Config{
-		Write:       *writePtr,
-		Verbose:     *verbosePtr,
-		FixMBIDs:    *fixMBIDsPtr,
-		EmbedCover:  *embedCoverPtr,
-		ConvertOpus: *convertOpusPtr,
-		NoPrune:     *noPrunePtr,
-		CoverName:   *coverNamePtr,
-		MergeTags:   mergeTags,
-		Progress:    !*noProgressPtr,
+		Write:              *writePtr,
+		LogLevel:           logLevel,
+		FixMBIDs:           *fixMBIDsPtr,
+		TrackUID:           *trackUIDPtr,
+		NormalizeKeys:      *normalizeKeysPtr,
+		StripTags:          stripTags,
+		DedupTags:          *dedupTagsPtr,
+		TrimValues:         *trimValuesPtr,
+		DropEmpty:          *dropEmptyPtr,
+		SetTags:            setTags,
+		ASCIIFold:          asciiFolds,
+		RenameTags:         renameTags,
+		ReplayGainPrefer:   replayGainPrefer,
+		Compact:            *compactPtr,
+		CompactPadding:     *paddingPtr,
+		DropApplication:    *dropApplicationPtr,
+		OutDir:             *outDirPtr,
+		CopyUnmodified:     *copyUnmodifiedPtr,
+		BatchSize:          *batchSizePtr,
+		OpusTagsOnly:       *opusTagsOnlyPtr,
+		OpusMergeMBIDs:     *opusMBIDsPtr,
+		ListOrphans:        *listOrphansPtr,
+		EmbedCover:         *embedCoverPtr,
+		EmbedThumbnail:     *embedThumbnailPtr,
+		ConvertOpus:        *convertOpusPtr,
+		RetagOpus:          *retagOpusPtr,
+		PreserveXattrs:     *preserveXattrsPtr,
+		StripID3v2:         *stripID3v2Ptr,
+		NoPrune:            *noPrunePtr,
+		CoverName:          *coverNamePtr,
+		CoverMaxAspect:     *coverMaxAspectPtr,
+		MaxCoverDimension:  *maxCoverSizePtr,
+		CoverSearchParents: *coverSearchParentsPtr,
+		CoverQuality:       *coverQualityPtr,
+		CoverTranscode:     *coverTranscodePtr,
+		CoverType:          uint32(*coverTypePtr),
+		CoverFiles:         coverFiles,
+		CoverDescription:   *coverDescriptionPtr,
+		DefaultCover:       *defaultCoverPtr,
+		StrictCover:        *strictCoverPtr,
+		StrictMBID:         *strictMBIDPtr,
+		ForceCover:         *forceCoverPtr,
+		Verify:             *verifyPtr,
+		PreserveMtime:      *preserveMtimePtr,
+		Backup:             *backupPtr || *backupDirPtr != "",
+		BackupDir:          *backupDirPtr,
+		ForceBackup:        *forcePtr,
+		MergeTags:          mergeTags,
+		MergeMode:          mergeMode,
+		MergeSeparator:     *mergeSepPtr,
+		Progress:           !*noProgressPtr,
+		ProgressBySize:     *progressBySizePtr,
+		Limit:              *limitPtr,
+		FollowSymlinks:     *followSymlinksPtr,
+		FailFast:           *failFastPtr,
 	}
 
-	// Check conflicts if converting
-	if config.ConvertOpus != "" {
-		if config.FixMBIDs || config.EmbedCover {
-			fmt.Fprintln(os.Stderr, "Error: --convert-opus cannot be used with --mb-ids or --embed-cover")
+	if *dryRunPtr && *writePtr {
+		fmt.Fprintln(os.Stderr, "Error: -w and --dry-run are mutually exclusive")
+		os.Exit(1)
+	}
+
+	if *convertPtr != "" {
+		format := strings.ToLower(*convertPtr)
+		if _, ok := convertFormats[format]; !ok {
+			fmt.Fprintf(os.Stderr, "Error: unknown --convert format %q (use %s)\n", *convertPtr, strings.Join(convertFormatNames, ", "))
 			os.Exit(1)
 		}
-		// Verify opusenc exists
-		if _, err := exec.LookPath("opusenc"); err != nil {
-			fmt.Fprintln(os.Stderr, "Error: opusenc not found in PATH")
+		if config.ConvertOpus != "" {
+			fmt.Fprintln(os.Stderr, "Error: --convert-opus cannot be combined with --convert, use --out-dir")
 			os.Exit(1)
 		}
-	} else if config.NoPrune {
-		fmt.Fprintln(os.Stderr, "Error: --no-prune is only valid with --convert-opus")
-		os.Exit(1)
+		if config.OutDir == "" {
+			fmt.Fprintln(os.Stderr, "Error: --convert needs --out-dir")
+			os.Exit(1)
+		}
+		// From here on the same as --convert-opus, whatever the format
+		config.ConvertOpus, config.OutDir = config.OutDir, ""
+		config.ConvertFormat = format
 	}
-
-	path := flag.Arg(0)
-	info, err := os.Stat(path)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error accessing path %s: %v\n", path, err)
+	if *syncCoverPtr {
+		// The cover file goes next to the source, not into the output
+		if config.OutDir != "" {
+			fmt.Fprintln(os.Stderr, "Error: --sync-cover cannot be used with --out-dir")
+			os.Exit(1)
+		}
+		names := config.coverNames()
+		if len(names) == 0 {
+			fmt.Fprintln(os.Stderr, "Error: --sync-cover needs a --cover-name")
+			os.Exit(1)
+		}
+		config.EmbedCover = true
+		config.CoverSync = newCoverExtractor(names[0])
+	}
+	if config.OutDir != "" && !config.fixing() {
+		fmt.Fprintln(os.Stderr, "Error: --out-dir is only valid with "+fixingFlags+" or --convert")
 		os.Exit(1)
 	}
-
-	if config.Progress {
-		if err := runWithProgress(path, info, config); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	if *inputFormatsPtr != "flac" {
+		if config.ConvertOpus == "" {
+			fmt.Fprintln(os.Stderr, "Error: --input-formats is only valid with --convert-opus")
 			os.Exit(1)
 		}
-		return
-	}
-
-	if info.IsDir() {
-		// Calculate absolute path for input root to handle relative paths correctly
-		absInputRoot, err := filepath.Abs(path)
+		formats, err := parseInputFormats(*inputFormatsPtr)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error getting absolute path for %s: %v\n", path, err)
+			fmt.Fprintf(os.Stderr, "Error: --input-formats: %v\n", err)
 			os.Exit(1)
 		}
-
-		err = filepath.WalkDir(path, func(filePath string, d os.DirEntry, err error) error {
-			if err != nil {
-				return err
-			}
-			if !d.IsDir() && strings.EqualFold(filepath.Ext(filePath), ".flac") {
-				if config.ConvertOpus != "" {
-					if _, err := convertOpus(filePath, absInputRoot, config); err != nil {
-						return fmt.Errorf("converting %s: %w", filePath, err)
-					}
-				} else {
-					if _, err := fixFlac(filePath, config); err != nil {
-						return fmt.Errorf("processing %s: %w", filePath, err)
-					}
+		config.InputFormats = formats
+	}
+	if config.OpusTagsOnly && (config.ConvertOpus == "" || !config.convertsOpus()) {
+		fmt.Fprintln(os.Stderr, "Error: --opus-tags-only is only valid with --convert-opus")
+		os.Exit(1)
+	}
+	if config.OpusMergeMBIDs && config.ConvertOpus == "" {
+		fmt.Fprintln(os.Stderr, "Error: --opus-mb-ids is only valid with --convert-opus")
+		os.Exit(1)
+	}
+	if *batchSizePtr < 1 {
+		fmt.Fprintln(os.Stderr, "Error: --batch-size must be at least 1")
+		os.Exit(1)
+	}
+	if config.CopyUnmodified && config.OutDir == "" {
+		fmt.Fprintln(os.Stderr, "Error: --copy-unmodified is only valid with --out-dir")
+		os.Exit(1)
+	}
+
+	// The modes exclude each other
+	var modes []string
+	for _, mode := range []struct {
+		name     string
+		selected bool
+	}{
+		{"--convert", config.ConvertOpus != ""},
+		{"the fixing modes", config.fixing()},
+		{"--retag-from-opus", config.RetagOpus != ""},
+		{"--report-bitrate", *reportBitratePtr},
+		{"--gen-thumbnails", *genThumbnailsPtr},
+		{"--lms-lint", *lmsLintPtr},
+		{"--extract-cover", *extractCoverPtr != ""},
+		{"--info", *infoPtr},
+		{"--list-tags", *listTagsPtr},
+		{"--album-summary", *albumSummaryPtr},
+	} {
+		if mode.selected {
+			modes = append(modes, mode.name)
+		}
+	}
+	if len(modes) > 1 {
+		fmt.Fprintf(os.Stderr, "Error: %s cannot be used with other modes (also given: %s)\n", modes[len(modes)-1], strings.Join(modes[:len(modes)-1], ", "))
+		os.Exit(1)
+	}
+
+	// Check conflicts if converting
+	if config.ConvertOpus != "" {
+		// Converting always writes to the output directory unless a dry
+		// run is requested explicitly
+		config.Write = !*dryRunPtr
+
+		// Verify the encoder exists; listing orphans does not convert
+		if !config.ListOrphans && !config.convertsOpus() {
+			if *encoderPtr != "auto" {
+				fmt.Fprintln(os.Stderr, "Error: --encoder is only valid with Opus output")
+				os.Exit(1)
+			}
+			if _, err := exec.LookPath("ffmpeg"); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: ffmpeg not found in PATH, needed for --convert %s\n", config.ConvertFormat)
+				os.Exit(1)
+			}
+			config.Encoder = ffmpegFormatEncoder{Format: config.convertFormat()}
+		} else if !config.ListOrphans {
+			encoder, err := selectEncoder(*encoderPtr)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			config.Encoder = encoder
+		}
+	} else if config.NoPrune && config.OutDir == "" {
+		fmt.Fprintln(os.Stderr, "Error: --no-prune is only valid with --convert-opus or --out-dir")
+		os.Exit(1)
+	} else if config.PreserveXattrs {
+		fmt.Fprintln(os.Stderr, "Error: --preserve-xattrs is only valid with --convert-opus")
+		os.Exit(1)
+	}
+
+	if config.ListOrphans {
+		if config.mirrorRoot() == "" {
+			fmt.Fprintln(os.Stderr, "Error: --list-orphans is only valid with --convert-opus or --out-dir")
+			os.Exit(1)
+		}
+		// Only report, whatever -w says
+		config.Write = false
+		config.Progress = false
+	}
+
+	if *sizeBudgetPtr != "" {
+		if config.ConvertOpus == "" {
+			fmt.Fprintln(os.Stderr, "Error: --size-budget is only valid with --convert-opus")
+			os.Exit(1)
+		}
+		limit, err := parseByteSize(*sizeBudgetPtr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --size-budget: %v\n", err)
+			os.Exit(1)
+		}
+		config.Budget = &sizeBudget{limit: limit}
+	}
+
+	if *copyCoverPtr {
+		if config.ConvertOpus == "" {
+			fmt.Fprintln(os.Stderr, "Error: --copy-cover is only valid with --convert-opus")
+			os.Exit(1)
+		}
+		config.CoverCopies = newCoverCopier()
+	}
+
+	if *encoderPtr != "auto" && config.ConvertOpus == "" {
+		fmt.Fprintln(os.Stderr, "Error: --encoder is only valid with --convert-opus")
+		os.Exit(1)
+	}
+
+	if config.EmbedThumbnail < 0 {
+		fmt.Fprintln(os.Stderr, "Error: --embed-thumbnail must not be negative")
+		os.Exit(1)
+	}
+
+	if config.CompactPadding < 0 {
+		fmt.Fprintln(os.Stderr, "Error: --padding must not be negative")
+		os.Exit(1)
+	}
+	if !config.Compact && (config.DropApplication || config.CompactPadding != defaultCompactPadding) {
+		fmt.Fprintln(os.Stderr, "Error: --padding and --drop-application are only valid with --compact")
+		os.Exit(1)
+	}
+
+	if *jobsPtr < 1 {
+		fmt.Fprintln(os.Stderr, "Error: --jobs must be at least 1")
+		os.Exit(1)
+	}
+	if *jobsPtr > 1 && config.ConvertOpus == "" {
+		fmt.Fprintln(os.Stderr, "Error: --jobs is only valid with --convert-opus")
+		os.Exit(1)
+	}
+	config.Jobs = *jobsPtr
+
+	if *encodeTimeoutPtr < 0 {
+		fmt.Fprintln(os.Stderr, "Error: --encode-timeout must not be negative")
+		os.Exit(1)
+	}
+	if *encodeTimeoutPtr > 0 && config.ConvertOpus == "" {
+		fmt.Fprintln(os.Stderr, "Error: --encode-timeout is only valid with --convert-opus")
+		os.Exit(1)
+	}
+	config.EncodeTimeout = *encodeTimeoutPtr
+
+	if *verifyOpusPtr {
+		if config.ConvertOpus == "" {
+			fmt.Fprintln(os.Stderr, "Error: --verify-opus is only valid with --convert-opus")
+			os.Exit(1)
+		}
+		if decoder := config.outputDecoder(); !config.ListOrphans {
+			if _, err := exec.LookPath(decoder); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: --verify-opus needs %s in PATH\n", decoder)
+				os.Exit(1)
+			}
+		}
+		config.VerifyOpus = true
+	}
+
+	if *opusBitratePtr != "" {
+		if config.ConvertOpus == "" {
+			fmt.Fprintln(os.Stderr, "Error: --opus-bitrate is only valid with --convert-opus")
+			os.Exit(1)
+		}
+		kbps, err := parseBitrate(*opusBitratePtr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --opus-bitrate: %v\n", err)
+			os.Exit(1)
+		}
+		config.OpusBitrate = kbps
+	}
+
+	if *opusRulesPtr != "" {
+		if config.ConvertOpus == "" {
+			fmt.Fprintln(os.Stderr, "Error: --opus-rules is only valid with --convert-opus")
+			os.Exit(1)
+		}
+		rules, err := loadOpusRules(*opusRulesPtr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --opus-rules: %v\n", err)
+			os.Exit(1)
+		}
+		config.OpusRules = rules
+	}
+
+	if *minFreeSpacePtr != "" {
+		if config.ConvertOpus == "" {
+			fmt.Fprintln(os.Stderr, "Error: --min-free-space is only valid with --convert-opus")
+			os.Exit(1)
+		}
+		minFree, err := parseByteSize(*minFreeSpacePtr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --min-free-space: %v\n", err)
+			os.Exit(1)
+		}
+		config.MinFreeSpace = minFree
+	}
+
+	// Fail early if the installed encoder lacks an option we pass
+	switch config.Encoder.(type) {
+	case opusencEncoder:
+		supported, err := opusencOptions()
+		if err == nil {
+			err = checkOpusencOptions(supported, config)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case ffmpegEncoder:
+		if err := checkFfmpegEncoder("libopus"); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case ffmpegFormatEncoder:
+		if err := checkFfmpegEncoder(config.convertFormat().Codec); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if config.Encoder != nil && config.needsFfmpeg() {
+		if _, err := exec.LookPath("ffmpeg"); err != nil {
+			fmt.Fprintln(os.Stderr, "Error: ffmpeg not found in PATH, needed for --input-formats")
+			os.Exit(1)
+		}
+		if err := checkFfmpegEncoder("libopus"); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if config.PreserveXattrs && !xattrsSupported {
+		config.Log(LogWarn, "--preserve-xattrs is not supported on this platform, ignoring\n")
+		config.PreserveXattrs = false
+	}
+
+	if config.PreserveMtime && !config.fixing() {
+		fmt.Fprintln(os.Stderr, "Error: --preserve-mtime is only valid with "+fixingFlags)
+		os.Exit(1)
+	}
+
+	if *reportPtr != "" {
+		if !config.fixing() {
+			fmt.Fprintln(os.Stderr, "Error: --report is only valid with "+fixingFlags)
+			os.Exit(1)
+		}
+		report, err := newFixReport(*reportPtr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --report: %v\n", err)
+			os.Exit(1)
+		}
+		config.Report = report
+	}
+
+	if config.Verify {
+		if !config.fixing() {
+			fmt.Fprintln(os.Stderr, "Error: --verify is only valid with "+fixingFlags)
+			os.Exit(1)
+		}
+		if _, err := exec.LookPath("flac"); err != nil {
+			fmt.Fprintln(os.Stderr, "Error: --verify needs flac in PATH")
+			os.Exit(1)
+		}
+	}
+
+	if config.Backup {
+		if !config.fixing() {
+			fmt.Fprintln(os.Stderr, "Error: --backup is only valid with "+fixingFlags)
+			os.Exit(1)
+		}
+		if config.OutDir != "" {
+			fmt.Fprintln(os.Stderr, "Error: --backup cannot be used with --out-dir, which leaves the files alone")
+			os.Exit(1)
+		}
+	}
+	if config.ForceBackup && !config.Backup {
+		fmt.Fprintln(os.Stderr, "Error: --force is only valid with --backup or --backup-dir")
+		os.Exit(1)
+	}
+
+	if config.ForceCover && !config.EmbedCover {
+		fmt.Fprintln(os.Stderr, "Error: --force-cover is only valid with --embed-cover")
+		os.Exit(1)
+	}
+
+	if config.StrictMBID && !config.FixMBIDs && !config.OpusMergeMBIDs {
+		fmt.Fprintln(os.Stderr, "Error: --strict-mbid is only valid with --mb-ids or --opus-mb-ids")
+		os.Exit(1)
+	}
+
+	if config.StrictCover && !config.EmbedCover {
+		fmt.Fprintln(os.Stderr, "Error: --strict-cover is only valid with --embed-cover")
+		os.Exit(1)
+	}
+
+	if config.DefaultCover != "" {
+		if !config.EmbedCover {
+			fmt.Fprintln(os.Stderr, "Error: --default-cover is only valid with --embed-cover")
+			os.Exit(1)
+		}
+		if _, err := os.Stat(config.DefaultCover); err != nil {
+			fmt.Fprintf(os.Stderr, "Error accessing default cover: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if !utf8.ValidString(config.CoverDescription) {
+		fmt.Fprintln(os.Stderr, "Error: --cover-description must be valid UTF-8")
+		os.Exit(1)
+	}
+
+	if config.CoverType < 1 || config.CoverType > 20 {
+		fmt.Fprintln(os.Stderr, "Error: --cover-type must be a FLAC picture type between 1 and 20")
+		os.Exit(1)
+	}
+
+	if len(config.CoverFiles) > 0 && !config.EmbedCover {
+		fmt.Fprintln(os.Stderr, "Error: --cover is only valid with --embed-cover")
+		os.Exit(1)
+	}
+	for i, spec := range config.CoverFiles {
+		if slices.ContainsFunc(config.CoverFiles[:i], func(s coverSpec) bool { return s.Type == spec.Type }) {
+			fmt.Fprintf(os.Stderr, "Error: --cover: picture type %d is given more than once\n", spec.Type)
+			os.Exit(1)
+		}
+	}
+
+	if config.CoverMaxAspect != 0 && config.CoverMaxAspect < 1 {
+		fmt.Fprintln(os.Stderr, "Error: --cover-max-aspect must be at least 1")
+		os.Exit(1)
+	}
+
+	if config.CoverSearchParents < 0 {
+		fmt.Fprintln(os.Stderr, "Error: --cover-search-parents must not be negative")
+		os.Exit(1)
+	}
+	if config.CoverSearchParents > 0 && !config.EmbedCover {
+		fmt.Fprintln(os.Stderr, "Error: --cover-search-parents is only valid with --embed-cover")
+		os.Exit(1)
+	}
+
+	if config.MaxCoverDimension < 0 {
+		fmt.Fprintln(os.Stderr, "Error: --max-cover-size must not be negative")
+		os.Exit(1)
+	}
+	if config.CoverQuality < 1 || config.CoverQuality > 100 {
+		fmt.Fprintln(os.Stderr, "Error: --cover-quality must be between 1 and 100")
+		os.Exit(1)
+	}
+
+	if *reportBitratePtr {
+		config.Bitrates = &bitrateReport{threshold: float64(*bitrateThresholdPtr)}
+	}
+
+	if *genThumbnailsPtr {
+		if *thumbnailSizePtr <= 0 {
+			fmt.Fprintln(os.Stderr, "Error: --thumbnail-size must be positive")
+			os.Exit(1)
+		}
+		config.Thumbnails = newThumbnailer(*thumbnailSizePtr)
+	}
+
+	if *lmsLintPtr {
+		config.Lint = &lmsLinter{}
+	}
+
+	if *extractCoverPtr != "" {
+		if filepath.Base(*extractCoverPtr) != *extractCoverPtr {
+			fmt.Fprintln(os.Stderr, "Error: --extract-cover must be a file name without directory")
+			os.Exit(1)
+		}
+		config.CoverExtracts = newCoverExtractor(*extractCoverPtr)
+	}
+
+	if *infoPtr {
+		config.AudioInfo = &audioInfoReport{}
+	}
+
+	if *listTagsPtr {
+		config.TagList = &tagLister{filter: tagFilter}
+		// The listing is the output, a progress bar would only hide it
+		config.Progress = false
+	} else if len(tagFilter) > 0 {
+		fmt.Fprintln(os.Stderr, "Error: --tag-filter is only valid with --list-tags")
+		os.Exit(1)
+	}
+
+	if *albumSummaryPtr {
+		config.AlbumSummary = &albumSummary{albums: make(map[string]*albumTotals)}
+	}
+
+	if *checkArtistIDsPtr {
+		config.ArtistIDCheck = newArtistIDChecker()
+	}
+
+	if *limitPtr < 0 {
+		fmt.Fprintln(os.Stderr, "Error: --limit must not be negative")
+		os.Exit(1)
+	}
+
+	if *maxFileSizePtr != "" {
+		size, err := parseByteSize(*maxFileSizePtr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --max-file-size: %v\n", err)
+			os.Exit(1)
+		}
+		config.MaxFileSize = size
+	}
+
+	if *sincePtr != "" {
+		since, err := parseSince(*sincePtr, time.Now())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --since: %v\n", err)
+			os.Exit(1)
+		}
+		config.Since = since
+	}
+
+	if config.EmbedCover {
+		config.Covers = &coverCache{}
+	}
+
+	path := flag.Arg(0)
+	info, err := os.Stat(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error accessing path %s: %v\n", path, err)
+		os.Exit(1)
+	}
+
+	// Backups below the input would be walked and fixed as well
+	if config.BackupDir != "" && info.IsDir() {
+		if _, err := relativeToRoot(path, config.BackupDir); err == nil {
+			fmt.Fprintln(os.Stderr, "Error: --backup-dir must not be inside the input directory")
+			os.Exit(1)
+		}
+	}
+
+	if config.mirrorRoot() != "" {
+		if n, err := cleanTempFiles(config); err != nil {
+			fmt.Fprintf(os.Stderr, "Error cleaning temp files: %v\n", err)
+			os.Exit(1)
+		} else if n > 0 && !config.DryRun() {
+			config.Log(LogInfo, "Removed %d temp files of an interrupted run\n", n)
+		}
+	}
+
+	stopProfiling, err := startProfiling(*cpuProfilePtr, *memProfilePtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	code := run(path, info, config)
+	if config.Report != nil {
+		if err := config.Report.Write(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing report: %v\n", err)
+			code = 1
+		}
+	}
+	stopProfiling()
+	os.Exit(code)
+}
+
+// run processes path with the prepared configuration and returns the exit
+// code.
+func run(path string, info os.FileInfo, config Config) int {
+	if config.ListOrphans {
+		return listOrphans(path, info, config)
+	}
+	// After the summary, whichever way the run ends
+	if config.ArtistIDCheck != nil {
+		defer config.ArtistIDCheck.Report(config)
+	}
+
+	if config.Progress {
+		stats, err := runWithProgress(path, info, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		return successCode(stats, config)
+	}
+
+	stats := Stats{}
+	var stopErr error
+	if info.IsDir() {
+		// Calculate absolute path for input root to handle relative paths correctly
+		absInputRoot, err := filepath.Abs(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error getting absolute path for %s: %v\n", path, err)
+			return 1
+		}
+
+		list, err := listFlacFiles(path, info, config.walkOptions())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error walking directory: %v\n", err)
+			return 1
+		}
+		for _, s := range list.skipped {
+			config.Log(LogWarn, "Skipping %s: path too long: %v\n", s.path, s.err)
+			stats.Add(StatsMsg{PathTooLong: true})
+		}
+
+		// Show the position in the run on verbose output
+		if config.LogLevel >= LogVerbose {
+			config.Counter = newFileCounter(len(list.files))
+		}
+
+		// An interrupt stops the run after the current file; a second
+		// one kills the encoders still running, a third exits right away
+		ctx, abort, release := interruptContexts()
+		defer release()
+		config.Abort = abort
+
+		interrupted := processList(ctx, list.files, absInputRoot, config, func(filePath string, fileStats StatsMsg, err error) bool {
+			if errors.Is(err, errOutOfSpace) {
+				stopErr = err
+				return false
+			}
+			// Deeply nested files (or their outputs) exceed the path
+			// limits; not worth failing the run
+			if isPathTooLong(err) {
+				config.Log(LogWarn, "Skipping %s: path too long: %v\n", filePath, err)
+				fileStats.PathTooLong = true
+				err = nil
+			}
+			if err != nil {
+				fileStats.Failure = &fileFailure{Path: filePath, Err: err}
+				if config.FailFast {
+					stats.Add(fileStats)
+					stopErr = fmt.Errorf("processing %s: %w", filePath, err)
+					return false
+				}
+				config.Log(LogError, "Error processing %s: %v\n", filePath, err)
+			}
+			stats.Add(fileStats)
+			return true
+		})
+		if interrupted && stopErr == nil {
+			stopErr = errInterrupted
+		}
+
+		// Prune output directory if converting and not disabled; a
+		// failed or interrupted run leaves the output alone
+		if config.mirrorRoot() != "" && !config.NoPrune && !(config.FailFast && stopErr != nil) && stopErr != errInterrupted {
+			config.Counter = nil
+			if err := pruneOutput(absInputRoot, config); err != nil {
+				fmt.Fprintf(os.Stderr, "Error pruning output: %v\n", err)
+			}
+		}
+	} else {
+		fileStats, err := processFile(path, singleFileRoot(path), config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error processing %s: %v\n", path, err)
+			return 1
+		}
+		stats.Add(fileStats)
+	}
+
+	printSummary(stats, config)
+	if config.Covers != nil {
+		config.Log(LogVerbose, "Cover images decoded: %d\n", config.Covers.Decodes())
+	}
+
+	if stopErr != nil {
+		fmt.Fprintf(os.Stderr, "Error: processing stopped: %v\n", stopErr)
+		return 1
+	}
+	if stats.failed > 0 {
+		return 1
+	}
+	return successCode(stats, config)
+}
+
+// exitWouldChange is the exit code of a successful dry-run that found
+// files to change.
+const exitWouldChange = 2
+
+// successCode returns the exit code of a run without errors: 0, or
+// exitWouldChange for a dry-run that would have changed files.
+func successCode(stats Stats, config Config) int {
+	if config.DryRun() && stats.changed() {
+		return exitWouldChange
+	}
+	return 0
+}
+
+// listOrphans runs the prune scan for --list-orphans, which reports what
+// pruning would remove without removing anything.
+func listOrphans(path string, info os.FileInfo, config Config) int {
+	if !info.IsDir() {
+		fmt.Fprintln(os.Stderr, "Error: --list-orphans needs a directory")
+		return 1
+	}
+	absInputRoot, err := filepath.Abs(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting absolute path for %s: %v\n", path, err)
+		return 1
+	}
+	if err := pruneOutput(absInputRoot, config); err != nil {
+		fmt.Fprintf(os.Stderr, "Error scanning output: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// startProfiling starts writing a CPU profile to cpuFile, if set. The
+// returned function stops it and writes a heap profile to memFile, if set.
+func startProfiling(cpuFile, memFile string) (func(), error) {
+	var cpu *os.File
+	if cpuFile != "" {
+		var err error
+		cpu, err = os.Create(cpuFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create CPU profile: %w", err)
+		}
+		if err := pprof.StartCPUProfile(cpu); err != nil {
+			cpu.Close()
+			return nil, fmt.Errorf("failed to start CPU profile: %w", err)
+		}
+	}
+
+	return func() {
+		if cpu != nil {
+			pprof.StopCPUProfile()
+			cpu.Close()
+		}
+		if memFile != "" {
+			mem, err := os.Create(memFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to create heap profile: %v\n", err)
+				return
+			}
+			defer mem.Close()
+			runtime.GC() // Up to date statistics
+			if err := pprof.WriteHeapProfile(mem); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to write heap profile: %v\n", err)
+			}
+		}
+	}, nil
+}
+
+// relativeToRoot returns the path of file below root, used to mirror it
+// into another tree. Both paths are made absolute and cleaned first, so
+// that relative, drive letter and UNC (\\server\share\...) paths on
+// Windows compare correctly. A file outside of root is an error, as its
+// mirrored path would escape the other tree.
+func relativeToRoot(root, file string) (string, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	absFile, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(absRoot, absFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to get relative path: %w", err)
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not below %s", file, root)
+	}
+	return rel, nil
+}
+
+// singleFileRoot returns the input root used when a single file is given:
+// the absolute directory of the file.
+func singleFileRoot(path string) string {
+	absInputRoot := filepath.Dir(path)
+	if absPath, err := filepath.Abs(absInputRoot); err == nil {
+		absInputRoot = absPath
+	}
+	return absInputRoot
+}
+
+// conversionSizes returns the sizes of a converted file and its Opus
+// file, or zeros if either cannot be read.
+func conversionSizes(filePath string, absInputRoot string, config Config) (int64, int64) {
+	absInputFile, err := filepath.Abs(filePath)
+	if err != nil {
+		return 0, 0
+	}
+	outputFile, err := opusOutputFile(absInputFile, absInputRoot, config)
+	if err != nil {
+		return 0, 0
+	}
+	inStat, err := os.Stat(absInputFile)
+	if err != nil {
+		return 0, 0
+	}
+	outStat, err := os.Stat(outputFile)
+	if err != nil {
+		return 0, 0
+	}
+	return inStat.Size(), outStat.Size()
+}
+
+// interruptContexts returns a context done on the first interrupt and one
+// done on the second. After that the interrupt is no longer caught.
+func interruptContexts() (stop, abort context.Context, release func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	stop, cancelStop := context.WithCancel(context.Background())
+	abort, cancelAbort := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		for _, cancel := range []context.CancelFunc{cancelStop, cancelAbort} {
+			select {
+			case <-sigs:
+				cancel()
+			case <-done:
+				return
+			}
+		}
+		signal.Stop(sigs)
+	}()
+	return stop, abort, func() {
+		close(done)
+		signal.Stop(sigs)
+		cancelStop()
+		cancelAbort()
+	}
+}
+
+// processList runs processFile on files, config.Jobs of them at a time,
+// and passes the results to handle in the order of files. The log output
+// of a file is held back until its result is handled, so that the output
+// of parallel files does not mix. handle returns false to stop the run;
+// files already started are finished but not handled. processList
+// reports whether ctx stopped it before all files were processed.
+func processList(ctx context.Context, files []string, absInputRoot string, config Config, handle func(filePath string, stats StatsMsg, err error) bool) bool {
+	if config.Jobs <= 1 {
+		for _, filePath := range files {
+			if ctx.Err() != nil {
+				return true
+			}
+			if config.Counter != nil {
+				config.Counter.Next()
+			}
+			stats, err := processFile(filePath, absInputRoot, config)
+			if !handle(filePath, stats, err) {
+				return false
+			}
+		}
+		return false
+	}
+
+	type logEntry struct {
+		level  LogLevel
+		format string
+		args   []any
+	}
+	type fileResult struct {
+		stats StatsMsg
+		err   error
+		log   []logEntry
+	}
+	type pendingFile struct {
+		path string
+		done chan fileResult
+	}
+
+	// The files are queued in order; the queue and the file being
+	// waited for limit the files in flight to config.Jobs
+	queue := make(chan pendingFile, config.Jobs-1)
+	stop := make(chan struct{})
+	interrupted := false
+	go func() {
+		defer close(queue)
+		for _, filePath := range files {
+			if ctx.Err() != nil {
+				interrupted = true
+				return
+			}
+			done := make(chan fileResult, 1)
+			select {
+			case queue <- pendingFile{filePath, done}:
+			case <-stop:
+				return
+			}
+			go func() {
+				var log []logEntry
+				fileConfig := config
+				fileConfig.LogFunc = func(level LogLevel, format string, args ...any) {
+					log = append(log, logEntry{level, format, args})
+				}
+				stats, err := processFile(filePath, absInputRoot, fileConfig)
+				done <- fileResult{stats, err, log}
+			}()
+		}
+	}()
+
+	stopped := false
+	for pending := range queue {
+		result := <-pending.done
+		if stopped {
+			continue
+		}
+		if config.Counter != nil {
+			config.Counter.Next()
+		}
+		for _, e := range result.log {
+			config.Log(e.level, e.format, e.args...)
+		}
+		if !handle(pending.path, result.stats, result.err) {
+			stopped = true
+			close(stop)
+		}
+	}
+	return interrupted
+}
+
+// processFile runs the selected mode on a single FLAC file and reports
+// what was done.
+func processFile(filePath string, absInputRoot string, config Config) (StatsMsg, error) {
+	stats := StatsMsg{}
+
+	if config.ArtistIDCheck != nil && isFlacFile(filePath) {
+		if err := config.ArtistIDCheck.Add(filePath); err != nil {
+			return stats, err
+		}
+	}
+
+	if config.ConvertOpus != "" {
+		outcome, err := convertOpus(filePath, absInputRoot, config)
+		stats.Converted = outcome == convertDone
+		stats.OpusTagsUpdated = outcome == convertTagsUpdated
+		stats.BudgetSkipped = outcome == convertOverBudget
+		stats.EncodeTimedOut = outcome == convertTimedOut
+		stats.VerifyFailed = outcome == convertVerifyFailed
+		if err == nil && outcome == convertDone && !config.DryRun() {
+			stats.InputBytes, stats.OutputBytes = conversionSizes(filePath, absInputRoot, config)
+		}
+		if err != nil || config.CoverCopies == nil || outcome == convertOverBudget {
+			return stats, err
+		}
+		stats.CoverCopied, err = config.CoverCopies.Copy(filePath, absInputRoot, config)
+		return stats, err
+	}
+
+	if config.RetagOpus != "" {
+		retagged, err := retagFromOpus(filePath, absInputRoot, config)
+		stats.Retagged = retagged
+		return stats, err
+	}
+
+	if config.Bitrates != nil {
+		return stats, config.Bitrates.Audit(filePath)
+	}
+
+	if config.Thumbnails != nil {
+		generated, err := config.Thumbnails.Generate(filePath, config)
+		stats.ThumbnailGenerated = generated
+		return stats, err
+	}
+
+	if config.Lint != nil {
+		return stats, config.Lint.Check(filePath)
+	}
+
+	if config.AudioInfo != nil {
+		return stats, config.AudioInfo.Add(filePath)
+	}
+
+	if config.TagList != nil {
+		return stats, config.TagList.Add(filePath)
+	}
+
+	if config.AlbumSummary != nil {
+		return stats, config.AlbumSummary.Add(filePath)
+	}
+
+	if config.CoverExtracts != nil {
+		f, err := readFlacMetadata(filePath)
+		if err != nil {
+			return stats, err
+		}
+		stats.CoverExtracted, err = extractCover(filePath, f, config.CoverExtracts, config)
+		return stats, err
+	}
+
+	var extracted bool
+	if config.CoverSync != nil && config.coverFileIn(filepath.Dir(filePath)) == "" {
+		var err error
+		if extracted, err = syncAlbumCover(filePath, config); err != nil {
+			return stats, err
+		}
+	}
+
+	var err error
+	if config.Report != nil {
+		stats, err = config.Report.Fix(filePath, absInputRoot, config)
+	} else {
+		stats, _, err = fixFile(filePath, absInputRoot, config)
+	}
+	stats.CoverExtracted = extracted
+	return stats, err
+}
+
+// fixFile runs the fixing modes on filePath, in place or into --out-dir.
+func fixFile(filePath string, absInputRoot string, config Config) (StatsMsg, FixStats, error) {
+	stats := StatsMsg{}
+	target := filePath
+	if config.OutDir != "" {
+		rel, err := relativeToRoot(absInputRoot, filePath)
+		if err != nil {
+			return stats, FixStats{}, err
+		}
+		target = filepath.Join(config.OutDir, rel)
+	}
+	backup, err := config.backupPath(filePath, absInputRoot)
+	if err != nil {
+		return stats, FixStats{}, err
+	}
+	config.coverRoot = absInputRoot
+	fs, err := fixFlacTo(filePath, target, backup, config)
+	stats.MBMerged = fs.MBIDsFixed
+	stats.MergedTags = fs.MergedTags
+	stats.TrackUIDSet = fs.TrackUIDSet
+	stats.KeysNormalized = fs.KeysNormalized > 0
+	stats.TagsStripped = fs.TagsStripped > 0
+	stats.TagsDeduplicated = fs.TagsDeduplicated > 0
+	stats.ValuesTrimmed = fs.ValuesTrimmed > 0
+	stats.EmptyDropped = fs.EmptyDropped > 0
+	stats.TagsSet = fs.TagsSet > 0
+	stats.TagsFolded = fs.TagsFolded > 0
+	stats.TagsRenamed = fs.TagsRenamed > 0
+	stats.GainTagsRemoved = fs.GainTagsRemoved > 0
+	stats.BytesReclaimed = fs.BytesReclaimed
+	stats.Album = fs.Album
+	stats.Artists = fs.Artists
+	stats.CoverEmbedded = fs.CoverEmbedded
+	stats.ThumbnailEmbedded = fs.ThumbnailEmbedded
+	stats.PermissionsFixed = fs.PermissionsFixed
+	stats.VerifyFailed = fs.VerifyFailed
+	return stats, fs, err
+}
+
+// convertOutcome describes what convertOpus did with a file.
+type convertOutcome int
+
+const (
+	convertFailed convertOutcome = iota
+	convertUpToDate
+	convertDone
+	convertOverBudget
+	convertTagsUpdated
+	convertTimedOut
+	convertVerifyFailed
+)
+
+// Encoder converts a FLAC file to an Opus file. convertOpus takes care of
+// the output paths, so implementations only write out.
+type Encoder interface {
+	Encode(in, out string, opts EncodeOptions) error
+}
+
+// EncodeOptions tune a single encoder run.
+type EncodeOptions struct {
+	// Output receives the encoder's console output. When nil, it is
+	// captured and reported with a failure.
+	Output io.Writer
+	// Bitrate is the target bitrate in kbps (0 uses the encoder's
+	// default).
+	Bitrate float64
+	// Picture is an image file to attach as front cover. Pictures embedded
+	// in the input are copied by the encoder itself.
+	Picture string
+	// Comments, when set, replace the comments of the input.
+	Comments []string
+	// Log, when set, receives debug tracing.
+	Log func(level LogLevel, format string, args ...any)
+	// Timeout, when set, kills encoder runs that take longer; they fail
+	// with errEncodeTimeout.
+	Timeout time.Duration
+	// Abort, when set and done, kills the encoder; the run fails with
+	// errInterrupted.
+	Abort context.Context
+}
+
+// errEncodeTimeout is returned for encoder runs exceeding the timeout.
+var errEncodeTimeout = errors.New("encoder timed out")
+
+// opusencEncoder runs the opusenc command line tool.
+type opusencEncoder struct{}
+
+func (opusencEncoder) Encode(in, out string, opts EncodeOptions) error {
+	var args []string
+	if opts.Bitrate > 0 {
+		args = append(args, "--bitrate", strconv.FormatFloat(opts.Bitrate, 'f', -1, 64))
+	}
+	if opts.Picture != "" {
+		// Spell out the front cover type so that '|' in the path is not
+		// taken as a field separator
+		args = append(args, "--picture", "3||||"+longPath(opts.Picture))
+	}
+	if opts.Comments != nil {
+		// --comment adds to the copied comments, so drop those first;
+		// pictures are still copied
+		args = append(args, "--discard-comments")
+		for _, c := range opts.Comments {
+			args = append(args, "--comment", c)
+		}
+	}
+	return runEncoder("opusenc", append(args, longPath(in), longPath(out)), opts)
+}
+
+// runEncoder runs an encoder command, sending its console output to
+// opts.Output.
+func runEncoder(name string, args []string, opts EncodeOptions) error {
+	ctx := context.Background()
+	if opts.Abort != nil {
+		ctx = opts.Abort
+	}
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	// Children of the encoder may keep its output open after the kill
+	cmd.WaitDelay = time.Second
+	// An interrupt stops the run after the current file, not the encoder;
+	// a kill takes the whole group
+	detachProcessGroup(cmd)
+	cmd.Cancel = func() error { return killProcessGroup(cmd) }
+	if opts.Log != nil {
+		opts.Log(LogDebug, "Running: %q\n", cmd.Args)
+	}
+
+	var stderr bytes.Buffer
+	if opts.Output != nil {
+		cmd.Stdout = opts.Output
+		cmd.Stderr = opts.Output
+	} else {
+		cmd.Stderr = &stderr
+	}
+
+	if err := cmd.Run(); err != nil {
+		if opts.Abort != nil && opts.Abort.Err() != nil {
+			return fmt.Errorf("%s: %w", name, errInterrupted)
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("%s: %w after %v", name, errEncodeTimeout, opts.Timeout)
+		}
+		if stderr.Len() > 0 {
+			return fmt.Errorf("%s failed: %v, stderr: %s", name, err, stderr.String())
+		}
+		return fmt.Errorf("%s failed: %w", name, err)
+	}
+	return nil
+}
+
+// ffmpegEncoder runs ffmpeg with libopus, for systems without opusenc.
+// ffmpeg does not copy pictures into Ogg, so the tags are replaced with
+// the ones opusenc would write afterwards.
+type ffmpegEncoder struct{}
+
+func (ffmpegEncoder) Encode(in, out string, opts EncodeOptions) error {
+	args := []string{"-nostdin", "-hide_banner", "-loglevel", "error", "-y", "-i", longPath(in), "-map", "0:a", "-c:a", "libopus"}
+	if opts.Bitrate > 0 {
+		args = append(args, "-b:a", strconv.FormatFloat(opts.Bitrate, 'f', -1, 64)+"k")
+	}
+	// The output name ends in the temp suffix, so name the format
+	args = append(args, "-f", "opus", longPath(out))
+	if err := runEncoder("ffmpeg", args, opts); err != nil {
+		return err
+	}
+
+	encoded, err := readOpusTags(out)
+	if err != nil {
+		return fmt.Errorf("failed to read tags from ffmpeg output: %w", err)
+	}
+	vc := encoded
+	if isFlacFile(in) {
+		if vc, err = opusTagsFor(in, opts.Picture, opts.Comments, encoded); err != nil {
+			return err
+		}
+	} else if opts.Picture != "" {
+		// ffmpeg copied the tags of other formats itself
+		comment, err := pictureComment(opts.Picture)
+		if err != nil {
+			return err
+		}
+		vc.Comments = append(vc.Comments, comment)
+	} else {
+		return nil
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		return err
+	}
+	if data, err = replaceOpusTags(data, vc); err != nil {
+		return fmt.Errorf("failed to write tags to ffmpeg output: %w", err)
+	}
+	return os.WriteFile(out, data, 0o644)
+}
+
+// ffmpegFormatEncoder runs ffmpeg for the output formats other than
+// Opus. ffmpeg maps the tags to ID3v2 or MP4 itself and copies embedded
+// pictures as attached pictures.
+type ffmpegFormatEncoder struct {
+	Format convertFormat
+}
+
+func (e ffmpegFormatEncoder) Encode(in, out string, opts EncodeOptions) error {
+	args := []string{"-nostdin", "-hide_banner", "-loglevel", "error", "-y", "-i", longPath(in)}
+	if opts.Picture != "" {
+		args = append(args, "-i", longPath(opts.Picture), "-map", "0:a", "-map", "1:v", "-disposition:v", "attached_pic")
+	} else {
+		args = append(args, "-map", "0:a", "-map", "0:v?")
+	}
+	args = append(args, "-c:a", e.Format.Codec, "-c:v", "copy")
+	if opts.Bitrate > 0 {
+		args = append(args, "-b:a", strconv.FormatFloat(opts.Bitrate, 'f', -1, 64)+"k")
+	}
+	if opts.Comments != nil {
+		args = append(args, "-map_metadata", "-1")
+		for _, c := range opts.Comments {
+			args = append(args, "-metadata", c)
+		}
+	}
+	// The output name ends in the temp suffix, so name the format
+	return runEncoder("ffmpeg", append(args, "-f", e.Format.Muxer, longPath(out)), opts)
+}
+
+// encoderNames are the choices of --encoder.
+var encoderNames = []string{"auto", "opusenc", "ffmpeg"}
+
+// selectEncoder returns the encoder for an --encoder choice. auto prefers
+// opusenc and falls back to ffmpeg.
+func selectEncoder(name string) (Encoder, error) {
+	_, opusencErr := exec.LookPath("opusenc")
+	_, ffmpegErr := exec.LookPath("ffmpeg")
+	switch strings.ToLower(name) {
+	case "auto":
+		if opusencErr == nil {
+			return opusencEncoder{}, nil
+		}
+		if ffmpegErr == nil {
+			return ffmpegEncoder{}, nil
+		}
+		return nil, errors.New("neither opusenc nor ffmpeg found in PATH")
+	case "opusenc":
+		if opusencErr != nil {
+			return nil, errors.New("opusenc not found in PATH")
+		}
+		return opusencEncoder{}, nil
+	case "ffmpeg":
+		if ffmpegErr != nil {
+			return nil, errors.New("ffmpeg not found in PATH")
+		}
+		return ffmpegEncoder{}, nil
+	}
+	return nil, fmt.Errorf("unknown encoder %q (use %s)", name, strings.Join(encoderNames, ", "))
+}
+
+// checkFfmpegEncoder fails if ffmpeg was built without the audio
+// encoder, e.g. libopus.
+func checkFfmpegEncoder(codec string) error {
+	out, err := exec.Command("ffmpeg", "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return fmt.Errorf("ffmpeg -encoders failed: %w", err)
+	}
+	if !regexp.MustCompile(`(?m)^\s*A\S*\s+` + regexp.QuoteMeta(codec) + `\s`).Match(out) {
+		return fmt.Errorf("ffmpeg has no %s encoder", codec)
+	}
+	return nil
+}
+
+// opusencOptions holds the options listed by opusenc --help. It is probed
+// once per run, so that an option missing from the installed version is
+// reported at startup instead of failing every file.
+var opusencOptions = sync.OnceValues(probeOpusenc)
+
+// probeOpusenc runs opusenc --help and returns the options it lists.
+func probeOpusenc() (map[string]bool, error) {
+	// Some versions exit non-zero after printing the help
+	out, err := exec.Command("opusenc", "--help").CombinedOutput()
+	options := parseOpusencOptions(string(out))
+	if len(options) == 0 {
+		if err != nil {
+			return nil, fmt.Errorf("opusenc --help failed: %w", err)
+		}
+		return nil, errors.New("opusenc --help lists no options")
+	}
+	return options, nil
+}
+
+var opusencOptionPattern = regexp.MustCompile(`--[a-z][a-z0-9-]*`)
+
+// parseOpusencOptions returns the long options mentioned in help output.
+func parseOpusencOptions(help string) map[string]bool {
+	options := make(map[string]bool)
+	for _, option := range opusencOptionPattern.FindAllString(help, -1) {
+		options[option] = true
+	}
+	return options
+}
+
+// requiredOpusencOption is an opusenc option the configuration relies on.
+type requiredOpusencOption struct {
+	option string
+	reason string
+}
+
+// requiredOpusencOptions returns the opusenc options that may be passed
+// with config.
+func requiredOpusencOptions(config Config) []requiredOpusencOption {
+	required := []requiredOpusencOption{
+		{"--picture", "attaching folder covers"},
+	}
+	if config.OpusBitrate > 0 {
+		required = append(required, requiredOpusencOption{"--bitrate", "--opus-bitrate"})
+	} else if config.OpusRules != nil {
+		required = append(required, requiredOpusencOption{"--bitrate", "--opus-rules"})
+	}
+	if config.OpusMergeMBIDs {
+		required = append(required,
+			requiredOpusencOption{"--discard-comments", "--opus-mb-ids"},
+			requiredOpusencOption{"--comment", "--opus-mb-ids"})
+	}
+	return required
+}
+
+// checkOpusencOptions reports the first required option that is missing
+// from the supported ones.
+func checkOpusencOptions(supported map[string]bool, config Config) error {
+	for _, r := range requiredOpusencOptions(config) {
+		if !supported[r.option] {
+			return fmt.Errorf("opusenc does not support %s, needed for %s", r.option, r.reason)
+		}
+	}
+	return nil
+}
+
+// opusCoverSource tells where the cover of a converted file comes from.
+type opusCoverSource int
+
+const (
+	opusCoverNone opusCoverSource = iota
+	opusCoverEmbedded
+	opusCoverExternal
+)
+
+// resolveOpusCover picks the cover for the Opus file of filename: its
+// embedded front cover (FLAC only), else the folder cover named by --cover-name, else
+// none. The returned path is only set for a folder cover.
+func resolveOpusCover(filename string, config Config) (opusCoverSource, string, error) {
+	var f *flac.File
+	if isFlacFile(filename) {
+		var err error
+		if f, err = readFlacMetadata(filename); err != nil {
+			return opusCoverNone, "", err
+		}
+	} else {
+		// Covers embedded in other formats are not copied
+		f = &flac.File{}
+	}
+	for _, block := range f.Meta {
+		if t, ok := pictureType(block); !ok || t != pictureTypeFrontCover {
+			continue
+		}
+		if _, err := ParsePicture(block.Data); err != nil {
+			config.Log(LogWarn, "%s: Ignoring broken embedded cover: %v\n", filename, err)
+			continue
+		}
+		return opusCoverEmbedded, "", nil
+	}
+
+	if coverPath := config.coverFileIn(filepath.Dir(filename)); coverPath != "" {
+		if info, err := os.Stat(coverPath); err == nil && info.Mode().IsRegular() {
+			return opusCoverExternal, coverPath, nil
+		}
+	}
+	return opusCoverNone, "", nil
+}
+
+// opusRules picks the encoder bitrate per file. A rules file has lines
+// like "192 GENRE=Classical*": a bitrate in kbps, or a {TAG} template
+// taking it from the file's tag, followed by a condition. The first rule
+// whose condition matches wins. Conditions are
+//
+//	TAG                      the tag is present
+//	TAG=pattern              a value of the tag matches the glob pattern
+//	stream.samplerate>48000  a STREAMINFO field (samplerate, bits or
+//	                         channels) compared with =, <, <=, > or >=
+//	*                        always (also an empty condition)
+type opusRules []opusRule
+
+type opusRule struct {
+	line    int
+	bitrate string
+	cond    string
+}
+
+var streamFields = map[string]func(*flac.StreamInfoBlock) int{
+	"samplerate": func(si *flac.StreamInfoBlock) int { return si.SampleRate },
+	"bits":       func(si *flac.StreamInfoBlock) int { return si.BitDepth },
+	"channels":   func(si *flac.StreamInfoBlock) int { return si.ChannelCount },
+}
+
+// loadOpusRules reads and validates a rules file.
+func loadOpusRules(filename string) (opusRules, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules opusRules
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		bitrate, cond, _ := strings.Cut(line, " ")
+		rule := opusRule{line: i + 1, bitrate: bitrate, cond: strings.TrimSpace(cond)}
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, rule.line, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (r opusRule) validate() error {
+	if !isTagTemplate(r.bitrate) {
+		if _, err := parseBitrate(r.bitrate); err != nil {
+			return err
+		}
+	}
+
+	if field, ok := strings.CutPrefix(r.cond, "stream."); ok {
+		name, _, _, err := parseStreamCondition(field)
+		if err != nil {
+			return err
+		}
+		if _, ok := streamFields[name]; !ok {
+			return fmt.Errorf("unknown STREAMINFO field %q", name)
+		}
+	} else if _, pattern, ok := strings.Cut(r.cond, "="); ok {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// parseBitrate parses a bitrate in kbps.
+func parseBitrate(s string) (float64, error) {
+	kbps, err := strconv.ParseFloat(s, 64)
+	if err != nil || !(kbps > 0) || math.IsInf(kbps, 0) {
+		return 0, fmt.Errorf("invalid bitrate %q, expected a positive number of kbps", s)
+	}
+	return kbps, nil
+}
+
+func isTagTemplate(s string) bool {
+	return len(s) > 2 && strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}")
+}
+
+// parseStreamCondition splits e.g. "bits>=24" into its parts.
+func parseStreamCondition(s string) (string, string, int, error) {
+	i := strings.IndexAny(s, "<>=")
+	if i <= 0 {
+		return "", "", 0, fmt.Errorf("invalid condition %q", "stream."+s)
+	}
+	op := s[i : i+1]
+	if i+1 < len(s) && s[i+1] == '=' && op != "=" {
+		op += "="
+	}
+	value, err := strconv.Atoi(s[i+len(op):])
+	if err != nil {
+		return "", "", 0, fmt.Errorf("invalid number in condition %q", "stream."+s)
+	}
+	return s[:i], op, value, nil
+}
+
+// match reports whether the condition holds for a file with the given
+// tags (keys in upper case) and STREAMINFO.
+func (r opusRule) match(tags map[string][]string, si *flac.StreamInfoBlock) bool {
+	if r.cond == "" || r.cond == "*" {
+		return true
+	}
+
+	if field, ok := strings.CutPrefix(r.cond, "stream."); ok {
+		if si == nil {
+			return false
+		}
+		name, op, value, _ := parseStreamCondition(field)
+		got := streamFields[name](si)
+		switch op {
+		case "=":
+			return got == value
+		case "<":
+			return got < value
+		case "<=":
+			return got <= value
+		case ">":
+			return got > value
+		case ">=":
+			return got >= value
+		}
+		return false
+	}
+
+	key, pattern, hasPattern := strings.Cut(r.cond, "=")
+	values, ok := tags[strings.ToUpper(key)]
+	if !hasPattern {
+		return ok
+	}
+	for _, v := range values {
+		if matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(v)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Bitrate returns the bitrate of the first matching rule. Rules with a
+// template are skipped when the tag holds no valid bitrate.
+func (rules opusRules) Bitrate(tags map[string][]string, si *flac.StreamInfoBlock) (float64, bool) {
+	for _, r := range rules {
+		if !r.match(tags, si) {
+			continue
+		}
+		value := r.bitrate
+		if isTagTemplate(value) {
+			values := tags[strings.ToUpper(value[1:len(value)-1])]
+			if len(values) == 0 {
+				continue
+			}
+			value = values[0]
+		}
+		if kbps, err := parseBitrate(value); err == nil {
+			return kbps, true
+		}
+	}
+	return 0, false
+}
+
+// bitrateFor evaluates the rules against the metadata of filename.
+func (rules opusRules) bitrateFor(filename string) (float64, bool, error) {
+	f, err := readFlacMetadata(filename)
+	if err != nil {
+		return 0, false, err
+	}
+	si, err := f.GetStreamInfo()
+	if err != nil {
+		return 0, false, err
+	}
+
+	tags, err := readTagMap(f)
+	if err != nil {
+		return 0, false, err
+	}
+	kbps, ok := rules.Bitrate(tags, si)
+	return kbps, ok, nil
+}
+
+// readTagMap returns the Vorbis comments of f by upper case key.
+func readTagMap(f *flac.File) (map[string][]string, error) {
+	tags := make(map[string][]string)
+	for _, block := range f.Meta {
+		if block.Type != flac.VorbisComment {
+			continue
+		}
+		cmts, err := ParseVorbisComment(block.Data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse vorbis comments: %w", err)
+		}
+		for _, c := range cmts.Comments {
+			if key, value, ok := strings.Cut(c, "="); ok {
+				key = strings.ToUpper(key)
+				tags[key] = append(tags[key], value)
+			}
+		}
+	}
+	return tags, nil
+}
+
+// opusOutputFile returns the converted file for absInputFile, at the
+// same relative path under the --convert-opus directory.
+func opusOutputFile(absInputFile string, inputRoot string, config Config) (string, error) {
+	relPath, err := relativeToRoot(inputRoot, absInputFile)
+	if err != nil {
+		return "", err
+	}
+	outputFile := filepath.Join(config.ConvertOpus, relPath)
+	return strings.TrimSuffix(outputFile, filepath.Ext(outputFile)) + config.mirrorExt(), nil
+}
+
+func convertOpus(inputFile string, inputRoot string, config Config) (convertOutcome, error) {
+	absInputFile, err := filepath.Abs(inputFile)
+	if err != nil {
+		return convertFailed, err
+	}
+
+	// Calculate relative path from input root
+	relPath, err := relativeToRoot(inputRoot, absInputFile)
+	if err != nil {
+		return convertFailed, err
+	}
+
+	// Determine output filename
+	outputFile, err := opusOutputFile(absInputFile, inputRoot, config)
+	if err != nil {
+		return convertFailed, err
+	}
+
+	outputDir := filepath.Dir(outputFile)
+
+	// Check if up to date
+	inStat, err := os.Stat(absInputFile)
+	if err != nil {
+		return convertFailed, err
+	}
+
+	outStat, err := os.Stat(outputFile)
+	if err == nil {
+		if !inStat.ModTime().After(outStat.ModTime()) {
+			// Up to date outputs occupy the budget as well
+			if config.Budget != nil {
+				config.Budget.Add(outStat.Size())
+			}
+			config.Log(LogVerbose, "Skipping (up to date): %s\n", relPath)
+			return convertUpToDate, nil
+		}
+	}
+
+	if config.Budget != nil && config.Budget.Exhausted() {
+		config.Log(LogVerbose, "Skipping (size budget reached): %s\n", relPath)
+		return convertOverBudget, nil
+	}
+
+	// The audio of an existing output is kept, only the tags follow;
+	// other formats carry no Vorbis comments to copy
+	if outStat != nil && config.OpusTagsOnly && isFlacFile(absInputFile) {
+		if config.DryRun() {
+			config.Log(LogInfo, "[DRY-RUN] Would update tags: %s\n", relPath)
+			return convertTagsUpdated, nil
+		}
+		config.Log(LogInfo, "Updating tags: %s\n", relPath)
+		if err := updateOpusTags(absInputFile, outputFile, config); err != nil {
+			return convertFailed, err
+		}
+		if config.Budget != nil {
+			if newStat, err := os.Stat(outputFile); err == nil {
+				config.Budget.Add(newStat.Size())
+			}
+		}
+		return convertTagsUpdated, nil
+	}
+
+	if config.DryRun() {
+		config.Log(LogInfo, "[DRY-RUN] Would convert: %s\n", relPath)
+		return convertDone, nil
+	}
+
+	// Ensure output directory exists
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return convertFailed, fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	if config.MinFreeSpace > 0 {
+		if err := checkFreeSpace(outputDir, config.MinFreeSpace); err != nil {
+			return convertFailed, err
+		}
+	}
+
+	config.Log(LogInfo, "Converting: %s\n", relPath)
+
+	// Atomic write: convert to .tmp first
+	tempOutputFile := outputFile + tempSuffix
+
+	opts := EncodeOptions{Log: config.Log, Bitrate: config.OpusBitrate, Timeout: config.EncodeTimeout, Abort: config.Abort}
+	source, coverPath, err := resolveOpusCover(absInputFile, config)
+	if err != nil {
+		return convertFailed, err
+	}
+	if opts.Comments, err = opusComments(absInputFile, config); err != nil {
+		return convertFailed, err
+	}
+	// Rules look at FLAC metadata, other formats use the default
+	if config.OpusRules != nil && isFlacFile(absInputFile) {
+		kbps, ok, err := config.OpusRules.bitrateFor(absInputFile)
+		if err != nil {
+			return convertFailed, err
+		}
+		if ok {
+			config.Log(LogDebug, "%s: Using %g kbps\n", relPath, kbps)
+			opts.Bitrate = kbps
+		}
+	}
+	switch source {
+	case opusCoverEmbedded:
+		config.Log(LogDebug, "%s: Using embedded cover\n", relPath)
+	case opusCoverExternal:
+		config.Log(LogDebug, "%s: Using cover %s\n", relPath, coverPath)
+		opts.Picture = coverPath
+	default:
+		config.Log(LogVerbose, "%s: No cover found\n", relPath)
+	}
+	// Parallel encoders would mix their output
+	if config.LogLevel >= LogVerbose && !config.Progress && config.Jobs <= 1 {
+		opts.Output = os.Stderr
+	}
+
+	// Success is decided by the encoder's result and the output itself;
+	// encoders write progress and benign warnings to stderr
+	if err := config.encoderFor(absInputFile).Encode(absInputFile, tempOutputFile, opts); err != nil {
+		// Clean up temp file on failure
+		os.Remove(tempOutputFile)
+		// A hanging encoder is likely stuck on a damaged file, go on
+		// with the next one
+		if errors.Is(err, errEncodeTimeout) {
+			config.Log(LogWarn, "Skipping %s: %v\n", relPath, err)
+			return convertTimedOut, nil
+		}
+		// A full disk is the likely cause then, stop the run
+		if config.MinFreeSpace > 0 {
+			if err := checkFreeSpace(outputDir, config.MinFreeSpace); err != nil {
+				return convertFailed, err
+			}
+		}
+		return convertFailed, err
+	}
+
+	if err := validateOutput(tempOutputFile, config.convertsOpus()); err != nil {
+		os.Remove(tempOutputFile)
+		return convertFailed, fmt.Errorf("encoder produced invalid output: %w", err)
+	}
+
+	// Encoders have been seen to exit cleanly with a truncated file
+	if config.VerifyOpus {
+		if err := decodeOutput(tempOutputFile, config); err != nil {
+			os.Remove(tempOutputFile)
+			config.Log(LogWarn, "Skipping %s: converted file does not decode: %v\n", relPath, err)
+			return convertVerifyFailed, nil
+		}
+	}
+
+	if config.Budget != nil {
+		tempStat, err := os.Stat(tempOutputFile)
+		if err != nil {
+			os.Remove(tempOutputFile)
+			return convertFailed, err
+		}
+		if !config.Budget.Fits(tempStat.Size()) {
+			os.Remove(tempOutputFile)
+			config.Log(LogInfo, "Size budget reached, not keeping: %s\n", relPath)
+			return convertOverBudget, nil
+		}
+	}
+
+	// If successful, rename
+	if err := os.Rename(tempOutputFile, outputFile); err != nil {
+		return convertFailed, fmt.Errorf("failed to rename temp file: %w", err)
+	}
+
+	// Best-effort: a missing attribute is not worth failing the conversion
+	if config.PreserveXattrs {
+		if err := copyXattrs(absInputFile, outputFile); err != nil {
+			config.Log(LogWarn, "%s: Could not copy extended attributes: %v\n", relPath, err)
+		}
+	}
+
+	return convertDone, nil
+}
+
+// errOutOfSpace stops a conversion run when the output filesystem runs
+// low on space.
+var errOutOfSpace = errors.New("not enough free space on output filesystem")
+
+// checkFreeSpace returns an error wrapping errOutOfSpace when less than
+// minFree bytes are available at path.
+func checkFreeSpace(path string, minFree int64) error {
+	free, err := freeSpace(path)
+	if err != nil {
+		return fmt.Errorf("failed to check free space: %w", err)
+	}
+	if free < minFree {
+		return fmt.Errorf("%w (%s free, minimum is %s)", errOutOfSpace, formatBytes(free), formatBytes(minFree))
+	}
+	return nil
+}
+
+// validateOpusOutput checks that an encoder output is a non-empty Ogg Opus
+// file with readable headers.
+func validateOpusOutput(path string) error {
+	return validateOutput(path, true)
+}
+
+// validateOutput checks that an encoder output is not empty and, for
+// Opus, that its headers are readable.
+func validateOutput(path string, opus bool) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("output file is empty")
+	}
+	if !opus {
+		return nil
+	}
+	_, err = readOpusTags(path)
+	return err
+}
+
+// outputDecoder returns the tool decoding the converted files for
+// --verify-opus.
+func (c Config) outputDecoder() string {
+	if c.convertsOpus() {
+		return "opusdec"
+	}
+	return "ffmpeg"
+}
+
+// decodeOutput decodes a converted file, discarding the audio, and
+// fails if the decoder reports an error.
+func decodeOutput(path string, config Config) error {
+	opts := EncodeOptions{Log: config.Log, Timeout: config.EncodeTimeout, Abort: config.Abort}
+	if config.convertsOpus() {
+		return runEncoder("opusdec", []string{"--quiet", longPath(path), os.DevNull}, opts)
+	}
+	return runEncoder("ffmpeg", []string{"-nostdin", "-hide_banner", "-loglevel", "error", "-xerror", "-i", longPath(path), "-f", "null", "-"}, opts)
+}
+
+// outputExtensions are the extensions of converted files. Conversions
+// write to the name with tempSuffix appended first.
+var outputExtensions = []string{".opus", ".mp3", ".m4a", ".flac"}
+
+const tempSuffix = ".tmp"
+
+// isTempOutput reports whether path is the temp file of a conversion.
+func isTempOutput(path string) bool {
+	base, ok := strings.CutSuffix(strings.ToLower(path), tempSuffix)
+	return ok && slices.Contains(outputExtensions, filepath.Ext(base))
+}
+
+func removeStaleTemp(path string, config Config) error {
+	if config.DryRun() {
+		config.Log(LogInfo, "[DRY-RUN] Would remove stale temp file: %s\n", path)
+		return nil
+	}
+	config.Log(LogVerbose, "Removing stale temp file: %s\n", path)
+	return os.Remove(path)
+}
+
+// cleanTempFiles removes the temp files an interrupted run left in the
+// output directory, so that they are gone even if no pruning follows.
+// Hidden directories are skipped like when pruning.
+func cleanTempFiles(config Config) (int, error) {
+	outputRoot := config.mirrorRoot()
+	removed := 0
+	err := filepath.WalkDir(outputRoot, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if path == outputRoot && errors.Is(err, fs.ErrNotExist) {
+				// Nothing converted yet
+				return filepath.SkipAll
+			}
+			return err
+		}
+		if d.IsDir() {
+			if strings.HasPrefix(d.Name(), ".") && path != outputRoot {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !isTempOutput(path) {
+			return nil
+		}
+		if err := removeStaleTemp(path, config); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+func pruneOutput(inputRoot string, config Config) error {
+	// We need to walk the output tree in reverse order (contents before directories)
+	// to effectively remove empty directories. However, WalkDir doesn't support reverse.
+	// So we'll remove files first, then do a second pass for directories or handle dirs specially.
+	// Actually, standard WalkDir is fine, we just can't delete the *current* dir while walking it easily
+	// unless we use filepath.Walk (which processes children).
+	// A simpler approach for empty dirs: remove them if os.Remove succeeds (it fails if not empty).
+
+	// Collect directories to try removing later (depth-first simulated by sorting length desc)
+	var dirsToRemove []string
+	// Entries left in each directory, to report the directories a dry run
+	// would remove
+	entries := make(map[string]int)
+	removed := func(path string) {
+		entries[filepath.Dir(path)]--
+	}
+
+	outputRoot := config.mirrorRoot()
+
+	// Collect outputs in batches; checking their sources is the slow part
+	// on large mirrors and is done concurrently for each batch, keeping
+	// memory flat however large the mirror is
+	var candidates []string
+	batchSize := config.batchSize()
+	checkCandidates := func() error {
+		orphans, err := findOrphans(candidates, inputRoot, outputRoot, config.sourceExtensions())
+		if err != nil {
+			return err
+		}
+		candidates = candidates[:0]
+		if err := removeOrphans(orphans, config); err != nil {
+			return err
+		}
+		for _, path := range orphans {
+			removed(path)
+		}
+		return nil
+	}
+	// Cover files next to the outputs, with --copy-cover
+	var coverCopies []string
+	coverNames := config.coverFileNames()
+
+	err := filepath.WalkDir(outputRoot, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != outputRoot {
+			entries[filepath.Dir(path)]++
+		}
+
+		if d.IsDir() {
+			// Skip hidden directories (like .stfolder)
+			if strings.HasPrefix(d.Name(), ".") && path != outputRoot {
+				return filepath.SkipDir
+			}
+			if path != outputRoot {
+				dirsToRemove = append(dirsToRemove, path)
+			}
+			return nil
+		}
+
+		// Clean up stale temp files
+		if isTempOutput(path) {
+			removed(path)
+			return removeStaleTemp(path, config)
+		}
+
+		if strings.EqualFold(filepath.Ext(path), config.mirrorExt()) {
+			candidates = append(candidates, path)
+			if len(candidates) >= batchSize {
+				return checkCandidates()
+			}
+		}
+		if config.CoverCopies != nil && slices.Contains(coverNames, d.Name()) {
+			coverCopies = append(coverCopies, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := checkCandidates(); err != nil {
+		return err
+	}
+
+	// Copied covers are orphans once the source album has no cover
+	var orphans []string
+	for _, path := range coverCopies {
+		rel, err := relativeToRoot(outputRoot, path)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(filepath.Join(inputRoot, rel)); os.IsNotExist(err) {
+			orphans = append(orphans, path)
+		}
+	}
+	if err := removeOrphans(orphans, config); err != nil {
+		return err
+	}
+	for _, path := range orphans {
+		removed(path)
+	}
+
+	// Remove empty directories
+	// Sort by length descending to ensure subdirs are removed before parents
+	// This is a naive but effective way to handle depth-first deletion
+	// (Longer paths are deeper)
+	slices.SortStableFunc(dirsToRemove, func(a, b string) int {
+		return cmp.Compare(len(b), len(a))
+	})
+
+	if config.DryRun() {
+		for _, dir := range dirsToRemove {
+			if entries[dir] == 0 {
+				config.Log(LogInfo, "[DRY-RUN] Would remove empty directory: %s\n", dir)
+				removed(dir)
+			}
+		}
+		return nil
+	}
+
+	for _, dir := range dirsToRemove {
+		// Attempt to remove. Will fail if not empty (which is what we want).
+		// We ignore error because "not empty" is a valid state.
+		os.Remove(dir)
+	}
+
+	return nil
+}
+
+// pruneWorkers is the number of concurrent source lookups while pruning.
+const pruneWorkers = 8
+
+// defaultBatchSize is the number of output files checked at once while
+// pruning, unless --batch-size is given.
+const defaultBatchSize = 10000
+
+// batchSize returns the configured batch size or the default.
+func (c Config) batchSize() int {
+	if c.BatchSize > 0 {
+		return c.BatchSize
+	}
+	return defaultBatchSize
+}
+
+// removeOrphans removes the orphaned outputs, or reports them in dry-run.
+func removeOrphans(orphans []string, config Config) error {
+	for _, path := range orphans {
+		if config.DryRun() {
+			config.Log(LogInfo, "[DRY-RUN] Would remove orphan: %s\n", path)
+			continue
+		}
+		config.Log(LogVerbose, "Removing orphan: %s\n", path)
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sourceExtensions returns the extensions the source of an output in
+// mirrorRoot may have.
+func (c Config) sourceExtensions() []string {
+	if c.ConvertOpus != "" {
+		return c.inputExtensions()
+	}
+	return []string{".flac"}
+}
+
+// findOrphans returns the outputs for which no source with one of the
+// extensions exists any longer, in the order of outputs.
+func findOrphans(outputs []string, inputRoot string, outputRoot string, extensions []string) ([]string, error) {
+	isOrphan := make([]bool, len(outputs))
+	errs := make([]error, len(outputs))
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range min(pruneWorkers, len(outputs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				rel, err := relativeToRoot(outputRoot, outputs[i])
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+				// Construct expected source path
+				base := filepath.Join(inputRoot, strings.TrimSuffix(rel, filepath.Ext(rel)))
+				found, err := sourceExists(base, extensions)
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+				isOrphan[i] = !found
+			}
+		}()
+	}
+	for i := range outputs {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	var orphans []string
+	for i, path := range outputs {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		if isOrphan[i] {
+			orphans = append(orphans, path)
+		}
+	}
+	return orphans, nil
+}
+
+// sourceExists reports whether base with one of the extensions exists.
+// The walk matches extensions case-insensitively (01.FLAC is converted
+// too), so when no exact name exists the directory is searched.
+func sourceExists(base string, extensions []string) (bool, error) {
+	for _, ext := range extensions {
+		if _, err := os.Stat(base + ext); err == nil {
+			return true, nil
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(base))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	name := filepath.Base(base)
+	for _, entry := range entries {
+		stem, ok := strings.CutPrefix(entry.Name(), name)
+		if ok && hasExtension(entry.Name(), extensions) && strings.EqualFold(stem, filepath.Ext(entry.Name())) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// retagIgnoredTags are tags written by the encoder itself or derived from
+// the audio; they are never copied back from the Opus file.
+var retagIgnoredTags = []string{
+	"ENCODER",
+	"ENCODER_OPTIONS",
+	"METADATA_BLOCK_PICTURE",
+	"R128_TRACK_GAIN",
+	"R128_ALBUM_GAIN",
+}
+
+func retagFromOpus(inputFile string, inputRoot string, config Config) (bool, error) {
+	absInputFile, err := filepath.Abs(inputFile)
+	if err != nil {
+		return false, err
+	}
+
+	relPath, err := relativeToRoot(inputRoot, absInputFile)
+	if err != nil {
+		return false, err
+	}
+
+	opusFile := filepath.Join(config.RetagOpus, relPath)
+	opusFile = strings.TrimSuffix(opusFile, filepath.Ext(opusFile)) + ".opus"
+
+	if _, err := os.Stat(opusFile); os.IsNotExist(err) {
+		config.Log(LogVerbose, "Skipping (no Opus file): %s\n", relPath)
+		return false, nil
+	}
+
+	opusTags, err := readOpusTags(opusFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to read tags from %s: %w", opusFile, err)
+	}
+
+	if tooLarge, err := config.tooLarge(inputFile); err != nil || tooLarge {
+		return false, err
+	}
+	f, id3, err := parseFlacFile(inputFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse flac file: %w", err)
+	}
+	if id3 != nil {
+		config.Log(LogWarn, "%s: Found an ID3v2 tag in front of the FLAC data\n", inputFile)
+		if config.StripID3v2 {
+			id3 = nil
+		}
+	}
+
+	cmtBlock := vorbisCommentBlock(f)
+
+	cmts := &VorbisComment{Vendor: opusTags.Vendor}
+	if cmtBlock != nil {
+		cmts, err = ParseVorbisComment(cmtBlock.Data)
+		if err != nil {
+			return false, fmt.Errorf("failed to parse vorbis comments: %w", err)
+		}
+	}
+
+	newComments, changed := mergeRetagComments(cmts.Comments, opusTags.Comments, config)
+	if len(changed) == 0 {
+		config.Log(LogVerbose, "Tags already in sync: %s\n", relPath)
+		return false, nil
+	}
+
+	config.Log(LogInfo, "%s: Retagging %s from Opus\n", inputFile, strings.Join(changed, ", "))
+
+	if config.DryRun() {
+		config.Log(LogInfo, "[DRY-RUN] Changes detected for %s, but not saving.\n", inputFile)
+		return true, nil
+	}
+
+	cmts.Comments = newComments
+	ensureVorbisComment(f).Data = cmts.Marshal()
+
+	config.Log(LogInfo, "Saving changes to %s...\n", inputFile)
+	if err := saveFlacFileAtomic(inputFile, f, id3); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// mergeRetagComments applies the tags found in the Opus file to the FLAC
+// comments. A key whose values differ is replaced as a whole at the
+// position of its first occurrence; keys only present in the Opus file are
+// appended. Keys only present in the FLAC file are kept. A merge tag the
+// Opus file holds merged (--opus-mb-ids) is not taken as changed. It
+// returns the new comment list and the keys that changed.
+func mergeRetagComments(flacComments, opusComments []string, config Config) ([]string, []string) {
+	splitComments := func(comments []string) ([]string, map[string][]string) {
+		var keys []string
+		values := make(map[string][]string)
+		for _, c := range comments {
+			parts := strings.SplitN(c, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			key := strings.ToUpper(parts[0])
+			if _, ok := values[key]; !ok {
+				keys = append(keys, key)
+			}
+			values[key] = append(values[key], parts[1])
+		}
+		return keys, values
+	}
+
+	_, flacValues := splitComments(flacComments)
+	opusKeys, opusValues := splitComments(opusComments)
+
+	var changed []string
+	for _, key := range opusKeys {
+		if slices.Contains(retagIgnoredTags, key) {
+			continue
+		}
+		if !slices.Equal(flacValues[key], opusValues[key]) && !slices.Equal(config.mergedValues(key, flacValues[key]), opusValues[key]) {
+			changed = append(changed, key)
+		}
+	}
+	if len(changed) == 0 {
+		return flacComments, nil
+	}
+
+	newComments := []string{}
+	written := make(map[string]bool)
+	for _, c := range flacComments {
+		parts := strings.SplitN(c, "=", 2)
+		key := strings.ToUpper(parts[0])
+		if len(parts) != 2 || !slices.Contains(changed, key) {
+			newComments = append(newComments, c)
+			continue
+		}
+		if written[key] {
+			continue
+		}
+		for _, v := range opusValues[key] {
+			newComments = append(newComments, key+"="+v)
+		}
+		written[key] = true
+	}
+	for _, key := range changed {
+		if written[key] {
+			continue
+		}
+		for _, v := range opusValues[key] {
+			newComments = append(newComments, key+"="+v)
+		}
+	}
+
+	return newComments, changed
+}
+
+// readOpusTags reads the Vorbis comments from the OpusTags header packet of
+// an Ogg Opus file.
+func readOpusTags(filename string) (*VorbisComment, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// The first packet is OpusHead, the second is OpusTags. Packets may span
+	// several pages, so reassemble them from the segment tables.
+	var packets [][]byte
+	var packet []byte
+	header := make([]byte, 27)
+	for len(packets) < 2 {
+		if _, err := io.ReadFull(file, header); err != nil {
+			return nil, fmt.Errorf("failed to read ogg page: %w", err)
+		}
+		if string(header[0:4]) != "OggS" {
+			return nil, fmt.Errorf("invalid ogg page header")
+		}
+
+		segments := make([]byte, header[26])
+		if _, err := io.ReadFull(file, segments); err != nil {
+			return nil, fmt.Errorf("failed to read ogg segment table: %w", err)
+		}
+
+		for _, size := range segments {
+			data := make([]byte, size)
+			if _, err := io.ReadFull(file, data); err != nil {
+				return nil, fmt.Errorf("failed to read ogg segment: %w", err)
+			}
+			packet = append(packet, data...)
+			if size < 255 {
+				packets = append(packets, packet)
+				packet = nil
+			}
+		}
+	}
+
+	if !bytes.HasPrefix(packets[0], []byte("OpusHead")) {
+		return nil, fmt.Errorf("not an opus stream")
+	}
+	if !bytes.HasPrefix(packets[1], []byte("OpusTags")) {
+		return nil, fmt.Errorf("missing OpusTags header")
+	}
+
+	return ParseVorbisComment(packets[1][len("OpusTags"):])
+}
+
+// opusKeptTags are tags of an existing Opus file kept when its tags are
+// updated from the FLAC file, as they describe the encoded audio.
+var opusKeptTags = []string{
+	"ENCODER",
+	"ENCODER_OPTIONS",
+	"R128_TRACK_GAIN",
+	"R128_ALBUM_GAIN",
+}
+
+// updateOpusTags replaces the tags and pictures of the existing Opus file
+// opusFile with those of flacFile, like opusenc would have written them,
+// without re-encoding the audio. The result is written atomically.
+func updateOpusTags(flacFile, opusFile string, config Config) error {
+	oldTags, err := readOpusTags(opusFile)
+	if err != nil {
+		return fmt.Errorf("failed to read tags from %s: %w", opusFile, err)
+	}
+
+	// Attach the folder cover like a conversion does
+	source, coverPath, err := resolveOpusCover(flacFile, config)
+	if err != nil {
+		return err
+	}
+	picture := ""
+	if source == opusCoverExternal {
+		picture = coverPath
+	}
+	comments, err := opusComments(flacFile, config)
+	if err != nil {
+		return err
+	}
+	vc, err := opusTagsFor(flacFile, picture, comments, oldTags)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(opusFile)
+	if err != nil {
+		return err
+	}
+	updated, err := replaceOpusTags(data, vc)
+	if err != nil {
+		return fmt.Errorf("%s: %w", opusFile, err)
+	}
+
+	tempFile := opusFile + tempSuffix
+	if err := os.WriteFile(tempFile, updated, 0o644); err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	// Make sure the stream still parses before replacing the output
+	if err := validateOpusOutput(tempFile); err != nil {
+		os.Remove(tempFile)
+		return fmt.Errorf("updating tags produced invalid output: %w", err)
+	}
+	if err := os.Rename(tempFile, opusFile); err != nil {
+		os.Remove(tempFile)
+		return fmt.Errorf("failed to rename temp file: %w", err)
+	}
+
+	if config.PreserveXattrs {
+		if err := copyXattrs(flacFile, opusFile); err != nil {
+			config.Log(LogWarn, "%s: Could not copy extended attributes: %v\n", opusFile, err)
+		}
+	}
+	return nil
+}
+
+// opusComments returns the comments of flacFile with the MBID merge
+// applied, for --opus-mb-ids. It returns nil if nothing was merged, so
+// the comments are copied unchanged. The FLAC file is not modified.
+func opusComments(flacFile string, config Config) ([]string, error) {
+	if !config.OpusMergeMBIDs || !isFlacFile(flacFile) {
+		return nil, nil
+	}
+	f, err := readFlacMetadata(flacFile)
+	if err != nil {
+		return nil, err
+	}
+	merged, err := processMBIDs(flacFile, f, config)
+	if err != nil || len(merged) == 0 {
+		return nil, err
+	}
+	for _, block := range f.Meta {
+		if block.Type == flac.VorbisComment {
+			cmts, err := ParseVorbisComment(block.Data)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse vorbis comments: %w", err)
+			}
+			return cmts.Comments, nil
+		}
+	}
+	return nil, nil
+}
+
+// opusTagsFor returns the Opus tags opusenc writes for flacFile: its
+// comments, or comments if set, and pictures, and the picture file if
+// set. The vendor and the opusKeptTags come from the tags of the encoded
+// file.
+func opusTagsFor(flacFile, picture string, comments []string, encoded *VorbisComment) (*VorbisComment, error) {
+	f, err := readFlacMetadata(flacFile)
+	if err != nil {
+		return nil, err
+	}
+
+	vc := &VorbisComment{Vendor: encoded.Vendor}
+	isKept := func(comment string) bool {
+		key, _, _ := strings.Cut(comment, "=")
+		return slices.Contains(opusKeptTags, strings.ToUpper(key))
+	}
+	for _, c := range encoded.Comments {
+		if isKept(c) {
+			vc.Comments = append(vc.Comments, c)
+		}
+	}
+	for _, block := range f.Meta {
+		switch block.Type {
+		case flac.VorbisComment:
+			if comments == nil {
+				cmts, err := ParseVorbisComment(block.Data)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse vorbis comments: %w", err)
+				}
+				comments = cmts.Comments
+			}
+			for _, c := range comments {
+				if !isKept(c) {
+					vc.Comments = append(vc.Comments, c)
+				}
+			}
+		case flac.Picture:
+			vc.Comments = append(vc.Comments, "METADATA_BLOCK_PICTURE="+base64.StdEncoding.EncodeToString(block.Data))
+		}
+	}
+
+	if picture != "" {
+		comment, err := pictureComment(picture)
+		if err != nil {
+			return nil, err
+		}
+		vc.Comments = append(vc.Comments, comment)
+	}
+	return vc, nil
+}
+
+// pictureComment returns the METADATA_BLOCK_PICTURE comment attaching the
+// image file picture as front cover.
+func pictureComment(picture string) (string, error) {
+	pic, err := loadCoverPicture(picture)
+	if err != nil {
+		return "", err
+	}
+	return "METADATA_BLOCK_PICTURE=" + base64.StdEncoding.EncodeToString(pic.Marshal()), nil
+}
+
+// oggPage is a page of an Ogg stream. Segments is the lacing table of
+// Body.
+type oggPage struct {
+	HeaderType byte
+	Granule    uint64
+	Serial     uint32
+	Sequence   uint32
+	Segments   []byte
+	Body       []byte
+}
+
+const oggContinued = 0x01 // HeaderType flag: the page continues a packet
+
+// oggCRCTable is the table of the CRC-32 used by Ogg (polynomial
+// 0x04c11db7, not reflected).
+var oggCRCTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for range 8 {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func oggCRC(data []byte) uint32 {
+	var crc uint32
+	for _, b := range data {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// Marshal encodes the page with its checksum.
+func (p oggPage) Marshal() []byte {
+	buf := make([]byte, 27, 27+len(p.Segments)+len(p.Body))
+	copy(buf, "OggS")
+	buf[5] = p.HeaderType
+	binary.LittleEndian.PutUint64(buf[6:14], p.Granule)
+	binary.LittleEndian.PutUint32(buf[14:18], p.Serial)
+	binary.LittleEndian.PutUint32(buf[18:22], p.Sequence)
+	buf[26] = byte(len(p.Segments))
+	buf = append(buf, p.Segments...)
+	buf = append(buf, p.Body...)
+	binary.LittleEndian.PutUint32(buf[22:26], oggCRC(buf))
+	return buf
+}
+
+// parseOggPages splits an Ogg stream into pages, verifying checksums.
+func parseOggPages(data []byte) ([]oggPage, error) {
+	var pages []oggPage
+	for len(data) > 0 {
+		if len(data) < 27 || string(data[0:4]) != "OggS" {
+			return nil, fmt.Errorf("invalid ogg page header at page %d", len(pages))
+		}
+		n := int(data[26])
+		if len(data) < 27+n {
+			return nil, fmt.Errorf("truncated ogg page %d", len(pages))
+		}
+		size := 27 + n
+		for _, s := range data[27 : 27+n] {
+			size += int(s)
+		}
+		if len(data) < size {
+			return nil, fmt.Errorf("truncated ogg page %d", len(pages))
+		}
+
+		page := oggPage{
+			HeaderType: data[5],
+			Granule:    binary.LittleEndian.Uint64(data[6:14]),
+			Serial:     binary.LittleEndian.Uint32(data[14:18]),
+			Sequence:   binary.LittleEndian.Uint32(data[18:22]),
+			Segments:   data[27 : 27+n],
+			Body:       data[27+n : size],
+		}
+		// Marshal recomputes the checksum
+		if !bytes.Equal(page.Marshal(), data[:size]) {
+			return nil, fmt.Errorf("checksum mismatch in ogg page %d", len(pages))
+		}
+		pages = append(pages, page)
+		data = data[size:]
+	}
+	return pages, nil
+}
+
+// replaceOpusTags returns the Ogg Opus stream data with its OpusTags
+// header replaced by vc. The audio pages are kept and only renumbered.
+func replaceOpusTags(data []byte, vc *VorbisComment) ([]byte, error) {
+	pages, err := parseOggPages(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// OpusHead fills the first page and OpusTags ends a page of its own
+	// before the audio starts
+	packets := 0
+	tagsEnd := -1
+	for i, page := range pages {
+		for j, s := range page.Segments {
+			if s == 255 {
+				continue
+			}
+			packets++
+			if packets == 1 && (i != 0 || j != len(page.Segments)-1) {
+				return nil, errors.New("unexpected OpusHead page layout")
+			}
+			if packets == 2 && j != len(page.Segments)-1 {
+				return nil, errors.New("unexpected OpusTags page layout")
+			}
+		}
+		if packets >= 2 {
+			tagsEnd = i
+			break
+		}
+	}
+	if tagsEnd < 0 {
+		return nil, errors.New("missing OpusTags header")
+	}
+	if !bytes.HasPrefix(pages[0].Body, []byte("OpusHead")) {
+		return nil, errors.New("not an opus stream")
+	}
+
+	packet := append([]byte("OpusTags"), vc.Marshal()...)
+	var lacing []byte
+	for n := len(packet); ; n -= 255 {
+		if n < 255 {
+			lacing = append(lacing, byte(n))
+			break
+		}
+		lacing = append(lacing, 255)
+	}
+
+	out := pages[0].Marshal()
+	seq := pages[0].Sequence + 1
+	for first := true; len(lacing) > 0; first = false {
+		page := oggPage{Serial: pages[0].Serial, Sequence: seq}
+		if !first {
+			page.HeaderType = oggContinued
+		}
+		page.Segments = lacing[:min(255, len(lacing))]
+		lacing = lacing[len(page.Segments):]
+		size := 0
+		for _, s := range page.Segments {
+			size += int(s)
+		}
+		page.Body = packet[:size]
+		packet = packet[size:]
+		out = append(out, page.Marshal()...)
+		seq++
+	}
+	for _, page := range pages[tagsEnd+1:] {
+		page.Sequence = seq
+		out = append(out, page.Marshal()...)
+		seq++
+	}
+	return out, nil
+}
+
+// readStreamInfo reads only the metadata of a FLAC file and returns its
+// STREAMINFO.
+func readStreamInfo(filename string) (*flac.StreamInfoBlock, error) {
+	f, err := readFlacMetadata(filename)
+	if err != nil {
+		return nil, err
+	}
+	return f.GetStreamInfo()
+}
+
+// skipID3v2 consumes an ID3v2 tag in front of the fLaC marker, which some
+// tools prepend although FLAC does not allow it. It returns the tag, or
+// nil if there is none.
+func skipID3v2(r *bufio.Reader) ([]byte, error) {
+	header, err := r.Peek(10)
+	if err != nil || string(header[:3]) != "ID3" {
+		// Too short files are left to the FLAC parser to reject
+		return nil, nil
+	}
+
+	// The size is "syncsafe", 7 bits per byte, and excludes the header
+	size := 0
+	for _, b := range header[6:10] {
+		if b&0x80 != 0 {
+			return nil, errors.New("invalid ID3v2 tag size")
+		}
+		size = size<<7 | int(b)
+	}
+	size += 10
+	if header[5]&0x10 != 0 {
+		size += 10 // Footer
+	}
+
+	tag := make([]byte, size)
+	if _, err := io.ReadFull(r, tag); err != nil {
+		return nil, fmt.Errorf("failed to read ID3v2 tag: %w", err)
+	}
+	return tag, nil
+}
+
+// readFlacMetadata reads only the metadata of a FLAC file, skipping a
+// leading ID3v2 tag.
+func readFlacMetadata(filename string) (*flac.File, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	if _, err := skipID3v2(r); err != nil {
+		return nil, err
+	}
+	f, err := flac.ParseMetadata(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse flac metadata: %w", err)
+	}
+	return f, nil
+}
+
+// tooLarge reports whether filename exceeds MaxFileSize, with a warning.
+// parseFlacFile reads whole files into memory, so a damaged file of
+// gigabytes could exhaust it.
+func (c Config) tooLarge(filename string) (bool, error) {
+	if c.MaxFileSize <= 0 {
+		return false, nil
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return false, err
+	}
+	if info.Size() <= c.MaxFileSize {
+		return false, nil
+	}
+	c.Log(LogWarn, "Skipping %s: %s exceeds the maximum file size of %s\n", filename, formatBytes(info.Size()), formatBytes(c.MaxFileSize))
+	return true, nil
+}
+
+// parseFlacFile parses a whole FLAC file like flac.ParseFile, but also
+// accepts a leading ID3v2 tag, which it returns.
+func parseFlacFile(filename string) (*flac.File, []byte, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	id3, err := skipID3v2(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := flac.ParseBytes(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, id3, nil
+}
+
+// saveFlacFile writes f to filename with the ID3v2 tag id3 (if any) in
+// front of it.
+func saveFlacFile(filename string, f *flac.File, id3 []byte) error {
+	if len(id3) == 0 {
+		return f.Save(filename)
+	}
+	return os.WriteFile(filename, append(id3, f.Marshal()...), 0o644)
+}
+
+// saveFlacFileAtomic saves f to a temp file next to filename and renames
+// it into place, so that an interrupted save leaves the old file intact.
+// The permissions of an existing file are kept.
+func saveFlacFileAtomic(filename string, f *flac.File, id3 []byte) error {
+	tempFile := filename + tempSuffix
+	if err := saveFlacFile(tempFile, f, id3); err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	if info, err := os.Stat(filename); err == nil {
+		if err := os.Chmod(tempFile, info.Mode().Perm()); err != nil {
+			os.Remove(tempFile)
+			return err
+		}
+	}
+	if err := os.Rename(tempFile, filename); err != nil {
+		os.Remove(tempFile)
+		return fmt.Errorf("failed to rename temp file: %w", err)
+	}
+	return nil
+}
+
+type bitrateEntry struct {
+	path string
+	kbps float64
+}
+
+// bitrateReport collects the approximate bitrate of each file, computed
+// from the file size and the STREAMINFO duration (no decoding).
+type bitrateReport struct {
+	threshold float64
+	mu        sync.Mutex
+	entries   []bitrateEntry
+	unknown   []string
+}
+
+// bitrateBucketSize is the width of a histogram bucket in kbps.
+const bitrateBucketSize = 200
+
+// bitrateLowestCount is the number of lowest-bitrate files listed.
+const bitrateLowestCount = 10
+
+func (r *bitrateReport) Audit(filename string) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	si, err := readStreamInfo(filename)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if si.SampleRate == 0 || si.SampleCount == 0 {
+		r.unknown = append(r.unknown, filename)
+		return nil
+	}
+	seconds := float64(si.SampleCount) / float64(si.SampleRate)
+	kbps := float64(info.Size()) * 8 / seconds / 1000
+	r.entries = append(r.entries, bitrateEntry{path: filename, kbps: kbps})
+	return nil
+}
+
+func (r *bitrateReport) Print() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.entries) == 0 {
+		fmt.Println("No files with known duration found.")
+	} else {
+		buckets := make(map[int]int)
+		maxBucket, maxCount := 0, 0
+		for _, e := range r.entries {
+			b := int(e.kbps) / bitrateBucketSize
+			buckets[b]++
+			maxBucket = max(maxBucket, b)
+			maxCount = max(maxCount, buckets[b])
+		}
+
+		fmt.Println("Bitrate distribution (kbps):")
+		for b := 0; b <= maxBucket; b++ {
+			bar := strings.Repeat("#", (buckets[b]*40+maxCount-1)/maxCount)
+			fmt.Printf("  %5d-%-5d %6d %s\n", b*bitrateBucketSize, (b+1)*bitrateBucketSize, buckets[b], bar)
+		}
+
+		slices.SortFunc(r.entries, func(a, b bitrateEntry) int {
+			return cmp.Compare(a.kbps, b.kbps)
+		})
+		fmt.Println("Lowest bitrates:")
+		for _, e := range r.entries[:min(bitrateLowestCount, len(r.entries))] {
+			marker := ""
+			if e.kbps < r.threshold {
+				marker = " (below threshold)"
+			}
+			fmt.Printf("  %7.1f kbps  %s%s\n", e.kbps, e.path, marker)
+		}
+
+		below := 0
+		for _, e := range r.entries {
+			if e.kbps < r.threshold {
+				below++
+			}
+		}
+		fmt.Printf("Files below %.0f kbps: %d\n", r.threshold, below)
+	}
+
+	for _, path := range r.unknown {
+		fmt.Printf("Unknown duration (no sample count in STREAMINFO): %s\n", path)
+	}
+}
+
+// audioInfo holds the STREAMINFO of a file for --info.
+type audioInfo struct {
+	path       string
+	sampleRate int
+	bits       int
+	channels   int
+	samples    int64
+	md5        []byte
+}
+
+// Format returns the format of the audio, e.g. "16 bit / 44.1 kHz".
+func (a audioInfo) Format() string {
+	return fmt.Sprintf("%d bit / %s kHz", a.bits, strconv.FormatFloat(float64(a.sampleRate)/1000, 'f', -1, 64))
+}
+
+// Length returns the duration as m:ss, or "unknown length" if STREAMINFO
+// has no sample count.
+func (a audioInfo) Length() string {
+	if a.samples == 0 || a.sampleRate == 0 {
+		return "unknown length"
+	}
+	seconds := a.samples / int64(a.sampleRate)
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+// HasMD5 reports whether the MD5 signature is set; encoders leave it
+// zero when they did not compute it.
+func (a audioInfo) HasMD5() bool {
+	return slices.ContainsFunc(a.md5, func(b byte) bool { return b != 0 })
+}
+
+// MD5 returns the audio MD5 signature in hex, or "no MD5".
+func (a audioInfo) MD5() string {
+	if !a.HasMD5() {
+		return "no MD5"
+	}
+	return "MD5 " + hex.EncodeToString(a.md5)
+}
+
+// audioInfoReport collects the audio properties of the files.
+type audioInfoReport struct {
+	mu      sync.Mutex
+	entries []audioInfo
+}
+
+func (r *audioInfoReport) Add(filename string) error {
+	si, err := readStreamInfo(filename)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, audioInfo{
+		path:       filename,
+		sampleRate: si.SampleRate,
+		bits:       si.BitDepth,
+		channels:   si.ChannelCount,
+		samples:    si.SampleCount,
+		md5:        si.AudioMD5,
+	})
+	return nil
+}
+
+func (r *audioInfoReport) Print() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	slices.SortFunc(r.entries, func(a, b audioInfo) int {
+		return cmp.Compare(a.path, b.path)
+	})
+	formats := make(map[string]int)
+	withoutMD5 := 0
+	for _, a := range r.entries {
+		fmt.Printf("%s: %s, %d ch, %s, %s\n", a.path, a.Format(), a.channels, a.Length(), a.MD5())
+		formats[a.Format()]++
+		if !a.HasMD5() {
+			withoutMD5++
+		}
+	}
+
+	fmt.Println("Formats:")
+	for _, format := range slices.Sorted(maps.Keys(formats)) {
+		fmt.Printf("  %-20s %6d\n", format, formats[format])
+	}
+	fmt.Printf("Files without MD5 signature: %d of %d\n", withoutMD5, len(r.entries))
+}
+
+// albumTotals is the track count and duration of one directory.
+type albumTotals struct {
+	tracks  int
+	seconds float64 // Of the tracks with known length
+	unknown int     // Tracks without sample count in STREAMINFO
+}
+
+// albumSummary collects the track count and total duration of the
+// directories for --album-summary.
+type albumSummary struct {
+	mu     sync.Mutex
+	albums map[string]*albumTotals
+}
+
+func (s *albumSummary) Add(filename string) error {
+	si, err := readStreamInfo(filename)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dir := filepath.Dir(filename)
+	a := s.albums[dir]
+	if a == nil {
+		a = &albumTotals{}
+		s.albums[dir] = a
+	}
+	a.tracks++
+	if si.SampleRate == 0 || si.SampleCount == 0 {
+		a.unknown++
+	} else {
+		a.seconds += float64(si.SampleCount) / float64(si.SampleRate)
+	}
+	return nil
+}
+
+// formatDuration returns seconds as h:mm:ss, or m:ss below an hour.
+func formatDuration(seconds float64) string {
+	s := int64(seconds + 0.5)
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
+
+func (s *albumSummary) Print() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tracks, total := 0, 0.0
+	for _, dir := range slices.Sorted(maps.Keys(s.albums)) {
+		a := s.albums[dir]
+		line := fmt.Sprintf("%s: %d tracks, %s", dir, a.tracks, formatDuration(a.seconds))
+		if a.unknown > 0 {
+			line += fmt.Sprintf(" (%d of unknown length)", a.unknown)
+		}
+		fmt.Println(line)
+		tracks += a.tracks
+		total += a.seconds
+	}
+	fmt.Printf("Albums: %d, Tracks: %d, Total Duration: %s\n", len(s.albums), tracks, formatDuration(total))
+}
+
+// tagLister collects the Vorbis comments and pictures of the files for
+// --list-tags. With a filter only the comments of these keys (in upper
+// case) are listed, and missing ones are marked.
+type tagLister struct {
+	filter  []string
+	mu      sync.Mutex
+	entries []tagListing
+}
+
+type tagListing struct {
+	path  string
+	lines []string
+}
+
+func (l *tagLister) Add(filename string) error {
+	f, err := readFlacMetadata(filename)
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	found := make(map[string]bool)
+	if block := vorbisCommentBlock(f); block != nil {
+		cmts, err := ParseVorbisComment(block.Data)
+		if err != nil {
+			return fmt.Errorf("failed to parse vorbis comments: %w", err)
+		}
+		for _, c := range cmts.Comments {
+			key, _, _ := strings.Cut(c, "=")
+			key = strings.ToUpper(key)
+			if len(l.filter) > 0 && !slices.Contains(l.filter, key) {
+				continue
+			}
+			found[key] = true
+			lines = append(lines, c)
+		}
+	}
+	if len(l.filter) > 0 {
+		for _, key := range l.filter {
+			if !found[key] {
+				lines = append(lines, key+" (missing)")
+			}
+		}
+	} else {
+		for _, block := range f.Meta {
+			if block.Type != flac.Picture {
+				continue
+			}
+			pic, err := ParsePicture(block.Data)
+			if err != nil {
+				return fmt.Errorf("failed to parse picture: %w", err)
+			}
+			lines = append(lines, fmt.Sprintf("Picture: type %d, %s, %dx%d, %d bytes", pic.PictureType, pic.MimeType, pic.Width, pic.Height, len(pic.Data)))
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, tagListing{path: filename, lines: lines})
+	return nil
+}
+
+func (l *tagLister) Print() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	slices.SortFunc(l.entries, func(a, b tagListing) int {
+		return cmp.Compare(a.path, b.path)
+	})
+	for _, e := range l.entries {
+		fmt.Printf("%s:\n", e.path)
+		for _, line := range e.lines {
+			fmt.Printf("  %s\n", line)
+		}
+	}
+}
+
+func processPermissions(filename string, config Config) (bool, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return false, err
+	}
+	mode := info.Mode()
+
+	// Target permission: rw-r--r-- (0644)
+	// We check if current permissions differ from 0644.
+	// We mask with 0777 to ignore file type bits.
+	if mode.Perm() != 0o644 {
+		if !config.DryRun() {
+			config.Log(LogInfo, "Fixing permissions for %s (was %o)\n", filename, mode.Perm())
+			if err := os.Chmod(filename, 0o644); err != nil {
+				return false, fmt.Errorf("failed to chmod %s: %w", filename, err)
+			}
+			return true, nil
+		} else {
+			config.Log(LogInfo, "[DRY-RUN] Would fix permissions for %s (is %o)\n", filename, mode.Perm())
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type FixStats struct {
+	MBIDsFixed        bool
+	MergedTags        []string
+	TrackUIDSet       bool
+	KeysNormalized    int    // Comments whose key was uppercased
+	TagsStripped      int    // Comments removed by --strip-tags
+	TagsDeduplicated  int    // Duplicate comments removed by --dedup-tags
+	ValuesTrimmed     int    // Values cleaned by --trim-values
+	EmptyDropped      int    // Empty comments removed by --drop-empty
+	TagsSet           int    // Tags changed by --set-tag
+	TagsFolded        int    // Tags written by --ascii-fold
+	TagsRenamed       int    // Comments renamed by --rename-tag
+	GainTagsRemoved   int    // Comments removed by --replaygain-prefer
+	BytesReclaimed    int64  // Metadata bytes saved by --compact
+	Album             string // Set for files that were changed
+	Artists           []string
+	CoverEmbedded     bool
+	ThumbnailEmbedded bool
+	PermissionsFixed  bool
+	VerifyFailed      bool // Not saved, see Config.Verify
+	// Details for --report
+	TagChanges []TagChange
+	Cover      *CoverInfo // The embedded cover, if CoverEmbedded
+}
+
+// CoverInfo describes an embedded cover.
+type CoverInfo struct {
+	Width  uint32 `json:"width"`
+	Height uint32 `json:"height"`
+	Bytes  int    `json:"bytes"`
+}
+
+// embeddedCoverInfo describes the cover of type coverType in f.
+func embeddedCoverInfo(f *flac.File, coverType uint32) *CoverInfo {
+	for _, block := range f.Meta {
+		if t, ok := pictureType(block); !ok || t != coverType {
+			continue
+		}
+		if pic, err := ParsePicture(block.Data); err == nil {
+			return &CoverInfo{Width: pic.Width, Height: pic.Height, Bytes: len(pic.Data)}
+		}
+	}
+	return nil
+}
+
+// metadataEqual reports whether the blocks of f.Meta have the types and
+// data of the original ones, in the same order.
+func metadataEqual(original []flac.MetaDataBlock, meta []*flac.MetaDataBlock) bool {
+	return slices.EqualFunc(original, meta, func(a flac.MetaDataBlock, b *flac.MetaDataBlock) bool {
+		return a.Type == b.Type && bytes.Equal(a.Data, b.Data)
+	})
+}
+
+func fixFlac(filename string, config Config) (FixStats, error) {
+	backup, err := config.backupPath(filename, singleFileRoot(filename))
+	if err != nil {
+		return FixStats{}, err
+	}
+	return fixFlacTo(filename, filename, backup, config)
+}
+
+// backupPath returns where --backup copies filePath to, or "" without
+// backups.
+func (c Config) backupPath(filePath string, absInputRoot string) (string, error) {
+	if !c.Backup {
+		return "", nil
+	}
+	if c.BackupDir == "" {
+		return filePath + backupSuffix, nil
+	}
+	rel, err := relativeToRoot(absInputRoot, filePath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(c.BackupDir, rel), nil
+}
+
+// backupSuffix is appended to backups next to the original file.
+const backupSuffix = ".bak"
+
+// backupFile copies filename to backup byte for byte. An existing backup
+// is only overwritten with force, so that a second run does not replace
+// the original with an already fixed file.
+func backupFile(filename string, backup string, force bool) error {
+	if _, err := os.Stat(backup); err == nil && !force {
+		return fmt.Errorf("backup %s exists (use --force to overwrite)", backup)
+	}
+	if err := os.MkdirAll(filepath.Dir(backup), 0o755); err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	in, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(backup)
+	if err != nil {
+		return fmt.Errorf("failed to create backup: %w", err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(backup)
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(backup)
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+	return nil
+}
+
+// fixFlacTo fixes filename and saves the result to target, which is
+// filename itself unless --out-dir is used. Before an in-place save the
+// file is copied to backup, if set.
+func fixFlacTo(filename string, target string, backup string, config Config) (FixStats, error) {
+	stats := FixStats{}
+	config.Log(LogVerbose, "Processing %s\n", filename)
+
+	if tooLarge, err := config.tooLarge(filename); err != nil || tooLarge {
+		return stats, err
+	}
+
+	inPlace := target == filename
+	if !inPlace {
+		// The source is not touched, so an up to date output is final
+		inStat, err := os.Stat(filename)
+		if err != nil {
+			return stats, err
+		}
+		if outStat, err := os.Stat(target); err == nil && !inStat.ModTime().After(outStat.ModTime()) {
+			config.Log(LogVerbose, "Skipping (up to date): %s\n", target)
+			return stats, nil
+		}
+	} else {
+		// Check/Fix Permissions
+		permFixed, err := processPermissions(filename, config)
+		if err != nil {
+			return stats, err
+		}
+		if permFixed {
+			stats.PermissionsFixed = true
+		}
+	}
+
+	f, id3, err := parseFlacFile(filename)
+	if err != nil {
+		return stats, fmt.Errorf("failed to parse flac file: %w", err)
+	}
+
+	modified := false
+	// The processX functions replace block data instead of changing it
+	// in place, so copying the blocks keeps the original data
+	original := make([]flac.MetaDataBlock, len(f.Meta))
+	for i, block := range f.Meta {
+		original[i] = *block
+	}
+
+	id3Stripped := false
+	if id3 != nil {
+		config.Log(LogWarn, "%s: Found an ID3v2 tag in front of the FLAC data\n", filename)
+		if config.StripID3v2 {
+			config.Log(LogInfo, "%s: Removing ID3v2 tag\n", filename)
+			id3 = nil
+			modified = true
+			id3Stripped = true
+		}
+	}
+
+	for i, block := range f.Meta {
+		config.Log(LogDebug, "%s: block %d: type %d, %d bytes\n", filename, i, block.Type, len(block.Data))
+	}
+
+	// Cleaned values may turn into duplicates, so this goes first
+	if config.TrimValues {
+		n, err := processValues(filename, f, config)
+		if err != nil {
+			return stats, err
+		}
+		if n > 0 {
+			modified = true
+			stats.ValuesTrimmed = n
+		}
+	}
+
+	if config.DropEmpty {
+		n, err := processEmptyValues(filename, f, config)
+		if err != nil {
+			return stats, err
+		}
+		if n > 0 {
+			modified = true
+			stats.EmptyDropped = n
+		}
+	}
+
+	if config.NormalizeKeys {
+		n, err := processKeys(filename, f, config)
+		if err != nil {
+			return stats, err
+		}
+		if n > 0 {
+			modified = true
+			stats.KeysNormalized = n
+		}
+	}
+
+	if len(config.RenameTags) > 0 {
+		n, err := processRenameTags(filename, f, config)
+		if err != nil {
+			return stats, err
+		}
+		if n > 0 {
+			modified = true
+			stats.TagsRenamed = n
+		}
+	}
+
+	if len(config.StripTags) > 0 {
+		n, err := processStripTags(filename, f, config)
+		if err != nil {
+			return stats, err
+		}
+		if n > 0 {
+			modified = true
+			stats.TagsStripped = n
+		}
+	}
+
+	if config.DedupTags {
+		n, err := processDuplicates(filename, f, config)
+		if err != nil {
+			return stats, err
+		}
+		if n > 0 {
+			modified = true
+			stats.TagsDeduplicated = n
+		}
+	}
+
+	if len(config.SetTags) > 0 {
+		n, err := processSetTags(filename, f, config)
+		if err != nil {
+			return stats, err
+		}
+		if n > 0 {
+			modified = true
+			stats.TagsSet = n
+		}
+	}
+
+	if len(config.ASCIIFold) > 0 {
+		n, err := processASCIIFold(filename, f, config)
+		if err != nil {
+			return stats, err
+		}
+		if n > 0 {
+			modified = true
+			stats.TagsFolded = n
+		}
+	}
+
+	if config.ReplayGainPrefer != "" {
+		n, err := processReplayGain(filename, f, config)
+		if err != nil {
+			return stats, err
+		}
+		if n > 0 {
+			modified = true
+			stats.GainTagsRemoved = n
+		}
+	}
+
+	if config.FixMBIDs {
+		merged, err := processMBIDs(filename, f, config)
+		if err != nil {
+			return stats, err
+		}
+		if len(merged) > 0 {
+			modified = true
+			stats.MBIDsFixed = true
+			stats.TagChanges = merged
+			for _, change := range merged {
+				stats.MergedTags = append(stats.MergedTags, change.Tag)
+			}
+		}
+	}
+
+	if config.EmbedCover {
+		embedded, err := processCovers(filename, f, config)
+		if err != nil {
+			return stats, err
+		}
+		if embedded != 0 {
+			modified = true
+			stats.CoverEmbedded = true
+			stats.Cover = embeddedCoverInfo(f, embedded)
+		}
+	}
+
+	// After embedding, so that a newly embedded cover gets one too
+	if config.EmbedThumbnail > 0 {
+		embedded, err := processThumbnail(filename, f, config)
+		if err != nil {
+			return stats, err
+		}
+		if embedded {
+			modified = true
+			stats.ThumbnailEmbedded = true
+		}
+	}
+
+	if config.TrackUID {
+		m, err := processTrackUID(filename, f, config)
+		if err != nil {
+			return stats, err
+		}
+		if m {
+			modified = true
+			stats.TrackUIDSet = true
+		}
+	}
+
+	// Last, so that the padding is measured against the final metadata
+	if config.Compact {
+		if n := processCompact(filename, f, config); n > 0 {
+			modified = true
+			stats.BytesReclaimed = n
+		}
+	}
+
+	// Changes that cancel out, e.g. --strip-tags and --set-tag of the
+	// same tag, leave nothing to write
+	if modified && !id3Stripped && metadataEqual(original, f.Meta) {
+		config.Log(LogVerbose, "%s: Metadata unchanged, not rewriting\n", filename)
+		modified = false
+		stats = FixStats{PermissionsFixed: stats.PermissionsFixed}
+	}
+
+	if modified || stats.PermissionsFixed {
+		stats.Album, stats.Artists = trackIdentity(f)
+	}
+
+	if !modified && (inPlace || !config.CopyUnmodified) {
+		return stats, nil
+	}
+
+	if config.DryRun() {
+		if modified {
+			config.Log(LogInfo, "[DRY-RUN] Changes detected for %s, but not saving.\n", filename)
+			// Show what would be written with -v
+			for _, change := range stats.TagChanges {
+				config.Log(LogVerbose, "[DRY-RUN]   %s: [%s] -> %s\n", change.Tag, strings.Join(change.Before, ", "), strings.Join(change.After, ", "))
+			}
+			if c := stats.Cover; c != nil {
+				config.Log(LogVerbose, "[DRY-RUN]   cover: %dx%d, %d bytes\n", c.Width, c.Height, c.Bytes)
+			}
+		} else {
+			config.Log(LogInfo, "[DRY-RUN] Would copy %s to %s\n", filename, target)
+		}
+		return stats, nil
+	}
+
+	// Rewriting a damaged file would hide the damage
+	if config.Verify {
+		if err := verifyFlac(filename); err != nil {
+			config.Log(LogWarn, "%s: Verification failed, not saving: %v\n", filename, err)
+			return FixStats{PermissionsFixed: stats.PermissionsFixed, VerifyFailed: true}, nil
+		}
+	}
+
+	if inPlace {
+		var mtime time.Time
+		if config.PreserveMtime {
+			info, err := os.Stat(filename)
+			if err != nil {
+				return stats, err
+			}
+			mtime = info.ModTime()
+		}
+		if backup != "" {
+			config.Log(LogVerbose, "Backing up %s to %s\n", filename, backup)
+			if err := backupFile(filename, backup, config.ForceBackup); err != nil {
+				return stats, err
+			}
+		}
+		config.Log(LogInfo, "Saving changes to %s...\n", filename)
+		if err := saveFlacFileAtomic(filename, f, id3); err != nil {
+			return stats, err
+		}
+		if config.PreserveMtime {
+			// A zero access time is left unchanged
+			if err := os.Chtimes(filename, time.Time{}, mtime); err != nil {
+				return stats, fmt.Errorf("failed to restore modification time: %w", err)
+			}
+		}
+		return stats, nil
+	}
+
+	// Write the mirrored file atomically, like conversions
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return stats, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	config.Log(LogInfo, "Saving to %s...\n", target)
+	return stats, saveFlacFileAtomic(target, f, id3)
+}
+
+// verifyFlac decodes filename with flac -t and returns an error if the
+// audio is damaged.
+func verifyFlac(filename string) error {
+	out, err := exec.Command("flac", "-t", "--silent", longPath(filename)).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("flac -t failed: %v: %s", err, msg)
+		}
+		return fmt.Errorf("flac -t failed: %w", err)
+	}
+	return nil
+}
+
+// fixReport collects the per-file results of the fixing modes for
+// --report.
+type fixReport struct {
+	path    string
+	mu      sync.Mutex
+	entries []fixReportEntry
+
+	// Set for newline-delimited reports, which are written as the files
+	// are processed
+	file *os.File
+	gz   *gzip.Writer
+	enc  *json.Encoder
+	err  error // The first failed write
+}
+
+// fixReportEntry is the result for one file. All fields are always
+// written, so that reports of different runs can be compared.
+type fixReportEntry struct {
+	Path              string      `json:"path"`
+	MBIDsMerged       bool        `json:"mbids_merged"`
+	MergedTags        []TagChange `json:"merged_tags"`
+	CoverEmbedded     *CoverInfo  `json:"cover_embedded"`
+	ThumbnailEmbedded bool        `json:"thumbnail_embedded"`
+	TrackUIDSet       bool        `json:"track_uid_set"`
+	KeysNormalized    int         `json:"keys_normalized"`
+	TagsStripped      int         `json:"tags_stripped"`
+	TagsDeduplicated  int         `json:"duplicates_removed"`
+	ValuesTrimmed     int         `json:"values_trimmed"`
+	EmptyDropped      int         `json:"empty_removed"`
+	TagsSet           int         `json:"tags_set"`
+	TagsFolded        int         `json:"tags_folded"`
+	TagsRenamed       int         `json:"tags_renamed"`
+	GainTagsRemoved   int         `json:"gain_tags_removed"`
+	BytesReclaimed    int64       `json:"bytes_reclaimed"`
+	PermissionsFixed  bool        `json:"permissions_fixed"`
+	VerifyFailed      bool        `json:"verify_failed"`
+	Warnings          []string    `json:"warnings"`
+	Error             string      `json:"error"`
+}
+
+// newFixReport prepares the report at path. Paths ending in .jsonl,
+// .ndjson or .gz get one JSON object per line, in processing order and
+// gzip-compressed for .gz, written file by file; other reports are
+// written by Write.
+func newFixReport(path string) (*fixReport, error) {
+	r := &fixReport{path: path}
+	lower := strings.ToLower(path)
+	if !strings.HasSuffix(lower, ".jsonl") && !strings.HasSuffix(lower, ".ndjson") && !strings.HasSuffix(lower, ".gz") {
+		return r, nil
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r.file = file
+	if strings.HasSuffix(lower, ".gz") {
+		r.gz = gzip.NewWriter(file)
+		r.enc = json.NewEncoder(r.gz)
+	} else {
+		r.enc = json.NewEncoder(file)
+	}
+	return r, nil
+}
+
+// writeLine writes an entry of a newline-delimited report. Compressed
+// lines are flushed, so that an interrupted report can still be read.
+func (r *fixReport) writeLine(entry fixReportEntry) {
+	if r.err != nil {
+		return
+	}
+	if r.err = r.enc.Encode(entry); r.err == nil && r.gz != nil {
+		r.err = r.gz.Flush()
+	}
+}
+
+// Fix runs fixFile and records its result along with the warnings
+// logged for the file.
+func (r *fixReport) Fix(filePath string, absInputRoot string, config Config) (StatsMsg, error) {
+	entry := fixReportEntry{Path: filePath, MergedTags: []TagChange{}, Warnings: []string{}}
+
+	// Warnings are recorded whatever the log level
+	inner := config
+	config.LogLevel = max(config.LogLevel, LogWarn)
+	config.LogFunc = func(level LogLevel, format string, args ...any) {
+		if level <= LogWarn {
+			entry.Warnings = append(entry.Warnings, strings.TrimSpace(fmt.Sprintf(format, args...)))
+		}
+		inner.Log(level, format, args...)
+	}
+
+	stats, fs, err := fixFile(filePath, absInputRoot, config)
+	entry.MBIDsMerged = fs.MBIDsFixed
+	if fs.TagChanges != nil {
+		entry.MergedTags = fs.TagChanges
+	}
+	entry.CoverEmbedded = fs.Cover
+	entry.ThumbnailEmbedded = fs.ThumbnailEmbedded
+	entry.TrackUIDSet = fs.TrackUIDSet
+	entry.KeysNormalized = fs.KeysNormalized
+	entry.TagsStripped = fs.TagsStripped
+	entry.TagsDeduplicated = fs.TagsDeduplicated
+	entry.ValuesTrimmed = fs.ValuesTrimmed
+	entry.EmptyDropped = fs.EmptyDropped
+	entry.TagsSet = fs.TagsSet
+	entry.TagsFolded = fs.TagsFolded
+	entry.TagsRenamed = fs.TagsRenamed
+	entry.GainTagsRemoved = fs.GainTagsRemoved
+	entry.BytesReclaimed = fs.BytesReclaimed
+	entry.PermissionsFixed = fs.PermissionsFixed
+	entry.VerifyFailed = fs.VerifyFailed
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	r.mu.Lock()
+	if r.enc != nil {
+		r.writeLine(entry)
+	} else {
+		r.entries = append(r.entries, entry)
+	}
+	r.mu.Unlock()
+	return stats, err
+}
+
+// Write writes the report as a JSON array sorted by path, or finishes a
+// newline-delimited one.
+func (r *fixReport) Write() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file != nil {
+		if r.gz != nil {
+			r.err = cmp.Or(r.err, r.gz.Close())
+		}
+		return cmp.Or(r.err, r.file.Close())
+	}
+	slices.SortFunc(r.entries, func(a, b fixReportEntry) int {
+		return cmp.Compare(a.Path, b.Path)
+	})
+	entries := r.entries
+	if entries == nil {
+		entries = []fixReportEntry{}
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(r.path, append(data, '\n'), 0o644)
+}
+
+// trackIdentity returns the album of a file, qualified by its album
+// artist, and all its ARTIST and ALBUMARTIST values for the summary.
+func trackIdentity(f *flac.File) (string, []string) {
+	var album, albumArtist string
+	var artists []string
+	for _, block := range f.Meta {
+		if block.Type != flac.VorbisComment {
+			continue
+		}
+		cmts, err := ParseVorbisComment(block.Data)
+		if err != nil {
+			return "", nil
+		}
+		for _, c := range cmts.Comments {
+			key, value, ok := strings.Cut(c, "=")
+			if !ok || value == "" {
+				continue
+			}
+			switch strings.ToUpper(key) {
+			case "ALBUM":
+				album = value
+			case "ALBUMARTIST":
+				albumArtist = value
+				artists = append(artists, value)
+			case "ARTIST":
+				artists = append(artists, value)
+			}
+		}
+		break
+	}
+
+	if album == "" {
+		return "", artists
+	}
+	if albumArtist == "" && len(artists) > 0 {
+		albumArtist = artists[0]
+	}
+	return albumArtist + "\x00" + album, artists
+}
+
+// TagChange is a tag whose repeated values were merged.
+type TagChange struct {
+	Tag    string   `json:"tag"`
+	Before []string `json:"before"`
+	After  []string `json:"after"`
+}
+
+// vendorString is the vendor of Vorbis comment blocks created by the tool.
+const vendorString = "fixflac4lms"
+
+// vorbisCommentBlock returns the Vorbis comment block of f, or nil if it
+// has none.
+func vorbisCommentBlock(f *flac.File) *flac.MetaDataBlock {
+	for _, block := range f.Meta {
+		if block.Type == flac.VorbisComment {
+			return block
+		}
+	}
+	return nil
+}
+
+// ensureVorbisComment returns the Vorbis comment block of f, appending an
+// empty one first if it has none, for modes that add tags. A FLAC file
+// may only have one, so an existing block is always reused.
+func ensureVorbisComment(f *flac.File) *flac.MetaDataBlock {
+	if block := vorbisCommentBlock(f); block != nil {
+		return block
+	}
+	block := &flac.MetaDataBlock{Type: flac.VorbisComment, Data: (&VorbisComment{Vendor: vendorString}).Marshal()}
+	f.Meta = append(f.Meta, block)
+	return block
+}
+
+// processMBIDs merges the values of repeated target tags into one, as
+// selected by config.MergeMode. It returns the merged tags.
+func processMBIDs(filename string, f *flac.File, config Config) ([]TagChange, error) {
+	cmtBlock := vorbisCommentBlock(f)
+	if cmtBlock == nil {
+		return nil, nil
+	}
+
+	cmts, err := ParseVorbisComment(cmtBlock.Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse vorbis comments: %w", err)
+	}
+
+	// Tags we want to check and potentially merge
+	targetTags := config.MergeTags
+
+	// Helper to check if a tag is in our target list
+	isTarget := func(t string) bool {
+		return slices.Contains(targetTags, t)
+	}
+
+	// Map to store values for checking: tagKey -> []values
+	tagValues := make(map[string][]string)
+
+	// Identify target tags and collect their values
+	for _, t := range targetTags {
+		tagValues[t] = []string{}
+	}
+
+	newComments := []string{}
+
+	// First pass: collect values for target tags and track others
+	for _, c := range cmts.Comments {
+		parts := strings.SplitN(c, "=", 2)
+		if len(parts) != 2 {
+			newComments = append(newComments, c)
+			continue
+		}
+
+		key := strings.ToUpper(parts[0])
+		val := parts[1]
+
+		if isTarget(key) {
+			tagValues[key] = append(tagValues[key], val)
+		} else {
+			if strings.HasPrefix(key, "MUSICBRAINZ_") {
+				// Track other MB tags for warning checks
+				tagValues[key] = append(tagValues[key], val)
+			}
+			newComments = append(newComments, c)
+		}
+	}
+
+	var merged []TagChange
+
+	// Check for warnings on non-target MB tags
+	for key, values := range tagValues {
+		if !isTarget(key) && len(values) > 1 {
+			config.Log(LogWarn, "%s: Multiple values found for %s (Count: %d). This might confuse LMS.\n", filename, key, len(values))
+		}
+	}
+
+	// Joining junk would hide it behind a tag that looks fixed
+	malformed := false
+	for _, t := range targetTags {
+		ids := tagValues[t]
+		if len(ids) < 2 || !strings.HasPrefix(t, "MUSICBRAINZ_") {
+			continue
+		}
+		for _, id := range ids {
+			// Values may have been joined before
+			for part := range strings.SplitSeq(id, config.mergeSeparator()) {
+				if !isMBID(part) {
+					config.Log(LogWarn, "%s: Malformed %s %q\n", filename, t, part)
+					malformed = true
 				}
 			}
-			return nil
+		}
+	}
+	if malformed && config.StrictMBID {
+		config.Log(LogWarn, "%s: Not merging because of malformed MusicBrainz IDs\n", filename)
+		return nil, nil
+	}
+
+	// Second pass: append processed tags
+	for _, t := range targetTags {
+		ids := tagValues[t]
+		if len(ids) > 0 {
+			if len(ids) > 1 && config.MergeMode == MergeFirst {
+				config.Log(LogInfo, "%s: Keeping the first of %d %s\n", filename, len(ids), t)
+				config.Log(LogVerbose, "%s: Dropping %s %s\n", filename, t, strings.Join(ids[1:], ", "))
+				newComments = append(newComments, t+"="+ids[0])
+				merged = append(merged, TagChange{Tag: t, Before: ids, After: ids[:1]})
+			} else if len(ids) > 1 {
+				config.Log(LogInfo, "%s: Merging %d %s\n", filename, len(ids), t)
+				combined := strings.Join(ids, config.mergeSeparator())
+				newComments = append(newComments, t+"="+combined)
+				merged = append(merged, TagChange{Tag: t, Before: ids, After: []string{combined}})
+			} else {
+				// Just one, keep it as is
+				newComments = append(newComments, t+"="+ids[0])
+			}
+		}
+	}
+
+	if len(merged) > 0 {
+		cmts.Comments = newComments
+		newBody := cmts.Marshal()
+		cmtBlock.Data = newBody
+	}
+
+	return merged, nil
+}
+
+// mbidPattern matches a MusicBrainz ID, a UUID in 8-4-4-4-12 hex form.
+var mbidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// isMBID reports whether s is a well-formed MusicBrainz ID.
+func isMBID(s string) bool {
+	return mbidPattern.MatchString(strings.TrimSpace(s))
+}
+
+// processValues trims surrounding whitespace from the values of the
+// Vorbis comments and removes control characters other than line breaks
+// and tabs, which multi-line values like lyrics use; a "\r\n" becomes
+// "\n". Keys are left alone. It returns the number of cleaned values.
+func processValues(filename string, f *flac.File, config Config) (int, error) {
+	cmtBlock := vorbisCommentBlock(f)
+	if cmtBlock == nil {
+		return 0, nil
+	}
+
+	cmts, err := ParseVorbisComment(cmtBlock.Data)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse vorbis comments: %w", err)
+	}
+
+	cleaned := 0
+	for i, c := range cmts.Comments {
+		key, value, found := strings.Cut(c, "=")
+		if !found {
+			continue
+		}
+		clean := strings.TrimSpace(strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) && r != '\n' && r != '\t' {
+				return -1
+			}
+			return r
+		}, value))
+		if clean != value {
+			config.Log(LogVerbose, "%s: Cleaning %s: %q -> %q\n", filename, key, value, clean)
+			cmts.Comments[i] = key + "=" + clean
+			cleaned++
+		}
+	}
+
+	if cleaned == 0 {
+		return 0, nil
+	}
+	config.Log(LogInfo, "%s: Cleaned %d tag values\n", filename, cleaned)
+	cmtBlock.Data = cmts.Marshal()
+	return cleaned, nil
+}
+
+// processEmptyValues removes the Vorbis comments whose value is empty or
+// only whitespace. Comments without "=" are malformed rather than empty
+// and kept. It returns the number of removed comments.
+func processEmptyValues(filename string, f *flac.File, config Config) (int, error) {
+	cmtBlock := vorbisCommentBlock(f)
+	if cmtBlock == nil {
+		return 0, nil
+	}
+
+	cmts, err := ParseVorbisComment(cmtBlock.Data)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse vorbis comments: %w", err)
+	}
+
+	var newComments []string
+	for _, c := range cmts.Comments {
+		if _, value, found := strings.Cut(c, "="); found && strings.TrimSpace(value) == "" {
+			config.Log(LogVerbose, "%s: Removing empty %q\n", filename, c)
+			continue
+		}
+		newComments = append(newComments, c)
+	}
+
+	removed := len(cmts.Comments) - len(newComments)
+	if removed == 0 {
+		return 0, nil
+	}
+	config.Log(LogInfo, "%s: Removing %d empty tags\n", filename, removed)
+	cmts.Comments = newComments
+	cmtBlock.Data = cmts.Marshal()
+	return removed, nil
+}
+
+// processKeys uppercases the keys of the Vorbis comments. A comment
+// that becomes identical to another one, as with "Album=X" next to
+// "ALBUM=X", is dropped. It returns the number of rewritten keys.
+func processKeys(filename string, f *flac.File, config Config) (int, error) {
+	cmtBlock := vorbisCommentBlock(f)
+	if cmtBlock == nil {
+		return 0, nil
+	}
+
+	cmts, err := ParseVorbisComment(cmtBlock.Data)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse vorbis comments: %w", err)
+	}
+
+	rewritten := 0
+	seen := make(map[string]bool, len(cmts.Comments))
+	newComments := make([]string, 0, len(cmts.Comments))
+	for _, c := range cmts.Comments {
+		// Values may contain '=' themselves, only the key is changed
+		key, value, found := strings.Cut(c, "=")
+		if upper := strings.ToUpper(key); found && upper != key {
+			config.Log(LogVerbose, "%s: Renaming %s to %s\n", filename, key, upper)
+			c = upper + "=" + value
+			rewritten++
+		}
+		if seen[c] {
+			config.Log(LogVerbose, "%s: Dropping duplicate %s\n", filename, c)
+			continue
+		}
+		seen[c] = true
+		newComments = append(newComments, c)
+	}
+
+	if rewritten == 0 {
+		return 0, nil
+	}
+	config.Log(LogInfo, "%s: Normalized %d tag keys\n", filename, rewritten)
+	cmts.Comments = newComments
+	cmtBlock.Data = cmts.Marshal()
+	return rewritten, nil
+}
+
+// processStripTags removes the Vorbis comments listed in StripTags and
+// returns how many were removed.
+func processStripTags(filename string, f *flac.File, config Config) (int, error) {
+	cmtBlock := vorbisCommentBlock(f)
+	if cmtBlock == nil {
+		return 0, nil
+	}
+
+	cmts, err := ParseVorbisComment(cmtBlock.Data)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse vorbis comments: %w", err)
+	}
+
+	strip := func(key string) bool {
+		return slices.ContainsFunc(config.StripTags, func(t string) bool {
+			return strings.EqualFold(t, key)
 		})
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error walking directory: %v\n", err)
-			os.Exit(1)
+	}
+
+	var newComments []string
+	for _, c := range cmts.Comments {
+		key, _, _ := strings.Cut(c, "=")
+		if strip(key) {
+			config.Log(LogVerbose, "%s: Removing %s\n", filename, c)
+			continue
+		}
+		newComments = append(newComments, c)
+	}
+
+	removed := len(cmts.Comments) - len(newComments)
+	if removed == 0 {
+		return 0, nil
+	}
+	config.Log(LogInfo, "%s: Removing %d tags\n", filename, removed)
+	cmts.Comments = newComments
+	cmtBlock.Data = cmts.Marshal()
+	return removed, nil
+}
+
+// processReplayGain removes the gain tags of the convention not chosen
+// by ReplayGainPrefer from files that carry both, e.g. the R128_* tags
+// of files that also have REPLAYGAIN_TRACK_GAIN, which LMS prefers. Files
+// with neither get a warning. It returns the number of removed comments.
+func processReplayGain(filename string, f *flac.File, config Config) (int, error) {
+	cmtBlock := vorbisCommentBlock(f)
+	if cmtBlock == nil {
+		config.Log(LogWarn, "%s: No ReplayGain or R128 gain tags\n", filename)
+		return 0, nil
+	}
+
+	cmts, err := ParseVorbisComment(cmtBlock.Data)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse vorbis comments: %w", err)
+	}
+
+	hasReplayGain, hasR128 := false, false
+	for _, c := range cmts.Comments {
+		key, _, _ := strings.Cut(c, "=")
+		switch strings.ToUpper(key) {
+		case "REPLAYGAIN_TRACK_GAIN":
+			hasReplayGain = true
+		case "R128_TRACK_GAIN":
+			hasR128 = true
+		}
+	}
+	if !hasReplayGain && !hasR128 {
+		config.Log(LogWarn, "%s: No ReplayGain or R128 gain tags\n", filename)
+		return 0, nil
+	}
+	if !hasReplayGain || !hasR128 {
+		return 0, nil
+	}
+
+	drop := "R128_"
+	if config.ReplayGainPrefer == "r128" {
+		drop = "REPLAYGAIN_"
+	}
+	var newComments []string
+	for _, c := range cmts.Comments {
+		key, _, _ := strings.Cut(c, "=")
+		if strings.HasPrefix(strings.ToUpper(key), drop) {
+			config.Log(LogVerbose, "%s: Removing %s\n", filename, c)
+			continue
+		}
+		newComments = append(newComments, c)
+	}
+
+	removed := len(cmts.Comments) - len(newComments)
+	config.Log(LogInfo, "%s: Removing %d %s* tags\n", filename, removed, drop)
+	cmts.Comments = newComments
+	cmtBlock.Data = cmts.Marshal()
+	return removed, nil
+}
+
+// defaultCompactPadding is the padding kept by --compact, as much as
+// the flac tool adds by default.
+const defaultCompactPadding = 8192
+
+// processCompact replaces the PADDING blocks with one of CompactPadding
+// bytes at the end, and drops APPLICATION blocks with DropApplication.
+// The metadata is only changed if it gets smaller; it returns the number
+// of bytes saved.
+func processCompact(filename string, f *flac.File, config Config) int64 {
+	var kept []*flac.MetaDataBlock
+	for _, block := range f.Meta {
+		if block.Type == flac.Padding {
+			continue
+		}
+		if block.Type == flac.Application && config.DropApplication {
+			config.Log(LogVerbose, "%s: Removing APPLICATION block of %d bytes\n", filename, len(block.Data))
+			continue
+		}
+		kept = append(kept, block)
+	}
+	if config.CompactPadding > 0 {
+		kept = append(kept, &flac.MetaDataBlock{Type: flac.Padding, Data: make([]byte, config.CompactPadding)})
+	}
+
+	reclaimed := metadataSize(f.Meta) - metadataSize(kept)
+	if reclaimed <= 0 {
+		return 0
+	}
+	config.Log(LogInfo, "%s: Compacting metadata, reclaiming %s\n", filename, formatBytes(reclaimed))
+	f.Meta = kept
+	return reclaimed
+}
+
+// metadataSize returns the size of the metadata blocks in the file,
+// including their 4 byte headers.
+func metadataSize(meta []*flac.MetaDataBlock) int64 {
+	var size int64
+	for _, block := range meta {
+		size += 4 + int64(len(block.Data))
+	}
+	return size
+}
+
+// validateSetTag checks a --set-tag value: a KEY=VALUE comment whose key
+// is valid in Vorbis comments.
+func validateSetTag(s string) error {
+	key, _, found := strings.Cut(s, "=")
+	if !found || key == "" {
+		return fmt.Errorf("expected KEY=VALUE, got %q", s)
+	}
+	for _, r := range key {
+		if r < 0x20 || r > 0x7D {
+			return fmt.Errorf("invalid character %q in key %q", r, key)
+		}
+	}
+	return nil
+}
+
+// validateRenameTag checks a --rename-tag value: an OLD=NEW pair of
+// different keys that are valid in Vorbis comments. OLD may contain
+// spaces, as written by some taggers.
+func validateRenameTag(s string) error {
+	from, to, found := strings.Cut(s, "=")
+	if !found || from == "" || to == "" {
+		return fmt.Errorf("expected OLD=NEW, got %q", s)
+	}
+	if strings.EqualFold(from, to) {
+		return fmt.Errorf("old and new key of %q are the same", s)
+	}
+	if err := validateSetTag(from + "="); err != nil {
+		return err
+	}
+	return validateSetTag(to + "=")
+}
+
+// processRenameTags gives the comments with an old key of RenameTags
+// the new key, in place. A renamed comment whose value the new key
+// already has is dropped. It returns the number of renamed comments.
+func processRenameTags(filename string, f *flac.File, config Config) (int, error) {
+	cmtBlock := vorbisCommentBlock(f)
+	if cmtBlock == nil {
+		return 0, nil
+	}
+	cmts, err := ParseVorbisComment(cmtBlock.Data)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse vorbis comments: %w", err)
+	}
+
+	renamed := 0
+	for _, pair := range config.RenameTags {
+		from, to, _ := strings.Cut(pair, "=")
+		to = strings.ToUpper(to)
+		var newComments []string
+		for _, c := range cmts.Comments {
+			key, value, found := strings.Cut(c, "=")
+			if !found || !strings.EqualFold(key, from) {
+				newComments = append(newComments, c)
+				continue
+			}
+			renamed++
+			config.Log(LogVerbose, "%s: Renaming %s to %s: %q\n", filename, key, to, value)
+			if !slices.ContainsFunc(cmts.Comments, func(c string) bool {
+				k, v, _ := strings.Cut(c, "=")
+				return strings.EqualFold(k, to) && v == value
+			}) && !slices.Contains(newComments, to+"="+value) {
+				newComments = append(newComments, to+"="+value)
+			}
+		}
+		cmts.Comments = newComments
+	}
+
+	if renamed == 0 {
+		return 0, nil
+	}
+	config.Log(LogInfo, "%s: Renaming %d tags\n", filename, renamed)
+	cmtBlock.Data = cmts.Marshal()
+	return renamed, nil
+}
+
+// validateASCIIFold checks an --ascii-fold value: a SOURCE=TARGET pair
+// of different keys that are valid in Vorbis comments.
+func validateASCIIFold(s string) error {
+	source, target, found := strings.Cut(s, "=")
+	if !found || source == "" || target == "" {
+		return fmt.Errorf("expected SOURCE=TARGET, got %q", s)
+	}
+	if strings.EqualFold(source, target) {
+		return fmt.Errorf("source and target of %q are the same tag", s)
+	}
+	return validateSetTag(target + "=")
+}
+
+// asciiSpellings replace letters and punctuation that have no
+// decomposition into ASCII.
+var asciiSpellings = strings.NewReplacer(
+	"ß", "ss", "Æ", "AE", "æ", "ae", "Œ", "OE", "œ", "oe", "Ø", "O", "ø", "o",
+	"Đ", "D", "đ", "d", "Ł", "L", "ł", "l", "Þ", "Th", "þ", "th", "ı", "i",
+	"‘", "'", "’", "'", "“", `"`, "”", `"`, "–", "-", "—", "-",
+)
+
+// asciiFold returns s without accents, with ligatures and similar
+// letters spelled out, e.g. "Björk" becomes "Bjork". It reports false
+// if s has characters without an ASCII spelling, e.g. Japanese.
+func asciiFold(s string) (string, bool) {
+	t := transform.Chain(norm.NFKD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	folded, _, err := transform.String(t, asciiSpellings.Replace(s))
+	if err != nil {
+		return "", false
+	}
+	for _, r := range folded {
+		if r > unicode.MaxASCII {
+			return "", false
 		}
+	}
+	return folded, true
+}
+
+// processASCIIFold writes the target tags of ASCIIFold from the folded
+// values of their sources. Targets that exist, and sources that are
+// pure ASCII already or cannot be folded, are left alone. It returns
+// the number of tags written.
+func processASCIIFold(filename string, f *flac.File, config Config) (int, error) {
+	cmtBlock := vorbisCommentBlock(f)
+	if cmtBlock == nil {
+		return 0, nil
+	}
+	cmts, err := ParseVorbisComment(cmtBlock.Data)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse vorbis comments: %w", err)
+	}
 
-		// Prune output directory if converting and not disabled
-		if config.ConvertOpus != "" && !config.NoPrune {
-			if err := pruneOutput(absInputRoot, config); err != nil {
-				fmt.Fprintf(os.Stderr, "Error pruning output: %v\n", err)
+	written := 0
+	for _, pair := range config.ASCIIFold {
+		source, target, _ := strings.Cut(pair, "=")
+		target = strings.ToUpper(target)
+		var values []string
+		hasTarget := false
+		for _, c := range cmts.Comments {
+			key, value, _ := strings.Cut(c, "=")
+			if strings.EqualFold(key, source) {
+				values = append(values, value)
 			}
+			hasTarget = hasTarget || strings.EqualFold(key, target)
 		}
-	} else {
-		if config.ConvertOpus != "" {
-			// For single file, input root is the directory of the file
-			absInputRoot := filepath.Dir(path)
-			if absPath, err := filepath.Abs(absInputRoot); err == nil {
-				absInputRoot = absPath
-			}
-			if _, err := convertOpus(path, absInputRoot, config); err != nil {
-				fmt.Fprintf(os.Stderr, "Error converting %s: %v\n", path, err)
-				os.Exit(1)
+		if hasTarget || len(values) == 0 {
+			continue
+		}
+
+		folded := make([]string, 0, len(values))
+		changed := false
+		for _, v := range values {
+			fv, ok := asciiFold(v)
+			if !ok {
+				config.Log(LogVerbose, "%s: Cannot fold %s %q to ASCII\n", filename, strings.ToUpper(source), v)
+				folded = nil
+				break
 			}
-		} else {
-			if _, err := fixFlac(path, config); err != nil {
-				fmt.Fprintf(os.Stderr, "Error processing %s: %v\n", path, err)
-				os.Exit(1)
+			changed = changed || fv != v
+			folded = append(folded, target+"="+fv)
+		}
+		if folded == nil || !changed {
+			continue
+		}
+		config.Log(LogVerbose, "%s: Setting %s from %s: [%s]\n", filename, target, strings.ToUpper(source), strings.Join(folded, ", "))
+		cmts.Comments = append(cmts.Comments, folded...)
+		written++
+	}
+
+	if written == 0 {
+		return 0, nil
+	}
+	config.Log(LogInfo, "%s: Writing %d ASCII-folded tags\n", filename, written)
+	cmtBlock.Data = cmts.Marshal()
+	return written, nil
+}
+
+// processSetTags writes the comments of SetTags. All values of their
+// keys are replaced, in the place of the first one; a key given several
+// times gets all its values. It returns the number of keys whose values
+// changed.
+func processSetTags(filename string, f *flac.File, config Config) (int, error) {
+	var keys []string
+	values := make(map[string][]string)
+	for _, tag := range config.SetTags {
+		key, value, _ := strings.Cut(tag, "=")
+		key = strings.ToUpper(key)
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+		values[key] = append(values[key], value)
+	}
+
+	cmts := &VorbisComment{Vendor: vendorString}
+	if cmtBlock := vorbisCommentBlock(f); cmtBlock != nil {
+		var err error
+		if cmts, err = ParseVorbisComment(cmtBlock.Data); err != nil {
+			return 0, fmt.Errorf("failed to parse vorbis comments: %w", err)
+		}
+	}
+
+	changed := 0
+	comments := cmts.Comments
+	for _, key := range keys {
+		var current, kept []string
+		first := -1
+		for _, c := range comments {
+			if k, v, _ := strings.Cut(c, "="); strings.EqualFold(k, key) {
+				if first < 0 {
+					first = len(kept)
+				}
+				current = append(current, v)
+				continue
 			}
+			kept = append(kept, c)
+		}
+		if slices.Equal(current, values[key]) {
+			continue
+		}
+
+		config.Log(LogVerbose, "%s: Setting %s: [%s] -> [%s]\n", filename, key, strings.Join(current, ", "), strings.Join(values[key], ", "))
+		if first < 0 {
+			first = len(kept)
+		}
+		set := make([]string, 0, len(values[key]))
+		for _, v := range values[key] {
+			set = append(set, key+"="+v)
 		}
+		comments = slices.Insert(kept, first, set...)
+		changed++
 	}
+
+	if changed == 0 {
+		return 0, nil
+	}
+	config.Log(LogInfo, "%s: Setting %d tags\n", filename, changed)
+	cmts.Comments = comments
+	ensureVorbisComment(f).Data = cmts.Marshal()
+	return changed, nil
 }
 
-func convertOpus(inputFile string, inputRoot string, config Config) (bool, error) {
-	absInputFile, err := filepath.Abs(inputFile)
+// processDuplicates removes Vorbis comments that repeat an earlier one
+// byte for byte and returns how many were removed. Different values of
+// the same key are a multi-value tag and are kept.
+func processDuplicates(filename string, f *flac.File, config Config) (int, error) {
+	cmtBlock := vorbisCommentBlock(f)
+	if cmtBlock == nil {
+		return 0, nil
+	}
+
+	cmts, err := ParseVorbisComment(cmtBlock.Data)
 	if err != nil {
-		return false, err
+		return 0, fmt.Errorf("failed to parse vorbis comments: %w", err)
 	}
 
-	// Calculate relative path from input root
-	relPath, err := filepath.Rel(inputRoot, absInputFile)
+	seen := make(map[string]bool, len(cmts.Comments))
+	newComments := make([]string, 0, len(cmts.Comments))
+	for _, c := range cmts.Comments {
+		if seen[c] {
+			config.Log(LogVerbose, "%s: Dropping duplicate %s\n", filename, c)
+			continue
+		}
+		seen[c] = true
+		newComments = append(newComments, c)
+	}
+
+	removed := len(cmts.Comments) - len(newComments)
+	if removed == 0 {
+		return 0, nil
+	}
+	config.Log(LogInfo, "%s: Removing %d duplicate tags\n", filename, removed)
+	cmts.Comments = newComments
+	cmtBlock.Data = cmts.Marshal()
+	return removed, nil
+}
+
+// trackUIDTag holds a copy of the MusicBrainz recording ID, which LMS
+// can use to recognize the same track in different folders.
+const trackUIDTag = "UFID"
+
+// processTrackUID makes sure the UFID tag matches MUSICBRAINZ_TRACKID.
+func processTrackUID(filename string, f *flac.File, config Config) (bool, error) {
+	cmtBlock := vorbisCommentBlock(f)
+	if cmtBlock == nil {
+		config.Log(LogWarn, "%s: No MUSICBRAINZ_TRACKID, cannot set %s\n", filename, trackUIDTag)
+		return false, nil
+	}
+
+	cmts, err := ParseVorbisComment(cmtBlock.Data)
 	if err != nil {
-		return false, fmt.Errorf("failed to get relative path: %w", err)
+		return false, fmt.Errorf("failed to parse vorbis comments: %w", err)
 	}
 
-	// Determine output filename
-	outputFile := filepath.Join(config.ConvertOpus, relPath)
-	outputFile = strings.TrimSuffix(outputFile, filepath.Ext(outputFile)) + ".opus"
+	var trackIDs, uids []string
+	for _, c := range cmts.Comments {
+		key, value, _ := strings.Cut(c, "=")
+		switch strings.ToUpper(key) {
+		case "MUSICBRAINZ_TRACKID":
+			trackIDs = append(trackIDs, value)
+		case trackUIDTag:
+			uids = append(uids, value)
+		}
+	}
 
-	// Ensure output directory exists
-	outputDir := filepath.Dir(outputFile)
-	if err := os.MkdirAll(outputDir, 0o755); err != nil {
-		return false, fmt.Errorf("failed to create output directory: %w", err)
+	switch {
+	case len(trackIDs) == 0:
+		config.Log(LogWarn, "%s: No MUSICBRAINZ_TRACKID, cannot set %s\n", filename, trackUIDTag)
+		return false, nil
+	case len(trackIDs) > 1:
+		config.Log(LogWarn, "%s: Multiple values found for MUSICBRAINZ_TRACKID (Count: %d), not setting %s\n", filename, len(trackIDs), trackUIDTag)
+		return false, nil
+	case len(uids) == 1 && uids[0] == trackIDs[0]:
+		return false, nil
+	case len(uids) == 0:
+		config.Log(LogInfo, "%s: Setting %s\n", filename, trackUIDTag)
+	default:
+		config.Log(LogWarn, "%s: %s %q does not match MUSICBRAINZ_TRACKID, replacing it\n", filename, trackUIDTag, strings.Join(uids, ", "))
 	}
 
-	// Check if up to date
-	inStat, err := os.Stat(absInputFile)
+	// Keep the order of the other comments
+	var newComments []string
+	for _, c := range cmts.Comments {
+		key, _, _ := strings.Cut(c, "=")
+		if !strings.EqualFold(key, trackUIDTag) {
+			newComments = append(newComments, c)
+		}
+	}
+	cmts.Comments = append(newComments, trackUIDTag+"="+trackIDs[0])
+	cmtBlock.Data = cmts.Marshal()
+	return true, nil
+}
+
+func processCover(filename string, f *flac.File, config Config) (bool, error) {
+	coverType := config.coverType()
+	var existing []int
+	for i, block := range f.Meta {
+		if t, ok := pictureType(block); ok && t == coverType {
+			// Already has a cover; other picture types (e.g. a back
+			// cover only) do not count
+			if !config.ForceCover {
+				return false, nil
+			}
+			existing = append(existing, i)
+		}
+	}
+	if len(existing) > 0 {
+		return replaceCover(filename, f, existing, config)
+	}
+
+	// No picture found, look for cover.jpg
+	pic, coverName, err := findFolderCover(filename, config)
 	if err != nil {
 		return false, err
 	}
 
-	if outStat, err := os.Stat(outputFile); err == nil {
-		if !inStat.ModTime().After(outStat.ModTime()) {
-			config.Log(LogVerbose, "Skipping (up to date): %s\n", relPath)
+	if pic == nil && config.DefaultCover != "" {
+		pic, err = config.loadCover(config.DefaultCover)
+		if err != nil {
+			return false, err
+		}
+		config.Log(LogInfo, "%s: Embedding placeholder %s\n", filename, config.DefaultCover)
+		pic.Description = placeholderDescription
+	} else if pic != nil {
+		config.Log(LogInfo, "%s: Embedding %s\n", filename, coverName)
+		pic.Description = config.CoverDescription
+	}
+
+	if pic == nil {
+		return false, nil
+	}
+	pic.PictureType = coverType
+
+	block := &flac.MetaDataBlock{
+		Type: flac.Picture,
+		Data: pic.Marshal(),
+	}
+
+	// Appending is safe: go-flac does not keep the "last metadata block"
+	// flag on the blocks but derives it from the position when marshaling.
+	f.Meta = append(f.Meta, block)
+	return true, nil
+}
+
+// pictureTypeFrontCover is the FLAC picture type of a front cover.
+const pictureTypeFrontCover = 3
+
+// thumbnailDescription marks pictures embedded by --embed-thumbnail.
+const thumbnailDescription = "thumbnail"
+
+// processThumbnail adds a copy of the front cover scaled down to
+// EmbedThumbnail pixels as another front cover, after the full one so
+// that players keep showing that. Files without a front cover larger
+// than the thumbnail, or with one of thumbnail size already, are left
+// alone.
+func processThumbnail(filename string, f *flac.File, config Config) (bool, error) {
+	var cover *Picture
+	for _, block := range f.Meta {
+		if t, ok := pictureType(block); !ok || t != pictureTypeFrontCover {
+			continue
+		}
+		pic, err := ParsePicture(block.Data)
+		if err != nil {
+			return false, fmt.Errorf("failed to parse picture: %w", err)
+		}
+		width, height := int(pic.Width), int(pic.Height)
+		if width == 0 || height == 0 {
+			// Not every tagger fills in the dimensions
+			cfg, _, err := image.DecodeConfig(bytes.NewReader(pic.Data))
+			if err != nil {
+				config.Log(LogVerbose, "%s: Cannot decode front cover: %v\n", filename, err)
+				continue
+			}
+			width, height = cfg.Width, cfg.Height
+		}
+		if max(width, height) <= config.EmbedThumbnail {
 			return false, nil
 		}
+		if cover == nil {
+			cover = pic
+		}
+	}
+	if cover == nil {
+		return false, nil
 	}
 
-	config.Log(LogInfo, "Converting: %s\n", relPath)
+	img, _, err := image.Decode(bytes.NewReader(cover.Data))
+	if err != nil {
+		config.Log(LogWarn, "%s: Cannot decode front cover, no thumbnail: %v\n", filename, err)
+		return false, nil
+	}
+	quality := config.CoverQuality
+	if quality <= 0 {
+		quality = defaultCoverQuality
+	}
+	width, height := fitDimensions(img.Bounds().Dx(), img.Bounds().Dy(), config.EmbedThumbnail)
+	thumb, err := encodeJPEGCover(cover, scaleImage(img, width, height), quality)
+	if err != nil {
+		return false, err
+	}
+	thumb.Description = thumbnailDescription
 
-	// Atomic write: convert to .tmp first
-	tempOutputFile := outputFile + ".tmp"
+	config.Log(LogInfo, "%s: Embedding %dx%d thumbnail\n", filename, width, height)
+	f.Meta = append(f.Meta, &flac.MetaDataBlock{Type: flac.Picture, Data: thumb.Marshal()})
+	return true, nil
+}
 
-	// Prepare opusenc command
-	cmd := exec.Command("opusenc", absInputFile, tempOutputFile)
+// coverSpec names a cover file and the picture type it is embedded as.
+type coverSpec struct {
+	Name string
+	Type uint32
+}
 
-	// Handle output
-	if config.Verbose && !config.Progress {
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-	} else {
-		var stderr bytes.Buffer
-		cmd.Stderr = &stderr
-		if err := cmd.Run(); err != nil {
-			return false, fmt.Errorf("opusenc failed: %v, stderr: %s", err, stderr.String())
+// parseCoverSpec parses a --cover value like "back.jpg:4".
+func parseCoverSpec(s string) (coverSpec, error) {
+	i := strings.LastIndex(s, ":")
+	if i <= 0 {
+		return coverSpec{}, fmt.Errorf("expected name:type, got %q", s)
+	}
+	t, err := strconv.ParseUint(s[i+1:], 10, 32)
+	if err != nil || t < 1 || t > 20 {
+		return coverSpec{}, fmt.Errorf("%q is not a FLAC picture type between 1 and 20", s[i+1:])
+	}
+	return coverSpec{Name: s[:i], Type: uint32(t)}, nil
+}
+
+// coverSpecs returns the cover files to embed: CoverFiles, or CoverName
+// as the cover type.
+func (c Config) coverSpecs() []coverSpec {
+	if len(c.CoverFiles) > 0 {
+		return c.CoverFiles
+	}
+	return []coverSpec{{Name: c.CoverName, Type: c.coverType()}}
+}
+
+// processCovers runs processCover for each of the coverSpecs. The
+// placeholder of --default-cover only stands in for the first one, and
+// only its file is expected to exist. It returns the picture type of the
+// first cover embedded, or 0 if none was.
+func processCovers(filename string, f *flac.File, config Config) (uint32, error) {
+	var embedded uint32
+	for i, spec := range config.coverSpecs() {
+		c := config
+		c.CoverName, c.CoverType = spec.Name, spec.Type
+		if i > 0 {
+			c.DefaultCover = ""
+			c.coverOptional = true
+		}
+		m, err := processCover(filename, f, c)
+		if err != nil {
+			return 0, err
 		}
-		// If successful, rename
-		if err := os.Rename(tempOutputFile, outputFile); err != nil {
-			return false, fmt.Errorf("failed to rename temp file: %w", err)
+		if m && embedded == 0 {
+			embedded = spec.Type
 		}
-		return true, nil
+	}
+	return embedded, nil
+}
+
+// coverType returns the picture type used for embedded covers.
+func (c Config) coverType() uint32 {
+	if c.CoverType == 0 {
+		return pictureTypeFrontCover
+	}
+	return c.CoverType
+}
+
+// pictureType returns the picture type of a picture block, which is stored
+// in its first four bytes.
+func pictureType(block *flac.MetaDataBlock) (uint32, bool) {
+	if block.Type != flac.Picture || len(block.Data) < 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(block.Data[:4]), true
+}
+
+// placeholderDescription marks pictures embedded from --default-cover.
+const placeholderDescription = "placeholder"
+
+// folderCoverPath returns the cover file for filename: the one next to
+// it, else the nearest one up to CoverSearchParents directories above,
+// without leaving coverRoot. It returns "" if there is none.
+func (c Config) folderCoverPath(filename string) string {
+	dir, err := filepath.Abs(filepath.Dir(filename))
+	if err != nil {
+		return ""
+	}
+	for i := 0; ; i++ {
+		if coverPath := c.coverFileIn(dir); coverPath != "" {
+			return coverPath
+		}
+		parent := filepath.Dir(dir)
+		if i >= c.CoverSearchParents || c.coverRoot == "" || dir == filepath.Clean(c.coverRoot) || parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// coverNames returns the names of CoverName in order of preference.
+func (c Config) coverNames() []string {
+	var names []string
+	for name := range strings.SplitSeq(c.CoverName, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// coverNamesText returns the coverNames for messages, e.g. "cover.jpg or
+// folder.jpg".
+func (c Config) coverNamesText() string {
+	return strings.Join(c.coverNames(), " or ")
+}
+
+// coverFileNames returns the coverNames followed by the names with the
+// extensions extractCover picks by image type, e.g. cover.png for
+// cover.jpg.
+func (c Config) coverFileNames() []string {
+	names := c.coverNames()
+	extensions := slices.Compact(slices.Sorted(maps.Values(pictureExtensions)))
+	for _, name := range c.coverNames() {
+		for _, ext := range extensions {
+			if renamed := strings.TrimSuffix(name, filepath.Ext(name)) + ext; !slices.Contains(names, renamed) {
+				names = append(names, renamed)
+			}
+		}
+	}
+	return names
+}
+
+// coverFileIn returns the first of the coverFileNames in dir that exists
+// and is not a directory, or "" if there is none. Other errors come up
+// when loading the cover.
+func (c Config) coverFileIn(dir string) string {
+	for _, name := range c.coverFileNames() {
+		path := filepath.Join(dir, name)
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+			continue
+		}
+		return path
+	}
+	return ""
+}
+
+// findFolderCover loads the cover file for filename, see folderCoverPath,
+// and returns it with its file name. It returns nil if there is none or
+// it is unsuitable.
+func findFolderCover(filename string, config Config) (*Picture, string, error) {
+	coverPath := config.folderCoverPath(filename)
+	if coverPath == "" {
+		// With a placeholder configured, a missing cover is expected
+		level := LogWarn
+		if config.DefaultCover != "" || config.coverOptional {
+			level = LogVerbose
+		}
+		config.Log(level, "%s: No embedded cover and no %s found\n", filename, config.coverNamesText())
+		return nil, "", nil
+	}
+	coverName := filepath.Base(coverPath)
+
+	if dir, _ := filepath.Abs(filepath.Dir(filename)); filepath.Dir(coverPath) != dir || len(config.coverNames()) > 1 {
+		config.Log(LogVerbose, "%s: Using %s\n", filename, coverPath)
+	}
+	pic, err := config.loadCover(coverPath)
+	if errors.Is(err, errCorruptCover) && !config.StrictCover {
+		// Not worth failing the file, other fixes still apply
+		config.Log(LogWarn, "%s: %v, skipping embed\n", filename, err)
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	if config.CoverMaxAspect > 0 && coverAspect(int(pic.Width), int(pic.Height)) > config.CoverMaxAspect {
+		config.Log(LogWarn, "%s: %s is %dx%d, aspect ratio exceeds %.2f, not embedding\n", filename, coverName, pic.Width, pic.Height, config.CoverMaxAspect)
+		return nil, "", nil
+	}
+
+	return pic, coverName, nil
+}
+
+// replaceCover replaces the embedded covers at the indexes existing of
+// f.Meta with the cover file, for --force-cover. Files without a cover
+// file, or whose cover already matches it, are left alone.
+func replaceCover(filename string, f *flac.File, existing []int, config Config) (bool, error) {
+	if config.folderCoverPath(filename) == "" {
+		config.Log(LogVerbose, "%s: No %s found, keeping embedded cover\n", filename, config.coverNamesText())
+		return false, nil
+	}
+	pic, coverName, err := findFolderCover(filename, config)
+	if pic == nil || err != nil {
+		return false, err
+	}
+	pic.PictureType = config.coverType()
+	pic.Description = config.CoverDescription
+	data := pic.Marshal()
+
+	if len(existing) == 1 && bytes.Equal(f.Meta[existing[0]].Data, data) {
+		return false, nil
+	}
+
+	config.Log(LogInfo, "%s: Replacing embedded cover with %s\n", filename, coverName)
+	// The new cover takes the place of the first old one
+	f.Meta[existing[0]] = &flac.MetaDataBlock{Type: flac.Picture, Data: data}
+	for _, i := range slices.Backward(existing[1:]) {
+		f.Meta = slices.Delete(f.Meta, i, i+1)
+	}
+	return true, nil
+}
+
+// loadCover loads a cover image, through the cover cache if one is set.
+func (c Config) loadCover(coverPath string) (*Picture, error) {
+	if c.Covers == nil {
+		return c.loadCoverFile(coverPath)
+	}
+	return c.Covers.Load(coverPath, c.loadCoverFile)
+}
+
+// defaultCoverQuality is the JPEG quality of downscaled covers.
+const defaultCoverQuality = 90
+
+// loadCoverFile loads a cover image, downscaled to MaxCoverDimension if
+// it is larger and transcoded to JPEG if CoverTranscode is set.
+func (c Config) loadCoverFile(coverPath string) (*Picture, error) {
+	pic, err := loadCoverPicture(coverPath)
+	if err != nil {
+		return nil, err
+	}
+	// The MIME type follows the data, e.g. for a PNG renamed to .jpg
+	if !hasPictureExtension(coverPath, pic.MimeType) {
+		c.Log(LogWarn, "%s is a %s image, embedding it as such\n", coverPath, pic.MimeType)
+	}
+
+	quality := c.CoverQuality
+	if quality <= 0 {
+		quality = defaultCoverQuality
+	}
+	if c.MaxCoverDimension > 0 {
+		shrunk, err := shrinkCover(pic, c.MaxCoverDimension, quality)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Base(coverPath), err)
+		}
+		if shrunk != pic {
+			c.Log(LogVerbose, "Downscaling %s from %dx%d to %dx%d\n", coverPath, pic.Width, pic.Height, shrunk.Width, shrunk.Height)
+		}
+		pic = shrunk
+	}
+
+	// A downscaled cover already is a JPEG
+	if c.CoverTranscode && pic.MimeType != "image/jpeg" {
+		c.Log(LogVerbose, "Transcoding %s from %s to JPEG\n", coverPath, pic.MimeType)
+		img, _, err := image.Decode(bytes.NewReader(pic.Data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w: %v", filepath.Base(coverPath), errCorruptCover, err)
+		}
+		if pic, err = encodeJPEGCover(pic, img, quality); err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Base(coverPath), err)
+		}
+	}
+	return pic, nil
+}
+
+// shrinkCover re-encodes pic as JPEG with its longer edge scaled down to
+// maxDim. Pictures that fit are returned as they are, so small covers are
+// not recompressed.
+func shrinkCover(pic *Picture, maxDim int, quality int) (*Picture, error) {
+	if int(pic.Width) <= maxDim && int(pic.Height) <= maxDim {
+		return pic, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(pic.Data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errCorruptCover, err)
+	}
+
+	width, height := fitDimensions(img.Bounds().Dx(), img.Bounds().Dy(), maxDim)
+	return encodeJPEGCover(pic, scaleImage(img, width, height), quality)
+}
+
+// encodeJPEGCover returns a copy of pic holding img encoded as JPEG.
+func encodeJPEGCover(pic *Picture, img image.Image, quality int) (*Picture, error) {
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, fmt.Errorf("failed to encode cover: %w", err)
+	}
+
+	encoded := *pic
+	encoded.MimeType = "image/jpeg"
+	encoded.Width = uint32(img.Bounds().Dx())
+	encoded.Height = uint32(img.Bounds().Dy())
+	encoded.Depth = 24
+	encoded.Colors = 0
+	encoded.Data = buf.Bytes()
+	return &encoded, nil
+}
+
+// coverCacheSize is the number of pictures kept by coverCache: the cover
+// of the current album plus the placeholder.
+const coverCacheSize = 2
+
+type cachedCover struct {
+	path string
+	pic  *Picture
+}
+
+// coverCache keeps the most recently loaded cover pictures. Files are
+// walked directory by directory, so all tracks of an album share one
+// decode of the album cover.
+type coverCache struct {
+	mu      sync.Mutex
+	entries []cachedCover
+	decodes int
+}
+
+// Load returns a copy of the picture for coverPath, loading it with load
+// on a cache miss. Callers may modify the returned Picture but not its Data.
+func (cc *coverCache) Load(coverPath string, load func(string) (*Picture, error)) (*Picture, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	for i, e := range cc.entries {
+		if e.path == coverPath {
+			// Move to front
+			copy(cc.entries[1:i+1], cc.entries[:i])
+			cc.entries[0] = e
+			pic := *e.pic
+			return &pic, nil
+		}
+	}
+
+	loaded, err := load(coverPath)
+	if err != nil {
+		return nil, err
+	}
+	cc.decodes++
+
+	cc.entries = slices.Insert(cc.entries, 0, cachedCover{path: coverPath, pic: loaded})
+	if len(cc.entries) > coverCacheSize {
+		cc.entries = cc.entries[:coverCacheSize]
+	}
+	pic := *loaded
+	return &pic, nil
+}
+
+// Decodes returns the number of images loaded from disk.
+func (cc *coverCache) Decodes() int {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.decodes
+}
+
+// errCorruptCover is returned for cover files that cannot be decoded.
+var errCorruptCover = errors.New("cover file is corrupt")
+
+// loadCoverPicture reads an image file into a front cover Picture.
+func loadCoverPicture(coverPath string) (*Picture, error) {
+	name := filepath.Base(coverPath)
+
+	file, err := os.Open(coverPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	defer file.Close()
+
+	// Decode config to get dimensions and format
+	cfg, format, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", errCorruptCover, name, err)
 	}
 
-	if err := cmd.Run(); err != nil {
-		// Clean up temp file on failure
-		os.Remove(tempOutputFile)
-		return false, fmt.Errorf("opusenc failed: %w", err)
+	// Reset file pointer to read data
+	if _, err := file.Seek(0, 0); err != nil {
+		return nil, fmt.Errorf("failed to seek %s: %w", name, err)
 	}
 
-	if err := os.Rename(tempOutputFile, outputFile); err != nil {
-		return false, fmt.Errorf("failed to rename temp file: %w", err)
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
 	}
 
-	return true, nil
+	return &Picture{
+		PictureType: 3, // Front Cover
+		MimeType:    "image/" + format,
+		Description: "",
+		Width:       uint32(cfg.Width),
+		Height:      uint32(cfg.Height),
+		Depth:       24, // Assuming 8 bits per RGB channel
+		Colors:      0,  // 0 for non-indexed images
+		Data:        data,
+	}, nil
 }
 
-func pruneOutput(inputRoot string, config Config) error {
-	// We need to walk the output tree in reverse order (contents before directories)
-	// to effectively remove empty directories. However, WalkDir doesn't support reverse.
-	// So we'll remove files first, then do a second pass for directories or handle dirs specially.
-	// Actually, standard WalkDir is fine, we just can't delete the *current* dir while walking it easily
-	// unless we use filepath.Walk (which processes children).
-	// A simpler approach for empty dirs: remove them if os.Remove succeeds (it fails if not empty).
-
-	// Collect directories to try removing later (depth-first simulated by sorting length desc)
-	var dirsToRemove []string
-
-	outputRoot := config.ConvertOpus
-
-	err := filepath.WalkDir(outputRoot, func(path string, d os.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
+// lmsCheck is a known LMS gotcha. It inspects the tags of a file (keys in
+// upper case) and returns an actionable message per problem.
+type lmsCheck func(tags map[string][]string) []string
 
-		if d.IsDir() {
-			// Skip hidden directories (like .stfolder)
-			if strings.HasPrefix(d.Name(), ".") && path != outputRoot {
-				return filepath.SkipDir
-			}
-			if path != outputRoot {
-				dirsToRemove = append(dirsToRemove, path)
+// lmsChecks are run by --lms-lint; add new checks here.
+var lmsChecks = []lmsCheck{
+	func(tags map[string][]string) []string {
+		for _, v := range tags["COMPILATION"] {
+			if v != "1" {
+				return []string{fmt.Sprintf("COMPILATION is %q, LMS only recognizes \"1\"; set it to 1 or remove it", v)}
 			}
+		}
+		return nil
+	},
+	func(tags map[string][]string) []string {
+		dates, years := tags["DATE"], tags["YEAR"]
+		if len(dates) == 0 || len(years) == 0 {
 			return nil
 		}
-
-		// Clean up stale temp files
-		if strings.HasSuffix(path, ".opus.tmp") {
-			config.Log(LogVerbose, "Removing stale temp file: %s\n", path)
-			return os.Remove(path)
+		if !strings.HasPrefix(dates[0], years[0]) {
+			return []string{fmt.Sprintf("DATE %q and YEAR %q disagree, LMS may show either; keep only DATE", dates[0], years[0])}
 		}
-
-		// Check for orphans
-		if strings.EqualFold(filepath.Ext(path), ".opus") {
-			rel, err := filepath.Rel(outputRoot, path)
-			if err != nil {
-				return err
-			}
-			// Construct expected source path
-			base := strings.TrimSuffix(rel, filepath.Ext(rel))
-			expectedFlac := filepath.Join(inputRoot, base+".flac")
-
-			// Check existence (case-insensitive check would be better but expensive,
-			// relying on standard stat for now as we mirrored it)
-			if _, err := os.Stat(expectedFlac); os.IsNotExist(err) {
-				config.Log(LogVerbose, "Removing orphan: %s\n", path)
-				return os.Remove(path)
-			}
+		return nil
+	},
+	func(tags map[string][]string) []string {
+		if len(tags["ARTISTS"]) > 0 {
+			return []string{"LMS ignores ARTISTS; put each artist into its own ARTIST tag"}
 		}
 		return nil
-	})
+	},
+	func(tags map[string][]string) []string {
+		if n := len(tags["ALBUMARTIST"]); n > 1 {
+			return []string{fmt.Sprintf("%d ALBUMARTIST values split the album in LMS; keep a single value", n)}
+		}
+		return nil
+	},
+}
+
+type lintFinding struct {
+	path    string
+	message string
+}
+
+// lmsLinter collects the findings of lmsChecks.
+type lmsLinter struct {
+	mu       sync.Mutex
+	checked  int
+	findings []lintFinding
+}
+
+func (l *lmsLinter) Check(filename string) error {
+	f, err := readFlacMetadata(filename)
 	if err != nil {
 		return err
 	}
-
-	// Remove empty directories
-	// Sort by length descending to ensure subdirs are removed before parents
-	// This is a naive but effective way to handle depth-first deletion
-	// (Longer paths are deeper)
-	for i := 0; i < len(dirsToRemove); i++ {
-		for j := i + 1; j < len(dirsToRemove); j++ {
-			if len(dirsToRemove[i]) < len(dirsToRemove[j]) {
-				dirsToRemove[i], dirsToRemove[j] = dirsToRemove[j], dirsToRemove[i]
-			}
-		}
+	tags, err := readTagMap(f)
+	if err != nil {
+		return err
 	}
 
-	for _, dir := range dirsToRemove {
-		// Attempt to remove. Will fail if not empty (which is what we want).
-		// We ignore error because "not empty" is a valid state.
-		os.Remove(dir)
+	var findings []lintFinding
+	for _, check := range lmsChecks {
+		for _, message := range check(tags) {
+			findings = append(findings, lintFinding{path: filename, message: message})
+		}
 	}
 
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.checked++
+	l.findings = append(l.findings, findings...)
 	return nil
 }
 
-func processPermissions(filename string, config Config) (bool, error) {
-	info, err := os.Stat(filename)
-	if err != nil {
-		return false, err
-	}
-	mode := info.Mode()
+func (l *lmsLinter) Print() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-	// Target permission: rw-r--r-- (0644)
-	// We check if current permissions differ from 0644.
-	// We mask with 0777 to ignore file type bits.
-	if mode.Perm() != 0o644 {
-		if config.Write {
-			config.Log(LogInfo, "Fixing permissions for %s (was %o)\n", filename, mode.Perm())
-			if err := os.Chmod(filename, 0o644); err != nil {
-				return false, fmt.Errorf("failed to chmod %s: %w", filename, err)
-			}
-			return true, nil
-		} else {
-			config.Log(LogInfo, "[DRY-RUN] Would fix permissions for %s (is %o)\n", filename, mode.Perm())
-			return true, nil
+	files := make(map[string]bool)
+	for _, f := range l.findings {
+		if !files[f.path] {
+			fmt.Printf("%s:\n", f.path)
+			files[f.path] = true
 		}
+		fmt.Printf("  %s\n", f.message)
 	}
-	return false, nil
+	fmt.Printf("Files with LMS issues: %d of %d\n", len(files), l.checked)
 }
 
-type FixStats struct {
-	MBIDsFixed       bool
-	CoverEmbedded    bool
-	PermissionsFixed bool
+// variousArtistsID is the MusicBrainz ID of "Various Artists", the
+// album artist of compilations, which shares no ID with the tracks.
+const variousArtistsID = "89ad4ac3-39f7-470e-963a-56509c546377"
+
+// mbidSearchPattern finds the MusicBrainz IDs in a value, also in
+// merged ones like "a+b".
+var mbidSearchPattern = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+
+// artistIDChecker collects the artist and album artist IDs per album
+// directory for --check-artist-ids.
+type artistIDChecker struct {
+	mu     sync.Mutex
+	albums map[string]*albumArtistIDs
 }
 
-func fixFlac(filename string, config Config) (FixStats, error) {
-	stats := FixStats{}
-	config.Log(LogVerbose, "Processing %s\n", filename)
+type albumArtistIDs struct {
+	artists      map[string]bool
+	albumArtists map[string]bool
+}
+
+func newArtistIDChecker() *artistIDChecker {
+	return &artistIDChecker{albums: make(map[string]*albumArtistIDs)}
+}
 
-	// Check/Fix Permissions
-	permFixed, err := processPermissions(filename, config)
+// Add records the IDs of filename for its album.
+func (c *artistIDChecker) Add(filename string) error {
+	f, err := readFlacMetadata(filename)
 	if err != nil {
-		return stats, err
-	}
-	if permFixed {
-		stats.PermissionsFixed = true
+		return err
 	}
-
-	f, err := flac.ParseFile(filename)
+	tags, err := readTagMap(f)
 	if err != nil {
-		return stats, fmt.Errorf("failed to parse flac file: %w", err)
+		return err
 	}
 
-	modified := false
-
-	if config.FixMBIDs {
-		m, err := processMBIDs(filename, f, config)
-		if err != nil {
-			return stats, err
-		}
-		if m {
-			modified = true
-			stats.MBIDsFixed = true
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dir := filepath.Dir(filename)
+	album := c.albums[dir]
+	if album == nil {
+		album = &albumArtistIDs{artists: make(map[string]bool), albumArtists: make(map[string]bool)}
+		c.albums[dir] = album
+	}
+	for key, ids := range map[string]map[string]bool{"MUSICBRAINZ_ARTISTID": album.artists, "MUSICBRAINZ_ALBUMARTISTID": album.albumArtists} {
+		for _, value := range tags[key] {
+			for _, id := range mbidSearchPattern.FindAllString(value, -1) {
+				ids[strings.ToLower(id)] = true
+			}
 		}
 	}
+	return nil
+}
 
-	if config.EmbedCover {
-		m, err := processCover(filename, f, config)
-		if err != nil {
-			return stats, err
+// Suspicious returns the album directories, sorted, that have both kinds
+// of IDs without one in common. Compilations by Various Artists are not
+// reported.
+func (c *artistIDChecker) Suspicious() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var dirs []string
+	for dir, album := range c.albums {
+		if len(album.artists) == 0 || len(album.albumArtists) == 0 || album.albumArtists[variousArtistsID] {
+			continue
 		}
-		if m {
-			modified = true
-			stats.CoverEmbedded = true
+		shared := false
+		for id := range album.albumArtists {
+			shared = shared || album.artists[id]
+		}
+		if !shared {
+			dirs = append(dirs, dir)
 		}
 	}
+	slices.Sort(dirs)
+	return dirs
+}
 
-	if !modified {
-		return stats, nil
+// Report warns about the suspicious albums.
+func (c *artistIDChecker) Report(config Config) {
+	dirs := c.Suspicious()
+	for _, dir := range dirs {
+		config.Log(LogWarn, "%s: MUSICBRAINZ_ALBUMARTISTID shares no ID with MUSICBRAINZ_ARTISTID of the tracks, check the album\n", dir)
 	}
-
-	if !config.Write {
-		config.Log(LogInfo, "[DRY-RUN] Changes detected for %s, but not saving.\n", filename)
-		return stats, nil
+	if len(dirs) > 0 {
+		config.Log(LogWarn, "Albums with suspicious artist IDs: %d\n", len(dirs))
 	}
+}
 
-	config.Log(LogInfo, "Saving changes to %s...\n", filename)
-	return stats, f.Save(filename)
+// coverCopier copies the cover file of each album next to its converted
+// files, for players that only read folder art.
+type coverCopier struct {
+	mu   sync.Mutex
+	done map[string]bool
 }
 
-func processMBIDs(filename string, f *flac.File, config Config) (bool, error) {
-	var cmtBlock *flac.MetaDataBlock
-	for _, block := range f.Meta {
-		if block.Type == flac.VorbisComment {
-			cmtBlock = block
-			break
-		}
+func newCoverCopier() *coverCopier {
+	return &coverCopier{done: make(map[string]bool)}
+}
+
+// Copy copies the cover file of the album of filename into the output
+// directory unless it was handled already or the copy is up to date.
+func (cc *coverCopier) Copy(filename string, inputRoot string, config Config) (bool, error) {
+	dir := filepath.Dir(filename)
+
+	cc.mu.Lock()
+	seen := cc.done[dir]
+	cc.done[dir] = true
+	cc.mu.Unlock()
+	if seen {
+		return false, nil
 	}
 
-	if cmtBlock == nil {
+	coverPath := config.coverFileIn(dir)
+	if coverPath == "" {
 		return false, nil
 	}
+	coverStat, err := os.Stat(coverPath)
+	if err != nil {
+		return false, err
+	}
 
-	cmts, err := ParseVorbisComment(cmtBlock.Data)
+	rel, err := relativeToRoot(inputRoot, coverPath)
 	if err != nil {
-		return false, fmt.Errorf("failed to parse vorbis comments: %w", err)
+		return false, err
+	}
+	outputPath := filepath.Join(config.ConvertOpus, rel)
+	if outStat, err := os.Stat(outputPath); err == nil && !coverStat.ModTime().After(outStat.ModTime()) {
+		return false, nil
 	}
 
-	// Tags we want to check and potentially merge
-	targetTags := config.MergeTags
+	if config.DryRun() {
+		config.Log(LogInfo, "[DRY-RUN] Would copy %s\n", rel)
+		return true, nil
+	}
 
-	// Helper to check if a tag is in our target list
-	isTarget := func(t string) bool {
-		return slices.Contains(targetTags, t)
+	data, err := os.ReadFile(coverPath)
+	if err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0o755); err != nil {
+		return false, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	config.Log(LogVerbose, "Copying %s\n", rel)
+	if err := os.WriteFile(outputPath, data, 0o644); err != nil {
+		return false, err
 	}
+	return true, nil
+}
 
-	// Map to store values for checking: tagKey -> []values
-	tagValues := make(map[string][]string)
+// coverExtractor tracks the album directories whose cover was extracted
+// by --extract-cover, so that each album is written once.
+type coverExtractor struct {
+	name string
+	mu   sync.Mutex
+	done map[string]bool
+}
 
-	// Identify target tags and collect their values
-	for _, t := range targetTags {
-		tagValues[t] = []string{}
+func newCoverExtractor(name string) *coverExtractor {
+	return &coverExtractor{name: name, done: make(map[string]bool)}
+}
+
+// pictureExtensions maps picture MIME types to file extensions.
+var pictureExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/jpg":  ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// hasPictureExtension reports whether name has the extension of
+// mimeType, counting .jpeg as .jpg.
+func hasPictureExtension(name, mimeType string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext == ".jpeg" {
+		ext = ".jpg"
 	}
+	return pictureExtensions[mimeType] == ext
+}
 
-	newComments := []string{}
+// coverFileName returns name with the extension of the MIME type, e.g.
+// cover.png for cover.jpg and image/png. Unknown types keep the name.
+func coverFileName(name, mimeType string) string {
+	ext, ok := pictureExtensions[strings.ToLower(mimeType)]
+	if !ok {
+		return name
+	}
+	current := strings.ToLower(filepath.Ext(name))
+	if current == ext || (ext == ".jpg" && current == ".jpeg") {
+		return name
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name)) + ext
+}
 
-	// First pass: collect values for target tags and track others
-	for _, c := range cmts.Comments {
-		parts := strings.SplitN(c, "=", 2)
-		if len(parts) != 2 {
-			newComments = append(newComments, c)
+// extractCover writes the embedded front cover of f next to filename,
+// named after --extract-cover or --cover-name. Albums that already have
+// the file are skipped. It reports whether a cover was written.
+func extractCover(filename string, f *flac.File, ce *coverExtractor, config Config) (bool, error) {
+	dir := filepath.Dir(filename)
+	ce.mu.Lock()
+	seen := ce.done[dir]
+	ce.mu.Unlock()
+	if seen {
+		return false, nil
+	}
+
+	var pic *Picture
+	for _, block := range f.Meta {
+		if t, ok := pictureType(block); !ok || t != pictureTypeFrontCover {
 			continue
 		}
+		p, err := ParsePicture(block.Data)
+		if err != nil {
+			config.Log(LogWarn, "%s: Ignoring broken embedded cover: %v\n", filename, err)
+			continue
+		}
+		if p.MimeType == "-->" {
+			// Only a link to the image
+			continue
+		}
+		if p.Description == placeholderDescription || p.Description == thumbnailDescription {
+			// Not the album's cover
+			continue
+		}
+		pic = p
+		break
+	}
+	if pic == nil {
+		config.Log(LogVerbose, "%s: No embedded front cover\n", filename)
+		return false, nil
+	}
 
-		key := strings.ToUpper(parts[0])
-		val := parts[1]
-
-		if isTarget(key) {
-			tagValues[key] = append(tagValues[key], val)
-		} else {
-			if strings.HasPrefix(key, "MUSICBRAINZ_") {
-				// Track other MB tags for warning checks
-				tagValues[key] = append(tagValues[key], val)
-			}
-			newComments = append(newComments, c)
+	coverPath := filepath.Join(dir, coverFileName(ce.name, pic.MimeType))
+	for _, p := range []string{filepath.Join(dir, ce.name), coverPath} {
+		if _, err := os.Stat(p); err == nil {
+			config.Log(LogVerbose, "Skipping (exists): %s\n", p)
+			ce.markDone(dir)
+			return false, nil
 		}
 	}
+	ce.markDone(dir)
 
-	modified := false
+	if config.DryRun() {
+		config.Log(LogInfo, "[DRY-RUN] Would extract cover to %s\n", coverPath)
+		return true, nil
+	}
+	config.Log(LogInfo, "Extracting cover to %s (%dx%d)\n", coverPath, pic.Width, pic.Height)
+	if err := os.WriteFile(coverPath, pic.Data, 0o644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
 
-	// Check for warnings on non-target MB tags
-	for key, values := range tagValues {
-		if !isTarget(key) && len(values) > 1 {
-			config.Log(LogWarn, "%s: Multiple values found for %s (Count: %d). This might confuse LMS.\n", filename, key, len(values))
-		}
+// syncAlbumCover extracts the embedded front cover of filename for
+// --sync-cover, or else that of another FLAC file in its directory, so
+// that the tracks without one get the cover embedded too. It reports
+// whether a cover was extracted.
+func syncAlbumCover(filename string, config Config) (bool, error) {
+	f, err := readFlacMetadata(filename)
+	if err != nil {
+		return false, err
+	}
+	if extracted, err := extractCover(filename, f, config.CoverSync, config); err != nil || config.CoverSync.isDone(filepath.Dir(filename)) {
+		return extracted, err
 	}
 
-	// Second pass: append processed tags
-	for _, t := range targetTags {
-		ids := tagValues[t]
-		if len(ids) > 0 {
-			if len(ids) > 1 {
-				config.Log(LogInfo, "%s: Merging %d %s\n", filename, len(ids), t)
-				combined := strings.Join(ids, "+")
-				newComments = append(newComments, t+"="+combined)
-				modified = true
-			} else {
-				// Just one, keep it as is
-				newComments = append(newComments, t+"="+ids[0])
-			}
+	entries, err := os.ReadDir(filepath.Dir(filename))
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		other := filepath.Join(filepath.Dir(filename), entry.Name())
+		if other == filename || entry.IsDir() || !isFlacFile(other) {
+			continue
+		}
+		f, err := readFlacMetadata(other)
+		if err != nil {
+			config.Log(LogVerbose, "%s: Not reading the cover: %v\n", other, err)
+			continue
+		}
+		if extracted, err := extractCover(other, f, config.CoverSync, config); err != nil || config.CoverSync.isDone(filepath.Dir(filename)) {
+			return extracted, err
 		}
 	}
+	return false, nil
+}
+
+func (ce *coverExtractor) isDone(dir string) bool {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	return ce.done[dir]
+}
+
+func (ce *coverExtractor) markDone(dir string) {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	ce.done[dir] = true
+}
+
+// thumbnailQuality is the JPEG quality of generated thumbnails.
+const thumbnailQuality = 85
+
+// thumbnailer writes a downscaled copy of the cover file once per album
+// directory.
+type thumbnailer struct {
+	size int
+	mu   sync.Mutex
+	done map[string]bool
+}
 
-	if modified {
-		cmts.Comments = newComments
-		newBody := cmts.Marshal()
-		cmtBlock.Data = newBody
-	}
+func newThumbnailer(size int) *thumbnailer {
+	return &thumbnailer{size: size, done: make(map[string]bool)}
+}
 
-	return modified, nil
+// thumbnailName returns the thumbnail file name for a cover file name,
+// e.g. cover_300.jpg for cover.jpg.
+func thumbnailName(coverName string, size int) string {
+	return fmt.Sprintf("%s_%d.jpg", strings.TrimSuffix(coverName, filepath.Ext(coverName)), size)
 }
 
-func processCover(filename string, f *flac.File, config Config) (bool, error) {
-	for _, block := range f.Meta {
-		if block.Type == flac.Picture {
-			// Already has a picture
-			return false, nil
-		}
+// Generate creates the thumbnail for the album of filename unless it was
+// handled already or the thumbnail is newer than the cover.
+func (th *thumbnailer) Generate(filename string, config Config) (bool, error) {
+	dir := filepath.Dir(filename)
+
+	th.mu.Lock()
+	seen := th.done[dir]
+	th.done[dir] = true
+	th.mu.Unlock()
+	if seen {
+		return false, nil
 	}
 
-	// No picture found, look for cover.jpg
-	dir := filepath.Dir(filename)
-	coverPath := filepath.Join(dir, config.CoverName)
+	coverPath := config.coverFileIn(dir)
+	if coverPath == "" {
+		config.Log(LogVerbose, "%s: No %s found\n", dir, config.coverNamesText())
+		return false, nil
+	}
+	coverName := filepath.Base(coverPath)
+	coverStat, err := os.Stat(coverPath)
+	if err != nil {
+		return false, err
+	}
 
-	if _, err := os.Stat(coverPath); os.IsNotExist(err) {
-		config.Log(LogWarn, "%s: No embedded cover and no %s found\n", filename, config.CoverName)
+	thumbPath := filepath.Join(dir, thumbnailName(coverName, th.size))
+	if thumbStat, err := os.Stat(thumbPath); err == nil && thumbStat.ModTime().After(coverStat.ModTime()) {
+		config.Log(LogVerbose, "Skipping (up to date): %s\n", thumbPath)
 		return false, nil
 	}
 
-	// Found cover.jpg, embed it
-	config.Log(LogInfo, "%s: Embedding %s\n", filename, config.CoverName)
+	if config.DryRun() {
+		config.Log(LogInfo, "[DRY-RUN] Would generate %s\n", thumbPath)
+		return true, nil
+	}
 
 	file, err := os.Open(coverPath)
 	if err != nil {
-		return false, fmt.Errorf("failed to open %s: %w", config.CoverName, err)
+		return false, fmt.Errorf("failed to open %s: %w", coverName, err)
 	}
 	defer file.Close()
 
-	// Decode config to get dimensions
-	cfg, _, err := image.DecodeConfig(file)
+	img, _, err := image.Decode(file)
 	if err != nil {
-		return false, fmt.Errorf("failed to decode %s config: %w", config.CoverName, err)
+		return false, fmt.Errorf("failed to decode %s: %w", coverName, err)
 	}
 
-	// Reset file pointer to read data
-	if _, err := file.Seek(0, 0); err != nil {
-		return false, fmt.Errorf("failed to seek %s: %w", config.CoverName, err)
+	width, height := fitDimensions(img.Bounds().Dx(), img.Bounds().Dy(), th.size)
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, scaleImage(img, width, height), &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		return false, fmt.Errorf("failed to encode thumbnail: %w", err)
 	}
 
-	data, err := io.ReadAll(file)
-	if err != nil {
-		return false, fmt.Errorf("failed to read %s: %w", config.CoverName, err)
+	config.Log(LogInfo, "Generating %s (%dx%d)\n", thumbPath, width, height)
+	if err := os.WriteFile(thumbPath, buf.Bytes(), 0o644); err != nil {
+		return false, fmt.Errorf("failed to write thumbnail: %w", err)
 	}
+	return true, nil
+}
 
-	pic := &Picture{
-		PictureType: 3, // Front Cover
-		MimeType:    "image/jpeg",
-		Description: "",
-		Width:       uint32(cfg.Width),
-		Height:      uint32(cfg.Height),
-		Depth:       24, // Assuming standard JPEG
-		Colors:      0,  // 0 for JPEG
-		Data:        data,
+// fitDimensions scales width and height down so that the longer edge is
+// at most maxDim, keeping the aspect ratio. Smaller images are unchanged.
+func fitDimensions(width, height, maxDim int) (int, int) {
+	if width <= maxDim && height <= maxDim {
+		return width, height
+	}
+	if width >= height {
+		return maxDim, max(1, height*maxDim/width)
 	}
+	return max(1, width*maxDim/height), maxDim
+}
 
-	block := &flac.MetaDataBlock{
-		Type: flac.Picture,
-		Data: pic.Marshal(),
+// scaleImage resizes img to width x height by averaging the source pixels
+// covered by each target pixel (box filter), which gives good results for
+// downscaling.
+func scaleImage(img image.Image, width, height int) *image.RGBA {
+	src := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := range height {
+		y0 := src.Min.Y + y*src.Dy()/height
+		y1 := max(y0+1, src.Min.Y+(y+1)*src.Dy()/height)
+		for x := range width {
+			x0 := src.Min.X + x*src.Dx()/width
+			x1 := max(x0+1, src.Min.X+(x+1)*src.Dx()/width)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(b / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
 	}
+	return dst
+}
 
-	f.Meta = append(f.Meta, block)
-	return true, nil
+// coverAspect returns the ratio of the longer to the shorter edge.
+func coverAspect(width, height int) float64 {
+	if width <= 0 || height <= 0 {
+		return 0
+	}
+	return float64(max(width, height)) / float64(min(width, height))
 }
 
-func runWithProgress(path string, info os.FileInfo, config Config) error {
+// runWithProgress processes path with the progress bar and returns the
+// stats of the run.
+func runWithProgress(path string, info os.FileInfo, config Config) (Stats, error) {
 	msgChan := make(chan tea.Msg, 100)
 	prog := progress.New(progress.WithDefaultGradient())
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	abort, kill := context.WithCancel(context.Background())
+	defer kill()
+	config.Abort = abort
+
 	m := model{
 		state:    stateCounting,
 		progress: prog,
@@ -689,155 +6565,505 @@ func runWithProgress(path string, info os.FileInfo, config Config) error {
 		path:     path,
 		info:     info,
 		config:   config,
+		ctx:      ctx,
+		cancel:   cancel,
+		kill:     kill,
 	}
 
 	p := tea.NewProgram(m)
 	finalModel, err := p.Run()
 	if err != nil {
-		return err
+		return Stats{}, err
 	}
 
 	// Print Summary
-	if finalM, ok := finalModel.(model); ok && finalM.total > 0 {
+	finalM, ok := finalModel.(model)
+	if ok && finalM.total > 0 {
 		if finalM.interrupted {
 			fmt.Println("Processing Interrupted!")
+		} else if finalM.stopReason != "" {
+			fmt.Println("Processing Stopped!")
 		} else {
 			fmt.Println("Processing Complete.")
 		}
 		fmt.Printf("Files Processed: %d / %d\n", finalM.processed, finalM.total)
+		printSummary(finalM.stats, config)
 
-		if config.ConvertOpus != "" {
-			fmt.Printf("Files Converted to Opus: %d\n", finalM.stats.converted)
-		} else {
-			if config.FixMBIDs {
-				fmt.Printf("Files with MB IDs Fixed: %d\n", finalM.stats.mbMerged)
-			}
-			if config.EmbedCover {
-				fmt.Printf("Files with Covers Embedded: %d\n", finalM.stats.coverEmbedded)
-			}
-			if finalM.stats.permissionsFixed > 0 {
-				fmt.Printf("Files with Permissions Fixed: %d\n", finalM.stats.permissionsFixed)
-			}
+		if finalM.interrupted {
+			return finalM.stats, fmt.Errorf("processing stopped: %w", errInterrupted)
+		}
+		if finalM.stopReason != "" {
+			return finalM.stats, fmt.Errorf("processing stopped: %s", finalM.stopReason)
+		}
+		if finalM.stats.failed > 0 {
+			return finalM.stats, fmt.Errorf("%d files failed", finalM.stats.failed)
 		}
 	}
 
-	return nil
+	return finalM.stats, nil
 }
 
-func countFlacFiles(path string, info os.FileInfo) (int, error) {
-	if !info.IsDir() {
-		if strings.EqualFold(filepath.Ext(path), ".flac") {
-			return 1, nil
+// printSummary prints the results of the run for the selected mode.
+func printSummary(stats Stats, config Config) {
+	if config.ConvertOpus != "" {
+		fmt.Printf("Files Converted to %s: %d\n", config.convertFormat().Name, stats.converted)
+		if stats.inputBytes > stats.outputBytes {
+			saved := stats.inputBytes - stats.outputBytes
+			fmt.Printf("Space Saved: %s (%.0f%% reduction)\n", formatBytes(saved), 100*float64(saved)/float64(stats.inputBytes))
+		}
+		if config.OpusTagsOnly {
+			fmt.Printf("Opus Files with Tags Updated: %d\n", stats.opusTagsUpdated)
+		}
+		if stats.budgetSkipped > 0 {
+			fmt.Printf("Files Skipped (size budget reached): %d\n", stats.budgetSkipped)
+		}
+		if stats.encodeTimedOut > 0 {
+			fmt.Printf("Files Skipped (encoder timed out): %d\n", stats.encodeTimedOut)
+		}
+		if config.VerifyOpus {
+			fmt.Printf("Files Skipped (output does not decode): %d\n", stats.verifyFailed)
+		}
+		if config.CoverCopies != nil {
+			fmt.Printf("Covers Copied: %d\n", stats.coversCopied)
+		}
+	} else if config.RetagOpus != "" {
+		fmt.Printf("Files Retagged from Opus: %d\n", stats.retagged)
+	} else if config.Bitrates != nil {
+		config.Bitrates.Print()
+	} else if config.Thumbnails != nil {
+		fmt.Printf("Thumbnails Generated: %d\n", stats.thumbnails)
+	} else if config.Lint != nil {
+		config.Lint.Print()
+	} else if config.AudioInfo != nil {
+		config.AudioInfo.Print()
+	} else if config.TagList != nil {
+		config.TagList.Print()
+	} else if config.AlbumSummary != nil {
+		config.AlbumSummary.Print()
+	} else if config.CoverExtracts != nil {
+		fmt.Printf("Covers Extracted: %d\n", stats.coversExtracted)
+	} else {
+		if config.FixMBIDs {
+			fmt.Printf("Files with MB IDs Fixed: %d\n", stats.mbMerged)
+			for _, tag := range config.MergeTags {
+				if n := stats.tagMerges[tag]; n > 0 {
+					fmt.Printf("  %s: %d\n", tag, n)
+				}
+			}
+		}
+		if config.EmbedCover {
+			fmt.Printf("Files with Covers Embedded: %d\n", stats.coverEmbedded)
+		}
+		if config.CoverSync != nil {
+			fmt.Printf("Covers Extracted: %d\n", stats.coversExtracted)
+		}
+		if config.EmbedThumbnail > 0 {
+			fmt.Printf("Files with Thumbnails Embedded: %d\n", stats.thumbnailsEmbedded)
+		}
+		if config.TrackUID {
+			fmt.Printf("Files with %s Set: %d\n", trackUIDTag, stats.trackUIDs)
+		}
+		if config.NormalizeKeys {
+			fmt.Printf("Files with Keys Normalized: %d\n", stats.keysNormalized)
+		}
+		if len(config.StripTags) > 0 {
+			fmt.Printf("Files with Tags Stripped: %d\n", stats.tagsStripped)
+		}
+		if config.DedupTags {
+			fmt.Printf("Files with Duplicate Tags Removed: %d\n", stats.tagsDeduplicated)
+		}
+		if config.TrimValues {
+			fmt.Printf("Files with Tag Values Trimmed: %d\n", stats.valuesTrimmed)
+		}
+		if config.DropEmpty {
+			fmt.Printf("Files with Empty Tags Removed: %d\n", stats.emptyDropped)
+		}
+		if len(config.SetTags) > 0 {
+			fmt.Printf("Files with Tags Set: %d\n", stats.tagsSet)
+		}
+		if len(config.RenameTags) > 0 {
+			fmt.Printf("Files with Tags Renamed: %d\n", stats.tagsRenamed)
+		}
+		if len(config.ASCIIFold) > 0 {
+			fmt.Printf("Files with Tags Folded: %d\n", stats.tagsFolded)
+		}
+		if config.ReplayGainPrefer != "" {
+			fmt.Printf("Files with Gain Tags Removed: %d\n", stats.gainTagsRemoved)
+		}
+		if config.Compact {
+			fmt.Printf("Files Compacted: %d (%s reclaimed)\n", stats.compacted, formatBytes(stats.bytesReclaimed))
+		}
+		if stats.permissionsFixed > 0 {
+			fmt.Printf("Files with Permissions Fixed: %d\n", stats.permissionsFixed)
+		}
+		if config.Verify {
+			fmt.Printf("Files Failing Verification (not saved): %d\n", stats.verifyFailed)
+		}
+		if stats.touched > 0 {
+			fmt.Printf("Touched %d tracks across %d albums and %d artists\n", stats.touched, len(stats.albums), len(stats.artists))
+		}
+	}
+	if stats.pathTooLong > 0 {
+		fmt.Printf("Paths Skipped (too long): %d\n", stats.pathTooLong)
+	}
+	if stats.failed > 0 {
+		fmt.Printf("Files Failed: %d\n", stats.failed)
+		for _, f := range stats.failures {
+			fmt.Printf("  %s: %v\n", f.Path, f.Err)
 		}
-		return 0, nil
 	}
+}
 
-	count := 0
-	err := filepath.WalkDir(path, func(path string, d os.DirEntry, err error) error {
-		if err != nil {
-			return err
+// flacFileList is the result of a single walk of the input: the files
+// to process and the directories skipped for exceeding the path limits.
+type flacFileList struct {
+	files   []string
+	sizes   []int64 // Of the files, only with --progress-by-size
+	skipped []skippedPath
+}
+
+// measure sets the sizes of the files. Files that cannot be read count
+// as empty.
+func (l *flacFileList) measure() {
+	l.sizes = make([]int64, len(l.files))
+	for i, path := range l.files {
+		if info, err := os.Stat(path); err == nil {
+			l.sizes[i] = info.Size()
 		}
-		if !d.IsDir() && strings.EqualFold(filepath.Ext(path), ".flac") {
-			count++
+	}
+}
+
+// skippedPath is a directory walkFlacFiles could not read.
+type skippedPath struct {
+	path string
+	err  error
+}
+
+// listFlacFiles walks path once and returns the files to process, so
+// the total of a run is known up front without walking the tree twice.
+// A single file is listed if it matches opts.
+func listFlacFiles(path string, info os.FileInfo, opts walkOptions) (flacFileList, error) {
+	var list flacFileList
+	if !info.IsDir() {
+		if opts.matches(path) {
+			list.files = []string{path}
 		}
+		return list, nil
+	}
+
+	err := walkFlacFiles(path, opts, func(skippedDir string, err error) {
+		list.skipped = append(list.skipped, skippedPath{skippedDir, err})
+	}, func(filePath string) error {
+		list.files = append(list.files, filePath)
 		return nil
 	})
-	return count, err
+	return list, err
 }
 
-// processFiles is the worker function that processes the files
-func processFiles(path string, info os.FileInfo, config Config, msgChan chan tea.Msg) {
-	defer func() { msgChan <- doneMsg{} }()
+// ignoreFileName marks a directory to be skipped. An empty file excludes
+// the whole subtree, otherwise each line is a glob pattern matched against
+// the paths below the directory (or their base names).
+const ignoreFileName = ".fixflacignore"
+
+// walkOptions controls which files walkFlacFiles visits.
+type walkOptions struct {
+	Limit          int       // Stop after that many files if positive
+	FollowSymlinks bool      // Descend into symlinked directories
+	Extensions     []string  // Extensions of the files to visit; nil means .flac
+	Since          time.Time // Skip files modified before it if set
+}
 
-	// Custom logger for config
-	config.LogFunc = func(level LogLevel, format string, args ...any) {
-		if level == LogInfo || level == LogWarn {
-			msgChan <- statusMsg(fmt.Sprintf(format, args...))
+// walkOptions returns the walk options of the run.
+func (c Config) walkOptions() walkOptions {
+	return walkOptions{Limit: c.Limit, FollowSymlinks: c.FollowSymlinks, Extensions: c.inputExtensions(), Since: c.Since}
+}
+
+// sinceLayouts are the time formats --since accepts, in local time
+// unless they carry a zone.
+var sinceLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+// parseSince parses a --since value: a duration before now like "36h",
+// a number of days like "7d", or a point in time like "2024-05-01".
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		if d < 0 {
+			return time.Time{}, fmt.Errorf("negative duration %q", s)
+		}
+		return now.Add(-d), nil
+	}
+	for _, layout := range sinceLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
 		}
 	}
+	return time.Time{}, fmt.Errorf("expected a duration like 24h or 7d, or a time like 2024-05-01, got %q", s)
+}
 
-	if info.IsDir() {
-		absInputRoot, err := filepath.Abs(path)
+// matches reports whether path has one of the extensions to visit.
+func (o walkOptions) matches(path string) bool {
+	if len(o.Extensions) == 0 {
+		return isFlacFile(path)
+	}
+	return hasExtension(path, o.Extensions)
+}
+
+// walkFlacFiles calls fn for every FLAC file (or file of the other
+// extensions in opts) below root, honoring ignore files. Paths exceeding
+// the system limits are passed to skipped, if set, and the walk goes on.
+//
+// With FollowSymlinks, symlinked directories are walked under their
+// link path. Directories and files are visited once by their resolved
+// path, which also stops symlink loops.
+func walkFlacFiles(root string, opts walkOptions, skipped func(path string, err error), fn func(filePath string) error) error {
+	// Directory -> patterns of its ignore file
+	ignores := make(map[string][]string)
+	visited := 0
+	// Resolved paths seen with FollowSymlinks
+	seen := make(map[string]bool)
+	// Set once the walk is stopped, which nested walks must pass on
+	stopped := false
+
+	skipTooLong := func(path string, d os.DirEntry, err error) error {
+		if skipped != nil {
+			skipped(path, err)
+		}
+		if d != nil && d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+
+	// firstVisit reports whether the resolved path was not seen before
+	firstVisit := func(path string) (bool, error) {
+		real, err := filepath.EvalSymlinks(path)
 		if err != nil {
-			config.Log(LogWarn, "Error getting absolute path: %v\n", err)
-			return
+			return false, err
+		}
+		if seen[real] {
+			return false, nil
 		}
+		seen[real] = true
+		return true, nil
+	}
+
+	// walk walks dir, reporting paths below it as paths below link
+	var walk func(dir, link string) error
+	walk = func(dir, link string) error {
+		return filepath.WalkDir(dir, func(filePath string, d os.DirEntry, err error) error {
+			if link != dir {
+				rel, relErr := filepath.Rel(dir, filePath)
+				if relErr != nil {
+					return relErr
+				}
+				filePath = filepath.Join(link, rel)
+			}
 
-		err = filepath.WalkDir(path, func(filePath string, d os.DirEntry, err error) error {
 			if err != nil {
+				if isPathTooLong(err) && filePath != root {
+					return skipTooLong(filePath, d, err)
+				}
 				return err
 			}
-			if !d.IsDir() && strings.EqualFold(filepath.Ext(filePath), ".flac") {
-				stats := StatsMsg{}
-				var processingErr error
 
-				if config.ConvertOpus != "" {
-					converted, err := convertOpus(filePath, absInputRoot, config)
-					processingErr = err
-					if converted {
-						stats.Converted = true
+			if isIgnored(filePath, root, ignores) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if opts.FollowSymlinks && d.Type()&fs.ModeSymlink != 0 {
+				// Broken links are left to fn like before
+				if info, err := os.Stat(filePath); err == nil && info.IsDir() {
+					target, err := filepath.EvalSymlinks(filePath)
+					if err != nil {
+						return err
 					}
-				} else {
-					fs, err := fixFlac(filePath, config)
-					processingErr = err
-					if fs.MBIDsFixed {
-						stats.MBMerged = true
+					if err := walk(target, filePath); err != nil || !stopped {
+						return err
 					}
-					if fs.CoverEmbedded {
-						stats.CoverEmbedded = true
+					return filepath.SkipAll
+				}
+			}
+
+			if d.IsDir() {
+				if opts.FollowSymlinks {
+					first, err := firstVisit(filePath)
+					if err != nil {
+						return err
 					}
-					if fs.PermissionsFixed {
-						stats.PermissionsFixed = true
+					if !first {
+						return filepath.SkipDir
 					}
 				}
-
-				if processingErr != nil {
-					config.Log(LogWarn, "Error processing %s: %v\n", filePath, processingErr)
+				patterns, found, err := readIgnoreFile(filePath)
+				if isPathTooLong(err) {
+					return skipTooLong(filePath, d, err)
 				}
+				if err != nil {
+					return err
+				}
+				if found {
+					if len(patterns) == 0 {
+						return filepath.SkipDir
+					}
+					ignores[filePath] = patterns
+				}
+				return nil
+			}
 
-				// Send stats update
-				msgChan <- stats
+			if !opts.matches(filePath) {
+				return nil
 			}
-			return nil
+			if opts.FollowSymlinks {
+				// A broken link fails when fn opens it
+				if first, err := firstVisit(filePath); err == nil && !first {
+					return nil
+				}
+			}
+			if !opts.Since.IsZero() {
+				// A broken link is left to fn, like above
+				if info, err := os.Stat(filePath); err == nil && info.ModTime().Before(opts.Since) {
+					return nil
+				}
+			}
+			if opts.Limit > 0 && visited >= opts.Limit {
+				stopped = true
+				return filepath.SkipAll
+			}
+			visited++
+			err = fn(filePath)
+			if err == filepath.SkipAll {
+				stopped = true
+			}
+			return err
 		})
-		if err != nil {
-			config.Log(LogWarn, "Error walking directory: %v\n", err)
+	}
+	return walk(root, root)
+}
+
+// readIgnoreFile reads the patterns of the ignore file in dir, skipping
+// blank lines and comments.
+func readIgnoreFile(dir string) ([]string, bool, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ignoreFileName))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	var patterns []string
+	for line := range strings.Lines(string(data)) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
 		}
+		patterns = append(patterns, strings.TrimSuffix(line, "/"))
+	}
+	return patterns, true, nil
+}
 
-		if config.ConvertOpus != "" && !config.NoPrune {
-			if err := pruneOutput(absInputRoot, config); err != nil {
-				config.Log(LogWarn, "Error pruning output: %v\n", err)
+// isIgnored checks filePath against the ignore patterns of all its parent
+// directories up to root.
+func isIgnored(filePath string, root string, ignores map[string][]string) bool {
+	if len(ignores) == 0 || filePath == root {
+		return false
+	}
+	for dir := filepath.Dir(filePath); ; dir = filepath.Dir(dir) {
+		if patterns, ok := ignores[dir]; ok {
+			rel, err := filepath.Rel(dir, filePath)
+			if err == nil {
+				for _, p := range patterns {
+					if m, _ := filepath.Match(p, rel); m {
+						return true
+					}
+					if m, _ := filepath.Match(p, filepath.Base(filePath)); m {
+						return true
+					}
+				}
 			}
 		}
+		if dir == root || dir == filepath.Dir(dir) {
+			return false
+		}
+	}
+}
 
-	} else {
-		// Single file
-		stats := StatsMsg{}
-		var processingErr error
+// errInterrupted stops a run that was interrupted by the user.
+var errInterrupted = errors.New("interrupted")
 
-		if config.ConvertOpus != "" {
-			absInputRoot := filepath.Dir(path)
-			converted, err := convertOpus(path, absInputRoot, config)
-			processingErr = err
-			if converted {
-				stats.Converted = true
+// processFiles is the worker function that processes the files of list,
+// or path itself if it is a single file. Once ctx is canceled no further
+// file is started.
+func processFiles(ctx context.Context, path string, info os.FileInfo, list flacFileList, config Config, msgChan chan tea.Msg) {
+	defer func() { msgChan <- doneMsg{} }()
+
+	// Custom logger for config
+	config.LogFunc = func(level LogLevel, format string, args ...any) {
+		if level <= LogInfo {
+			msgChan <- statusMsg(fmt.Sprintf(format, args...))
+		}
+	}
+
+	if info.IsDir() {
+		absInputRoot, err := filepath.Abs(path)
+		if err != nil {
+			config.Log(LogError, "Error getting absolute path: %v\n", err)
+			return
+		}
+
+		for _, s := range list.skipped {
+			config.Log(LogWarn, "Skipping %s: path too long: %v\n", s.path, s.err)
+			msgChan <- skipMsg{}
+		}
+
+		failed := false
+		interrupted := processList(ctx, list.files, absInputRoot, config, func(filePath string, stats StatsMsg, err error) bool {
+			if errors.Is(err, errOutOfSpace) {
+				msgChan <- stopMsg(err.Error())
+				return false
 			}
-		} else {
-			fs, err := fixFlac(path, config)
-			processingErr = err
-			if fs.MBIDsFixed {
-				stats.MBMerged = true
+			if isPathTooLong(err) {
+				config.Log(LogWarn, "Skipping %s: path too long: %v\n", filePath, err)
+				stats.PathTooLong = true
+				err = nil
 			}
-			if fs.CoverEmbedded {
-				stats.CoverEmbedded = true
+			if err != nil {
+				stats.Failure = &fileFailure{Path: filePath, Err: err}
+				if config.FailFast {
+					failed = true
+					msgChan <- stats
+					msgChan <- stopMsg(fmt.Sprintf("processing %s: %v", filePath, err))
+					return false
+				}
+				config.Log(LogError, "Error processing %s: %v\n", filePath, err)
 			}
-			if fs.PermissionsFixed {
-				stats.PermissionsFixed = true
+
+			// Send stats update
+			msgChan <- stats
+			return true
+		})
+		// Interrupted runs leave the output alone like failed ones
+		failed = failed || interrupted
+
+		if config.mirrorRoot() != "" && !config.NoPrune && !failed {
+			if err := pruneOutput(absInputRoot, config); err != nil {
+				config.Log(LogError, "Error pruning output: %v\n", err)
 			}
 		}
 
-		if processingErr != nil {
-			config.Log(LogWarn, "Error processing %s: %v\n", path, processingErr)
+	} else {
+		// Single file
+		stats, err := processFile(path, singleFileRoot(path), config)
+		if err != nil {
+			stats.Failure = &fileFailure{Path: path, Err: err}
+			config.Log(LogError, "Error processing %s: %v\n", path, err)
 		}
 		msgChan <- stats
 	}
@@ -853,23 +7079,201 @@ const (
 	stateDone
 )
 
+// fileFailure is a file that could not be processed, listed in the
+// summary.
+type fileFailure struct {
+	Path string
+	Err  error
+}
+
 type Stats struct {
-	mbMerged         int
-	coverEmbedded    int
-	converted        int
-	permissionsFixed int
+	mbMerged           int
+	coverEmbedded      int
+	thumbnailsEmbedded int
+	converted          int
+	inputBytes         int64 // Size of the converted files
+	outputBytes        int64 // Size of their Opus files
+	opusTagsUpdated    int
+	retagged           int
+	budgetSkipped      int
+	encodeTimedOut     int
+	thumbnails         int
+	coversExtracted    int
+	coversCopied       int
+	permissionsFixed   int
+	tagMerges          map[string]int // Files per merged tag key
+	trackUIDs          int
+	keysNormalized     int
+	tagsStripped       int
+	tagsDeduplicated   int
+	valuesTrimmed      int
+	emptyDropped       int
+	tagsFolded         int
+	tagsRenamed        int
+	tagsSet            int
+	gainTagsRemoved    int
+	compacted          int
+	bytesReclaimed     int64
+	touched            int
+	failed             int
+	failures           []fileFailure // In the order of the run
+	pathTooLong        int
+	verifyFailed       int
+	albums             map[string]struct{}
+	artists            map[string]struct{}
+}
+
+// changed reports whether files were changed, or would have been in a
+// dry-run. Pruning is not counted.
+func (s Stats) changed() bool {
+	return s.touched > 0 || s.converted > 0 || s.opusTagsUpdated > 0 || s.retagged > 0 ||
+		s.thumbnails > 0 || s.coversExtracted > 0 || s.coversCopied > 0
+}
+
+// Add aggregates the result of a single file.
+func (s *Stats) Add(msg StatsMsg) {
+	if msg.MBMerged {
+		s.mbMerged++
+	}
+	if msg.TrackUIDSet {
+		s.trackUIDs++
+	}
+	if msg.KeysNormalized {
+		s.keysNormalized++
+	}
+	if msg.TagsStripped {
+		s.tagsStripped++
+	}
+	if msg.TagsDeduplicated {
+		s.tagsDeduplicated++
+	}
+	if msg.ValuesTrimmed {
+		s.valuesTrimmed++
+	}
+	if msg.EmptyDropped {
+		s.emptyDropped++
+	}
+	if msg.TagsRenamed {
+		s.tagsRenamed++
+	}
+	if msg.TagsFolded {
+		s.tagsFolded++
+	}
+	if msg.TagsSet {
+		s.tagsSet++
+	}
+	if msg.GainTagsRemoved {
+		s.gainTagsRemoved++
+	}
+	if msg.BytesReclaimed > 0 {
+		s.compacted++
+		s.bytesReclaimed += msg.BytesReclaimed
+	}
+	if msg.MBMerged || msg.CoverEmbedded || msg.ThumbnailEmbedded || msg.TrackUIDSet || msg.KeysNormalized || msg.TagsStripped || msg.TagsDeduplicated || msg.ValuesTrimmed || msg.EmptyDropped || msg.TagsSet || msg.TagsFolded || msg.TagsRenamed || msg.GainTagsRemoved || msg.BytesReclaimed > 0 || msg.PermissionsFixed {
+		s.touched++
+		if s.albums == nil {
+			s.albums = make(map[string]struct{})
+			s.artists = make(map[string]struct{})
+		}
+		if msg.Album != "" {
+			s.albums[msg.Album] = struct{}{}
+		}
+		for _, artist := range msg.Artists {
+			s.artists[artist] = struct{}{}
+		}
+	}
+	if msg.Failure != nil {
+		s.failed++
+		s.failures = append(s.failures, *msg.Failure)
+	}
+	if msg.PathTooLong {
+		s.pathTooLong++
+	}
+	if msg.VerifyFailed {
+		s.verifyFailed++
+	}
+	for _, tag := range msg.MergedTags {
+		if s.tagMerges == nil {
+			s.tagMerges = make(map[string]int)
+		}
+		s.tagMerges[tag]++
+	}
+	if msg.CoverEmbedded {
+		s.coverEmbedded++
+	}
+	if msg.ThumbnailEmbedded {
+		s.thumbnailsEmbedded++
+	}
+	if msg.PermissionsFixed {
+		s.permissionsFixed++
+	}
+	if msg.Converted {
+		s.converted++
+		s.inputBytes += msg.InputBytes
+		s.outputBytes += msg.OutputBytes
+	}
+	if msg.OpusTagsUpdated {
+		s.opusTagsUpdated++
+	}
+	if msg.Retagged {
+		s.retagged++
+	}
+	if msg.BudgetSkipped {
+		s.budgetSkipped++
+	}
+	if msg.EncodeTimedOut {
+		s.encodeTimedOut++
+	}
+	if msg.ThumbnailGenerated {
+		s.thumbnails++
+	}
+	if msg.CoverExtracted {
+		s.coversExtracted++
+	}
+	if msg.CoverCopied {
+		s.coversCopied++
+	}
 }
 
 type (
 	StatsMsg struct {
-		MBMerged         bool
-		CoverEmbedded    bool
-		Converted        bool
-		PermissionsFixed bool
+		MBMerged           bool
+		MergedTags         []string // Tag keys whose values were merged
+		TrackUIDSet        bool
+		KeysNormalized     bool
+		TagsStripped       bool
+		TagsDeduplicated   bool
+		ValuesTrimmed      bool
+		EmptyDropped       bool
+		TagsSet            bool
+		TagsFolded         bool
+		TagsRenamed        bool
+		GainTagsRemoved    bool
+		BytesReclaimed     int64
+		Album              string   // Album of a fixed file, see trackIdentity
+		Artists            []string // Artists of a fixed file
+		CoverEmbedded      bool
+		ThumbnailEmbedded  bool
+		Converted          bool
+		InputBytes         int64 // Size of a converted file
+		OutputBytes        int64 // Size of its Opus file
+		OpusTagsUpdated    bool
+		Retagged           bool
+		BudgetSkipped      bool
+		EncodeTimedOut     bool
+		ThumbnailGenerated bool
+		CoverExtracted     bool
+		CoverCopied        bool
+		PermissionsFixed   bool
+		VerifyFailed       bool
+		PathTooLong        bool         // Skipped for exceeding the path limits
+		Failure            *fileFailure // Processing the file returned an error
 	}
 	statusMsg string
+	stopMsg   string // The worker stopped early, with the reason
 	doneMsg   struct{}
-	countMsg  int
+	skipMsg   struct{}     // A directory was skipped, see walkFlacFiles
+	countMsg  flacFileList // The files found by the single walk
 	errMsg    error
 )
 
@@ -878,7 +7282,10 @@ type model struct {
 	progress    progress.Model
 	total       int
 	processed   int
+	totalBytes  int64 // With --progress-by-size
+	doneBytes   int64
 	interrupted bool
+	stopReason  string
 	stats       Stats // Aggregated stats
 	status      string
 	quitting    bool
@@ -887,26 +7294,34 @@ type model struct {
 	// Context for worker
 	path   string
 	info   os.FileInfo
+	files  flacFileList
 	config Config
+	ctx    context.Context
+	cancel context.CancelFunc // Stops the worker after the current file
+	kill   context.CancelFunc // Kills the encoders still running
+	killed bool
 }
 
 func (m model) Init() tea.Cmd {
-	return countFilesCmd(m.path, m.info)
+	return listFilesCmd(m.path, m.info, m.config.walkOptions(), m.config.ProgressBySize)
 }
 
-func countFilesCmd(path string, info os.FileInfo) tea.Cmd {
+func listFilesCmd(path string, info os.FileInfo, opts walkOptions, bySize bool) tea.Cmd {
 	return func() tea.Msg {
-		n, err := countFlacFiles(path, info)
+		list, err := listFlacFiles(path, info, opts)
 		if err != nil {
 			return errMsg(err)
 		}
-		return countMsg(n)
+		if bySize {
+			list.measure()
+		}
+		return countMsg(list)
 	}
 }
 
-func startWorkerCmd(sub chan tea.Msg, path string, info os.FileInfo, config Config) tea.Cmd {
+func startWorkerCmd(ctx context.Context, sub chan tea.Msg, path string, info os.FileInfo, list flacFileList, config Config) tea.Cmd {
 	return func() tea.Msg {
-		go processFiles(path, info, config, sub)
+		go processFiles(ctx, path, info, list, config, sub)
 		return nil
 	}
 }
@@ -921,6 +7336,19 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
 		if msg.String() == "ctrl+c" || msg.String() == "q" {
+			// Let the worker finish the current file, it reports done
+			// then; pressing the key again kills the encoders still
+			// running, a third time quits right away
+			if m.state == stateProcessing && !m.interrupted {
+				m.interrupted = true
+				m.cancel()
+				return m, nil
+			}
+			if m.state == stateProcessing && !m.killed {
+				m.killed = true
+				m.kill()
+				return m, nil
+			}
 			m.interrupted = true
 			m.quitting = true
 			return m, tea.Quit
@@ -930,17 +7358,26 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		return m, nil
 
 	case countMsg:
-		m.total = int(msg)
+		m.files = flacFileList(msg)
+		m.total = len(m.files.files)
+		for _, size := range m.files.sizes {
+			m.totalBytes += size
+		}
 		if m.total == 0 {
 			m.quitting = true
 			return m, tea.Quit
 		}
 		m.state = stateProcessing
 		return m, tea.Batch(
-			startWorkerCmd(m.sub, m.path, m.info, m.config),
+			startWorkerCmd(m.ctx, m.sub, m.path, m.info, m.files, m.config),
 			waitForActivity(m.sub),
 		)
 
+	case skipMsg:
+		// Not a counted file, so the progress stays
+		m.stats.pathTooLong++
+		return m, waitForActivity(m.sub)
+
 	case errMsg:
 		m.status = fmt.Sprintf("Error: %v", msg)
 		m.quitting = true
@@ -950,26 +7387,15 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		// Increment progress
 		if m.state == stateProcessing {
 			m.processed++
-			// Update aggregated stats
-			if msg.MBMerged {
-				m.stats.mbMerged++
-			}
-			if msg.CoverEmbedded {
-				m.stats.coverEmbedded++
-			}
-			if msg.PermissionsFixed {
-				m.stats.permissionsFixed++
-			}
-			if msg.Converted {
-				m.stats.converted++
+			// Files are reported in the order of the list
+			if m.processed <= len(m.files.sizes) {
+				m.doneBytes += m.files.sizes[m.processed-1]
 			}
+			// Update aggregated stats
+			m.stats.Add(msg)
 
 			// Update progress bar
-			pct := float64(m.processed) / float64(m.total)
-			if pct > 1.0 {
-				pct = 1.0
-			}
-			cmd := m.progress.SetPercent(pct)
+			cmd := m.progress.SetPercent(m.percent())
 			return m, tea.Batch(cmd, waitForActivity(m.sub))
 		}
 		return m, waitForActivity(m.sub)
@@ -978,6 +7404,10 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.status = strings.TrimSpace(string(msg))
 		return m, waitForActivity(m.sub)
 
+	case stopMsg:
+		m.stopReason = string(msg)
+		return m, waitForActivity(m.sub)
+
 	case doneMsg:
 		m.quitting = true
 		return m, tea.Quit
@@ -990,6 +7420,16 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	return m, nil
 }
 
+// percent returns the share of the run done, by files or, with
+// --progress-by-size, by bytes.
+func (m model) percent() float64 {
+	pct := float64(m.processed) / float64(m.total)
+	if m.totalBytes > 0 {
+		pct = float64(m.doneBytes) / float64(m.totalBytes)
+	}
+	return min(pct, 1.0)
+}
+
 func (m model) View() string {
 	if m.quitting {
 		return ""
@@ -1000,8 +7440,13 @@ func (m model) View() string {
 	}
 
 	s := fmt.Sprintf("Found %d FLAC files.\n", m.total)
+	if m.totalBytes > 0 {
+		s = fmt.Sprintf("Found %d FLAC files (%s).\n", m.total, formatBytes(m.totalBytes))
+	}
 	s += m.progress.View() + "\n"
-	if m.status != "" {
+	if m.interrupted {
+		s += "Stopping after the current file (press again to quit now)...\n"
+	} else if m.status != "" {
 		s += lipgloss.NewStyle().Foreground(lipgloss.Color("212")).Render(m.status) + "\n"
 	} else {
 		s += "\n" // Keep layout stable
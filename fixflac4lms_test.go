@@ -1,12 +1,32 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"maps"
+	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/charmbracelet/bubbles/progress"
+	tea "github.com/charmbracelet/bubbletea"
 	"github.com/go-flac/go-flac"
 )
 
@@ -92,6 +112,42 @@ func TestPictureMarshal(t *testing.T) {
 	}
 }
 
+func TestParsePicture(t *testing.T) {
+	pic := &Picture{
+		PictureType: 3,
+		MimeType:    "image/jpeg",
+		Description: "Cover",
+		Width:       500,
+		Height:      400,
+		Depth:       24,
+		Colors:      0,
+		Data:        []byte{0x01, 0x02, 0x03, 0x04},
+	}
+	data := pic.Marshal()
+
+	parsed, err := ParsePicture(data)
+	if err != nil {
+		t.Fatalf("ParsePicture failed: %v", err)
+	}
+	if !reflect.DeepEqual(parsed, pic) {
+		t.Errorf("Round trip mismatch: got %+v, want %+v", parsed, pic)
+	}
+
+	// Every truncation is an error, not a panic
+	for n := range len(data) {
+		if _, err := ParsePicture(data[:n]); err == nil {
+			t.Errorf("Expected an error for %d of %d bytes", n, len(data))
+		}
+	}
+
+	// A length beyond the block
+	bad := slices.Clone(data)
+	binary.BigEndian.PutUint32(bad[4:8], 1<<31)
+	if _, err := ParsePicture(bad); err == nil {
+		t.Error("Expected an error for an oversized MIME type length")
+	}
+}
+
 func TestConfigValidation(t *testing.T) {
 	// Valid config: just converting
 
@@ -141,6 +197,61 @@ func TestRelativePathLogic(t *testing.T) {
 	}
 }
 
+func TestRelativeToRoot(t *testing.T) {
+	type testCase struct {
+		root, file, expected string
+	}
+	var tests []testCase
+	var outside []testCase
+	if runtime.GOOS == "windows" {
+		tests = []testCase{
+			{`C:\Music`, `C:\Music\Artist\Song.flac`, `Artist\Song.flac`},
+			{`c:\music\`, `C:\Music\Artist\Song.flac`, `Artist\Song.flac`},
+			{`C:/Music`, `C:\Music\Artist\..\Other\Song.flac`, `Other\Song.flac`},
+			{`\\server\share\music`, `\\server\share\music\Artist\Song.flac`, `Artist\Song.flac`},
+			{`\\server\share\music\`, `\\SERVER\share\music\Artist\Song.flac`, `Artist\Song.flac`},
+			{`//server/share/music`, `\\server\share\music\Artist\Song.flac`, `Artist\Song.flac`},
+		}
+		outside = []testCase{
+			{`\\server\share\music`, `\\server\share\other\Song.flac`, ""},
+			{`\\server\share\music`, `D:\music\Song.flac`, ""},
+			{`C:\Music`, `D:\Music\Song.flac`, ""},
+		}
+	} else {
+		tests = []testCase{
+			{"/music/library", "/music/library/Artist/Album/Song.flac", "Artist/Album/Song.flac"},
+			{"/music/library/", "/music/library/Artist/Song.flac", "Artist/Song.flac"},
+			{"/music//library/.", "/music/library/Artist/../Other/Song.flac", "Other/Song.flac"},
+		}
+		outside = []testCase{
+			{"/music/library", "/music/other/Song.flac", ""},
+			{"/music/library", "/music/library/../library2/Song.flac", ""},
+		}
+	}
+
+	for _, tt := range tests {
+		rel, err := relativeToRoot(tt.root, tt.file)
+		if err != nil || rel != tt.expected {
+			t.Errorf("relativeToRoot(%q, %q) = %q, %v; expected %q", tt.root, tt.file, rel, err, tt.expected)
+		}
+	}
+	for _, tt := range outside {
+		if rel, err := relativeToRoot(tt.root, tt.file); err == nil {
+			t.Errorf("relativeToRoot(%q, %q) = %q; expected an error", tt.root, tt.file, rel)
+		}
+	}
+
+	// Relative roots are resolved against the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd failed: %v", err)
+	}
+	rel, err := relativeToRoot(".", filepath.Join(wd, "Artist", "Song.flac"))
+	if err != nil || rel != filepath.Join("Artist", "Song.flac") {
+		t.Errorf("Expected relative root to work, got %q, %v", rel, err)
+	}
+}
+
 func TestPrunePathLogic(t *testing.T) {
 	// Simulate the logic used in pruneOutput to find source FLAC
 
@@ -198,13 +309,14 @@ func TestProcessMBIDs_CustomTags(t *testing.T) {
 		MergeTags: []string{"CUSTOM_TAG"},
 	}
 
-	modified, err := processMBIDs("test.flac", f, config)
+	merged, err := processMBIDs("test.flac", f, config)
 	if err != nil {
 		t.Fatalf("processMBIDs failed: %v", err)
 	}
 
-	if !modified {
-		t.Error("Expected modified to be true")
+	want := []TagChange{{Tag: "CUSTOM_TAG", Before: []string{"Value1", "Value2"}, After: []string{"Value1+Value2"}}}
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("Expected CUSTOM_TAG to be reported as merged, got %v", merged)
 	}
 
 	// Parse back to check
@@ -235,3 +347,4011 @@ func TestProcessMBIDs_CustomTags(t *testing.T) {
 		t.Errorf("Expected 2 OTHER_TAGs, got %d", otherCount)
 	}
 }
+
+// writeTestFlac writes a minimal FLAC file with a STREAMINFO block, a
+// Vorbis comment block holding the given comments and a fake audio frame.
+func writeTestFlac(t *testing.T, path string, comments []string) {
+	t.Helper()
+
+	streamInfo := make([]byte, 34)
+	// 44100 Hz, 2 channels, 16 bits per sample, one second of audio
+	binary.BigEndian.PutUint32(streamInfo[10:14], 44100<<12|1<<9|15<<4)
+	binary.BigEndian.PutUint32(streamInfo[14:18], 44100)
+
+	vc := &VorbisComment{Vendor: "test", Comments: comments}
+	f := &flac.File{
+		Meta: []*flac.MetaDataBlock{
+			{Type: flac.StreamInfo, Data: streamInfo},
+			{Type: flac.VorbisComment, Data: vc.Marshal()},
+		},
+		Frames: []byte{0xFF, 0xF8, 0x00, 0x00},
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	if err := f.Save(path); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+}
+
+// writeTestOpus writes an Ogg file containing just the OpusHead and
+// OpusTags header packets, which is all readOpusTags looks at.
+func writeTestOpus(t *testing.T, path string, comments []string) {
+	t.Helper()
+
+	vc := &VorbisComment{Vendor: "libopus", Comments: comments}
+	packets := [][]byte{
+		append([]byte("OpusHead"), make([]byte, 11)...),
+		append([]byte("OpusTags"), vc.Marshal()...),
+	}
+
+	buf := new(bytes.Buffer)
+	for i, packet := range packets {
+		var segments []byte
+		for n := len(packet); ; n -= 255 {
+			if n < 255 {
+				segments = append(segments, byte(n))
+				break
+			}
+			segments = append(segments, 255)
+		}
+		page := oggPage{Sequence: uint32(i), Segments: segments, Body: packet}
+		buf.Write(page.Marshal())
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+}
+
+// readTestComments returns the Vorbis comments of a FLAC file on disk.
+func readTestComments(t *testing.T, path string) []string {
+	t.Helper()
+
+	f, err := flac.ParseFile(path)
+	if err != nil {
+		t.Fatalf("ParseFile failed: %v", err)
+	}
+	for _, block := range f.Meta {
+		if block.Type == flac.VorbisComment {
+			vc, err := ParseVorbisComment(block.Data)
+			if err != nil {
+				t.Fatalf("ParseVorbisComment failed: %v", err)
+			}
+			return vc.Comments
+		}
+	}
+	return nil
+}
+
+func TestRetagFromOpus(t *testing.T) {
+	inputRoot := t.TempDir()
+	opusRoot := t.TempDir()
+
+	flacPath := filepath.Join(inputRoot, "Artist", "Album", "Song.flac")
+	writeTestFlac(t, flacPath, []string{
+		"TITLE=Old Title",
+		"ARTIST=Artist",
+		"GENRE=Rock",
+	})
+	writeTestOpus(t, filepath.Join(opusRoot, "Artist", "Album", "Song.opus"), []string{
+		"ENCODER=opusenc",
+		"TITLE=New Title",
+		"ARTIST=Artist",
+		"MOOD=Happy",
+	})
+
+	config := Config{RetagOpus: opusRoot, Write: true}
+
+	retagged, err := retagFromOpus(flacPath, inputRoot, config)
+	if err != nil {
+		t.Fatalf("retagFromOpus failed: %v", err)
+	}
+	if !retagged {
+		t.Error("Expected file to be retagged")
+	}
+
+	expected := []string{"TITLE=New Title", "ARTIST=Artist", "GENRE=Rock", "MOOD=Happy"}
+	if got := readTestComments(t, flacPath); !slices.Equal(got, expected) {
+		t.Errorf("Expected comments %v, got %v", expected, got)
+	}
+
+	// Second run has nothing left to do
+	retagged, err = retagFromOpus(flacPath, inputRoot, config)
+	if err != nil {
+		t.Fatalf("retagFromOpus failed: %v", err)
+	}
+	if retagged {
+		t.Error("Expected no retag on second run")
+	}
+}
+
+func TestRetagFromOpus_MergedMBIDs(t *testing.T) {
+	inputRoot := t.TempDir()
+	opusRoot := t.TempDir()
+
+	// As written by --convert-opus --opus-mb-ids
+	flacPath := filepath.Join(inputRoot, "Song.flac")
+	writeTestFlac(t, flacPath, []string{"TITLE=Title", "MUSICBRAINZ_ARTISTID=a", "MUSICBRAINZ_ARTISTID=b"})
+	writeTestOpus(t, filepath.Join(opusRoot, "Song.opus"), []string{"TITLE=Title", "MUSICBRAINZ_ARTISTID=a+b"})
+
+	config := Config{RetagOpus: opusRoot, Write: true, MergeTags: []string{"MUSICBRAINZ_ARTISTID"}}
+	retagged, err := retagFromOpus(flacPath, inputRoot, config)
+	if err != nil {
+		t.Fatalf("retagFromOpus failed: %v", err)
+	}
+	if retagged {
+		t.Error("Expected the merged IDs not to be written back")
+	}
+
+	// Other IDs are still taken from the Opus file
+	writeTestOpus(t, filepath.Join(opusRoot, "Song.opus"), []string{"TITLE=Title", "MUSICBRAINZ_ARTISTID=c"})
+	if _, err := retagFromOpus(flacPath, inputRoot, config); err != nil {
+		t.Fatalf("retagFromOpus failed: %v", err)
+	}
+	expected := []string{"TITLE=Title", "MUSICBRAINZ_ARTISTID=c"}
+	if got := readTestComments(t, flacPath); !slices.Equal(got, expected) {
+		t.Errorf("Expected comments %v, got %v", expected, got)
+	}
+}
+
+func TestRetagFromOpus_MissingOpus(t *testing.T) {
+	inputRoot := t.TempDir()
+	flacPath := filepath.Join(inputRoot, "Song.flac")
+	writeTestFlac(t, flacPath, []string{"TITLE=Title"})
+
+	config := Config{RetagOpus: t.TempDir(), Write: true}
+
+	retagged, err := retagFromOpus(flacPath, inputRoot, config)
+	if err != nil {
+		t.Fatalf("retagFromOpus failed: %v", err)
+	}
+	if retagged {
+		t.Error("Expected file without Opus counterpart to be skipped")
+	}
+}
+
+// writeTestJPEG writes a blank JPEG image with the given dimensions.
+func writeTestJPEG(t *testing.T, path string, width, height int) {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	if err := jpeg.Encode(buf, img, nil); err != nil {
+		t.Fatalf("jpeg.Encode failed: %v", err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+}
+
+func TestProcessCover_MaxAspect(t *testing.T) {
+	dir := t.TempDir()
+	writeTestJPEG(t, filepath.Join(dir, "cover.jpg"), 300, 100)
+
+	config := Config{
+		EmbedCover:     true,
+		CoverName:      "cover.jpg",
+		CoverMaxAspect: 2,
+	}
+
+	f := &flac.File{}
+	modified, err := processCover(filepath.Join(dir, "test.flac"), f, config)
+	if err != nil {
+		t.Fatalf("processCover failed: %v", err)
+	}
+	if modified || len(f.Meta) != 0 {
+		t.Error("Expected wide cover to be rejected")
+	}
+
+	// The same image passes with a looser limit
+	config.CoverMaxAspect = 3
+	modified, err = processCover(filepath.Join(dir, "test.flac"), f, config)
+	if err != nil {
+		t.Fatalf("processCover failed: %v", err)
+	}
+	if !modified || len(f.Meta) != 1 {
+		t.Error("Expected cover to be embedded")
+	}
+}
+
+func TestProcessCover_MaxSize(t *testing.T) {
+	dir := t.TempDir()
+	coverPath := filepath.Join(dir, "cover.jpg")
+	config := Config{
+		EmbedCover:        true,
+		CoverName:         "cover.jpg",
+		MaxCoverDimension: 150,
+	}
+
+	embed := func() *Picture {
+		t.Helper()
+		f := &flac.File{}
+		if _, err := processCover(filepath.Join(dir, "test.flac"), f, config); err != nil {
+			t.Fatalf("processCover failed: %v", err)
+		}
+		if len(f.Meta) != 1 {
+			t.Fatalf("Expected cover to be embedded")
+		}
+		pic, err := ParsePicture(f.Meta[0].Data)
+		if err != nil {
+			t.Fatalf("ParsePicture failed: %v", err)
+		}
+		return pic
+	}
+
+	// Small covers are embedded as they are
+	writeTestJPEG(t, coverPath, 100, 50)
+	data, err := os.ReadFile(coverPath)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if pic := embed(); !bytes.Equal(pic.Data, data) {
+		t.Error("Expected small cover not to be re-encoded")
+	}
+
+	writeTestJPEG(t, coverPath, 300, 100)
+	pic := embed()
+	if pic.Width != 150 || pic.Height != 50 || pic.MimeType != "image/jpeg" {
+		t.Errorf("Expected a 150x50 JPEG, got %dx%d %s", pic.Width, pic.Height, pic.MimeType)
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(pic.Data))
+	if err != nil {
+		t.Fatalf("DecodeConfig failed: %v", err)
+	}
+	if cfg.Width != 150 || cfg.Height != 50 {
+		t.Errorf("Expected the image data to be 150x50, got %dx%d", cfg.Width, cfg.Height)
+	}
+}
+
+func TestFileCounterPrefix(t *testing.T) {
+	fc := newFileCounter(10)
+
+	fc.Next()
+	if got := fc.Prefix(); got != "[1/10] " {
+		t.Errorf("Expected prefix '[1/10] ', got %q", got)
+	}
+
+	fc.Next()
+	if got := fc.Prefix(); !strings.HasPrefix(got, "[2/10 ETA ") {
+		t.Errorf("Expected prefix with ETA, got %q", got)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := map[string]int64{
+		"1024": 1024,
+		"512K": 512 << 10,
+		"1.5M": 3 << 19,
+		"32G":  32 << 30,
+		"2tb":  2 << 40,
+	}
+	for in, expected := range tests {
+		got, err := parseByteSize(in)
+		if err != nil {
+			t.Errorf("parseByteSize(%q) failed: %v", in, err)
+			continue
+		}
+		if got != expected {
+			t.Errorf("parseByteSize(%q): expected %d, got %d", in, expected, got)
+		}
+	}
+
+	for _, in := range []string{"", "G", "-1M", "lots"} {
+		if _, err := parseByteSize(in); err == nil {
+			t.Errorf("Expected error for %q", in)
+		}
+	}
+}
+
+func TestSizeBudget(t *testing.T) {
+	b := &sizeBudget{limit: 100}
+
+	if !b.Fits(60) {
+		t.Error("Expected 60 bytes to fit")
+	}
+	if b.Fits(50) {
+		t.Error("Expected 50 more bytes not to fit")
+	}
+	// Once exhausted, even small files are refused so the run stops
+	if b.Fits(10) {
+		t.Error("Expected budget to stay exhausted")
+	}
+}
+
+func TestSaveAfterAppendingPicture(t *testing.T) {
+	dir := t.TempDir()
+	flacPath := filepath.Join(dir, "test.flac")
+	writeTestFlac(t, flacPath, []string{"TITLE=Title"})
+	writeTestJPEG(t, filepath.Join(dir, "cover.jpg"), 100, 100)
+
+	f, err := flac.ParseFile(flacPath)
+	if err != nil {
+		t.Fatalf("ParseFile failed: %v", err)
+	}
+	frames := slices.Clone(f.Frames)
+
+	config := Config{EmbedCover: true, CoverName: "cover.jpg"}
+	if _, err := processCover(flacPath, f, config); err != nil {
+		t.Fatalf("processCover failed: %v", err)
+	}
+	if err := f.Save(flacPath); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	// Walk the raw block chain: only the final block may carry the "last"
+	// flag, and the audio frames must start right after it.
+	data, err := os.ReadFile(flacPath)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	offset := 4
+	var types []flac.BlockType
+	for {
+		header := data[offset]
+		length := int(data[offset+1])<<16 | int(data[offset+2])<<8 | int(data[offset+3])
+		types = append(types, flac.BlockType(header&0x7F))
+		offset += 4 + length
+		if header&0x80 != 0 {
+			break
+		}
+		if offset >= len(data) {
+			t.Fatal("No block with the last-block flag found")
+		}
+	}
+
+	expected := []flac.BlockType{flac.StreamInfo, flac.VorbisComment, flac.Picture}
+	if !slices.Equal(types, expected) {
+		t.Errorf("Expected block chain %v, got %v", expected, types)
+	}
+	if !bytes.Equal(data[offset:], frames) {
+		t.Errorf("Audio frames do not start at offset %d", offset)
+	}
+
+	reparsed, err := flac.ParseFile(flacPath)
+	if err != nil {
+		t.Fatalf("Reparsing saved file failed: %v", err)
+	}
+	if len(reparsed.Meta) != 3 {
+		t.Errorf("Expected 3 metadata blocks, got %d", len(reparsed.Meta))
+	}
+}
+
+func TestBitrateReport(t *testing.T) {
+	dir := t.TempDir()
+	flacPath := filepath.Join(dir, "test.flac")
+	writeTestFlac(t, flacPath, []string{"TITLE=Title"})
+
+	info, err := os.Stat(flacPath)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+
+	r := &bitrateReport{threshold: 400}
+	if err := r.Audit(flacPath); err != nil {
+		t.Fatalf("Audit failed: %v", err)
+	}
+
+	if len(r.entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(r.entries))
+	}
+	// The test file holds exactly one second of audio
+	expected := float64(info.Size()) * 8 / 1000
+	if r.entries[0].kbps != expected {
+		t.Errorf("Expected %.3f kbps, got %.3f", expected, r.entries[0].kbps)
+	}
+}
+
+func TestAudioInfoReport(t *testing.T) {
+	flacPath := filepath.Join(t.TempDir(), "test.flac")
+	writeTestFlac(t, flacPath, []string{"TITLE=Title"})
+
+	r := &audioInfoReport{}
+	if err := r.Add(flacPath); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if len(r.entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(r.entries))
+	}
+
+	// The test file holds one second of 16 bit stereo audio without MD5
+	a := r.entries[0]
+	if a.channels != 2 || a.Format() != "16 bit / 44.1 kHz" || a.Length() != "0:01" || a.MD5() != "no MD5" {
+		t.Errorf("Unexpected info %s, %d ch, %s, %s", a.Format(), a.channels, a.Length(), a.MD5())
+	}
+
+	a = audioInfo{sampleRate: 192000, bits: 24, md5: []byte{0xab, 0, 0, 1}}
+	if a.Format() != "24 bit / 192 kHz" || a.Length() != "unknown length" || a.MD5() != "MD5 ab000001" {
+		t.Errorf("Unexpected info %s, %s, %s", a.Format(), a.Length(), a.MD5())
+	}
+}
+
+func TestAlbumSummary(t *testing.T) {
+	dir := t.TempDir()
+	s := &albumSummary{albums: make(map[string]*albumTotals)}
+	for _, name := range []string{"A/01.flac", "A/02.flac", "B/01.flac"} {
+		writeTestFlac(t, filepath.Join(dir, name), []string{"TITLE=Title"})
+		if err := s.Add(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+
+	// Each test file holds one second of audio
+	a := s.albums[filepath.Join(dir, "A")]
+	if a == nil || a.tracks != 2 || a.unknown != 0 || formatDuration(a.seconds) != "0:02" {
+		t.Errorf("Unexpected totals for A: %+v", a)
+	}
+	if b := s.albums[filepath.Join(dir, "B")]; b == nil || b.tracks != 1 {
+		t.Errorf("Unexpected totals for B: %+v", b)
+	}
+
+	for seconds, expected := range map[float64]string{0: "0:00", 59.6: "1:00", 3725: "1:02:05"} {
+		if got := formatDuration(seconds); got != expected {
+			t.Errorf("formatDuration(%v): expected %q, got %q", seconds, expected, got)
+		}
+	}
+}
+
+func TestTagLister(t *testing.T) {
+	dir := t.TempDir()
+	flacPath := filepath.Join(dir, "test.flac")
+	writeTestFlac(t, flacPath, []string{"TITLE=Title", "musicbrainz_albumid=abc"})
+	writeTestJPEG(t, filepath.Join(dir, "cover.jpg"), 20, 10)
+	config := Config{Write: true, EmbedCover: true, CoverName: "cover.jpg", LogFunc: func(LogLevel, string, ...any) {}}
+	if _, err := fixFlac(flacPath, config); err != nil {
+		t.Fatalf("fixFlac failed: %v", err)
+	}
+
+	l := &tagLister{}
+	if err := l.Add(flacPath); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	size := fileSize(t, filepath.Join(dir, "cover.jpg"))
+	expected := []string{"TITLE=Title", "musicbrainz_albumid=abc", fmt.Sprintf("Picture: type 3, image/jpeg, 20x10, %d bytes", size)}
+	if !slices.Equal(l.entries[0].lines, expected) {
+		t.Errorf("Expected %q, got %q", expected, l.entries[0].lines)
+	}
+
+	// Filtered keys are matched in any case, missing ones are marked
+	l = &tagLister{filter: []string{"MUSICBRAINZ_ALBUMID", "MUSICBRAINZ_TRACKID"}}
+	if err := l.Add(flacPath); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	expected = []string{"musicbrainz_albumid=abc", "MUSICBRAINZ_TRACKID (missing)"}
+	if !slices.Equal(l.entries[0].lines, expected) {
+		t.Errorf("Expected %q, got %q", expected, l.entries[0].lines)
+	}
+}
+
+func TestProcessCover_MimeFromData(t *testing.T) {
+	dir := t.TempDir()
+
+	// A PNG saved under the JPEG name
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 30, 20))); err != nil {
+		t.Fatalf("png.Encode failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cover.jpg"), buf.Bytes(), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	var warnings []string
+	config := Config{EmbedCover: true, CoverName: "cover.jpg", LogFunc: func(level LogLevel, format string, args ...any) {
+		if level == LogWarn {
+			warnings = append(warnings, fmt.Sprintf(format, args...))
+		}
+	}}
+	f := &flac.File{}
+	if _, err := processCover(filepath.Join(dir, "test.flac"), f, config); err != nil {
+		t.Fatalf("processCover failed: %v", err)
+	}
+	if len(f.Meta) != 1 {
+		t.Fatal("Expected cover to be embedded")
+	}
+	pic, err := ParsePicture(f.Meta[0].Data)
+	if err != nil {
+		t.Fatalf("ParsePicture failed: %v", err)
+	}
+	if pic.MimeType != "image/png" || pic.Width != 30 || pic.Height != 20 {
+		t.Errorf("Expected a 30x20 PNG, got %dx%d %s", pic.Width, pic.Height, pic.MimeType)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "image/png") {
+		t.Errorf("Expected a warning about the extension, got %q", warnings)
+	}
+
+	for name, expected := range map[string]bool{"cover.jpg": true, "Cover.JPEG": true, "cover.png": false, "cover": false} {
+		if got := hasPictureExtension(name, "image/jpeg"); got != expected {
+			t.Errorf("hasPictureExtension(%q): expected %v, got %v", name, expected, got)
+		}
+	}
+}
+
+// testWebP is a 1x1 lossless WebP image.
+const testWebP = "UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA=="
+
+func TestProcessCover_WebP(t *testing.T) {
+	dir := t.TempDir()
+	data, err := base64.StdEncoding.DecodeString(testWebP)
+	if err != nil {
+		t.Fatalf("DecodeString failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cover.webp"), data, 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	embed := func(config Config) *Picture {
+		t.Helper()
+		f := &flac.File{}
+		if _, err := processCover(filepath.Join(dir, "test.flac"), f, config); err != nil {
+			t.Fatalf("processCover failed: %v", err)
+		}
+		if len(f.Meta) != 1 {
+			t.Fatalf("Expected cover to be embedded")
+		}
+		pic, err := ParsePicture(f.Meta[0].Data)
+		if err != nil {
+			t.Fatalf("ParsePicture failed: %v", err)
+		}
+		return pic
+	}
+
+	// The MIME type matches the stored data
+	config := Config{EmbedCover: true, CoverName: "cover.webp"}
+	pic := embed(config)
+	if pic.MimeType != "image/webp" || pic.Width != 1 || pic.Height != 1 || !bytes.Equal(pic.Data, data) {
+		t.Errorf("Expected the 1x1 WebP as it is, got %dx%d %s", pic.Width, pic.Height, pic.MimeType)
+	}
+
+	config.CoverTranscode = true
+	pic = embed(config)
+	if pic.MimeType != "image/jpeg" || pic.Width != 1 || pic.Height != 1 {
+		t.Errorf("Expected a 1x1 JPEG, got %dx%d %s", pic.Width, pic.Height, pic.MimeType)
+	}
+	if _, format, err := image.DecodeConfig(bytes.NewReader(pic.Data)); err != nil || format != "jpeg" {
+		t.Errorf("Expected JPEG data, got %q (%v)", format, err)
+	}
+}
+
+func TestProcessThumbnail(t *testing.T) {
+	dir := t.TempDir()
+	coverFile := func(width, height int) *flac.MetaDataBlock {
+		t.Helper()
+		path := filepath.Join(dir, "cover.jpg")
+		writeTestJPEG(t, path, width, height)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		// No dimensions in the header, as some taggers write it
+		pic := &Picture{PictureType: 3, MimeType: "image/jpeg", Data: data}
+		return &flac.MetaDataBlock{Type: flac.Picture, Data: pic.Marshal()}
+	}
+	config := Config{EmbedThumbnail: 100}
+
+	f := &flac.File{Meta: []*flac.MetaDataBlock{coverFile(400, 200)}}
+	embedded, err := processThumbnail("test.flac", f, config)
+	if err != nil || !embedded || len(f.Meta) != 2 {
+		t.Fatalf("Expected a thumbnail to be embedded, got %v (%v)", embedded, err)
+	}
+	thumb, err := ParsePicture(f.Meta[1].Data)
+	if err != nil {
+		t.Fatalf("ParsePicture failed: %v", err)
+	}
+	if thumb.PictureType != 3 || thumb.Width != 100 || thumb.Height != 50 || thumb.MimeType != "image/jpeg" || thumb.Description != thumbnailDescription {
+		t.Errorf("Unexpected thumbnail: type %d, %dx%d %s %q", thumb.PictureType, thumb.Width, thumb.Height, thumb.MimeType, thumb.Description)
+	}
+
+	// The thumbnail is there now
+	if embedded, err := processThumbnail("test.flac", f, config); err != nil || embedded {
+		t.Errorf("Expected no second thumbnail, got %v (%v)", embedded, err)
+	}
+
+	// A small cover needs none
+	f = &flac.File{Meta: []*flac.MetaDataBlock{coverFile(80, 80)}}
+	if embedded, err := processThumbnail("test.flac", f, config); err != nil || embedded {
+		t.Errorf("Expected no thumbnail for a small cover, got %v (%v)", embedded, err)
+	}
+}
+
+func TestProcessCover_DefaultCover(t *testing.T) {
+	dir := t.TempDir()
+	placeholder := filepath.Join(t.TempDir(), "logo.jpg")
+	writeTestJPEG(t, placeholder, 64, 64)
+
+	config := Config{
+		EmbedCover:   true,
+		CoverName:    "cover.jpg",
+		DefaultCover: placeholder,
+	}
+
+	f := &flac.File{}
+	modified, err := processCover(filepath.Join(dir, "test.flac"), f, config)
+	if err != nil {
+		t.Fatalf("processCover failed: %v", err)
+	}
+	if !modified || len(f.Meta) != 1 {
+		t.Fatal("Expected placeholder cover to be embedded")
+	}
+
+	// Pictures are big-endian: type, mime length + mime, description
+	// length + description
+	data := f.Meta[0].Data
+	mimeLen := binary.BigEndian.Uint32(data[4:8])
+	descStart := 8 + mimeLen
+	descLen := binary.BigEndian.Uint32(data[descStart : descStart+4])
+	desc := string(data[descStart+4 : descStart+4+descLen])
+	if desc != "placeholder" {
+		t.Errorf("Expected description 'placeholder', got %q", desc)
+	}
+}
+
+func TestProcessCover_SearchParents(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "music")
+	album := filepath.Join(root, "Album")
+	disc := filepath.Join(album, "CD1", "Extra")
+	if err := os.MkdirAll(disc, 0o755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	writeTestJPEG(t, filepath.Join(album, "cover.jpg"), 20, 20)
+	writeTestJPEG(t, filepath.Join(filepath.Dir(root), "cover.jpg"), 30, 30)
+	filename := filepath.Join(disc, "01.flac")
+
+	embedded := func(parents int, coverRoot string) int {
+		config := Config{EmbedCover: true, CoverName: "cover.jpg", CoverSearchParents: parents, coverRoot: coverRoot}
+		f := &flac.File{}
+		if _, err := processCover(filename, f, config); err != nil {
+			t.Fatalf("processCover failed: %v", err)
+		}
+		if len(f.Meta) == 0 {
+			return 0
+		}
+		pic, err := ParsePicture(f.Meta[0].Data)
+		if err != nil {
+			t.Fatalf("ParsePicture failed: %v", err)
+		}
+		return int(pic.Width)
+	}
+
+	// The album cover is two levels up
+	if w := embedded(1, root); w != 0 {
+		t.Errorf("Expected no cover within one level, got width %d", w)
+	}
+	if w := embedded(2, root); w != 20 {
+		t.Errorf("Expected the album cover, got width %d", w)
+	}
+	// The search stops at the input root, not at the cover outside it
+	if w := embedded(5, album); w != 20 {
+		t.Errorf("Expected the album cover, got width %d", w)
+	}
+	if w := embedded(5, disc); w != 0 {
+		t.Errorf("Expected no cover above the input root, got width %d", w)
+	}
+	if w := embedded(5, ""); w != 0 {
+		t.Errorf("Expected no search without an input root, got width %d", w)
+	}
+}
+
+func TestProcessCovers(t *testing.T) {
+	dir := t.TempDir()
+	writeTestJPEG(t, filepath.Join(dir, "cover.jpg"), 20, 20)
+	writeTestJPEG(t, filepath.Join(dir, "back.jpg"), 30, 10)
+	filename := filepath.Join(dir, "01.flac")
+
+	var warnings []string
+	config := Config{
+		EmbedCover: true,
+		CoverFiles: []coverSpec{{"cover.jpg", 3}, {"back.jpg", 4}, {"inlay.jpg", 5}},
+		LogLevel:   LogWarn,
+		LogFunc: func(level LogLevel, format string, args ...any) {
+			warnings = append(warnings, fmt.Sprintf(format, args...))
+		},
+	}
+	types := func(f *flac.File) map[uint32]uint32 {
+		found := make(map[uint32]uint32)
+		for _, block := range f.Meta {
+			pic, err := ParsePicture(block.Data)
+			if err != nil {
+				t.Fatalf("ParsePicture failed: %v", err)
+			}
+			found[pic.PictureType] = pic.Width
+		}
+		return found
+	}
+
+	f := &flac.File{}
+	embedded, err := processCovers(filename, f, config)
+	if err != nil {
+		t.Fatalf("processCovers failed: %v", err)
+	}
+	if got := types(f); embedded != 3 || !maps.Equal(got, map[uint32]uint32{3: 20, 4: 30}) {
+		t.Errorf("Expected front and back cover, got %d, %v", embedded, got)
+	}
+	// Only the first cover file is expected to exist
+	if len(warnings) != 0 {
+		t.Errorf("Unexpected warnings %q", warnings)
+	}
+
+	// Types already present are skipped
+	back := &Picture{PictureType: 4, MimeType: "image/jpeg", Width: 1, Height: 1, Data: []byte{0xff}}
+	f = &flac.File{Meta: []*flac.MetaDataBlock{{Type: flac.Picture, Data: back.Marshal()}}}
+	if embedded, err = processCovers(filename, f, config); err != nil {
+		t.Fatalf("processCovers failed: %v", err)
+	}
+	if got := types(f); embedded != 3 || !maps.Equal(got, map[uint32]uint32{3: 20, 4: 1}) {
+		t.Errorf("Expected the back cover to be kept, got %d, %v", embedded, got)
+	}
+}
+
+func TestParseCoverSpec(t *testing.T) {
+	spec, err := parseCoverSpec("back:side.jpg:4")
+	if err != nil || spec != (coverSpec{"back:side.jpg", 4}) {
+		t.Errorf("Unexpected result %v, %v", spec, err)
+	}
+	for _, bad := range []string{"back.jpg", ":4", "back.jpg:0", "back.jpg:21", "back.jpg:x"} {
+		if _, err := parseCoverSpec(bad); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
+
+func TestProcessCover_CacheDecodesOncePerAlbum(t *testing.T) {
+	dir := t.TempDir()
+	writeTestJPEG(t, filepath.Join(dir, "cover.jpg"), 100, 100)
+
+	config := Config{
+		EmbedCover: true,
+		CoverName:  "cover.jpg",
+		Covers:     &coverCache{},
+	}
+
+	for i := range 12 {
+		f := &flac.File{}
+		filename := filepath.Join(dir, fmt.Sprintf("%02d.flac", i+1))
+		modified, err := processCover(filename, f, config)
+		if err != nil {
+			t.Fatalf("processCover failed: %v", err)
+		}
+		if !modified {
+			t.Errorf("Expected cover to be embedded into %s", filename)
+		}
+	}
+
+	if decodes := config.Covers.Decodes(); decodes != 1 {
+		t.Errorf("Expected 1 cover decode for the album, got %d", decodes)
+	}
+}
+
+func TestProcessCover_OnlyBackCover(t *testing.T) {
+	dir := t.TempDir()
+	writeTestJPEG(t, filepath.Join(dir, "cover.jpg"), 100, 100)
+
+	// Back cover, "Other" and illustration
+	f := &flac.File{}
+	for _, typ := range []uint32{4, 0, 18} {
+		pic := &Picture{PictureType: typ, MimeType: "image/jpeg", Data: []byte{0x01}}
+		f.Meta = append(f.Meta, &flac.MetaDataBlock{Type: flac.Picture, Data: pic.Marshal()})
+	}
+
+	config := Config{EmbedCover: true, CoverName: "cover.jpg"}
+
+	modified, err := processCover(filepath.Join(dir, "test.flac"), f, config)
+	if err != nil {
+		t.Fatalf("processCover failed: %v", err)
+	}
+	if !modified || len(f.Meta) != 4 {
+		t.Fatal("Expected front cover to be embedded next to the other pictures")
+	}
+	if typ, _ := pictureType(f.Meta[3]); typ != 3 {
+		t.Errorf("Expected embedded picture type 3, got %d", typ)
+	}
+
+	// With the front cover present, nothing more happens
+	modified, err = processCover(filepath.Join(dir, "test.flac"), f, config)
+	if err != nil {
+		t.Fatalf("processCover failed: %v", err)
+	}
+	if modified {
+		t.Error("Expected file with front cover to be left alone")
+	}
+}
+
+func TestProcessCover_Force(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "test.flac")
+
+	old := &Picture{PictureType: 3, MimeType: "image/jpeg", Data: []byte{0x01}}
+	dup := &Picture{PictureType: 3, MimeType: "image/jpeg", Data: []byte{0x02}}
+	back := &Picture{PictureType: 4, MimeType: "image/jpeg", Data: []byte{0x03}}
+	f := &flac.File{Meta: []*flac.MetaDataBlock{
+		{Type: flac.Picture, Data: old.Marshal()},
+		{Type: flac.Picture, Data: back.Marshal()},
+		{Type: flac.Picture, Data: dup.Marshal()},
+	}}
+
+	config := Config{EmbedCover: true, ForceCover: true, CoverName: "cover.jpg"}
+
+	// Without a cover file the embedded one stays
+	modified, err := processCover(filename, f, config)
+	if err != nil || modified {
+		t.Fatalf("Expected no change without cover file, got %v, %v", modified, err)
+	}
+
+	writeTestJPEG(t, filepath.Join(dir, "cover.jpg"), 100, 100)
+	modified, err = processCover(filename, f, config)
+	if err != nil || !modified {
+		t.Fatalf("Expected the cover to be replaced, got %v, %v", modified, err)
+	}
+	if len(f.Meta) != 2 {
+		t.Fatalf("Expected the front covers to be replaced by one, got %d blocks", len(f.Meta))
+	}
+	front, err := ParsePicture(f.Meta[0].Data)
+	if err != nil {
+		t.Fatalf("ParsePicture failed: %v", err)
+	}
+	if front.PictureType != 3 || front.Width != 100 {
+		t.Errorf("Expected the cover file as front cover, got %+v", front)
+	}
+	if !bytes.Equal(f.Meta[1].Data, back.Marshal()) {
+		t.Error("Expected the back cover to be kept")
+	}
+
+	// Replacing again is a no-op
+	if modified, err := processCover(filename, f, config); err != nil || modified {
+		t.Errorf("Expected no change for an up to date cover, got %v, %v", modified, err)
+	}
+}
+
+func TestWalkFlacFiles_IgnoreFile(t *testing.T) {
+	root := t.TempDir()
+	for _, p := range []string{
+		"Artist/Album/01.flac",
+		"Artist/WIP/01.flac",
+		"Other/Album/01.FLAC",
+		"Other/Album/02.flac",
+		"Other/Samples/01.flac",
+		"Other/Album/cover.jpg",
+	} {
+		full := filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+			t.Fatalf("MkdirAll failed: %v", err)
+		}
+		if err := os.WriteFile(full, nil, 0o644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+
+	// An empty ignore file skips the directory, patterns skip matches
+	if err := os.WriteFile(filepath.Join(root, "Artist/WIP", ignoreFileName), nil, 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	patterns := "# not music\nSamples/\n02.*\n"
+	if err := os.WriteFile(filepath.Join(root, "Other", ignoreFileName), []byte(patterns), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	var found []string
+	err := walkFlacFiles(root, walkOptions{}, nil, func(filePath string) error {
+		rel, _ := filepath.Rel(root, filePath)
+		found = append(found, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walkFlacFiles failed: %v", err)
+	}
+
+	expected := []string{"Artist/Album/01.flac", "Other/Album/01.FLAC"}
+	if !slices.Equal(found, expected) {
+		t.Errorf("Expected %v, got %v", expected, found)
+	}
+}
+
+func TestWalkFlacFiles_Limit(t *testing.T) {
+	root := t.TempDir()
+	touch(t, root, "A/01.flac", "A/02.flac", "A/cover.jpg", "B/01.flac")
+
+	var found []string
+	err := walkFlacFiles(root, walkOptions{Limit: 2}, nil, func(filePath string) error {
+		found = append(found, filepath.Base(filePath))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walkFlacFiles failed: %v", err)
+	}
+	if len(found) != 2 {
+		t.Errorf("Expected 2 files, got %v", found)
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if list, err := listFlacFiles(root, info, walkOptions{Limit: 2}); err != nil || len(list.files) != 2 {
+		t.Errorf("Expected list capped at 2, got %v (%v)", list.files, err)
+	}
+	list, err := listFlacFiles(root, info, walkOptions{})
+	expected := []string{filepath.Join(root, "A", "01.flac"), filepath.Join(root, "A", "02.flac"), filepath.Join(root, "B", "01.flac")}
+	if err != nil || !slices.Equal(list.files, expected) {
+		t.Errorf("Expected %v without limit, got %v (%v)", expected, list.files, err)
+	}
+}
+
+func TestWalkFlacFiles_Since(t *testing.T) {
+	root := t.TempDir()
+	touch(t, root, "A/01.flac", "A/02.flac", "B/01.flac")
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{"A/01.flac", "B/01.flac"} {
+		if err := os.Chtimes(filepath.Join(root, name), old, old); err != nil {
+			t.Fatalf("Chtimes failed: %v", err)
+		}
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	// Old files do not count towards the limit either
+	list, err := listFlacFiles(root, info, walkOptions{Limit: 1, Since: time.Now().Add(-24 * time.Hour)})
+	expected := []string{filepath.Join(root, "A", "02.flac")}
+	if err != nil || !slices.Equal(list.files, expected) {
+		t.Errorf("Expected %v, got %v (%v)", expected, list.files, err)
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.Local)
+	tests := map[string]time.Time{
+		"36h":                  now.Add(-36 * time.Hour),
+		"7d":                   time.Date(2024, 5, 3, 12, 0, 0, 0, time.Local),
+		"2024-05-01":           time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local),
+		"2024-05-01T08:30:00":  time.Date(2024, 5, 1, 8, 30, 0, 0, time.Local),
+		"2024-05-01T08:30:00Z": time.Date(2024, 5, 1, 8, 30, 0, 0, time.UTC),
+	}
+	for s, expected := range tests {
+		if got, err := parseSince(s, now); err != nil || !got.Equal(expected) {
+			t.Errorf("parseSince(%q): expected %v, got %v (%v)", s, expected, got, err)
+		}
+	}
+	for _, bad := range []string{"", "-1h", "yesterday", "2024-13-01"} {
+		if _, err := parseSince(bad, now); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
+
+// touch creates empty files below root.
+func touch(t *testing.T, root string, paths ...string) {
+	t.Helper()
+	for _, p := range paths {
+		full := filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+			t.Fatalf("MkdirAll failed: %v", err)
+		}
+		if err := os.WriteFile(full, nil, 0o644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestPruneOutput(t *testing.T) {
+	// The default batch holds all outputs; small ones flush mid-walk
+	for _, batchSize := range []int{0, 1, 2} {
+		t.Run(fmt.Sprintf("batch-%d", batchSize), func(t *testing.T) {
+			inputRoot := t.TempDir()
+			outputRoot := t.TempDir()
+
+			touch(t, inputRoot, "Artist/Album/01.flac")
+			touch(t, outputRoot,
+				"Artist/Album/01.opus",
+				"Artist/Album/02.opus",
+				"Artist/Album/03.opus.tmp",
+				"Gone/Album/01.opus",
+				".stfolder/marker.opus",
+			)
+
+			config := Config{ConvertOpus: outputRoot, Write: true, BatchSize: batchSize}
+			if err := pruneOutput(inputRoot, config); err != nil {
+				t.Fatalf("pruneOutput failed: %v", err)
+			}
+
+			for p, expected := range map[string]bool{
+				"Artist/Album/01.opus":     true,
+				"Artist/Album/02.opus":     false,
+				"Artist/Album/03.opus.tmp": false,
+				"Gone":                     false,
+				".stfolder/marker.opus":    true,
+			} {
+				if got := exists(filepath.Join(outputRoot, p)); got != expected {
+					t.Errorf("%s: expected exists=%v, got %v", p, expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestPruneOutput_SourceExtensions(t *testing.T) {
+	for _, tt := range []struct {
+		formats []string
+		kept    map[string]bool
+	}{
+		{nil, map[string]bool{"01.opus": true, "02.opus": false, "03.opus": false}},
+		{[]string{".flac", ".m4a"}, map[string]bool{"01.opus": true, "02.opus": true, "03.opus": false}},
+	} {
+		inputRoot := t.TempDir()
+		outputRoot := t.TempDir()
+		// Upper case extensions are converted as well
+		touch(t, inputRoot, "Album/01.FLAC", "Album/02.m4a", "Album/03.wav")
+		touch(t, outputRoot, "Album/01.opus", "Album/02.opus", "Album/03.opus")
+
+		config := Config{ConvertOpus: outputRoot, Write: true, InputFormats: tt.formats}
+		if err := pruneOutput(inputRoot, config); err != nil {
+			t.Fatalf("pruneOutput failed: %v", err)
+		}
+		for name, expected := range tt.kept {
+			if got := exists(filepath.Join(outputRoot, "Album", name)); got != expected {
+				t.Errorf("%v: %s: expected exists=%v, got %v", tt.formats, name, expected, got)
+			}
+		}
+	}
+}
+
+func TestCleanTempFiles(t *testing.T) {
+	outputRoot := t.TempDir()
+	touch(t, outputRoot,
+		"Artist/Album/01.opus",
+		"Artist/Album/02.opus.tmp",
+		"Artist/Album/03.OPUS.TMP",
+		"Artist/Album/notes.tmp",
+		".stfolder/04.opus.tmp",
+	)
+
+	config := Config{ConvertOpus: outputRoot}
+	if n, err := cleanTempFiles(config); err != nil || n != 2 {
+		t.Fatalf("Expected 2 temp files in dry-run, got %d (%v)", n, err)
+	}
+	if !exists(filepath.Join(outputRoot, "Artist/Album/02.opus.tmp")) {
+		t.Error("Expected dry-run to keep temp files")
+	}
+
+	config.Write = true
+	if n, err := cleanTempFiles(config); err != nil || n != 2 {
+		t.Fatalf("Expected 2 temp files removed, got %d (%v)", n, err)
+	}
+	for p, expected := range map[string]bool{
+		"Artist/Album/01.opus":     true,
+		"Artist/Album/02.opus.tmp": false,
+		"Artist/Album/03.OPUS.TMP": false,
+		"Artist/Album/notes.tmp":   true,
+		".stfolder/04.opus.tmp":    true,
+	} {
+		if got := exists(filepath.Join(outputRoot, p)); got != expected {
+			t.Errorf("%s: expected exists=%v, got %v", p, expected, got)
+		}
+	}
+
+	// A missing output directory is not an error
+	config.ConvertOpus = filepath.Join(outputRoot, "missing")
+	if n, err := cleanTempFiles(config); err != nil || n != 0 {
+		t.Errorf("Expected nothing to clean, got %d (%v)", n, err)
+	}
+}
+
+func TestCoverCopier(t *testing.T) {
+	inputRoot := t.TempDir()
+	outputRoot := t.TempDir()
+	touch(t, inputRoot, "Artist/Album/01.flac", "Artist/Album/02.flac")
+	writeTestJPEG(t, filepath.Join(inputRoot, "Artist/Album/cover.jpg"), 10, 10)
+
+	config := Config{ConvertOpus: outputRoot, Write: true, CoverName: "cover.jpg", CoverCopies: newCoverCopier()}
+	copied, err := config.CoverCopies.Copy(filepath.Join(inputRoot, "Artist/Album/01.flac"), inputRoot, config)
+	if err != nil || !copied {
+		t.Fatalf("Expected cover to be copied, got %v, %v", copied, err)
+	}
+	if !exists(filepath.Join(outputRoot, "Artist/Album/cover.jpg")) {
+		t.Fatal("Expected copied cover in the output")
+	}
+
+	// Once per album, and not again when up to date
+	copied, err = config.CoverCopies.Copy(filepath.Join(inputRoot, "Artist/Album/02.flac"), inputRoot, config)
+	if err != nil || copied {
+		t.Errorf("Expected album to be handled once, got %v, %v", copied, err)
+	}
+	copied, err = newCoverCopier().Copy(filepath.Join(inputRoot, "Artist/Album/01.flac"), inputRoot, config)
+	if err != nil || copied {
+		t.Errorf("Expected up to date copy to be kept, got %v, %v", copied, err)
+	}
+
+	// Prune removes copies whose source cover is gone
+	touch(t, outputRoot, "Artist/Album/01.opus", "Gone/Album/cover.jpg")
+	if err := pruneOutput(inputRoot, config); err != nil {
+		t.Fatalf("pruneOutput failed: %v", err)
+	}
+	if !exists(filepath.Join(outputRoot, "Artist/Album/cover.jpg")) {
+		t.Error("Expected cover with source to be kept")
+	}
+	if exists(filepath.Join(outputRoot, "Gone")) {
+		t.Error("Expected orphaned cover and its directory to be removed")
+	}
+}
+
+func TestThumbnailerGenerate(t *testing.T) {
+	dir := t.TempDir()
+	writeTestJPEG(t, filepath.Join(dir, "cover.jpg"), 600, 400)
+
+	config := Config{Write: true, CoverName: "cover.jpg"}
+	th := newThumbnailer(300)
+
+	generated, err := th.Generate(filepath.Join(dir, "01.flac"), config)
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	if !generated {
+		t.Fatal("Expected thumbnail to be generated")
+	}
+
+	file, err := os.Open(filepath.Join(dir, "cover_300.jpg"))
+	if err != nil {
+		t.Fatalf("Open thumbnail failed: %v", err)
+	}
+	defer file.Close()
+	cfg, _, err := image.DecodeConfig(file)
+	if err != nil {
+		t.Fatalf("DecodeConfig failed: %v", err)
+	}
+	if cfg.Width != 300 || cfg.Height != 200 {
+		t.Errorf("Expected 300x200 thumbnail, got %dx%d", cfg.Width, cfg.Height)
+	}
+
+	// Other tracks of the same album do not generate it again
+	generated, err = th.Generate(filepath.Join(dir, "02.flac"), config)
+	if err != nil || generated {
+		t.Errorf("Expected album to be handled once, got generated=%v err=%v", generated, err)
+	}
+
+	// A later run finds the thumbnail up to date
+	generated, err = newThumbnailer(300).Generate(filepath.Join(dir, "01.flac"), config)
+	if err != nil || generated {
+		t.Errorf("Expected up to date thumbnail to be skipped, got generated=%v err=%v", generated, err)
+	}
+}
+
+// installFakeOpusenc puts an opusenc shell script running body first into
+// PATH. The script gets the input and output file as $1 and $2.
+func installFakeOpusenc(t *testing.T, body string) {
+	t.Helper()
+	installFakeTool(t, "opusenc", body)
+}
+
+// installFakeTool puts a shell script with the given body into the PATH
+// as name.
+func installFakeTool(t *testing.T, name, body string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake encoder script needs a POSIX shell")
+	}
+
+	dir := t.TempDir()
+	script := "#!/bin/sh\n" + body + "\n"
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0o755); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestConvertOpus_StderrWarningsOnSuccess(t *testing.T) {
+	inputRoot := t.TempDir()
+	outputRoot := t.TempDir()
+	flacPath := filepath.Join(inputRoot, "Song.flac")
+	writeTestFlac(t, flacPath, []string{"TITLE=Title"})
+
+	validOpus := filepath.Join(t.TempDir(), "valid.opus")
+	writeTestOpus(t, validOpus, []string{"TITLE=Title"})
+
+	installFakeOpusenc(t, `echo "Warning: something benign" >&2; cp "`+validOpus+`" "$2"`)
+
+	config := Config{ConvertOpus: outputRoot, Write: true}
+	outcome, err := convertOpus(flacPath, inputRoot, config)
+	if err != nil {
+		t.Fatalf("convertOpus failed: %v", err)
+	}
+	if outcome != convertDone {
+		t.Errorf("Expected conversion to succeed, got outcome %d", outcome)
+	}
+	if !exists(filepath.Join(outputRoot, "Song.opus")) {
+		t.Error("Expected output file to exist")
+	}
+}
+
+func TestConvertOpus_EncodeTimeout(t *testing.T) {
+	inputRoot := t.TempDir()
+	outputRoot := t.TempDir()
+	flacPath := filepath.Join(inputRoot, "Song.flac")
+	writeTestFlac(t, flacPath, []string{"TITLE=Title"})
+
+	// Hangs after starting the output
+	installFakeOpusenc(t, `echo partial > "$2"; sleep 10`)
+
+	var warnings []string
+	config := Config{ConvertOpus: outputRoot, Write: true, EncodeTimeout: 100 * time.Millisecond, LogFunc: func(level LogLevel, format string, args ...any) {
+		if level == LogWarn {
+			warnings = append(warnings, fmt.Sprintf(format, args...))
+		}
+	}}
+	start := time.Now()
+	outcome, err := convertOpus(flacPath, inputRoot, config)
+	if err != nil {
+		t.Fatalf("Expected the timeout not to fail the run, got %v", err)
+	}
+	if outcome != convertTimedOut {
+		t.Errorf("Expected outcome %d, got %d", convertTimedOut, outcome)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the encoder to be killed, took %v", elapsed)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "timed out") {
+		t.Errorf("Expected a timeout warning, got %q", warnings)
+	}
+	entries, _ := os.ReadDir(outputRoot)
+	if len(entries) != 0 {
+		t.Errorf("Expected no output to be left, found %d entries", len(entries))
+	}
+}
+
+func TestConvertOpus_VerifyOpus(t *testing.T) {
+	inputRoot := t.TempDir()
+	outputRoot := t.TempDir()
+	flacPath := filepath.Join(inputRoot, "Song.flac")
+	writeTestFlac(t, flacPath, []string{"TITLE=Title"})
+	outputPath := filepath.Join(outputRoot, "Song.opus")
+	if err := os.WriteFile(outputPath, []byte("previous"), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(outputPath, old, old); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+
+	encoder := &fakeEncoder{opus: filepath.Join(t.TempDir(), "valid.opus")}
+	writeTestOpus(t, encoder.opus, []string{"TITLE=Title"})
+	var warnings []string
+	config := Config{ConvertOpus: outputRoot, Write: true, Encoder: encoder, VerifyOpus: true, LogFunc: func(level LogLevel, format string, args ...any) {
+		if level == LogWarn {
+			warnings = append(warnings, fmt.Sprintf(format, args...))
+		}
+	}}
+
+	// A broken file is dropped and the previous output kept
+	installFakeTool(t, "opusdec", `echo "Error: truncated stream" >&2; exit 1`)
+	outcome, err := convertOpus(flacPath, inputRoot, config)
+	if err != nil || outcome != convertVerifyFailed {
+		t.Fatalf("Expected outcome %d, got %d, %v", convertVerifyFailed, outcome, err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "truncated stream") {
+		t.Errorf("Expected a warning with the decoder error, got %q", warnings)
+	}
+	if data, _ := os.ReadFile(outputPath); string(data) != "previous" {
+		t.Errorf("Expected the previous output to be kept, got %q", data)
+	}
+	if exists(outputPath + tempSuffix) {
+		t.Error("Expected the temp file to be removed")
+	}
+
+	installFakeTool(t, "opusdec", `exit 0`)
+	if outcome, err := convertOpus(flacPath, inputRoot, config); err != nil || outcome != convertDone {
+		t.Errorf("Expected outcome %d, got %d, %v", convertDone, outcome, err)
+	}
+}
+
+func TestConvertOpus_InvalidOutput(t *testing.T) {
+	inputRoot := t.TempDir()
+	outputRoot := t.TempDir()
+	flacPath := filepath.Join(inputRoot, "Song.flac")
+	writeTestFlac(t, flacPath, []string{"TITLE=Title"})
+
+	// Exits 0 but leaves an empty file behind
+	installFakeOpusenc(t, `: > "$2"`)
+
+	config := Config{ConvertOpus: outputRoot, Write: true}
+	outcome, err := convertOpus(flacPath, inputRoot, config)
+	if err == nil || outcome != convertFailed {
+		t.Fatalf("Expected conversion to fail, got outcome %d err %v", outcome, err)
+	}
+	if exists(filepath.Join(outputRoot, "Song.opus")) || exists(filepath.Join(outputRoot, "Song.opus.tmp")) {
+		t.Error("Expected no output or temp file to remain")
+	}
+}
+
+// fakeEncoder records its calls and copies a prepared Opus file, or
+// leaves a partial file and fails when err is set.
+type fakeEncoder struct {
+	opus     string
+	err      error
+	calls    []string
+	pictures []string
+	bitrates []float64
+	comments [][]string
+}
+
+func (e *fakeEncoder) Encode(in, out string, opts EncodeOptions) error {
+	e.calls = append(e.calls, out)
+	e.pictures = append(e.pictures, opts.Picture)
+	e.bitrates = append(e.bitrates, opts.Bitrate)
+	e.comments = append(e.comments, opts.Comments)
+	if e.err != nil {
+		os.WriteFile(out, []byte("partial"), 0o644)
+		return e.err
+	}
+	data, err := os.ReadFile(e.opus)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(out, data, 0o644)
+}
+
+func TestProcessFile_ConversionSizes(t *testing.T) {
+	inputRoot := t.TempDir()
+	outputRoot := t.TempDir()
+	flacPath := filepath.Join(inputRoot, "Album", "Song.flac")
+	writeTestFlac(t, flacPath, []string{"TITLE=Title"})
+
+	encoder := &fakeEncoder{opus: filepath.Join(t.TempDir(), "valid.opus")}
+	writeTestOpus(t, encoder.opus, []string{"TITLE=Title"})
+	config := Config{ConvertOpus: outputRoot, Write: true, Encoder: encoder, LogFunc: func(LogLevel, string, ...any) {}}
+
+	msg, err := processFile(flacPath, inputRoot, config)
+	if err != nil {
+		t.Fatalf("processFile failed: %v", err)
+	}
+	in, out := fileSize(t, flacPath), fileSize(t, encoder.opus)
+	if !msg.Converted || msg.InputBytes != in || msg.OutputBytes != out {
+		t.Errorf("Expected %d and %d bytes, got %+v", in, out, msg)
+	}
+
+	var stats Stats
+	stats.Add(msg)
+	stats.Add(StatsMsg{Converted: true, InputBytes: 1000, OutputBytes: 100})
+	if stats.inputBytes != in+1000 || stats.outputBytes != out+100 {
+		t.Errorf("Expected the sizes to add up, got %d and %d", stats.inputBytes, stats.outputBytes)
+	}
+
+	// Up to date files are not counted again
+	if msg, err := processFile(flacPath, inputRoot, config); err != nil || msg.InputBytes != 0 {
+		t.Errorf("Expected no sizes for an up to date file, got %+v (%v)", msg, err)
+	}
+}
+
+// concurrentEncoder copies a prepared Opus file slowly and records how
+// many encodes ran at the same time.
+type concurrentEncoder struct {
+	opus    string
+	mu      sync.Mutex
+	running int
+	max     int
+}
+
+func (e *concurrentEncoder) Encode(in, out string, opts EncodeOptions) error {
+	e.mu.Lock()
+	e.running++
+	e.max = max(e.max, e.running)
+	e.mu.Unlock()
+	defer func() {
+		e.mu.Lock()
+		e.running--
+		e.mu.Unlock()
+	}()
+
+	opts.Log(LogInfo, "Encoding %s\n", filepath.Base(in))
+	time.Sleep(20 * time.Millisecond)
+	opts.Log(LogInfo, "Encoded %s\n", filepath.Base(in))
+	data, err := os.ReadFile(e.opus)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(out, data, 0o644)
+}
+
+func TestProcessList_Jobs(t *testing.T) {
+	inputRoot := t.TempDir()
+	outputRoot := t.TempDir()
+	var files []string
+	for i := range 8 {
+		file := filepath.Join(inputRoot, fmt.Sprintf("%02d.flac", i+1))
+		writeTestFlac(t, file, []string{"TITLE=Title"})
+		files = append(files, file)
+	}
+
+	encoder := &concurrentEncoder{opus: filepath.Join(t.TempDir(), "valid.opus")}
+	writeTestOpus(t, encoder.opus, []string{"TITLE=Title"})
+	var log []string
+	config := Config{ConvertOpus: outputRoot, Write: true, Encoder: encoder, Jobs: 3, LogFunc: func(level LogLevel, format string, args ...any) {
+		if strings.HasPrefix(format, "Encod") {
+			log = append(log, fmt.Sprintf(format, args...))
+		}
+	}}
+
+	var handled []string
+	interrupted := processList(context.Background(), files, inputRoot, config, func(filePath string, stats StatsMsg, err error) bool {
+		if err != nil || !stats.Converted {
+			t.Errorf("Expected %s to be converted, got %+v (%v)", filePath, stats, err)
+		}
+		handled = append(handled, filePath)
+		return true
+	})
+	if interrupted {
+		t.Error("Expected the run not to be interrupted")
+	}
+	if !slices.Equal(handled, files) {
+		t.Errorf("Expected the results in order, got %v", handled)
+	}
+	if encoder.max < 2 || encoder.max > 3 {
+		t.Errorf("Expected 2 to 3 encodes at a time, got %d", encoder.max)
+	}
+
+	// The lines of a file are kept together
+	for i := 0; i+1 < len(log); i += 2 {
+		name := strings.TrimSuffix(strings.TrimPrefix(log[i], "Encoding "), "\n")
+		if log[i+1] != "Encoded "+name+"\n" {
+			t.Errorf("Expected the log of %s together, got %q", name, log[i:i+2])
+		}
+	}
+
+	// Stopping waits for the files in flight without handling them
+	for _, file := range files {
+		os.Chtimes(file, time.Now().Add(time.Hour), time.Now().Add(time.Hour))
+	}
+	handled = nil
+	processList(context.Background(), files, inputRoot, config, func(filePath string, stats StatsMsg, err error) bool {
+		handled = append(handled, filePath)
+		return len(handled) < 2
+	})
+	if len(handled) != 2 {
+		t.Errorf("Expected 2 handled files, got %d", len(handled))
+	}
+	encoder.mu.Lock()
+	defer encoder.mu.Unlock()
+	if encoder.running != 0 {
+		t.Errorf("Expected no encodes left running, got %d", encoder.running)
+	}
+}
+
+func TestConvertOpus_Encoder(t *testing.T) {
+	inputRoot := t.TempDir()
+	outputRoot := t.TempDir()
+	flacPath := filepath.Join(inputRoot, "Album", "Song.flac")
+	writeTestFlac(t, flacPath, []string{"TITLE=Title"})
+	opusPath := filepath.Join(outputRoot, "Album", "Song.opus")
+
+	encoder := &fakeEncoder{opus: filepath.Join(t.TempDir(), "valid.opus")}
+	writeTestOpus(t, encoder.opus, []string{"TITLE=Title"})
+	config := Config{ConvertOpus: outputRoot, Write: true, Encoder: encoder}
+
+	// The encoder writes to a temp file that is renamed into place
+	outcome, err := convertOpus(flacPath, inputRoot, config)
+	if err != nil || outcome != convertDone {
+		t.Fatalf("Expected conversion, got outcome %d err %v", outcome, err)
+	}
+	if !slices.Equal(encoder.calls, []string{opusPath + ".tmp"}) {
+		t.Errorf("Expected encoding to the temp file, got %v", encoder.calls)
+	}
+	if !exists(opusPath) || exists(opusPath+".tmp") {
+		t.Error("Expected the temp file to be renamed")
+	}
+
+	// An up to date output is not encoded again
+	outcome, err = convertOpus(flacPath, inputRoot, config)
+	if err != nil || outcome != convertUpToDate || len(encoder.calls) != 1 {
+		t.Errorf("Expected up to date skip, got outcome %d err %v calls %d", outcome, err, len(encoder.calls))
+	}
+
+	// A failing encoder leaves the previous output and no temp file
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(flacPath, future, future); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+	encoder.err = errors.New("encoder crashed")
+	outcome, err = convertOpus(flacPath, inputRoot, config)
+	if !errors.Is(err, encoder.err) || outcome != convertFailed {
+		t.Errorf("Expected failure, got outcome %d err %v", outcome, err)
+	}
+	if !exists(opusPath) || exists(opusPath+".tmp") {
+		t.Error("Expected the previous output and no temp file")
+	}
+}
+
+func TestResolveOpusCover(t *testing.T) {
+	dir := t.TempDir()
+	flacPath := filepath.Join(dir, "Song.flac")
+	writeTestFlac(t, flacPath, []string{"TITLE=Title"})
+	config := Config{CoverName: "cover.jpg"}
+
+	// No cover at all
+	source, path, err := resolveOpusCover(flacPath, config)
+	if err != nil || source != opusCoverNone || path != "" {
+		t.Errorf("Expected no cover, got %d %q %v", source, path, err)
+	}
+
+	// Folder cover
+	coverPath := filepath.Join(dir, "cover.jpg")
+	writeTestJPEG(t, coverPath, 10, 10)
+	source, path, err = resolveOpusCover(flacPath, config)
+	if err != nil || source != opusCoverExternal || path != coverPath {
+		t.Errorf("Expected folder cover, got %d %q %v", source, path, err)
+	}
+
+	// A back cover does not count as embedded cover
+	f, err := flac.ParseFile(flacPath)
+	if err != nil {
+		t.Fatalf("ParseFile failed: %v", err)
+	}
+	back := &Picture{PictureType: 4, MimeType: "image/jpeg", Data: []byte{0x01}}
+	f.Meta = append(f.Meta, &flac.MetaDataBlock{Type: flac.Picture, Data: back.Marshal()})
+	if err := f.Save(flacPath); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if source, _, _ := resolveOpusCover(flacPath, config); source != opusCoverExternal {
+		t.Errorf("Expected folder cover next to a back cover, got %d", source)
+	}
+
+	// An embedded front cover wins over the folder cover
+	f, err = flac.ParseFile(flacPath)
+	if err != nil {
+		t.Fatalf("ParseFile failed: %v", err)
+	}
+	front := &Picture{PictureType: 3, MimeType: "image/jpeg", Data: []byte{0x01}}
+	f.Meta = append(f.Meta, &flac.MetaDataBlock{Type: flac.Picture, Data: front.Marshal()})
+	if err := f.Save(flacPath); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	source, path, err = resolveOpusCover(flacPath, config)
+	if err != nil || source != opusCoverEmbedded || path != "" {
+		t.Errorf("Expected embedded cover, got %d %q %v", source, path, err)
+	}
+}
+
+func TestConvertOpus_FolderCover(t *testing.T) {
+	inputRoot := t.TempDir()
+	outputRoot := t.TempDir()
+	flacPath := filepath.Join(inputRoot, "Song.flac")
+	writeTestFlac(t, flacPath, []string{"TITLE=Title"})
+	coverPath := filepath.Join(inputRoot, "cover.jpg")
+	writeTestJPEG(t, coverPath, 10, 10)
+
+	encoder := &fakeEncoder{opus: filepath.Join(t.TempDir(), "valid.opus")}
+	writeTestOpus(t, encoder.opus, []string{"TITLE=Title"})
+	config := Config{ConvertOpus: outputRoot, Write: true, CoverName: "cover.jpg", Encoder: encoder}
+
+	if _, err := convertOpus(flacPath, inputRoot, config); err != nil {
+		t.Fatalf("convertOpus failed: %v", err)
+	}
+	if !slices.Equal(encoder.pictures, []string{coverPath}) {
+		t.Errorf("Expected the folder cover to be passed to the encoder, got %v", encoder.pictures)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := map[int64]string{
+		512:     "512 B",
+		1536:    "1.5 KiB",
+		5 << 30: "5.0 GiB",
+	}
+	for in, expected := range tests {
+		if got := formatBytes(in); got != expected {
+			t.Errorf("formatBytes(%d): expected %q, got %q", in, expected, got)
+		}
+	}
+}
+
+func TestConvertOpus_MinFreeSpace(t *testing.T) {
+	inputRoot := t.TempDir()
+	outputRoot := t.TempDir()
+	flacPath := filepath.Join(inputRoot, "Song.flac")
+	writeTestFlac(t, flacPath, []string{"TITLE=Title"})
+
+	installFakeOpusenc(t, `exit 1`)
+
+	// No filesystem has an exabyte free
+	config := Config{ConvertOpus: outputRoot, Write: true, MinFreeSpace: 1 << 60}
+	_, err := convertOpus(flacPath, inputRoot, config)
+	if !errors.Is(err, errOutOfSpace) {
+		t.Fatalf("Expected errOutOfSpace, got %v", err)
+	}
+	if exists(filepath.Join(outputRoot, "Song.opus.tmp")) {
+		t.Error("Expected no temp file to remain")
+	}
+}
+
+func TestProcessCover_Description(t *testing.T) {
+	dir := t.TempDir()
+	writeTestJPEG(t, filepath.Join(dir, "cover.jpg"), 100, 100)
+
+	config := Config{
+		EmbedCover:       true,
+		CoverName:        "cover.jpg",
+		CoverDescription: "Front Cover – Vorderseite",
+	}
+
+	f := &flac.File{}
+	if _, err := processCover(filepath.Join(dir, "test.flac"), f, config); err != nil {
+		t.Fatalf("processCover failed: %v", err)
+	}
+	if len(f.Meta) != 1 {
+		t.Fatal("Expected cover to be embedded")
+	}
+
+	pic, err := ParsePicture(f.Meta[0].Data)
+	if err != nil {
+		t.Fatalf("ParsePicture failed: %v", err)
+	}
+	if pic.Description != config.CoverDescription {
+		t.Errorf("Expected description %q, got %q", config.CoverDescription, pic.Description)
+	}
+}
+
+// snapshotTree records path, size, mode and modification time of every
+// entry below root.
+func snapshotTree(t *testing.T, root string) map[string]string {
+	t.Helper()
+	snapshot := map[string]string{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		snapshot[path] = fmt.Sprintf("%d %v %v", info.Size(), info.Mode(), info.ModTime())
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+	return snapshot
+}
+
+func TestDryRun_NoChanges(t *testing.T) {
+	inputRoot := t.TempDir()
+	opusRoot := t.TempDir()
+	outputRoot := t.TempDir()
+
+	albumDir := filepath.Join(inputRoot, "Artist", "Album")
+	flacPath := filepath.Join(albumDir, "Song.flac")
+	writeTestFlac(t, flacPath, []string{
+		"TITLE=Old Title",
+		"MUSICBRAINZ_ALBUMID=1",
+		"MUSICBRAINZ_ALBUMID=2",
+	})
+	if err := os.Chmod(flacPath, 0o600); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	writeTestJPEG(t, filepath.Join(albumDir, "cover.jpg"), 400, 400)
+	writeTestOpus(t, filepath.Join(opusRoot, "Artist", "Album", "Song.opus"), []string{
+		"TITLE=New Title",
+	})
+	touch(t, outputRoot, "Gone/01.opus", "Artist/Album/02.opus.tmp")
+
+	validOpus := filepath.Join(t.TempDir(), "valid.opus")
+	writeTestOpus(t, validOpus, []string{"TITLE=Title"})
+	installFakeOpusenc(t, `cp "`+validOpus+`" "$2"`)
+
+	config := Config{
+		FixMBIDs:   true,
+		EmbedCover: true,
+		CoverName:  "cover.jpg",
+		LogFunc:    func(LogLevel, string, ...any) {},
+	}
+	if !config.DryRun() {
+		t.Fatal("Expected config without -w to be a dry run")
+	}
+
+	before := map[string]map[string]string{
+		inputRoot:  snapshotTree(t, inputRoot),
+		opusRoot:   snapshotTree(t, opusRoot),
+		outputRoot: snapshotTree(t, outputRoot),
+	}
+
+	if _, err := fixFlac(flacPath, config); err != nil {
+		t.Errorf("fixFlac failed: %v", err)
+	}
+
+	retagConfig := config
+	retagConfig.RetagOpus = opusRoot
+	if retagged, err := retagFromOpus(flacPath, inputRoot, retagConfig); err != nil || !retagged {
+		t.Errorf("Expected retag to be reported, got retagged=%v err=%v", retagged, err)
+	}
+
+	convertConfig := config
+	convertConfig.ConvertOpus = outputRoot
+	if outcome, err := convertOpus(flacPath, inputRoot, convertConfig); err != nil || outcome != convertDone {
+		t.Errorf("Expected conversion to be reported, got outcome=%d err=%v", outcome, err)
+	}
+	if err := pruneOutput(inputRoot, convertConfig); err != nil {
+		t.Errorf("pruneOutput failed: %v", err)
+	}
+
+	if generated, err := newThumbnailer(100).Generate(flacPath, config); err != nil || !generated {
+		t.Errorf("Expected thumbnail to be reported, got generated=%v err=%v", generated, err)
+	}
+
+	for root, snapshot := range before {
+		if got := snapshotTree(t, root); !maps.Equal(got, snapshot) {
+			t.Errorf("Dry run modified %s:\nbefore: %v\nafter:  %v", root, snapshot, got)
+		}
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for _, name := range []string{"error", "warn", "info", "verbose", "debug"} {
+		level, err := parseLogLevel(name)
+		if err != nil {
+			t.Errorf("parseLogLevel(%q) failed: %v", name, err)
+			continue
+		}
+		if level.String() != name {
+			t.Errorf("parseLogLevel(%q) = %v", name, level)
+		}
+	}
+	if level, err := parseLogLevel("WARN"); err != nil || level != LogWarn {
+		t.Errorf("Expected case-insensitive match, got %v, %v", level, err)
+	}
+	if _, err := parseLogLevel("trace"); err == nil {
+		t.Error("Expected error for unknown level")
+	}
+}
+
+func TestConfigLogLevel(t *testing.T) {
+	var logged []LogLevel
+	config := Config{
+		LogLevel: LogWarn,
+		LogFunc: func(level LogLevel, format string, args ...any) {
+			logged = append(logged, level)
+		},
+	}
+	for _, level := range []LogLevel{LogError, LogWarn, LogInfo, LogVerbose, LogDebug} {
+		config.Log(level, "message\n")
+	}
+	if expected := []LogLevel{LogError, LogWarn}; !slices.Equal(logged, expected) {
+		t.Errorf("Expected levels %v to be logged, got %v", expected, logged)
+	}
+
+	// The zero value logs up to info
+	logged = nil
+	config.LogLevel = 0
+	config.Log(LogInfo, "message\n")
+	config.Log(LogVerbose, "message\n")
+	if expected := []LogLevel{LogInfo}; !slices.Equal(logged, expected) {
+		t.Errorf("Expected levels %v to be logged, got %v", expected, logged)
+	}
+}
+
+func TestStatsAdd_TagMerges(t *testing.T) {
+	var stats Stats
+	stats.Add(StatsMsg{MBMerged: true, MergedTags: []string{"MUSICBRAINZ_ARTISTID", "MUSICBRAINZ_ALBUMARTISTID"}})
+	stats.Add(StatsMsg{MBMerged: true, MergedTags: []string{"MUSICBRAINZ_ARTISTID"}})
+	stats.Add(StatsMsg{})
+
+	if stats.mbMerged != 2 {
+		t.Errorf("Expected 2 files with merges, got %d", stats.mbMerged)
+	}
+	expected := map[string]int{"MUSICBRAINZ_ARTISTID": 2, "MUSICBRAINZ_ALBUMARTISTID": 1}
+	if !maps.Equal(stats.tagMerges, expected) {
+		t.Errorf("Expected %v, got %v", expected, stats.tagMerges)
+	}
+}
+
+// prependID3v2 puts a minimal ID3v2.4 tag in front of the file at path and
+// returns the tag.
+func prependID3v2(t *testing.T, path string) []byte {
+	t.Helper()
+	frame := []byte("TIT2\x00\x00\x00\x06\x00\x00\x03Title")
+	padding := make([]byte, 200) // Makes the size use two syncsafe bytes
+	body := append(frame, padding...)
+	size := len(body)
+	tag := append([]byte{'I', 'D', '3', 4, 0, 0,
+		byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}, body...)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if err := os.WriteFile(path, append(slices.Clone(tag), data...), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	return tag
+}
+
+func TestFixFlac_LeadingID3v2(t *testing.T) {
+	dir := t.TempDir()
+	flacPath := filepath.Join(dir, "Song.flac")
+	writeTestFlac(t, flacPath, []string{"MUSICBRAINZ_ARTISTID=1", "MUSICBRAINZ_ARTISTID=2"})
+	tag := prependID3v2(t, flacPath)
+
+	f, id3, err := parseFlacFile(flacPath)
+	if err != nil {
+		t.Fatalf("parseFlacFile failed: %v", err)
+	}
+	if !bytes.Equal(id3, tag) {
+		t.Errorf("Expected the ID3v2 tag to be returned, got %d bytes", len(id3))
+	}
+	if len(f.Frames) == 0 {
+		t.Error("Expected audio frames after the tag")
+	}
+	if _, err := readStreamInfo(flacPath); err != nil {
+		t.Errorf("readStreamInfo failed: %v", err)
+	}
+
+	// Fixing keeps the tag unless asked to strip it
+	config := Config{Write: true, FixMBIDs: true, MergeTags: []string{"MUSICBRAINZ_ARTISTID"}}
+	if _, err := fixFlac(flacPath, config); err != nil {
+		t.Fatalf("fixFlac failed: %v", err)
+	}
+	data, err := os.ReadFile(flacPath)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if !bytes.HasPrefix(data, tag) || !bytes.HasPrefix(data[len(tag):], []byte("fLaC")) {
+		t.Error("Expected the ID3v2 tag to be kept in front of the FLAC data")
+	}
+
+	config.StripID3v2 = true
+	if _, err := fixFlac(flacPath, config); err != nil {
+		t.Fatalf("fixFlac failed: %v", err)
+	}
+	data, err = os.ReadFile(flacPath)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if !bytes.HasPrefix(data, []byte("fLaC")) {
+		t.Error("Expected the ID3v2 tag to be stripped")
+	}
+	if got := readTestComments(t, flacPath); !slices.Equal(got, []string{"MUSICBRAINZ_ARTISTID=1+2"}) {
+		t.Errorf("Unexpected comments %v", got)
+	}
+}
+
+func TestOpusRules(t *testing.T) {
+	rulesPath := filepath.Join(t.TempDir(), "rules")
+	rules := `# Bitrate per file
+{BITRATE_HINT} BITRATE_HINT
+192 GENRE=classical*
+160 stream.bits>=24
+96
+`
+	if err := os.WriteFile(rulesPath, []byte(rules), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	parsed, err := loadOpusRules(rulesPath)
+	if err != nil {
+		t.Fatalf("loadOpusRules failed: %v", err)
+	}
+
+	si16 := &flac.StreamInfoBlock{SampleRate: 44100, BitDepth: 16, ChannelCount: 2}
+	si24 := &flac.StreamInfoBlock{SampleRate: 96000, BitDepth: 24, ChannelCount: 2}
+	tests := []struct {
+		name     string
+		tags     map[string][]string
+		si       *flac.StreamInfoBlock
+		expected float64
+	}{
+		{"template", map[string][]string{"BITRATE_HINT": {"256"}}, si24, 256},
+		{"invalid template value", map[string][]string{"BITRATE_HINT": {"high"}}, si16, 96},
+		{"tag pattern", map[string][]string{"GENRE": {"Rock", "Classical Music"}}, si16, 192},
+		{"streaminfo", nil, si24, 160},
+		{"default", map[string][]string{"GENRE": {"Rock"}}, si16, 96},
+	}
+	for _, tt := range tests {
+		if got, ok := parsed.Bitrate(tt.tags, tt.si); !ok || got != tt.expected {
+			t.Errorf("%s: expected %g, got %g (%v)", tt.name, tt.expected, got, ok)
+		}
+	}
+
+	// Without a catch-all rule the encoder default applies
+	if _, ok := parsed[:3].Bitrate(nil, si16); ok {
+		t.Error("Expected no match")
+	}
+
+	for _, invalid := range []string{"fast *", "-96 *", "96 stream.bits>x", "96 stream.length>1", "96 GENRE=[", "0"} {
+		if err := os.WriteFile(rulesPath, []byte(invalid+"\n"), 0o644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		if _, err := loadOpusRules(rulesPath); err == nil {
+			t.Errorf("Expected error for rule %q", invalid)
+		}
+	}
+}
+
+func TestConvertOpus_Rules(t *testing.T) {
+	inputRoot := t.TempDir()
+	outputRoot := t.TempDir()
+	flacPath := filepath.Join(inputRoot, "Song.flac")
+	writeTestFlac(t, flacPath, []string{"GENRE=Classical"})
+
+	encoder := &fakeEncoder{opus: filepath.Join(t.TempDir(), "valid.opus")}
+	writeTestOpus(t, encoder.opus, []string{"GENRE=Classical"})
+	config := Config{
+		ConvertOpus: outputRoot,
+		Write:       true,
+		Encoder:     encoder,
+		OpusRules:   opusRules{{bitrate: "192", cond: "GENRE=Classical"}},
+	}
+
+	if _, err := convertOpus(flacPath, inputRoot, config); err != nil {
+		t.Fatalf("convertOpus failed: %v", err)
+	}
+	if !slices.Equal(encoder.bitrates, []float64{192}) {
+		t.Errorf("Expected bitrate 192 to be passed to the encoder, got %v", encoder.bitrates)
+	}
+}
+
+func TestConvertOpus_Bitrate(t *testing.T) {
+	inputRoot := t.TempDir()
+	outputRoot := t.TempDir()
+	classical := filepath.Join(inputRoot, "Classical.flac")
+	rock := filepath.Join(inputRoot, "Rock.flac")
+	writeTestFlac(t, classical, []string{"GENRE=Classical"})
+	writeTestFlac(t, rock, []string{"GENRE=Rock"})
+
+	encoder := &fakeEncoder{opus: filepath.Join(t.TempDir(), "valid.opus")}
+	writeTestOpus(t, encoder.opus, nil)
+	config := Config{
+		ConvertOpus: outputRoot,
+		Write:       true,
+		Encoder:     encoder,
+		OpusBitrate: 96,
+	}
+	if _, err := convertOpus(rock, inputRoot, config); err != nil {
+		t.Fatalf("convertOpus failed: %v", err)
+	}
+
+	// Rules take precedence, the flag covers the rest
+	config.OpusRules = opusRules{{bitrate: "192", cond: "GENRE=Classical"}}
+	for _, file := range []string{classical, rock} {
+		os.Remove(filepath.Join(outputRoot, strings.TrimSuffix(filepath.Base(file), ".flac")+".opus"))
+		if _, err := convertOpus(file, inputRoot, config); err != nil {
+			t.Fatalf("convertOpus failed: %v", err)
+		}
+	}
+	if want := []float64{96, 192, 96}; !slices.Equal(encoder.bitrates, want) {
+		t.Errorf("Expected bitrates %v, got %v", want, encoder.bitrates)
+	}
+}
+
+func TestStatsAdd_Touched(t *testing.T) {
+	dir := t.TempDir()
+	var stats Stats
+	for i, comments := range [][]string{
+		{"ALBUM=Hits", "ALBUMARTIST=Band", "ARTIST=Band", "ARTIST=Guest"},
+		{"ALBUM=Hits", "ALBUMARTIST=Band", "ARTIST=Band"},
+		{"ALBUM=Hits", "ARTIST=Other"}, // Same title, different album
+	} {
+		path := filepath.Join(dir, fmt.Sprintf("%02d.flac", i))
+		writeTestFlac(t, path, comments)
+		f, err := flac.ParseFile(path)
+		if err != nil {
+			t.Fatalf("ParseFile failed: %v", err)
+		}
+		album, artists := trackIdentity(f)
+		stats.Add(StatsMsg{CoverEmbedded: true, Album: album, Artists: artists})
+	}
+	stats.Add(StatsMsg{}) // Untouched files do not count
+
+	if stats.touched != 3 || len(stats.albums) != 2 || len(stats.artists) != 3 {
+		t.Errorf("Expected 3 tracks, 2 albums, 3 artists, got %d, %d, %d",
+			stats.touched, len(stats.albums), len(stats.artists))
+	}
+}
+
+func TestProcessFiles_FailFast(t *testing.T) {
+	root := t.TempDir()
+	touch(t, root, "01.flac") // Not a valid FLAC file
+	writeTestFlac(t, filepath.Join(root, "02.flac"), []string{"TITLE=Title"})
+	info, err := os.Stat(root)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+
+	list, err := listFlacFiles(root, info, walkOptions{})
+	if err != nil {
+		t.Fatalf("listFlacFiles failed: %v", err)
+	}
+
+	run := func(config Config) (stats Stats, processed int, stopped bool) {
+		msgChan := make(chan tea.Msg, 100)
+		processFiles(context.Background(), root, info, list, config, msgChan)
+		close(msgChan)
+		for msg := range msgChan {
+			switch msg := msg.(type) {
+			case StatsMsg:
+				stats.Add(msg)
+				processed++
+			case stopMsg:
+				stopped = true
+			}
+		}
+		return stats, processed, stopped
+	}
+
+	stats, processed, stopped := run(Config{FixMBIDs: true})
+	if stopped || processed != 2 || stats.failed != 1 {
+		t.Errorf("Expected the run to continue after the error, got stopped=%v processed=%d failed=%d", stopped, processed, stats.failed)
+	}
+	if len(stats.failures) != 1 || stats.failures[0].Path != filepath.Join(root, "01.flac") || stats.failures[0].Err == nil {
+		t.Errorf("Expected the failure of 01.flac to be collected, got %v", stats.failures)
+	}
+
+	stats, processed, stopped = run(Config{FixMBIDs: true, FailFast: true})
+	if !stopped || processed != 1 || stats.failed != 1 {
+		t.Errorf("Expected the run to stop at the error, got stopped=%v processed=%d failed=%d", stopped, processed, stats.failed)
+	}
+}
+
+func TestProcessFiles_Interrupt(t *testing.T) {
+	root := t.TempDir()
+	writeTestFlac(t, filepath.Join(root, "01.flac"), []string{"MUSICBRAINZ_ARTISTID=a", "MUSICBRAINZ_ARTISTID=b"})
+	info, err := os.Stat(root)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	list, err := listFlacFiles(root, info, walkOptions{})
+	if err != nil {
+		t.Fatalf("listFlacFiles failed: %v", err)
+	}
+
+	// The key stops the worker but keeps the model waiting for it
+	ctx, cancel := context.WithCancel(context.Background())
+	abort, kill := context.WithCancel(context.Background())
+	m := model{state: stateProcessing, sub: make(chan tea.Msg, 100), ctx: ctx, cancel: cancel, kill: kill}
+	updated, cmd := m.Update(tea.KeyMsg{Type: tea.KeyCtrlC})
+	if m = updated.(model); !m.interrupted || m.quitting || cmd != nil || ctx.Err() == nil {
+		t.Fatalf("Expected the worker to be stopped, got interrupted=%v quitting=%v", m.interrupted, m.quitting)
+	}
+
+	config := Config{FixMBIDs: true, Write: true, MergeTags: []string{"MUSICBRAINZ_ARTISTID"}}
+	processFiles(ctx, root, info, list, config, m.sub)
+	close(m.sub)
+	for msg := range m.sub {
+		if _, ok := msg.(StatsMsg); ok {
+			t.Error("Expected no file to be processed after the interrupt")
+		}
+	}
+
+	// Pressing again kills the encoders, a third time quits right away
+	updated, _ = m.Update(tea.KeyMsg{Type: tea.KeyCtrlC})
+	if m = updated.(model); m.quitting || abort.Err() == nil {
+		t.Errorf("Expected a second interrupt to kill the encoders, got quitting=%v", m.quitting)
+	}
+	if updated, _ := m.Update(tea.KeyMsg{Type: tea.KeyCtrlC}); !updated.(model).quitting {
+		t.Error("Expected a third interrupt to quit")
+	}
+}
+
+func TestModel_ProgressBySize(t *testing.T) {
+	root := t.TempDir()
+	for name, size := range map[string]int{"01.flac": 100, "02.flac": 300} {
+		if err := os.WriteFile(filepath.Join(root, name), make([]byte, size), 0o644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+
+	run := func(bySize bool) []float64 {
+		t.Helper()
+		msg := listFilesCmd(root, info, walkOptions{}, bySize)()
+		m := model{progress: progress.New(), sub: make(chan tea.Msg, 100), ctx: context.Background()}
+		updated, _ := m.Update(msg)
+		m = updated.(model)
+		var got []float64
+		for range 2 {
+			updated, _ = m.Update(StatsMsg{})
+			m = updated.(model)
+			got = append(got, m.percent())
+		}
+		return got
+	}
+
+	if got, want := run(false), []float64{0.5, 1}; !slices.Equal(got, want) {
+		t.Errorf("Expected %v by count, got %v", want, got)
+	}
+	if got, want := run(true), []float64{0.25, 1}; !slices.Equal(got, want) {
+		t.Errorf("Expected %v by size, got %v", want, got)
+	}
+}
+
+func TestProcessTrackUID(t *testing.T) {
+	tests := []struct {
+		name     string
+		comments []string
+		modified bool
+		expected []string
+	}{
+		{"missing", []string{"MUSICBRAINZ_TRACKID=abc", "TITLE=Title"}, true,
+			[]string{"MUSICBRAINZ_TRACKID=abc", "TITLE=Title", "UFID=abc"}},
+		{"consistent", []string{"MUSICBRAINZ_TRACKID=abc", "UFID=abc"}, false,
+			[]string{"MUSICBRAINZ_TRACKID=abc", "UFID=abc"}},
+		{"inconsistent", []string{"ufid=old", "MUSICBRAINZ_TRACKID=abc", "UFID=other"}, true,
+			[]string{"MUSICBRAINZ_TRACKID=abc", "UFID=abc"}},
+		{"no track ID", []string{"TITLE=Title"}, false,
+			[]string{"TITLE=Title"}},
+		{"multiple track IDs", []string{"MUSICBRAINZ_TRACKID=abc", "MUSICBRAINZ_TRACKID=def"}, false,
+			[]string{"MUSICBRAINZ_TRACKID=abc", "MUSICBRAINZ_TRACKID=def"}},
+	}
+
+	for _, tt := range tests {
+		vc := &VorbisComment{Vendor: "vendor", Comments: tt.comments}
+		f := &flac.File{
+			Meta: []*flac.MetaDataBlock{{Type: flac.VorbisComment, Data: vc.Marshal()}},
+		}
+
+		modified, err := processTrackUID("test.flac", f, Config{TrackUID: true})
+		if err != nil {
+			t.Fatalf("%s: processTrackUID failed: %v", tt.name, err)
+		}
+		if modified != tt.modified {
+			t.Errorf("%s: expected modified=%v, got %v", tt.name, tt.modified, modified)
+		}
+		got, _ := ParseVorbisComment(f.Meta[0].Data)
+		if !slices.Equal(got.Comments, tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, got.Comments)
+		}
+	}
+}
+
+func TestProcessKeys(t *testing.T) {
+	tests := []struct {
+		name      string
+		comments  []string
+		rewritten int
+		expected  []string
+	}{
+		{"uppercase", []string{"ALBUM=Album", "TITLE=a=b"}, 0,
+			[]string{"ALBUM=Album", "TITLE=a=b"}},
+		{"mixed case", []string{"Album=Album", "title=a=b", "ARTIST=Artist"}, 2,
+			[]string{"ALBUM=Album", "TITLE=a=b", "ARTIST=Artist"}},
+		{"case duplicate", []string{"ALBUM=Album", "Album=Album", "Genre=Rock", "genre=Pop"}, 3,
+			[]string{"ALBUM=Album", "GENRE=Rock", "GENRE=Pop"}},
+		{"no separator", []string{"junk", "Junk"}, 0,
+			[]string{"junk", "Junk"}},
+	}
+
+	for _, tt := range tests {
+		vc := &VorbisComment{Vendor: "vendor", Comments: tt.comments}
+		f := &flac.File{
+			Meta: []*flac.MetaDataBlock{{Type: flac.VorbisComment, Data: vc.Marshal()}},
+		}
+
+		rewritten, err := processKeys("test.flac", f, Config{NormalizeKeys: true})
+		if err != nil {
+			t.Fatalf("%s: processKeys failed: %v", tt.name, err)
+		}
+		if rewritten != tt.rewritten {
+			t.Errorf("%s: expected %d rewritten keys, got %d", tt.name, tt.rewritten, rewritten)
+		}
+		got, _ := ParseVorbisComment(f.Meta[0].Data)
+		if !slices.Equal(got.Comments, tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, got.Comments)
+		}
+	}
+}
+
+func TestEnsureVorbisComment(t *testing.T) {
+	f := &flac.File{Meta: []*flac.MetaDataBlock{{Type: flac.StreamInfo}}}
+	if vorbisCommentBlock(f) != nil {
+		t.Fatal("Expected no comment block")
+	}
+
+	block := ensureVorbisComment(f)
+	if len(f.Meta) != 2 || f.Meta[1] != block || block.Type != flac.VorbisComment {
+		t.Fatalf("Expected a comment block to be appended, got %d blocks", len(f.Meta))
+	}
+	vc, err := ParseVorbisComment(block.Data)
+	if err != nil || vc.Vendor != vendorString || len(vc.Comments) != 0 {
+		t.Errorf("Expected an empty comment block, got %v (%v)", vc, err)
+	}
+
+	if again := ensureVorbisComment(f); again != block || len(f.Meta) != 2 {
+		t.Error("Expected the existing comment block to be reused")
+	}
+}
+
+func TestProcessValues(t *testing.T) {
+	comments := []string{"ARTIST=Artist ", "TITLE=Title\r", "ALBUM=Al\x00bum", "LYRICS=Line 1\r\nLine 2\n", " Genre =Rock", "junk "}
+	vc := &VorbisComment{Vendor: "vendor", Comments: comments}
+	f := &flac.File{
+		Meta: []*flac.MetaDataBlock{{Type: flac.VorbisComment, Data: vc.Marshal()}},
+	}
+
+	cleaned, err := processValues("test.flac", f, Config{TrimValues: true})
+	if err != nil {
+		t.Fatalf("processValues failed: %v", err)
+	}
+	if cleaned != 4 {
+		t.Errorf("Expected 4 cleaned values, got %d", cleaned)
+	}
+	// Keys and comments without a value are left alone
+	want := []string{"ARTIST=Artist", "TITLE=Title", "ALBUM=Album", "LYRICS=Line 1\nLine 2", " Genre =Rock", "junk "}
+	got, _ := ParseVorbisComment(f.Meta[0].Data)
+	if !slices.Equal(got.Comments, want) {
+		t.Errorf("Expected %q, got %q", want, got.Comments)
+	}
+
+	data := f.Meta[0].Data
+	if cleaned, err := processValues("test.flac", f, Config{TrimValues: true}); err != nil || cleaned != 0 || !bytes.Equal(f.Meta[0].Data, data) {
+		t.Errorf("Expected clean values to be left alone, got %d (%v)", cleaned, err)
+	}
+}
+
+func TestProcessSetTags(t *testing.T) {
+	setTags := []string{"albumartist=Various Artists", "GENRE=Rock", "GENRE=Pop", "COMPILATION=1"}
+	tests := []struct {
+		name     string
+		comments []string
+		changed  int
+		expected []string
+	}{
+		{"set", []string{"TITLE=Title", "AlbumArtist=Someone", "GENRE=Jazz", "ALBUMARTIST=Other"}, 3,
+			[]string{"TITLE=Title", "ALBUMARTIST=Various Artists", "GENRE=Rock", "GENRE=Pop", "COMPILATION=1"}},
+		{"already set", []string{"ALBUMARTIST=Various Artists", "GENRE=Rock", "GENRE=Pop", "COMPILATION=1"}, 0,
+			[]string{"ALBUMARTIST=Various Artists", "GENRE=Rock", "GENRE=Pop", "COMPILATION=1"}},
+		{"no comment block", nil, 3,
+			[]string{"ALBUMARTIST=Various Artists", "GENRE=Rock", "GENRE=Pop", "COMPILATION=1"}},
+	}
+
+	for _, tt := range tests {
+		f := &flac.File{}
+		if tt.comments != nil {
+			vc := &VorbisComment{Vendor: "vendor", Comments: tt.comments}
+			f.Meta = append(f.Meta, &flac.MetaDataBlock{Type: flac.VorbisComment, Data: vc.Marshal()})
+		}
+
+		changed, err := processSetTags("test.flac", f, Config{SetTags: setTags})
+		if err != nil {
+			t.Fatalf("%s: processSetTags failed: %v", tt.name, err)
+		}
+		if changed != tt.changed {
+			t.Errorf("%s: expected %d changed tags, got %d", tt.name, tt.changed, changed)
+		}
+		block := vorbisCommentBlock(f)
+		if block == nil {
+			t.Fatalf("%s: expected a comment block", tt.name)
+		}
+		got, _ := ParseVorbisComment(block.Data)
+		if !slices.Equal(got.Comments, tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, got.Comments)
+		}
+	}
+
+	for _, bad := range []string{"ALBUMARTIST", "=Value", "ALBUM~ARTIST=x"} {
+		if err := validateSetTag(bad); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+	if err := validateSetTag("COMMENT=a=b"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestProcessEmptyValues(t *testing.T) {
+	comments := []string{"TITLE=Title", "DISCNUMBER=", "COMMENT= \t", "MALFORMED", "ARTIST= Artist"}
+	vc := &VorbisComment{Vendor: "vendor", Comments: comments}
+	f := &flac.File{Meta: []*flac.MetaDataBlock{{Type: flac.VorbisComment, Data: vc.Marshal()}}}
+
+	removed, err := processEmptyValues("test.flac", f, Config{DropEmpty: true})
+	if err != nil {
+		t.Fatalf("processEmptyValues failed: %v", err)
+	}
+	if removed != 2 {
+		t.Errorf("Expected 2 removed tags, got %d", removed)
+	}
+	got, _ := ParseVorbisComment(f.Meta[0].Data)
+	expected := []string{"TITLE=Title", "MALFORMED", "ARTIST= Artist"}
+	if !slices.Equal(got.Comments, expected) {
+		t.Errorf("Expected %v, got %v", expected, got.Comments)
+	}
+
+	// Nothing left to remove, the block is not rewritten
+	data := f.Meta[0].Data
+	if removed, err := processEmptyValues("test.flac", f, Config{DropEmpty: true}); err != nil || removed != 0 || !bytes.Equal(f.Meta[0].Data, data) {
+		t.Errorf("Expected no changes, got %d (%v)", removed, err)
+	}
+}
+
+func TestArtistIDChecker(t *testing.T) {
+	root := t.TempDir()
+	const (
+		a = "11111111-1111-1111-1111-111111111111"
+		b = "22222222-2222-2222-2222-222222222222"
+		c = "33333333-3333-3333-3333-333333333333"
+	)
+	albums := map[string][][]string{
+		// The album artist is on one track, merged with a guest
+		"Good": {
+			{"MUSICBRAINZ_ARTISTID=" + a + "+" + b, "MUSICBRAINZ_ALBUMARTISTID=" + a},
+			{"MUSICBRAINZ_ARTISTID=" + b, "MUSICBRAINZ_ALBUMARTISTID=" + a},
+		},
+		"Swapped": {
+			{"MUSICBRAINZ_ARTISTID=" + a, "MUSICBRAINZ_ALBUMARTISTID=" + c},
+			{"MUSICBRAINZ_ARTISTID=" + b, "MUSICBRAINZ_ALBUMARTISTID=" + c},
+		},
+		"Compilation": {
+			{"MUSICBRAINZ_ARTISTID=" + a, "MUSICBRAINZ_ALBUMARTISTID=" + variousArtistsID},
+		},
+		"Untagged": {{"TITLE=Title"}},
+	}
+	checker := newArtistIDChecker()
+	for album, files := range albums {
+		for i, comments := range files {
+			path := filepath.Join(root, album, fmt.Sprintf("%02d.flac", i+1))
+			writeTestFlac(t, path, comments)
+			if err := checker.Add(path); err != nil {
+				t.Fatalf("Add failed: %v", err)
+			}
+		}
+	}
+
+	var warnings []string
+	checker.Report(Config{LogFunc: func(level LogLevel, format string, args ...any) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}})
+	if len(warnings) != 2 || !strings.HasPrefix(warnings[0], filepath.Join(root, "Swapped")+":") {
+		t.Errorf("Expected a warning for the swapped album only, got %q", warnings)
+	}
+}
+
+func TestProcessRenameTags(t *testing.T) {
+	comments := []string{"TITLE=Title", "ALBUM ARTIST=Artist A", "AlbumArtist=Artist B", "album artist=Artist B", "ALBUM ARTIST=Artist C"}
+	vc := &VorbisComment{Vendor: "vendor", Comments: comments}
+	f := &flac.File{Meta: []*flac.MetaDataBlock{{Type: flac.VorbisComment, Data: vc.Marshal()}}}
+	config := Config{RenameTags: []string{"Album Artist=albumartist", "COMMENT=DESCRIPTION"}}
+
+	// Values the new key already has are merged
+	renamed, err := processRenameTags("test.flac", f, config)
+	if err != nil || renamed != 3 {
+		t.Fatalf("Expected 3 renamed tags, got %d (%v)", renamed, err)
+	}
+	got, _ := ParseVorbisComment(f.Meta[0].Data)
+	expected := []string{"TITLE=Title", "ALBUMARTIST=Artist A", "AlbumArtist=Artist B", "ALBUMARTIST=Artist C"}
+	if !slices.Equal(got.Comments, expected) {
+		t.Errorf("Expected %v, got %v", expected, got.Comments)
+	}
+
+	// Files without the old key are not rewritten
+	data := f.Meta[0].Data
+	if renamed, err := processRenameTags("test.flac", f, config); err != nil || renamed != 0 || !bytes.Equal(f.Meta[0].Data, data) {
+		t.Errorf("Expected no changes, got %d (%v)", renamed, err)
+	}
+
+	for _, bad := range []string{"ALBUM ARTIST", "=ALBUMARTIST", "ALBUM ARTIST=", "Artist=ARTIST", "ALBUM ARTIST=ALBUM~ARTIST"} {
+		if err := validateRenameTag(bad); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
+
+func TestASCIIFold(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+		ok       bool
+	}{
+		{"Björk", "Bjork", true},
+		{"Motörhead – Ace of Spades", "Motorhead - Ace of Spades", true},
+		{"Ærøskøbing Straße", "AEroskobing Strasse", true},
+		{"ﬁve", "five", true},
+		{"坂本龍一", "", false},
+	} {
+		if got, ok := asciiFold(tc.in); got != tc.want || ok != tc.ok {
+			t.Errorf("asciiFold(%q) = %q, %v; expected %q, %v", tc.in, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestProcessASCIIFold(t *testing.T) {
+	comments := []string{
+		"ARTIST=Sigur Rós", "ARTIST=Björk",
+		"ALBUMARTIST=Beyoncé", "ALBUMARTISTSORT=Knowles, Beyoncé",
+		"TITLE=Plain", "COMPOSER=坂本龍一",
+	}
+	vc := &VorbisComment{Vendor: "vendor", Comments: comments}
+	f := &flac.File{Meta: []*flac.MetaDataBlock{{Type: flac.VorbisComment, Data: vc.Marshal()}}}
+	config := Config{ASCIIFold: []string{"ARTIST=artistsort", "ALBUMARTIST=ALBUMARTISTSORT", "TITLE=TITLESORT", "COMPOSER=COMPOSERSORT", "ALBUM=ALBUMSORT"}}
+
+	// Only the missing target of a source with non-ASCII values is written
+	written, err := processASCIIFold("test.flac", f, config)
+	if err != nil || written != 1 {
+		t.Fatalf("Expected 1 tag written, got %d (%v)", written, err)
+	}
+	got, _ := ParseVorbisComment(f.Meta[0].Data)
+	expected := append(slices.Clone(comments), "ARTISTSORT=Sigur Ros", "ARTISTSORT=Bjork")
+	if !slices.Equal(got.Comments, expected) {
+		t.Errorf("Expected %v, got %v", expected, got.Comments)
+	}
+
+	// The target exists now
+	data := f.Meta[0].Data
+	if written, err := processASCIIFold("test.flac", f, config); err != nil || written != 0 || !bytes.Equal(f.Meta[0].Data, data) {
+		t.Errorf("Expected no changes, got %d (%v)", written, err)
+	}
+
+	for _, bad := range []string{"ARTIST", "ARTIST=", "=ARTISTSORT", "ARTIST=artist", "ARTIST=ARTIST~SORT"} {
+		if err := validateASCIIFold(bad); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
+
+func TestProcessCompact(t *testing.T) {
+	blocks := func() []*flac.MetaDataBlock {
+		return []*flac.MetaDataBlock{
+			{Type: flac.StreamInfo, Data: make([]byte, 34)},
+			{Type: flac.Padding, Data: make([]byte, 100000)},
+			{Type: flac.SeekTable, Data: make([]byte, 18)},
+			{Type: flac.Application, Data: []byte("riffdata")},
+			{Type: flac.VorbisComment, Data: (&VorbisComment{Vendor: "test"}).Marshal()},
+			{Type: flac.Padding, Data: make([]byte, 50)},
+		}
+	}
+	types := func(meta []*flac.MetaDataBlock) []flac.BlockType {
+		var t []flac.BlockType
+		for _, block := range meta {
+			t = append(t, block.Type)
+		}
+		return t
+	}
+
+	f := &flac.File{Meta: blocks()}
+	if n := processCompact("test.flac", f, Config{Compact: true, CompactPadding: 1000}); n != 100050+4-1000 {
+		t.Errorf("Expected %d bytes reclaimed, got %d", 100050+4-1000, n)
+	}
+	expected := []flac.BlockType{flac.StreamInfo, flac.SeekTable, flac.Application, flac.VorbisComment, flac.Padding}
+	if got := types(f.Meta); !slices.Equal(got, expected) {
+		t.Errorf("Expected blocks %v, got %v", expected, got)
+	}
+	if len(f.Meta[4].Data) != 1000 {
+		t.Errorf("Expected 1000 bytes of padding, got %d", len(f.Meta[4].Data))
+	}
+
+	// Already compact
+	if n := processCompact("test.flac", f, Config{Compact: true, CompactPadding: 1000}); n != 0 {
+		t.Errorf("Expected nothing to reclaim, got %d", n)
+	}
+
+	// Padding that would grow is left alone
+	f = &flac.File{Meta: blocks()}
+	if n := processCompact("test.flac", f, Config{Compact: true, CompactPadding: 200000}); n != 0 || len(f.Meta) != 6 {
+		t.Errorf("Expected the metadata to be kept, got %d reclaimed and %d blocks", n, len(f.Meta))
+	}
+
+	f = &flac.File{Meta: blocks()}
+	processCompact("test.flac", f, Config{Compact: true, DropApplication: true})
+	expected = []flac.BlockType{flac.StreamInfo, flac.SeekTable, flac.VorbisComment}
+	if got := types(f.Meta); !slices.Equal(got, expected) {
+		t.Errorf("Expected blocks %v, got %v", expected, got)
+	}
+}
+
+func TestProcessReplayGain(t *testing.T) {
+	both := []string{"TITLE=Title", "REPLAYGAIN_TRACK_GAIN=-7.5 dB", "replaygain_track_peak=0.98", "R128_TRACK_GAIN=-1234", "R128_ALBUM_GAIN=-1100"}
+	tests := []struct {
+		name     string
+		prefer   string
+		comments []string
+		removed  int
+		warned   bool
+		expected []string
+	}{
+		{"keep track", "track", both, 2, false,
+			[]string{"TITLE=Title", "REPLAYGAIN_TRACK_GAIN=-7.5 dB", "replaygain_track_peak=0.98"}},
+		{"keep r128", "r128", both, 2, false,
+			[]string{"TITLE=Title", "R128_TRACK_GAIN=-1234", "R128_ALBUM_GAIN=-1100"}},
+		{"only r128", "track", []string{"R128_TRACK_GAIN=-1234"}, 0, false,
+			[]string{"R128_TRACK_GAIN=-1234"}},
+		{"neither", "track", []string{"TITLE=Title"}, 0, true,
+			[]string{"TITLE=Title"}},
+	}
+
+	for _, tt := range tests {
+		vc := &VorbisComment{Vendor: "vendor", Comments: tt.comments}
+		f := &flac.File{Meta: []*flac.MetaDataBlock{{Type: flac.VorbisComment, Data: vc.Marshal()}}}
+		warned := false
+		config := Config{ReplayGainPrefer: tt.prefer, LogFunc: func(level LogLevel, format string, args ...any) {
+			if level == LogWarn {
+				warned = true
+			}
+		}}
+
+		removed, err := processReplayGain("test.flac", f, config)
+		if err != nil {
+			t.Fatalf("%s: processReplayGain failed: %v", tt.name, err)
+		}
+		if removed != tt.removed || warned != tt.warned {
+			t.Errorf("%s: expected %d removed (warned %v), got %d (warned %v)", tt.name, tt.removed, tt.warned, removed, warned)
+		}
+		got, _ := ParseVorbisComment(f.Meta[0].Data)
+		if !slices.Equal(got.Comments, tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, got.Comments)
+		}
+	}
+}
+
+func TestProcessStripTags(t *testing.T) {
+	comments := []string{"TITLE=Title", "comment=Ripped", "ENCODEDBY=Ripper", "COMMENT=Again", "ARTIST=Artist"}
+	vc := &VorbisComment{Vendor: "vendor", Comments: comments}
+	f := &flac.File{
+		Meta: []*flac.MetaDataBlock{{Type: flac.VorbisComment, Data: vc.Marshal()}},
+	}
+	data := f.Meta[0].Data
+
+	removed, err := processStripTags("test.flac", f, Config{StripTags: []string{"MISSING"}})
+	if err != nil {
+		t.Fatalf("processStripTags failed: %v", err)
+	}
+	if removed != 0 || !bytes.Equal(f.Meta[0].Data, data) {
+		t.Errorf("Expected no changes, got %d removed tags", removed)
+	}
+
+	removed, err = processStripTags("test.flac", f, Config{StripTags: []string{"Comment", "encodedby"}})
+	if err != nil {
+		t.Fatalf("processStripTags failed: %v", err)
+	}
+	if removed != 3 {
+		t.Errorf("Expected 3 removed tags, got %d", removed)
+	}
+	got, _ := ParseVorbisComment(f.Meta[0].Data)
+	if expected := []string{"TITLE=Title", "ARTIST=Artist"}; !slices.Equal(got.Comments, expected) {
+		t.Errorf("Expected %v, got %v", expected, got.Comments)
+	}
+}
+
+func TestProcessDuplicates(t *testing.T) {
+	tests := []struct {
+		name     string
+		comments []string
+		removed  int
+		expected []string
+	}{
+		{"unique", []string{"GENRE=Rock", "GENRE=Pop", "TITLE=Title"}, 0,
+			[]string{"GENRE=Rock", "GENRE=Pop", "TITLE=Title"}},
+		{"duplicates", []string{"GENRE=Rock", "TITLE=Title", "GENRE=Rock", "GENRE=Pop", "GENRE=Rock"}, 2,
+			[]string{"GENRE=Rock", "TITLE=Title", "GENRE=Pop"}},
+		{"not byte-identical", []string{"GENRE=Rock", "genre=Rock", "GENRE=rock"}, 0,
+			[]string{"GENRE=Rock", "genre=Rock", "GENRE=rock"}},
+	}
+
+	for _, tt := range tests {
+		vc := &VorbisComment{Vendor: "vendor", Comments: tt.comments}
+		f := &flac.File{
+			Meta: []*flac.MetaDataBlock{{Type: flac.VorbisComment, Data: vc.Marshal()}},
+		}
+
+		removed, err := processDuplicates("test.flac", f, Config{DedupTags: true})
+		if err != nil {
+			t.Fatalf("%s: processDuplicates failed: %v", tt.name, err)
+		}
+		if removed != tt.removed {
+			t.Errorf("%s: expected %d removed tags, got %d", tt.name, tt.removed, removed)
+		}
+		got, _ := ParseVorbisComment(f.Meta[0].Data)
+		if !slices.Equal(got.Comments, tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, got.Comments)
+		}
+	}
+}
+
+func TestFixFlac_CorruptCover(t *testing.T) {
+	dir := t.TempDir()
+	flacPath := filepath.Join(dir, "Song.flac")
+	writeTestFlac(t, flacPath, []string{"MUSICBRAINZ_ARTISTID=1", "MUSICBRAINZ_ARTISTID=2"})
+	if err := os.WriteFile(filepath.Join(dir, "cover.jpg"), []byte("\xff\xd8truncated"), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	config := Config{
+		Write:      true,
+		FixMBIDs:   true,
+		MergeTags:  []string{"MUSICBRAINZ_ARTISTID"},
+		EmbedCover: true,
+		CoverName:  "cover.jpg",
+	}
+
+	// With --strict-cover the file fails as a whole
+	strict := config
+	strict.StrictCover = true
+	if _, err := fixFlac(flacPath, strict); !errors.Is(err, errCorruptCover) {
+		t.Errorf("Expected corrupt cover error, got %v", err)
+	}
+
+	// Otherwise the embed is skipped and the other fixes are saved
+	stats, err := fixFlac(flacPath, config)
+	if err != nil {
+		t.Fatalf("fixFlac failed: %v", err)
+	}
+	if !stats.MBIDsFixed || stats.CoverEmbedded {
+		t.Errorf("Expected only MB IDs to be fixed, got %+v", stats)
+	}
+	if got := readTestComments(t, flacPath); !slices.Equal(got, []string{"MUSICBRAINZ_ARTISTID=1+2"}) {
+		t.Errorf("Unexpected comments %v", got)
+	}
+}
+
+func TestLMSLinter(t *testing.T) {
+	dir := t.TempDir()
+	clean := filepath.Join(dir, "clean.flac")
+	writeTestFlac(t, clean, []string{"COMPILATION=1", "DATE=1999-05-01", "YEAR=1999", "ALBUMARTIST=Band"})
+	broken := filepath.Join(dir, "broken.flac")
+	writeTestFlac(t, broken, []string{
+		"compilation=yes",
+		"DATE=2001",
+		"YEAR=1999",
+		"ARTISTS=A",
+		"ALBUMARTIST=A",
+		"ALBUMARTIST=B",
+	})
+
+	var lint lmsLinter
+	for _, path := range []string{clean, broken} {
+		if err := lint.Check(path); err != nil {
+			t.Fatalf("Check failed: %v", err)
+		}
+	}
+
+	if lint.checked != 2 || len(lint.findings) != 4 {
+		t.Fatalf("Expected 4 findings in 2 files, got %d in %d: %v", len(lint.findings), lint.checked, lint.findings)
+	}
+	for _, f := range lint.findings {
+		if f.path != broken {
+			t.Errorf("Unexpected finding for %s: %s", f.path, f.message)
+		}
+	}
+}
+
+func TestProcessFile_OutDir(t *testing.T) {
+	inputRoot := t.TempDir()
+	outDir := t.TempDir()
+	fixed := filepath.Join(inputRoot, "Album", "01.flac")
+	clean := filepath.Join(inputRoot, "Album", "02.flac")
+	touch(t, inputRoot, "Album/01.flac")
+	writeTestFlac(t, fixed, []string{"MUSICBRAINZ_ARTISTID=1", "MUSICBRAINZ_ARTISTID=2"})
+	writeTestFlac(t, clean, []string{"MUSICBRAINZ_ARTISTID=1"})
+	touch(t, outDir, "Gone/01.flac")
+	before, err := os.ReadFile(fixed)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+
+	config := Config{Write: true, FixMBIDs: true, MergeTags: []string{"MUSICBRAINZ_ARTISTID"}, OutDir: outDir}
+	for _, file := range []string{fixed, clean} {
+		if _, err := processFile(file, inputRoot, config); err != nil {
+			t.Fatalf("processFile(%s) failed: %v", file, err)
+		}
+	}
+
+	after, err := os.ReadFile(fixed)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("Expected the source file to be left untouched")
+	}
+	out := filepath.Join(outDir, "Album", "01.flac")
+	if got := readTestComments(t, out); !slices.Equal(got, []string{"MUSICBRAINZ_ARTISTID=1+2"}) {
+		t.Errorf("Unexpected comments %v in output", got)
+	}
+	if exists(filepath.Join(outDir, "Album", "02.flac")) {
+		t.Error("Expected unmodified file not to be copied without --copy-unmodified")
+	}
+
+	config.CopyUnmodified = true
+	if _, err := processFile(clean, inputRoot, config); err != nil {
+		t.Fatalf("processFile failed: %v", err)
+	}
+	if got := readTestComments(t, filepath.Join(outDir, "Album", "02.flac")); !slices.Equal(got, []string{"MUSICBRAINZ_ARTISTID=1"}) {
+		t.Errorf("Unexpected comments %v in copied file", got)
+	}
+
+	if err := pruneOutput(inputRoot, config); err != nil {
+		t.Fatalf("pruneOutput failed: %v", err)
+	}
+	if exists(filepath.Join(outDir, "Gone")) {
+		t.Error("Expected orphaned output to be pruned")
+	}
+	if !exists(out) {
+		t.Error("Expected mirrored output to be kept")
+	}
+}
+
+func TestCheckOpusencOptions(t *testing.T) {
+	help := `Usage: opusenc [options] input_file output_file.opus
+Encoding options:
+ --bitrate n.nnn    Set target bitrate in kbit/sec (6-256/channel)
+ --vbr              Use variable bitrate encoding (default)
+Metadata options:
+ --picture file     Attach album art (see --help-picture)
+`
+	supported := parseOpusencOptions(help)
+	for _, option := range []string{"--bitrate", "--vbr", "--picture", "--help-picture"} {
+		if !supported[option] {
+			t.Errorf("Expected %s to be supported", option)
+		}
+	}
+
+	config := Config{OpusRules: opusRules{{bitrate: "96"}}}
+	if err := checkOpusencOptions(supported, config); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	delete(supported, "--bitrate")
+	if err := checkOpusencOptions(supported, Config{}); err != nil {
+		t.Errorf("Expected --bitrate not to be needed without rules, got %v", err)
+	}
+	err := checkOpusencOptions(supported, config)
+	if err == nil || !strings.Contains(err.Error(), "--bitrate") {
+		t.Errorf("Expected an error about --bitrate, got %v", err)
+	}
+}
+
+func TestProbeOpusenc(t *testing.T) {
+	installFakeOpusenc(t, `echo " --picture file  Attach album art"; exit 1`)
+	supported, err := probeOpusenc()
+	if err != nil {
+		t.Fatalf("probeOpusenc failed: %v", err)
+	}
+	if !supported["--picture"] || supported["--bitrate"] {
+		t.Errorf("Unexpected options %v", supported)
+	}
+
+	installFakeOpusenc(t, `exit 1`)
+	if _, err := probeOpusenc(); err == nil {
+		t.Error("Expected an error without help output")
+	}
+}
+
+func TestConvertOpus_TagsOnly(t *testing.T) {
+	inputRoot := t.TempDir()
+	outputRoot := t.TempDir()
+	flacPath := filepath.Join(inputRoot, "Song.flac")
+	opusPath := filepath.Join(outputRoot, "Song.opus")
+	writeTestFlac(t, flacPath, []string{"TITLE=New", "ARTIST=Artist"})
+
+	// A picture large enough to span several Ogg pages
+	f, err := flac.ParseFile(flacPath)
+	if err != nil {
+		t.Fatalf("ParseFile failed: %v", err)
+	}
+	pic := &Picture{PictureType: 3, MimeType: "image/jpeg", Data: bytes.Repeat([]byte{0xAB}, 100000)}
+	f.Meta = append(f.Meta, &flac.MetaDataBlock{Type: flac.Picture, Data: pic.Marshal()})
+	if err := f.Save(flacPath); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	writeTestOpus(t, opusPath, []string{"ENCODER=opusenc", "TITLE=Old"})
+	audio := oggPage{Granule: 960, Sequence: 2, Segments: []byte{4}, Body: []byte("abcd")}
+	file, err := os.OpenFile(opusPath, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	file.Write(audio.Marshal())
+	file.Close()
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(opusPath, old, old); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+
+	encoder := &fakeEncoder{err: errors.New("should not encode")}
+	config := Config{ConvertOpus: outputRoot, Write: true, OpusTagsOnly: true, Encoder: encoder}
+	outcome, err := convertOpus(flacPath, inputRoot, config)
+	if err != nil {
+		t.Fatalf("convertOpus failed: %v", err)
+	}
+	if outcome != convertTagsUpdated {
+		t.Errorf("Expected tags to be updated, got outcome %v", outcome)
+	}
+	if len(encoder.calls) != 0 {
+		t.Error("Expected no encoder run")
+	}
+
+	vc, err := readOpusTags(opusPath)
+	if err != nil {
+		t.Fatalf("readOpusTags failed: %v", err)
+	}
+	want := []string{"ENCODER=opusenc", "TITLE=New", "ARTIST=Artist", "METADATA_BLOCK_PICTURE=" + base64.StdEncoding.EncodeToString(pic.Marshal())}
+	if !slices.Equal(vc.Comments, want) {
+		t.Errorf("Unexpected comments %.80q", vc.Comments)
+	}
+
+	data, err := os.ReadFile(opusPath)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	pages, err := parseOggPages(data)
+	if err != nil {
+		t.Fatalf("parseOggPages failed: %v", err)
+	}
+	if len(pages) < 4 {
+		t.Fatalf("Expected the tags to span several pages, got %d pages", len(pages))
+	}
+	for i, page := range pages {
+		if page.Sequence != uint32(i) {
+			t.Errorf("Page %d has sequence number %d", i, page.Sequence)
+		}
+	}
+	if last := pages[len(pages)-1]; !bytes.Equal(last.Body, audio.Body) || last.Granule != audio.Granule {
+		t.Error("Expected the audio page to be kept")
+	}
+
+	// Up to date now
+	if outcome, err := convertOpus(flacPath, inputRoot, config); err != nil || outcome != convertUpToDate {
+		t.Errorf("Expected up to date, got %v, %v", outcome, err)
+	}
+}
+
+func TestParseOggPages_Checksum(t *testing.T) {
+	data := oggPage{Segments: []byte{3}, Body: []byte("abc")}.Marshal()
+	if _, err := parseOggPages(data); err != nil {
+		t.Fatalf("parseOggPages failed: %v", err)
+	}
+	data[len(data)-1] ^= 0xFF
+	if _, err := parseOggPages(data); err == nil {
+		t.Error("Expected a checksum error")
+	}
+}
+
+func TestRun_DryRunExitCode(t *testing.T) {
+	root := t.TempDir()
+	writeTestFlac(t, filepath.Join(root, "01.flac"), []string{"MUSICBRAINZ_ARTISTID=a"})
+	info, err := os.Stat(root)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	config := Config{FixMBIDs: true, MergeTags: []string{"MUSICBRAINZ_ARTISTID"}, LogFunc: func(LogLevel, string, ...any) {}}
+
+	if code := run(root, info, config); code != 0 {
+		t.Errorf("Expected 0 for a clean tree, got %d", code)
+	}
+
+	writeTestFlac(t, filepath.Join(root, "02.flac"), []string{"MUSICBRAINZ_ARTISTID=a", "MUSICBRAINZ_ARTISTID=b"})
+	if code := run(root, info, config); code != exitWouldChange {
+		t.Errorf("Expected %d for a dry-run with changes, got %d", exitWouldChange, code)
+	}
+	config.Write = true
+	if code := run(root, info, config); code != 0 {
+		t.Errorf("Expected 0 after writing the changes, got %d", code)
+	}
+}
+
+func TestListOrphans(t *testing.T) {
+	inputRoot := t.TempDir()
+	outputRoot := t.TempDir()
+
+	touch(t, inputRoot, "Artist/Album/01.flac")
+	touch(t, outputRoot,
+		"Artist/Album/01.opus",
+		"Artist/Album/02.opus",
+		"Gone/Album/01.opus",
+		"Gone/Album/02.opus.tmp",
+		"Mixed/Album/01.opus",
+		"Mixed/notes.txt",
+	)
+	before := snapshotTree(t, outputRoot)
+
+	var lines []string
+	config := Config{ConvertOpus: outputRoot, ListOrphans: true, LogFunc: func(level LogLevel, format string, args ...any) {
+		lines = append(lines, strings.TrimSpace(fmt.Sprintf(format, args...)))
+	}}
+	info, err := os.Stat(inputRoot)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if code := run(inputRoot, info, config); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+
+	if after := snapshotTree(t, outputRoot); !maps.Equal(before, after) {
+		t.Error("Expected the output to be left untouched")
+	}
+	slices.Sort(lines)
+	want := []string{
+		"[DRY-RUN] Would remove empty directory: " + filepath.Join(outputRoot, "Gone"),
+		"[DRY-RUN] Would remove empty directory: " + filepath.Join(outputRoot, "Gone", "Album"),
+		"[DRY-RUN] Would remove empty directory: " + filepath.Join(outputRoot, "Mixed", "Album"),
+		"[DRY-RUN] Would remove orphan: " + filepath.Join(outputRoot, "Artist", "Album", "02.opus"),
+		"[DRY-RUN] Would remove orphan: " + filepath.Join(outputRoot, "Gone", "Album", "01.opus"),
+		"[DRY-RUN] Would remove orphan: " + filepath.Join(outputRoot, "Mixed", "Album", "01.opus"),
+		"[DRY-RUN] Would remove stale temp file: " + filepath.Join(outputRoot, "Gone", "Album", "02.opus.tmp"),
+	}
+	if !slices.Equal(lines, want) {
+		t.Errorf("Unexpected report:\n%s", strings.Join(lines, "\n"))
+	}
+}
+
+func TestProcessMBIDs_MergeFirst(t *testing.T) {
+	vc := &VorbisComment{
+		Vendor: "vendor",
+		Comments: []string{
+			"MUSICBRAINZ_ARTISTID=id1",
+			"TITLE=Title",
+			"MUSICBRAINZ_ARTISTID=id2",
+			"MUSICBRAINZ_ARTISTID=id3",
+		},
+	}
+	f := &flac.File{Meta: []*flac.MetaDataBlock{{Type: flac.VorbisComment, Data: vc.Marshal()}}}
+
+	config := Config{FixMBIDs: true, MergeTags: []string{"MUSICBRAINZ_ARTISTID"}, MergeMode: MergeFirst}
+	merged, err := processMBIDs("test.flac", f, config)
+	if err != nil {
+		t.Fatalf("processMBIDs failed: %v", err)
+	}
+	want := []TagChange{{Tag: "MUSICBRAINZ_ARTISTID", Before: []string{"id1", "id2", "id3"}, After: []string{"id1"}}}
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("Expected MUSICBRAINZ_ARTISTID to be reported, got %v", merged)
+	}
+
+	newVC, err := ParseVorbisComment(f.Meta[0].Data)
+	if err != nil {
+		t.Fatalf("ParseVorbisComment failed: %v", err)
+	}
+	if want := []string{"TITLE=Title", "MUSICBRAINZ_ARTISTID=id1"}; !slices.Equal(newVC.Comments, want) {
+		t.Errorf("Expected %v, got %v", want, newVC.Comments)
+	}
+}
+
+func TestProcessMBIDs_MergeSeparator(t *testing.T) {
+	vc := &VorbisComment{
+		Vendor:   "vendor",
+		Comments: []string{"MUSICBRAINZ_ARTISTID=id1", "MUSICBRAINZ_ARTISTID=id2"},
+	}
+	f := &flac.File{Meta: []*flac.MetaDataBlock{{Type: flac.VorbisComment, Data: vc.Marshal()}}}
+
+	config := Config{FixMBIDs: true, MergeTags: []string{"MUSICBRAINZ_ARTISTID"}, MergeSeparator: ";"}
+	if _, err := processMBIDs("test.flac", f, config); err != nil {
+		t.Fatalf("processMBIDs failed: %v", err)
+	}
+
+	newVC, err := ParseVorbisComment(f.Meta[0].Data)
+	if err != nil {
+		t.Fatalf("ParseVorbisComment failed: %v", err)
+	}
+	if want := []string{"MUSICBRAINZ_ARTISTID=id1;id2"}; !slices.Equal(newVC.Comments, want) {
+		t.Errorf("Expected %v, got %v", want, newVC.Comments)
+	}
+}
+
+func TestProcessMBIDs_Malformed(t *testing.T) {
+	const id1, id2 = "b10bbbfc-cf9e-42e0-be17-e2c3e1d2600d", "0383dadf-2a4e-4d10-a46a-e9e041da8eb3"
+	comments := []string{"MUSICBRAINZ_ARTISTID=" + id1, "MUSICBRAINZ_ARTISTID=n/a", "MUSICBRAINZ_ALBUMARTISTID=" + id1 + "+" + id2, "MUSICBRAINZ_ALBUMARTISTID=" + id2}
+
+	for _, strict := range []bool{false, true} {
+		vc := &VorbisComment{Vendor: "vendor", Comments: comments}
+		f := &flac.File{Meta: []*flac.MetaDataBlock{{Type: flac.VorbisComment, Data: vc.Marshal()}}}
+
+		var warnings []string
+		config := Config{
+			FixMBIDs:   true,
+			StrictMBID: strict,
+			MergeTags:  []string{"MUSICBRAINZ_ARTISTID", "MUSICBRAINZ_ALBUMARTISTID"},
+			LogLevel:   LogWarn,
+			LogFunc: func(level LogLevel, format string, args ...any) {
+				warnings = append(warnings, fmt.Sprintf(format, args...))
+			},
+		}
+		merged, err := processMBIDs("test.flac", f, config)
+		if err != nil {
+			t.Fatalf("processMBIDs failed: %v", err)
+		}
+		if len(warnings) == 0 || !strings.Contains(warnings[0], `Malformed MUSICBRAINZ_ARTISTID "n/a"`) {
+			t.Errorf("Expected a warning about the malformed ID, got %q", warnings)
+		}
+
+		// Joined values are checked part by part
+		for _, w := range warnings {
+			if strings.Contains(w, "ALBUMARTISTID") {
+				t.Errorf("Unexpected warning %q", w)
+			}
+		}
+		want := 2
+		if strict {
+			want = 0
+		}
+		if len(merged) != want {
+			t.Errorf("strict=%v: Expected %d merged tags, got %v", strict, want, merged)
+		}
+	}
+}
+
+func TestParseMergeMode(t *testing.T) {
+	for s, want := range map[string]MergeMode{"join": MergeJoin, "First": MergeFirst} {
+		got, err := parseMergeMode(s)
+		if err != nil || got != want {
+			t.Errorf("parseMergeMode(%q) = %v, %v; want %v", s, got, err, want)
+		}
+	}
+	if _, err := parseMergeMode("multivalue"); err == nil {
+		t.Error("Expected an error for an unknown mode")
+	}
+}
+
+func TestConvertOpus_MergeMBIDs(t *testing.T) {
+	inputRoot := t.TempDir()
+	outputRoot := t.TempDir()
+	flacPath := filepath.Join(inputRoot, "Song.flac")
+	comments := []string{"TITLE=Title", "MUSICBRAINZ_ARTISTID=a", "MUSICBRAINZ_ARTISTID=b"}
+	writeTestFlac(t, flacPath, comments)
+	plainPath := filepath.Join(inputRoot, "Plain.flac")
+	writeTestFlac(t, plainPath, []string{"TITLE=Plain", "MUSICBRAINZ_ARTISTID=a"})
+
+	encoder := &fakeEncoder{opus: filepath.Join(t.TempDir(), "valid.opus")}
+	writeTestOpus(t, encoder.opus, nil)
+	config := Config{
+		ConvertOpus:    outputRoot,
+		Write:          true,
+		Encoder:        encoder,
+		OpusMergeMBIDs: true,
+		MergeTags:      []string{"MUSICBRAINZ_ARTISTID"},
+		MergeSeparator: ";",
+	}
+	for _, path := range []string{flacPath, plainPath} {
+		if _, err := convertOpus(path, inputRoot, config); err != nil {
+			t.Fatalf("convertOpus failed: %v", err)
+		}
+	}
+
+	want := []string{"TITLE=Title", "MUSICBRAINZ_ARTISTID=a;b"}
+	if len(encoder.comments) != 2 || !slices.Equal(encoder.comments[0], want) {
+		t.Fatalf("Expected comments %q, got %q", want, encoder.comments)
+	}
+	if encoder.comments[1] != nil {
+		t.Errorf("Expected the comments of a file without merges to be copied, got %q", encoder.comments[1])
+	}
+	if got := readTestComments(t, flacPath); !slices.Equal(got, comments) {
+		t.Errorf("Expected the FLAC file to be unchanged, got %q", got)
+	}
+}
+
+func TestOpusencEncoder_Comments(t *testing.T) {
+	dir := t.TempDir()
+	argsPath := filepath.Join(dir, "args")
+	installFakeOpusenc(t, `printf '%s\n' "$@" > "`+argsPath+`"`)
+
+	opts := EncodeOptions{Comments: []string{"TITLE=Title", "MUSICBRAINZ_ARTISTID=a+b"}}
+	if err := (opusencEncoder{}).Encode("in.flac", "out.opus", opts); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	data, err := os.ReadFile(argsPath)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	want := "--discard-comments\n--comment\nTITLE=Title\n--comment\nMUSICBRAINZ_ARTISTID=a+b\nin.flac\nout.opus\n"
+	if string(data) != want {
+		t.Errorf("Expected arguments %q, got %q", want, data)
+	}
+}
+
+func TestFfmpegEncoder(t *testing.T) {
+	dir := t.TempDir()
+	flacPath := filepath.Join(dir, "Song.flac")
+	writeTestFlac(t, flacPath, []string{"TITLE=Title", "ARTIST=Artist"})
+	coverPath := filepath.Join(dir, "cover.jpg")
+	writeTestJPEG(t, coverPath, 10, 10)
+
+	// ffmpeg copies the tags but no pictures
+	encoded := filepath.Join(t.TempDir(), "encoded.opus")
+	writeTestOpus(t, encoded, []string{"encoder=Lavf61", "TITLE=Title", "ARTIST=Artist"})
+	installFakeTool(t, "ffmpeg", `for last; do :; done; cp "`+encoded+`" "$last"`)
+
+	out := filepath.Join(dir, "Song.opus.tmp")
+	if err := (ffmpegEncoder{}).Encode(flacPath, out, EncodeOptions{Picture: coverPath}); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	vc, err := readOpusTags(out)
+	if err != nil {
+		t.Fatalf("readOpusTags failed: %v", err)
+	}
+	if len(vc.Comments) != 4 || !slices.Equal(vc.Comments[:3], []string{"encoder=Lavf61", "TITLE=Title", "ARTIST=Artist"}) ||
+		!strings.HasPrefix(vc.Comments[3], "METADATA_BLOCK_PICTURE=") {
+		t.Errorf("Unexpected comments %.60q", vc.Comments)
+	}
+}
+
+func TestFfmpegEncoder_OtherFormat(t *testing.T) {
+	dir := t.TempDir()
+	m4aPath := filepath.Join(dir, "Song.m4a")
+	touch(t, dir, "Song.m4a")
+	coverPath := filepath.Join(dir, "cover.jpg")
+	writeTestJPEG(t, coverPath, 10, 10)
+
+	// The tags ffmpeg copied from the input are kept
+	encoded := filepath.Join(t.TempDir(), "encoded.opus")
+	writeTestOpus(t, encoded, []string{"encoder=Lavf61", "TITLE=Title"})
+	installFakeTool(t, "ffmpeg", `for last; do :; done; cp "`+encoded+`" "$last"`)
+
+	out := filepath.Join(dir, "Song.opus.tmp")
+	if err := (ffmpegEncoder{}).Encode(m4aPath, out, EncodeOptions{}); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	vc, err := readOpusTags(out)
+	if err != nil {
+		t.Fatalf("readOpusTags failed: %v", err)
+	}
+	if want := []string{"encoder=Lavf61", "TITLE=Title"}; !slices.Equal(vc.Comments, want) {
+		t.Errorf("Expected %v, got %v", want, vc.Comments)
+	}
+
+	if err := (ffmpegEncoder{}).Encode(m4aPath, out, EncodeOptions{Picture: coverPath}); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if vc, err = readOpusTags(out); err != nil {
+		t.Fatalf("readOpusTags failed: %v", err)
+	}
+	if len(vc.Comments) != 3 || !strings.HasPrefix(vc.Comments[2], "METADATA_BLOCK_PICTURE=") {
+		t.Errorf("Expected the cover to be attached, got %.60q", vc.Comments)
+	}
+}
+
+func TestConvertOpus_InputFormats(t *testing.T) {
+	inputRoot := t.TempDir()
+	outputRoot := t.TempDir()
+	writeTestFlac(t, filepath.Join(inputRoot, "Album", "01.flac"), []string{"GENRE=Rock"})
+	touch(t, inputRoot, "Album/02.m4a", "Album/03.WAV", "Album/04.mp3")
+	touch(t, outputRoot, "Album/05.opus")
+
+	encoder := &fakeEncoder{opus: filepath.Join(t.TempDir(), "valid.opus")}
+	writeTestOpus(t, encoder.opus, nil)
+	config := Config{
+		ConvertOpus:  outputRoot,
+		Write:        true,
+		Encoder:      encoder,
+		InputFormats: []string{".flac", ".m4a", ".wav"},
+		OpusRules:    opusRules{{bitrate: "192", cond: "GENRE=Rock"}},
+	}
+
+	var found []string
+	err := walkFlacFiles(inputRoot, config.walkOptions(), nil, func(filePath string) error {
+		found = append(found, filepath.Base(filePath))
+		_, err := convertOpus(filePath, inputRoot, config)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("walkFlacFiles failed: %v", err)
+	}
+	if want := []string{"01.flac", "02.m4a", "03.WAV"}; !slices.Equal(found, want) {
+		t.Errorf("Expected %v, got %v", want, found)
+	}
+	// Rules only apply to FLAC files
+	if want := []float64{192, 0, 0}; !slices.Equal(encoder.bitrates, want) {
+		t.Errorf("Expected bitrates %v, got %v", want, encoder.bitrates)
+	}
+
+	// Outputs of the other formats are not orphans
+	if err := pruneOutput(inputRoot, config); err != nil {
+		t.Fatalf("pruneOutput failed: %v", err)
+	}
+	for name, expected := range map[string]bool{"01.opus": true, "02.opus": true, "05.opus": false} {
+		if got := exists(filepath.Join(outputRoot, "Album", name)); got != expected {
+			t.Errorf("%s: expected exists=%v, got %v", name, expected, got)
+		}
+	}
+}
+
+func TestConvertOpus_MP3(t *testing.T) {
+	inputRoot := t.TempDir()
+	outputRoot := t.TempDir()
+	writeTestFlac(t, filepath.Join(inputRoot, "Album", "01.flac"), []string{"TITLE=Title"})
+	touch(t, outputRoot, "Album/02.mp3", "Album/03.opus")
+
+	// Outputs other than Opus are only checked for being empty
+	encoder := &fakeEncoder{opus: filepath.Join(t.TempDir(), "encoded.mp3")}
+	if err := os.WriteFile(encoder.opus, []byte("ID3 mp3 data"), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	config := Config{ConvertOpus: outputRoot, ConvertFormat: "mp3", Write: true, Encoder: encoder}
+
+	flacPath := filepath.Join(inputRoot, "Album", "01.flac")
+	outcome, err := convertOpus(flacPath, inputRoot, config)
+	if err != nil || outcome != convertDone {
+		t.Fatalf("Expected convertDone, got %v, %v", outcome, err)
+	}
+	if want := filepath.Join(outputRoot, "Album", "01.mp3") + tempSuffix; !slices.Equal(encoder.calls, []string{want}) {
+		t.Errorf("Expected output %s, got %v", want, encoder.calls)
+	}
+	if outcome, _ := convertOpus(flacPath, inputRoot, config); outcome != convertUpToDate {
+		t.Errorf("Expected the MP3 file to be up to date, got %v", outcome)
+	}
+
+	// Only files of the output format are pruned
+	if err := pruneOutput(inputRoot, config); err != nil {
+		t.Fatalf("pruneOutput failed: %v", err)
+	}
+	for name, expected := range map[string]bool{"01.mp3": true, "02.mp3": false, "03.opus": true} {
+		if got := exists(filepath.Join(outputRoot, "Album", name)); got != expected {
+			t.Errorf("%s: expected exists=%v, got %v", name, expected, got)
+		}
+	}
+}
+
+func TestFfmpegFormatEncoder(t *testing.T) {
+	dir := t.TempDir()
+	argsPath := filepath.Join(dir, "args")
+	installFakeTool(t, "ffmpeg", `printf '%s\n' "$@" > "`+argsPath+`"`)
+
+	encoder := ffmpegFormatEncoder{Format: convertFormats["aac"]}
+	opts := EncodeOptions{Bitrate: 256, Picture: "cover.jpg", Comments: []string{"TITLE=Title"}}
+	if err := encoder.Encode("in.flac", "out.m4a.tmp", opts); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	data, err := os.ReadFile(argsPath)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	want := "-i\ncover.jpg\n-map\n0:a\n-map\n1:v\n-disposition:v\nattached_pic\n-c:a\naac\n-c:v\ncopy\n-b:a\n256k\n" +
+		"-map_metadata\n-1\n-metadata\nTITLE=Title\n-f\nipod\nout.m4a.tmp\n"
+	if !strings.HasSuffix(string(data), want) {
+		t.Errorf("Expected arguments ending in %q, got %q", want, data)
+	}
+
+	// Without a cover file the embedded pictures are copied, and so are
+	// the tags
+	if err := (ffmpegFormatEncoder{Format: convertFormats["mp3"]}).Encode("in.flac", "out.mp3.tmp", EncodeOptions{}); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if data, err = os.ReadFile(argsPath); err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	want = "-i\nin.flac\n-map\n0:a\n-map\n0:v?\n-c:a\nlibmp3lame\n-c:v\ncopy\n-f\nmp3\nout.mp3.tmp\n"
+	if !strings.HasSuffix(string(data), want) {
+		t.Errorf("Expected arguments ending in %q, got %q", want, data)
+	}
+}
+
+func TestEncoderFor(t *testing.T) {
+	config := Config{Encoder: opusencEncoder{}}
+	if e := config.encoderFor("Song.FLAC"); e != (opusencEncoder{}) {
+		t.Errorf("Expected opusenc for FLAC, got %v", e)
+	}
+	if e := config.encoderFor("Song.m4a"); e != (ffmpegEncoder{}) {
+		t.Errorf("Expected ffmpeg for m4a, got %v", e)
+	}
+	if config.needsFfmpeg() {
+		t.Error("Expected FLAC only not to need ffmpeg")
+	}
+	config.InputFormats = []string{".flac", ".m4a"}
+	if !config.needsFfmpeg() {
+		t.Error("Expected m4a to need ffmpeg")
+	}
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.toml")
+	content := `# Nightly run
+mb-ids = true
+convert-opus = "/mnt/opus dir" # mirror
+cover-name = 'C:\covers\front.jpg'
+opus-bitrate = 96
+merge-sep = ";"
+colour = "blue"
+`
+	if err := os.WriteFile(configPath, []byte(content), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	mbIDs := fs.Bool("mb-ids", false, "")
+	convertOpus := fs.String("convert-opus", "", "")
+	coverName := fs.String("cover-name", "cover.jpg", "")
+	bitrate := fs.String("opus-bitrate", "", "")
+	mergeSep := fs.String("merge-sep", "+", "")
+	if err := fs.Parse([]string{"--opus-bitrate", "128"}); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	var warnings []string
+	warn := func(format string, args ...any) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+	if err := applyConfigFile(fs, configPath, warn); err != nil {
+		t.Fatalf("applyConfigFile failed: %v", err)
+	}
+	if !*mbIDs || *convertOpus != "/mnt/opus dir" || *coverName != `C:\covers\front.jpg` || *mergeSep != ";" {
+		t.Errorf("Unexpected values %v, %q, %q, %q", *mbIDs, *convertOpus, *coverName, *mergeSep)
+	}
+	// The command line wins
+	if *bitrate != "128" {
+		t.Errorf("Expected the command line bitrate, got %q", *bitrate)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], `"colour"`) {
+		t.Errorf("Expected a warning about the unknown key, got %q", warnings)
+	}
+
+	for _, bad := range []string{"mb-ids = maybe", "[opus]", "cover-name", `cover-name = "open`} {
+		if err := os.WriteFile(configPath, []byte(bad), 0o644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.Bool("mb-ids", false, "")
+		fs.String("cover-name", "cover.jpg", "")
+		if err := applyConfigFile(fs, configPath, warn); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
+
+func TestParseInputFormats(t *testing.T) {
+	got, err := parseInputFormats("flac, .M4A,wav,flac")
+	if want := []string{".flac", ".m4a", ".wav"}; err != nil || !slices.Equal(got, want) {
+		t.Errorf("Expected %v, got %v, %v", want, got, err)
+	}
+	for _, s := range []string{"mp3", "", " , "} {
+		if _, err := parseInputFormats(s); err == nil {
+			t.Errorf("Expected an error for %q", s)
+		}
+	}
+}
+
+func TestSelectEncoder(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	if _, err := selectEncoder("auto"); err == nil {
+		t.Error("Expected an error without any encoder")
+	}
+
+	installFakeTool(t, "ffmpeg", "exit 0")
+	if e, err := selectEncoder("auto"); err != nil || e != (ffmpegEncoder{}) {
+		t.Errorf("Expected the ffmpeg fallback, got %v, %v", e, err)
+	}
+	if _, err := selectEncoder("opusenc"); err == nil {
+		t.Error("Expected an error for the missing opusenc")
+	}
+
+	installFakeOpusenc(t, "exit 0")
+	if e, err := selectEncoder("auto"); err != nil || e != (opusencEncoder{}) {
+		t.Errorf("Expected opusenc to be preferred, got %v, %v", e, err)
+	}
+	if e, err := selectEncoder("ffmpeg"); err != nil || e != (ffmpegEncoder{}) {
+		t.Errorf("Expected ffmpeg, got %v, %v", e, err)
+	}
+	if _, err := selectEncoder("lame"); err == nil {
+		t.Error("Expected an error for an unknown encoder")
+	}
+}
+
+func TestCheckFfmpegEncoder(t *testing.T) {
+	installFakeTool(t, "ffmpeg", `echo " A....D libopus              libopus Opus (codec opus)"`)
+	if err := checkFfmpegEncoder("libopus"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	installFakeTool(t, "ffmpeg", `echo " A....D opus                 Opus"`)
+	if err := checkFfmpegEncoder("libopus"); err == nil {
+		t.Error("Expected an error without libopus")
+	}
+}
+
+func TestExtractCover(t *testing.T) {
+	dir := t.TempDir()
+	png := &Picture{PictureType: 3, MimeType: "image/png", Width: 1, Height: 1, Data: []byte("png data")}
+	back := &Picture{PictureType: 4, MimeType: "image/jpeg", Data: []byte("back")}
+	f := &flac.File{Meta: []*flac.MetaDataBlock{
+		{Type: flac.Picture, Data: back.Marshal()},
+		{Type: flac.Picture, Data: png.Marshal()},
+	}}
+	filename := filepath.Join(dir, "01.flac")
+
+	// Dry-run writes nothing and reports each album once
+	config := Config{CoverExtracts: newCoverExtractor("cover.jpg")}
+	for _, want := range []bool{true, false} {
+		extracted, err := extractCover(filename, f, config.CoverExtracts, config)
+		if err != nil || extracted != want {
+			t.Errorf("Expected %v, got %v, %v", want, extracted, err)
+		}
+	}
+	if exists(filepath.Join(dir, "cover.png")) {
+		t.Error("Expected no file in dry-run")
+	}
+
+	config = Config{Write: true, CoverExtracts: newCoverExtractor("cover.jpg")}
+	if extracted, err := extractCover(filename, f, config.CoverExtracts, config); err != nil || !extracted {
+		t.Fatalf("Expected the cover to be extracted, got %v, %v", extracted, err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "cover.png"))
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if string(data) != "png data" {
+		t.Errorf("Expected the front cover, got %q", data)
+	}
+
+	// An existing file is kept
+	config.CoverExtracts = newCoverExtractor("cover.jpg")
+	if extracted, err := extractCover(filename, f, config.CoverExtracts, config); err != nil || extracted {
+		t.Errorf("Expected the existing cover to be kept, got %v, %v", extracted, err)
+	}
+
+	// Placeholders and thumbnails embedded by the tool are no album cover
+	for _, description := range []string{placeholderDescription, thumbnailDescription} {
+		dir := t.TempDir()
+		pic := &Picture{PictureType: 3, MimeType: "image/jpeg", Description: description, Data: []byte("jpeg data")}
+		f := &flac.File{Meta: []*flac.MetaDataBlock{{Type: flac.Picture, Data: pic.Marshal()}}}
+		config.CoverExtracts = newCoverExtractor("cover.jpg")
+		if extracted, err := extractCover(filepath.Join(dir, "01.flac"), f, config.CoverExtracts, config); err != nil || extracted {
+			t.Errorf("%s: Expected no cover to be extracted, got %v, %v", description, extracted, err)
+		}
+		if exists(filepath.Join(dir, "cover.jpg")) {
+			t.Errorf("%s: Expected no cover file", description)
+		}
+	}
+}
+
+func TestCoverFileIn(t *testing.T) {
+	dir := t.TempDir()
+	touch(t, dir, "folder.jpg", "front.jpg", "cover.jpg/not-a-file")
+	config := Config{CoverName: " cover.jpg, folder.jpg,,front.jpg"}
+
+	if want := []string{"cover.jpg", "folder.jpg", "front.jpg"}; !slices.Equal(config.coverNames(), want) {
+		t.Errorf("Expected %v, got %v", want, config.coverNames())
+	}
+	// The first name that is a file wins
+	if got, want := config.coverFileIn(dir), filepath.Join(dir, "folder.jpg"); got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if got := config.coverFileIn(filepath.Join(dir, "cover.jpg")); got != "" {
+		t.Errorf("Expected no cover, got %s", got)
+	}
+
+	// Then the names with the extension of another image type
+	pngDir := t.TempDir()
+	touch(t, pngDir, "cover.png")
+	if got, want := config.coverFileIn(pngDir), filepath.Join(pngDir, "cover.png"); got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	touch(t, pngDir, "front.jpg")
+	if got, want := config.coverFileIn(pngDir), filepath.Join(pngDir, "front.jpg"); got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	// Embedding uses the same order
+	flacPath := filepath.Join(dir, "01.flac")
+	writeTestFlac(t, flacPath, []string{"TITLE=Title"})
+	writeTestJPEG(t, filepath.Join(dir, "folder.jpg"), 30, 20)
+	var lines []string
+	config = Config{Write: true, EmbedCover: true, CoverName: "cover.jpg,folder.jpg", LogFunc: func(level LogLevel, format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}}
+	stats, err := processFile(flacPath, dir, config)
+	if err != nil || !stats.CoverEmbedded {
+		t.Fatalf("Expected folder.jpg to be embedded, got %+v, %v", stats, err)
+	}
+	// Messages name the file used, not the list
+	if want := flacPath + ": Embedding folder.jpg\n"; !slices.Contains(lines, want) {
+		t.Errorf("Expected %q in %q", want, lines)
+	}
+}
+
+func TestProcessFile_SyncCover(t *testing.T) {
+	root := t.TempDir()
+	withFile := filepath.Join(root, "WithFile", "01.flac")
+	writeTestFlac(t, withFile, []string{"TITLE=Title"})
+	writeTestJPEG(t, filepath.Join(root, "WithFile", "cover.jpg"), 40, 40)
+	config := Config{
+		Write:      true,
+		EmbedCover: true,
+		CoverName:  "cover.jpg",
+		CoverSync:  newCoverExtractor("cover.jpg"),
+		LogFunc:    func(LogLevel, string, ...any) {},
+	}
+
+	// The cover file is embedded where the FLAC has none
+	stats, err := processFile(withFile, root, config)
+	if err != nil || !stats.CoverEmbedded || stats.CoverExtracted {
+		t.Fatalf("Expected the cover to be embedded, got %+v, %v", stats, err)
+	}
+
+	// The embedded cover is extracted where the file is missing
+	embedded := filepath.Join(root, "Embedded", "01.flac")
+	if err := os.MkdirAll(filepath.Dir(embedded), 0o755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	data, err := os.ReadFile(withFile)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if err := os.WriteFile(embedded, data, 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	stats, err = processFile(embedded, root, config)
+	if err != nil || stats.CoverEmbedded || !stats.CoverExtracted {
+		t.Fatalf("Expected the cover to be extracted, got %+v, %v", stats, err)
+	}
+	if fileSize(t, filepath.Join(root, "Embedded", "cover.jpg")) != fileSize(t, filepath.Join(root, "WithFile", "cover.jpg")) {
+		t.Error("Expected the extracted cover to match the embedded one")
+	}
+
+	// Both albums are in sync now
+	for _, path := range []string{withFile, embedded} {
+		config.CoverSync = newCoverExtractor("cover.jpg")
+		if stats, err := processFile(path, root, config); err != nil || stats.CoverEmbedded || stats.CoverExtracted {
+			t.Errorf("%s: Expected nothing to do, got %+v, %v", path, stats, err)
+		}
+	}
+}
+
+func TestProcessFile_SyncCoverPNG(t *testing.T) {
+	dir := t.TempDir()
+	withArt := filepath.Join(dir, "01.flac")
+	withoutArt := filepath.Join(dir, "02.flac")
+	writeTestFlac(t, withArt, []string{"TITLE=One"})
+	writeTestFlac(t, withoutArt, []string{"TITLE=Two"})
+
+	// Only the first track has the cover embedded, as PNG
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 30, 20))); err != nil {
+		t.Fatalf("png.Encode failed: %v", err)
+	}
+	pngPath := filepath.Join(dir, "cover.png")
+	if err := os.WriteFile(pngPath, buf.Bytes(), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	embed := Config{Write: true, EmbedCover: true, CoverName: "cover.png", LogFunc: func(LogLevel, string, ...any) {}}
+	if _, err := fixFlac(withArt, embed); err != nil {
+		t.Fatalf("fixFlac failed: %v", err)
+	}
+	if err := os.Remove(pngPath); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+
+	var warnings []string
+	config := Config{
+		Write:      true,
+		EmbedCover: true,
+		CoverName:  "cover.jpg",
+		CoverSync:  newCoverExtractor("cover.jpg"),
+		LogFunc: func(level LogLevel, format string, args ...any) {
+			if level == LogWarn {
+				warnings = append(warnings, fmt.Sprintf(format, args...))
+			}
+		},
+	}
+
+	// The track without art gets the cover of the other one
+	stats, err := processFile(withoutArt, dir, config)
+	if err != nil || !stats.CoverExtracted || !stats.CoverEmbedded {
+		t.Fatalf("Expected the cover to be extracted and embedded, got %+v, %v", stats, err)
+	}
+	if !exists(pngPath) {
+		t.Error("Expected the cover to be extracted as cover.png")
+	}
+
+	// Both tracks are in sync now, also in a later run
+	for _, path := range []string{withArt, withoutArt} {
+		config.CoverSync = newCoverExtractor("cover.jpg")
+		if stats, err := processFile(path, dir, config); err != nil || stats.CoverEmbedded || stats.CoverExtracted {
+			t.Errorf("%s: Expected nothing to do, got %+v, %v", path, stats, err)
+		}
+	}
+	if len(warnings) > 0 {
+		t.Errorf("Expected no warnings, got %q", warnings)
+	}
+}
+
+func TestCoverFileName(t *testing.T) {
+	for _, tc := range []struct{ name, mime, want string }{
+		{"cover.jpg", "image/jpeg", "cover.jpg"},
+		{"cover.jpeg", "image/jpeg", "cover.jpeg"},
+		{"cover.jpg", "image/png", "cover.png"},
+		{"folder", "image/PNG", "folder.png"},
+		{"cover.jpg", "image/x-unknown", "cover.jpg"},
+	} {
+		if got := coverFileName(tc.name, tc.mime); got != tc.want {
+			t.Errorf("coverFileName(%q, %q) = %q, want %q", tc.name, tc.mime, got, tc.want)
+		}
+	}
+}
+
+func TestFixFlac_Verify(t *testing.T) {
+	flacPath := filepath.Join(t.TempDir(), "Song.flac")
+	writeTestFlac(t, flacPath, []string{"MUSICBRAINZ_ARTISTID=1", "MUSICBRAINZ_ARTISTID=2"})
+	config := Config{Write: true, FixMBIDs: true, MergeTags: []string{"MUSICBRAINZ_ARTISTID"}, Verify: true}
+
+	installFakeTool(t, "flac", `echo "$3: ERROR while decoding data" >&2; exit 1`)
+	stats, err := fixFlac(flacPath, config)
+	if err != nil {
+		t.Fatalf("fixFlac failed: %v", err)
+	}
+	if !stats.VerifyFailed || stats.MBIDsFixed {
+		t.Errorf("Expected a failed verification and no fix, got %+v", stats)
+	}
+	if got := readTestComments(t, flacPath); len(got) != 2 {
+		t.Errorf("Expected the damaged file not to be saved, got %v", got)
+	}
+
+	installFakeTool(t, "flac", `exit 0`)
+	stats, err = fixFlac(flacPath, config)
+	if err != nil {
+		t.Fatalf("fixFlac failed: %v", err)
+	}
+	if stats.VerifyFailed || !stats.MBIDsFixed {
+		t.Errorf("Expected the verified file to be fixed, got %+v", stats)
+	}
+	if got := readTestComments(t, flacPath); !slices.Equal(got, []string{"MUSICBRAINZ_ARTISTID=1+2"}) {
+		t.Errorf("Unexpected comments %v", got)
+	}
+}
+
+func TestFixReport(t *testing.T) {
+	dir := t.TempDir()
+	fixed := filepath.Join(dir, "Album", "01.flac")
+	broken := filepath.Join(dir, "Album", "02.flac")
+	const id1, id2 = "b10bbbfc-cf9e-42e0-be17-e2c3e1d2600d", "0383dadf-2a4e-4d10-a46a-e9e041da8eb3"
+	writeTestFlac(t, fixed, []string{"MUSICBRAINZ_ARTISTID=" + id1, "MUSICBRAINZ_ARTISTID=" + id2, "MUSICBRAINZ_ALBUMID=a", "MUSICBRAINZ_ALBUMID=b"})
+	if err := os.WriteFile(broken, []byte("not a flac"), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	writeTestJPEG(t, filepath.Join(dir, "Album", "cover.jpg"), 20, 10)
+
+	reportPath := filepath.Join(t.TempDir(), "report.json")
+	report, err := newFixReport(reportPath)
+	if err != nil {
+		t.Fatalf("newFixReport failed: %v", err)
+	}
+	config := Config{
+		Write:      true,
+		FixMBIDs:   true,
+		MergeTags:  []string{"MUSICBRAINZ_ARTISTID"},
+		EmbedCover: true,
+		CoverName:  "cover.jpg",
+		LogLevel:   LogError,
+		LogFunc:    func(LogLevel, string, ...any) {},
+		Report:     report,
+	}
+	// Reported in path order whatever the processing order
+	for _, file := range []string{broken, fixed} {
+		processFile(file, dir, config)
+	}
+	if err := config.Report.Write(); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	data, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	var entries []map[string]any
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if len(entries) != 2 || entries[0]["path"] != fixed || entries[1]["path"] != broken {
+		t.Fatalf("Unexpected entries %s", data)
+	}
+
+	want := map[string]any{
+		"path":         fixed,
+		"mbids_merged": true,
+		"merged_tags": []any{map[string]any{
+			"tag":    "MUSICBRAINZ_ARTISTID",
+			"before": []any{id1, id2},
+			"after":  []any{id1 + "+" + id2},
+		}},
+		"cover_embedded":     map[string]any{"width": 20.0, "height": 10.0, "bytes": float64(fileSize(t, filepath.Join(dir, "Album", "cover.jpg")))},
+		"track_uid_set":      false,
+		"keys_normalized":    0.0,
+		"tags_stripped":      0.0,
+		"duplicates_removed": 0.0,
+		"values_trimmed":     0.0,
+		"empty_removed":      0.0,
+		"tags_set":           0.0,
+		"tags_folded":        0.0,
+		"tags_renamed":       0.0,
+		"gain_tags_removed":  0.0,
+		"thumbnail_embedded": false,
+		"bytes_reclaimed":    0.0,
+		"permissions_fixed":  false,
+		"verify_failed":      false,
+		"warnings":           []any{fixed + ": Multiple values found for MUSICBRAINZ_ALBUMID (Count: 2). This might confuse LMS."},
+		"error":              "",
+	}
+	if !reflect.DeepEqual(entries[0], want) {
+		t.Errorf("Unexpected entry %v", entries[0])
+	}
+	if entries[1]["error"] == "" || entries[1]["cover_embedded"] != nil {
+		t.Errorf("Expected an error entry, got %v", entries[1])
+	}
+}
+
+func TestFixReport_Stream(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{filepath.Join(dir, "02.flac"), filepath.Join(dir, "01.flac")}
+	for _, file := range files {
+		writeTestFlac(t, file, []string{"TITLE= Title"})
+	}
+
+	reportPath := filepath.Join(t.TempDir(), "report.jsonl.gz")
+	report, err := newFixReport(reportPath)
+	if err != nil {
+		t.Fatalf("newFixReport failed: %v", err)
+	}
+	config := Config{TrimValues: true, LogFunc: func(LogLevel, string, ...any) {}, Report: report}
+
+	readLines := func() []map[string]any {
+		t.Helper()
+		file, err := os.Open(reportPath)
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer file.Close()
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatalf("gzip.NewReader failed: %v", err)
+		}
+		// An unfinished report ends without the gzip trailer
+		var entries []map[string]any
+		scanner := bufio.NewScanner(gz)
+		for scanner.Scan() {
+			var entry map[string]any
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				t.Fatalf("Unmarshal failed: %v", err)
+			}
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+
+	// Each file is readable as soon as it is processed
+	processFile(files[0], dir, config)
+	if entries := readLines(); len(entries) != 1 || entries[0]["path"] != files[0] || entries[0]["values_trimmed"] != 1.0 {
+		t.Fatalf("Expected the first entry, got %v", entries)
+	}
+
+	// Entries stay in processing order
+	processFile(files[1], dir, config)
+	if err := report.Write(); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	entries := readLines()
+	if len(entries) != 2 || entries[0]["path"] != files[0] || entries[1]["path"] != files[1] {
+		t.Errorf("Expected entries in processing order, got %v", entries)
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	return info.Size()
+}
+
+func TestSaveFlacFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	flacPath := filepath.Join(dir, "Song.flac")
+	writeTestFlac(t, flacPath, []string{"TITLE=Old"})
+	if err := os.Chmod(flacPath, 0o640); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	before, err := os.ReadFile(flacPath)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+
+	f, err := flac.ParseFile(flacPath)
+	if err != nil {
+		t.Fatalf("ParseFile failed: %v", err)
+	}
+	vc := &VorbisComment{Vendor: "vendor", Comments: []string{"TITLE=New"}}
+	for _, block := range f.Meta {
+		if block.Type == flac.VorbisComment {
+			block.Data = vc.Marshal()
+		}
+	}
+
+	// A failed save leaves the original alone
+	touch(t, dir, "Song.flac.tmp/blocker")
+	if err := saveFlacFileAtomic(flacPath, f, nil); err == nil {
+		t.Fatal("Expected the save to fail")
+	}
+	if after, _ := os.ReadFile(flacPath); !bytes.Equal(after, before) {
+		t.Error("Expected the original to be intact after a failed save")
+	}
+	if err := os.RemoveAll(flacPath + tempSuffix); err != nil {
+		t.Fatalf("RemoveAll failed: %v", err)
+	}
+
+	if err := saveFlacFileAtomic(flacPath, f, nil); err != nil {
+		t.Fatalf("saveFlacFileAtomic failed: %v", err)
+	}
+	if got := readTestComments(t, flacPath); !slices.Equal(got, []string{"TITLE=New"}) {
+		t.Errorf("Expected the new tags, got %v", got)
+	}
+	info, err := os.Stat(flacPath)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Mode().Perm() != 0o640 {
+		t.Errorf("Expected mode 0640 to be kept, got %v", info.Mode().Perm())
+	}
+	if exists(flacPath + tempSuffix) {
+		t.Error("Expected no temp file to be left")
+	}
+}
+
+func TestFixFlac_Backup(t *testing.T) {
+	dir := t.TempDir()
+	fixed := filepath.Join(dir, "01.flac")
+	clean := filepath.Join(dir, "02.flac")
+	unfixed := []string{"MUSICBRAINZ_ARTISTID=1", "MUSICBRAINZ_ARTISTID=2"}
+	writeTestFlac(t, fixed, unfixed)
+	writeTestFlac(t, clean, []string{"MUSICBRAINZ_ARTISTID=1"})
+	original, err := os.ReadFile(fixed)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+
+	config := Config{Write: true, FixMBIDs: true, MergeTags: []string{"MUSICBRAINZ_ARTISTID"}, Backup: true}
+	for _, file := range []string{fixed, clean} {
+		if _, err := fixFlac(file, config); err != nil {
+			t.Fatalf("fixFlac failed: %v", err)
+		}
+	}
+	if backup, _ := os.ReadFile(fixed + ".bak"); !bytes.Equal(backup, original) {
+		t.Error("Expected the backup to hold the original file")
+	}
+	if exists(clean + ".bak") {
+		t.Error("Expected no backup of an unmodified file")
+	}
+
+	// An existing backup is kept unless forced
+	writeTestFlac(t, fixed, unfixed)
+	if _, err := fixFlac(fixed, config); err == nil {
+		t.Error("Expected an error for an existing backup")
+	}
+	if got := readTestComments(t, fixed); !slices.Equal(got, unfixed) {
+		t.Errorf("Expected the file not to be saved, got %v", got)
+	}
+	config.ForceBackup = true
+	if _, err := fixFlac(fixed, config); err != nil {
+		t.Errorf("Expected --force to overwrite the backup, got %v", err)
+	}
+
+	// A backup directory mirrors the input tree
+	root := t.TempDir()
+	backupDir := t.TempDir()
+	song := filepath.Join(root, "Album", "01.flac")
+	writeTestFlac(t, song, unfixed)
+	config = Config{Write: true, FixMBIDs: true, MergeTags: []string{"MUSICBRAINZ_ARTISTID"}, Backup: true, BackupDir: backupDir}
+	if _, _, err := fixFile(song, root, config); err != nil {
+		t.Fatalf("fixFile failed: %v", err)
+	}
+	if backup, _ := os.ReadFile(filepath.Join(backupDir, "Album", "01.flac")); !bytes.Equal(backup, original) {
+		t.Error("Expected the backup in the mirrored path")
+	}
+}
+
+func TestFixFlac_DryRunDiff(t *testing.T) {
+	dir := t.TempDir()
+	flacPath := filepath.Join(dir, "Song.flac")
+	writeTestFlac(t, flacPath, []string{"MUSICBRAINZ_ARTISTID=1", "MUSICBRAINZ_ARTISTID=2"})
+	writeTestJPEG(t, filepath.Join(dir, "cover.jpg"), 20, 10)
+	before, err := os.ReadFile(flacPath)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+
+	var logged []string
+	config := Config{
+		FixMBIDs:   true,
+		MergeTags:  []string{"MUSICBRAINZ_ARTISTID"},
+		EmbedCover: true,
+		CoverName:  "cover.jpg",
+		LogLevel:   LogVerbose,
+		LogFunc: func(level LogLevel, format string, args ...any) {
+			logged = append(logged, fmt.Sprintf(format, args...))
+		},
+	}
+	if _, err := fixFlac(flacPath, config); err != nil {
+		t.Fatalf("fixFlac failed: %v", err)
+	}
+
+	coverSize := fileSize(t, filepath.Join(dir, "cover.jpg"))
+	for _, want := range []string{
+		"[DRY-RUN]   MUSICBRAINZ_ARTISTID: [1, 2] -> 1+2\n",
+		fmt.Sprintf("[DRY-RUN]   cover: 20x10, %d bytes\n", coverSize),
+	} {
+		if !slices.Contains(logged, want) {
+			t.Errorf("Expected %q to be logged, got %q", want, logged)
+		}
+	}
+	if after, _ := os.ReadFile(flacPath); !bytes.Equal(after, before) {
+		t.Error("Expected the file to be left alone in dry-run")
+	}
+}
+
+func TestFixFlac_MaxFileSize(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "01.flac")
+	writeTestFlac(t, filename, []string{"MUSICBRAINZ_ARTISTID=a", "MUSICBRAINZ_ARTISTID=b"})
+	size := fileSize(t, filename)
+
+	var warnings []string
+	config := Config{Write: true, FixMBIDs: true, MergeTags: []string{"MUSICBRAINZ_ARTISTID"}, MaxFileSize: size - 1, LogFunc: func(level LogLevel, format string, args ...any) {
+		if level == LogWarn {
+			warnings = append(warnings, fmt.Sprintf(format, args...))
+		}
+	}}
+	stats, err := fixFlac(filename, config)
+	if err != nil || stats.MBIDsFixed {
+		t.Errorf("Expected the file to be skipped, got %+v (%v)", stats, err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "maximum file size") {
+		t.Errorf("Expected a warning, got %q", warnings)
+	}
+
+	config.MaxFileSize = size
+	if stats, err := fixFlac(filename, config); err != nil || !stats.MBIDsFixed {
+		t.Errorf("Expected a file at the limit to be fixed, got %+v (%v)", stats, err)
+	}
+}
+
+func TestFixFlac_ChangesCancelOut(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "01.flac")
+	writeTestFlac(t, filename, []string{"TITLE=Title", "COMMENT=Ripped"})
+	old := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filename, old, old); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+
+	// The stripped tag is set again to the same value in the same place
+	config := Config{Write: true, StripTags: []string{"COMMENT"}, SetTags: []string{"COMMENT=Ripped"}, LogFunc: func(LogLevel, string, ...any) {}}
+	stats, err := fixFlac(filename, config)
+	if err != nil {
+		t.Fatalf("fixFlac failed: %v", err)
+	}
+	if stats.TagsStripped != 0 || stats.TagsSet != 0 {
+		t.Errorf("Expected no changes to be reported, got %+v", stats)
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if !info.ModTime().Equal(old) {
+		t.Errorf("Expected the file not to be rewritten, got mtime %v", info.ModTime())
+	}
+
+	// A real change is still saved
+	config.SetTags = []string{"COMMENT=Fixed"}
+	if stats, err := fixFlac(filename, config); err != nil || stats.TagsSet != 1 {
+		t.Fatalf("Expected the tag to be set, got %+v (%v)", stats, err)
+	}
+	if got := readTestComments(t, filename); !slices.Equal(got, []string{"TITLE=Title", "COMMENT=Fixed"}) {
+		t.Errorf("Unexpected comments %v", got)
+	}
+}
+
+func TestFixFlac_PreserveMtime(t *testing.T) {
+	dir := t.TempDir()
+	fixed := filepath.Join(dir, "01.flac")
+	clean := filepath.Join(dir, "02.flac")
+	writeTestFlac(t, fixed, []string{"MUSICBRAINZ_ARTISTID=1", "MUSICBRAINZ_ARTISTID=2"})
+	writeTestFlac(t, clean, []string{"MUSICBRAINZ_ARTISTID=1"})
+	old := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, file := range []string{fixed, clean} {
+		if err := os.Chtimes(file, old, old); err != nil {
+			t.Fatalf("Chtimes failed: %v", err)
+		}
+	}
+
+	config := Config{Write: true, FixMBIDs: true, MergeTags: []string{"MUSICBRAINZ_ARTISTID"}, PreserveMtime: true}
+	for _, file := range []string{fixed, clean} {
+		if _, err := fixFlac(file, config); err != nil {
+			t.Fatalf("fixFlac failed: %v", err)
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+		if !info.ModTime().Equal(old) {
+			t.Errorf("%s: Expected mtime %v, got %v", file, old, info.ModTime())
+		}
+	}
+	if got := readTestComments(t, fixed); !slices.Equal(got, []string{"MUSICBRAINZ_ARTISTID=1+2"}) {
+		t.Errorf("Expected the file to be fixed, got %v", got)
+	}
+}
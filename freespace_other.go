@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !windows
+
+package main
+
+import "errors"
+
+// freeSpace is not available on this platform.
+func freeSpace(path string) (int64, error) {
+	return 0, errors.New("free space check not supported on this platform")
+}
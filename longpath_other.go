@@ -0,0 +1,14 @@
+//go:build !unix && !windows
+
+package main
+
+// isPathTooLong reports whether err is caused by a path or file name
+// exceeding the system limits. Not detected on this platform.
+func isPathTooLong(err error) bool {
+	return false
+}
+
+// longPath returns path in a form external tools can open.
+func longPath(path string) string {
+	return path
+}
@@ -0,0 +1,21 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// isPathTooLong reports whether err is caused by a path or file name
+// exceeding the system limits.
+func isPathTooLong(err error) bool {
+	return errors.Is(err, unix.ENAMETOOLONG)
+}
+
+// longPath returns path in a form external tools can open. Unix systems
+// have no extended-length syntax.
+func longPath(path string) string {
+	return path
+}
@@ -0,0 +1,66 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestWalkFlacFiles_PathTooLong(t *testing.T) {
+	root := t.TempDir()
+	touch(t, root, "A/01.flac", "C/01.flac")
+
+	// Nest directories below B until their absolute path exceeds
+	// PATH_MAX, creating them relative to the previous one
+	t.Chdir(root)
+	if err := os.Mkdir("B", 0o755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	t.Chdir("B")
+	name := strings.Repeat("d", 250)
+	for range 20 {
+		if err := os.Mkdir(name, 0o755); err != nil {
+			t.Fatalf("Mkdir failed: %v", err)
+		}
+		t.Chdir(name)
+	}
+	if err := os.WriteFile("deep.flac", nil, 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	var files, skipped []string
+	err := walkFlacFiles(root, walkOptions{}, func(path string, err error) {
+		if !isPathTooLong(err) {
+			t.Errorf("Unexpected error for %s: %v", path, err)
+		}
+		skipped = append(skipped, path)
+	}, func(filePath string) error {
+		files = append(files, filePath)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walkFlacFiles failed: %v", err)
+	}
+
+	want := []string{filepath.Join(root, "A", "01.flac"), filepath.Join(root, "C", "01.flac")}
+	if !slices.Equal(files, want) {
+		t.Errorf("Expected %v, got %v", want, files)
+	}
+	if len(skipped) != 1 || !strings.HasPrefix(skipped[0], filepath.Join(root, "B")) {
+		t.Errorf("Expected one skipped directory below B, got %v", skipped)
+	}
+}
+
+func TestProcessFile_PathTooLong(t *testing.T) {
+	root := t.TempDir()
+	filePath := filepath.Join(root, strings.Repeat("n", 300)+".flac")
+
+	_, err := processFile(filePath, root, Config{FixMBIDs: true})
+	if !isPathTooLong(err) {
+		t.Errorf("Expected a path too long error, got %v", err)
+	}
+}
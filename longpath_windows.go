@@ -0,0 +1,37 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/windows"
+)
+
+// isPathTooLong reports whether err is caused by a path or file name
+// exceeding the system limits.
+func isPathTooLong(err error) bool {
+	return errors.Is(err, windows.ERROR_FILENAME_EXCED_RANGE)
+}
+
+// maxPath is the classic Windows path limit (MAX_PATH).
+const maxPath = 260
+
+// longPath returns path in a form external tools can open. The os package
+// handles long paths itself, but tools like opusenc need the
+// extended-length prefix (\\?\) beyond MAX_PATH.
+func longPath(path string) string {
+	if len(path) < maxPath || strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if rest, ok := strings.CutPrefix(abs, `\\`); ok {
+		return `\\?\UNC\` + rest
+	}
+	return `\\?\` + abs
+}
@@ -0,0 +1,131 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// runInterruptChild runs the conversion of FIXFLAC4LMS_TEST_INTERRUPT in
+// the child process of an interrupt test and exits.
+func runInterruptChild(t *testing.T) {
+	roots := os.Getenv("FIXFLAC4LMS_TEST_INTERRUPT")
+	if roots == "" {
+		return
+	}
+	inputRoot, outputRoot, _ := strings.Cut(roots, string(os.PathListSeparator))
+	info, err := os.Stat(inputRoot)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	config := Config{ConvertOpus: outputRoot, Write: true, LogFunc: func(LogLevel, string, ...any) {}}
+	os.Exit(run(inputRoot, info, config))
+}
+
+// startInterruptChild converts inputRoot to outputRoot in a child process
+// and returns once the encoder wrote its pid to started.
+func startInterruptChild(t *testing.T, inputRoot, outputRoot, started string) *exec.Cmd {
+	t.Helper()
+	// Like the shell, start the run as its own process group, which a
+	// Ctrl-C in the terminal interrupts as a whole
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$")
+	cmd.Env = append(os.Environ(), "FIXFLAC4LMS_TEST_INTERRUPT="+inputRoot+string(os.PathListSeparator)+outputRoot)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); !exists(started); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			cmd.Process.Kill()
+			t.Fatal("Encoder was not started")
+		}
+	}
+	return cmd
+}
+
+// interrupt sends SIGINT to the process group of cmd, as Ctrl-C does.
+func interrupt(t *testing.T, cmd *exec.Cmd) {
+	t.Helper()
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGINT); err != nil {
+		t.Fatalf("Kill failed: %v", err)
+	}
+}
+
+func TestRun_InterruptFinishesConversion(t *testing.T) {
+	runInterruptChild(t)
+
+	inputRoot := t.TempDir()
+	outputRoot := t.TempDir()
+	writeTestFlac(t, filepath.Join(inputRoot, "01.flac"), []string{"TITLE=One"})
+	writeTestFlac(t, filepath.Join(inputRoot, "02.flac"), []string{"TITLE=Two"})
+	validOpus := filepath.Join(t.TempDir(), "valid.opus")
+	writeTestOpus(t, validOpus, []string{"TITLE=Title"})
+	started := filepath.Join(t.TempDir(), "started")
+	installFakeOpusenc(t, `for out; do :; done; touch "`+started+`"; sleep 1; cp "`+validOpus+`" "$out"`)
+
+	cmd := startInterruptChild(t, inputRoot, outputRoot, started)
+	interrupt(t, cmd)
+	cmd.Wait()
+
+	// The conversion in progress is completed, the next one not started
+	if !exists(filepath.Join(outputRoot, "01.opus")) {
+		t.Error("Expected the interrupted conversion to be completed")
+	}
+	if exists(filepath.Join(outputRoot, "02.opus")) {
+		t.Error("Expected the run to stop after the current file")
+	}
+}
+
+func TestRun_SecondInterruptKillsEncoder(t *testing.T) {
+	runInterruptChild(t)
+
+	inputRoot := t.TempDir()
+	outputRoot := t.TempDir()
+	writeTestFlac(t, filepath.Join(inputRoot, "01.flac"), []string{"TITLE=One"})
+	started := filepath.Join(t.TempDir(), "started")
+	installFakeOpusenc(t, `echo $$ > "`+started+`.tmp"; mv "`+started+`.tmp" "`+started+`"; exec sleep 30`)
+
+	cmd := startInterruptChild(t, inputRoot, outputRoot, started)
+	data, err := os.ReadFile(started)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatalf("Bad pid %q: %v", data, err)
+	}
+	interrupt(t, cmd)
+	// The first interrupt is taken before the second arrives
+	time.Sleep(100 * time.Millisecond)
+	interrupt(t, cmd)
+
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(10 * time.Second):
+		syscall.Kill(pid, syscall.SIGKILL)
+		cmd.Process.Kill()
+		t.Fatal("Expected the run to end after the second interrupt")
+	}
+
+	// No encoder is left behind writing into the output
+	if err := syscall.Kill(pid, 0); !errors.Is(err, syscall.ESRCH) {
+		syscall.Kill(pid, syscall.SIGKILL)
+		t.Errorf("Expected the encoder to be killed, got %v", err)
+	}
+	if exists(filepath.Join(outputRoot, "01.opus")) {
+		t.Error("Expected no output for the killed conversion")
+	}
+}
@@ -0,0 +1,61 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestWalkFlacFiles_FollowSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "music")
+	touch(t, root, "Artist/Album/01.flac")
+	touch(t, dir, "store/VA/01.flac")
+
+	links := map[string]string{
+		"Various":      filepath.Join(dir, "store", "VA"),
+		"Again":        filepath.Join(dir, "store", "VA"),
+		"Artist/Loop":  root,
+		"Link.flac":    filepath.Join("Artist", "Album", "01.flac"),
+		"Missing.flac": filepath.Join(dir, "missing.flac"),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatalf("Symlink failed: %v", err)
+		}
+	}
+
+	walk := func(opts walkOptions) []string {
+		var found []string
+		err := walkFlacFiles(root, opts, nil, func(filePath string) error {
+			rel, _ := filepath.Rel(root, filePath)
+			found = append(found, filepath.ToSlash(rel))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("walkFlacFiles failed: %v", err)
+		}
+		return found
+	}
+
+	// Symlinked files were always passed on
+	expected := []string{"Artist/Album/01.flac", "Link.flac", "Missing.flac"}
+	if found := walk(walkOptions{}); !slices.Equal(found, expected) {
+		t.Errorf("Expected %v, got %v", expected, found)
+	}
+
+	// Each file once, under the first path; the loop is not followed
+	expected = []string{"Again/01.flac", "Artist/Album/01.flac", "Missing.flac"}
+	if found := walk(walkOptions{FollowSymlinks: true}); !slices.Equal(found, expected) {
+		t.Errorf("Expected %v, got %v", expected, found)
+	}
+
+	// The limit also stops the walk from inside a linked directory
+	expected = []string{"Again/01.flac"}
+	if found := walk(walkOptions{Limit: 1, FollowSymlinks: true}); !slices.Equal(found, expected) {
+		t.Errorf("Expected %v, got %v", expected, found)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package main
+
+const xattrsSupported = false
+
+// copyXattrs is a no-op on platforms without extended attribute support.
+func copyXattrs(src, dst string) error {
+	return nil
+}
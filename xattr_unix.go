@@ -0,0 +1,79 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const xattrsSupported = true
+
+// copyXattrs copies the extended attributes of src to dst. On Linux only
+// the user namespace is copied, the other namespaces are either managed by
+// the system or need privileges.
+func copyXattrs(src, dst string) error {
+	names, err := listXattrs(src)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if runtime.GOOS == "linux" && !strings.HasPrefix(name, "user.") {
+			continue
+		}
+		value, err := getXattr(src, name)
+		if err != nil {
+			return fmt.Errorf("failed to read xattr %s: %w", name, err)
+		}
+		if err := unix.Setxattr(dst, name, value, 0); err != nil {
+			return fmt.Errorf("failed to write xattr %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func listXattrs(path string) ([]string, error) {
+	size, err := unix.Listxattr(path, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list xattrs: %w", err)
+	}
+	if size == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Listxattr(path, buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list xattrs: %w", err)
+	}
+
+	var names []string
+	for name := range bytes.SplitSeq(buf[:size], []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+	return names, nil
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	size, err := unix.Getxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Getxattr(path, name, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:size], nil
+}
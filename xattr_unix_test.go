@@ -0,0 +1,38 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCopyXattrs(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.flac")
+	dst := filepath.Join(dir, "dst.opus")
+	for _, p := range []string{src, dst} {
+		if err := os.WriteFile(p, []byte("data"), 0o644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+
+	if err := unix.Setxattr(src, "user.fixflac4lms.test", []byte("red"), 0); err != nil {
+		t.Skipf("Filesystem does not support user xattrs: %v", err)
+	}
+
+	if err := copyXattrs(src, dst); err != nil {
+		t.Fatalf("copyXattrs failed: %v", err)
+	}
+
+	value, err := getXattr(dst, "user.fixflac4lms.test")
+	if err != nil {
+		t.Fatalf("getXattr failed: %v", err)
+	}
+	if string(value) != "red" {
+		t.Errorf("Expected xattr value 'red', got %q", value)
+	}
+}